@@ -1,7 +0,0 @@
-package main
-
-func main() {
-	Server, _ := InitializeServer()
-	Server.SetupRoute()
-	Server.RunServer()
-}
@@ -1,12 +1,107 @@
 // docker run --name mysql -p 3306:3306 -e MYSQL_ROOT_PASSWORD=password -d mysql
 // MYSQL_URI = root:password@tcp(127.0.0.1:3306)/users
-// 需要先在MySQL中创建一个叫user的数据库
+// 数据库和表可以用 `go run ./usermgmt-admin init` 创建
+// DATA_FILE = ../internal/services/data/users.json，不用数据库
+// MEMORY=true 时用户保存在内存中，重启后丢失；什么都不设置时无法启动
 
 package main
 
+import (
+	"context"
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+	"usermanagement/internal/config"
+	"usermanagement/internal/handlers"
+	"usermanagement/internal/tracing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// closeTimeout is the deadline to close the database connection on shutdown
+const closeTimeout = 10 * time.Second
+
+// initializers build the server of each backend, with the injectors of wire.go
+var initializers = map[string]func(cfg *config.Config) (*handlers.Server, error){
+	config.BackendMongo:  InitializeMongoServer,
+	config.BackendMySQL:  InitializeMySQLServer,
+	config.BackendJSON:   InitializeJSONServer,
+	config.BackendMemory: InitializeMemoryServer,
+}
+
 func main() {
-	Server, _ := InitializeServer()
-	Server.LoginDB()
-	Server.SetupRoute()
-	Server.RunServer()
+	os.Exit(run())
+}
+
+// run runs the server until SIGINT or SIGTERM, and returns the exit code
+func run() int {
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	// gin prints its routes in debug mode, which isn't structured
+	if os.Getenv(gin.EnvGinMode) == "" {
+		gin.SetMode(gin.ReleaseMode)
+	}
+
+	cfg, err := config.Load(os.Args[1:])
+	if err != nil {
+		// the configured logger isn't created yet
+		slog.New(slog.NewJSONHandler(os.Stderr, nil)).Error("load the configuration", slog.Any("error", err))
+		return 1
+	}
+	server, err := initializers[cfg.Database.Backend()](cfg)
+	if err != nil {
+		slog.New(slog.NewJSONHandler(os.Stderr, nil)).Error("start", slog.Any("error", err))
+		return 1
+	}
+	logger := server.Logger()
+	slog.SetDefault(logger)
+
+	shutdownTracing, err := tracing.Setup(ctx, cfg.Tracing.Exporter, cfg.Tracing.Endpoint, cfg.Tracing.ServiceName)
+	if err != nil {
+		logger.Error("set up tracing", slog.Any("error", err))
+		return 1
+	}
+
+	if err := server.LoginDB(); err != nil {
+		logger.Error("connect to the database", slog.Any("error", err))
+		return 1
+	}
+	if cfg.Redis.URL != "" {
+		server.AddReadinessCheck("redis", server.PingLoginState)
+	}
+	server.SetupRoute()
+
+	purged := make(chan struct{})
+	go func() {
+		defer close(purged)
+		if cfg.Deletion.PurgeInterval > 0 {
+			server.RunPurger(ctx, cfg.Deletion.PurgeInterval)
+		}
+	}()
+
+	code := 0
+	if err := server.RunServer(ctx); err != nil {
+		logger.Error("serve", slog.Any("error", err))
+		code = 1
+	}
+	// stop the purger too when the server fails
+	stop()
+	<-purged
+
+	// the in-flight requests are drained, it's safe to close the database
+	closeCtx, cancel := context.WithTimeout(context.Background(), closeTimeout)
+	defer cancel()
+	if err := server.CloseDB(closeCtx); err != nil {
+		logger.Error("close the database", slog.Any("error", err))
+		code = 1
+	}
+	// flush the last spans
+	if err := shutdownTracing(closeCtx); err != nil {
+		logger.Error("shut down tracing", slog.Any("error", err))
+	}
+	logger.Info("server stopped")
+	return code
 }
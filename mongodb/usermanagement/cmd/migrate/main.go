@@ -0,0 +1,100 @@
+// migrate copies the users from one backend to another and verifies the copy:
+//
+//	migrate [flags] <source> <destination>
+//
+// where a backend is json:<path> for a users.json file,
+// mongodb://<host>/<database> or mysql:<data source name>,
+// e.g. `go run ./migrate json:../internal/services/data/users.json mongodb://localhost:27017/user` in cmd/.
+// It exits with 1 if the copy fails or if the verification finds a difference.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+	"usermanagement/internal/logging"
+	"usermanagement/internal/migrate"
+)
+
+func main() {
+	os.Exit(run(os.Args[1:]))
+}
+
+func run(args []string) int {
+	fs := flag.NewFlagSet("migrate", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: migrate [flags] <source> <destination>")
+		fmt.Fprintln(fs.Output(), "\nthe backends are json:<path>, mongodb://<host>/<database> or mysql:<data source name>\n\nflags:")
+		fs.PrintDefaults()
+	}
+	checkpoint := fs.String("checkpoint", "", "file saving the progress after each batch, to resume an interrupted migration")
+	batchSize := fs.Int("batch-size", migrate.DefaultBatchSize, "number of users copied at once")
+	verifyOnly := fs.Bool("verify-only", false, "only compare the source with the destination")
+	logLevel := fs.String("log-level", "info", "minimum log level: debug, info, warn or error")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() != 2 {
+		fs.Usage()
+		return 2
+	}
+	source, destination := fs.Arg(0), fs.Arg(1)
+
+	// the logs go to the standard error, the standard output is for the verification
+	logger, err := logging.New(os.Stderr, *logLevel, "text")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	src, err := migrate.Open(ctx, source, false, logger)
+	if err != nil {
+		logger.Error("open the source", slog.String("source", migrate.Redact(source)), slog.Any("error", err))
+		return 1
+	}
+	defer src.CloseDB(context.Background())
+	dst, err := migrate.Open(ctx, destination, !*verifyOnly, logger)
+	if err != nil {
+		logger.Error("open the destination", slog.String("destination", migrate.Redact(destination)), slog.Any("error", err))
+		return 1
+	}
+	defer dst.CloseDB(context.Background())
+
+	if !*verifyOnly {
+		result, err := migrate.Run(ctx, src, dst, migrate.Redact(source), migrate.Redact(destination), migrate.Options{
+			BatchSize:  *batchSize,
+			Checkpoint: *checkpoint,
+			Logger:     logger,
+		})
+		if err != nil {
+			logger.Error("migrate the users", slog.Int("copied", result.Copied), slog.Any("error", err))
+			return 1
+		}
+		logger.Info("users migrated", slog.Int("copied", result.Copied), slog.Int("skipped", result.Skipped),
+			slog.Int("hashed", result.Hashed))
+	}
+
+	verification, err := migrate.Verify(ctx, src, dst, *batchSize)
+	if err != nil {
+		logger.Error("verify the migration", slog.Any("error", err))
+		return 1
+	}
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	_ = encoder.Encode(verification)
+	if !verification.OK() {
+		logger.Error("the destination differs from the source", slog.Int("missing", verification.Missing),
+			slog.Int("different", verification.Different))
+		return 1
+	}
+	return 0
+}
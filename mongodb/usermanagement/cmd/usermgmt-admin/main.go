@@ -0,0 +1,769 @@
+// usermgmt-admin administers the users directly in the database, with the configuration of the server:
+//
+//	usermgmt-admin [configuration flags] <command> [command flags] [arguments]
+//
+// e.g. `go run ./usermgmt-admin -config ../config.example.yml list` in cmd/.
+// The passwords are read from the standard input, never from the arguments,
+// and every change is recorded in the audit log.
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/signal"
+	"os/user"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+	"usermanagement/internal/config"
+	"usermanagement/internal/logging"
+	"usermanagement/internal/models"
+	"usermanagement/internal/schema"
+	"usermanagement/internal/services"
+
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/term"
+)
+
+// errUsage is returned for invalid arguments, the usage is printed and the exit code is 2
+var errUsage = errors.New("invalid arguments")
+
+// command is a subcommand of usermgmt-admin
+type command struct {
+	usage string
+	run   func(a *admin, ctx context.Context, args []string) error
+}
+
+var commands = map[string]command{
+	"init": {
+		usage: "init\n\tcreate the MySQL database and apply the schema migrations, or create the MongoDB indexes",
+		run:   (*admin).initDB,
+	},
+	"schema": {
+		usage: "schema status [-format table|json] | up [version] | down <version>\n\tshow, apply or revert the MySQL schema migrations, up to the latest version by default",
+		run:   (*admin).schema,
+	},
+	"create": {
+		usage: "create [-roles role,...] [-locked] [-status status] <username>\n\tcreate a user, the password is read from the standard input",
+		run:   (*admin).create,
+	},
+	"reset-password": {
+		usage: "reset-password <username>\n\treplace the password, read from the standard input",
+		run:   (*admin).resetPassword,
+	},
+	"lock": {
+		usage: "lock <username>\n\tprevent the user from logging in",
+		run: func(a *admin, ctx context.Context, args []string) error {
+			return a.setLocked(ctx, args, true)
+		},
+	},
+	"unlock": {
+		usage: "unlock <username>\n\tlet the user log in again",
+		run: func(a *admin, ctx context.Context, args []string) error {
+			return a.setLocked(ctx, args, false)
+		},
+	},
+	"status": {
+		usage: "status <username> pending|active|suspended|deactivated\n\tchange the status of the user, only the active users can log in",
+		run:   (*admin).setStatus,
+	},
+	"roles": {
+		usage: "roles <username> [role,...]\n\treplace the roles of the user, none to remove them all",
+		run:   (*admin).setRoles,
+	},
+	"delete": {
+		usage: "delete <username>\n\tdelete the user, it can be restored during the grace period",
+		run:   (*admin).deleteUser,
+	},
+	"restore": {
+		usage: "restore <id>\n\trestore a deleted user, with its username",
+		run:   (*admin).restoreUser,
+	},
+	"purge": {
+		usage: "purge\n\tremove for good the users deleted for longer than the grace period, as the server does",
+		run:   (*admin).purge,
+	},
+	"reindex": {
+		usage: "reindex\n\trebuild the search index of the users, e.g. for the users stored before the text search",
+		run:   (*admin).reindex,
+	},
+	"list": {
+		usage: "list [-format table|json] [-deleted | -filter <filter>]\n\tlist the users, the ones matching the filter, or the deleted users not purged yet",
+		run:   (*admin).list,
+	},
+	"search": {
+		usage: "search [-format table|json] (-username <username> | -id <id>)\n\tshow a user",
+		run:   (*admin).search,
+	},
+	"export": {
+		usage: "export [-format csv|ndjson] [-o file]\n\twrite the users with their password hashes, to the standard output by default",
+		run:   (*admin).export,
+	},
+	"import": {
+		usage: "import [-format csv|ndjson] [-mode create|skip-existing|upsert] [-dry-run] [-i file]\n\tcreate the users of a file, read from the standard input by default",
+		run:   (*admin).importUsers,
+	},
+}
+
+func main() {
+	os.Exit(run(os.Args[1:]))
+}
+
+func run(args []string) int {
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	cfg, args, err := config.LoadArgs(args)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	if len(args) == 0 {
+		printUsage()
+		return 2
+	}
+	cmd, ok := commands[args[0]]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "unknown command %q\n", args[0])
+		printUsage()
+		return 2
+	}
+
+	// the logs go to the standard error, the standard output is for the results
+	logger, err := logging.New(os.Stderr, cfg.Log.Level, cfg.Log.Format)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	if cfg.Database.Backend() == config.BackendMemory {
+		// the changes would be lost on exit
+		fmt.Fprintln(os.Stderr, "usermgmt-admin needs a database: set MONGO_URI, MYSQL_URI or DATA_FILE")
+		return 2
+	}
+	if args[0] == "init" && cfg.Database.MySQL.URI != "" && cfg.Database.Mongo.URI == "" {
+		// LoginDB can't connect to a missing database
+		if err := services.CreateMySQLDatabase(ctx, cfg.Database); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+	}
+
+	// the migrations are applied by init and schema only
+	cfg.Database.MySQL.AutoMigrate = false
+	// the lru cache of the servers can't be reached, their users change after cache.ttl
+	var userCache *services.UserCache
+	if cfg.Cache.Backend == config.CacheRedis {
+		userCache, err = services.NewUserCache(cfg.Cache, cfg.Redis, logger)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 2
+		}
+	}
+	// the imports validate the attributes
+	attributes, err := services.NewAttributeSchema(cfg.Attributes)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	userService := services.NewUserServiceWithBackend(services.NewBackend(cfg.Database, logger), userCache, cfg.Deletion, attributes, logger)
+	if err := userService.LoginDB(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer userService.CloseDB(context.Background())
+
+	a := &admin{
+		users:  userService,
+		actor:  actor(),
+		stdin:  bufio.NewReader(os.Stdin),
+		stdout: os.Stdout,
+		logger: logger,
+	}
+	if err := cmd.run(a, ctx, args[1:]); err != nil {
+		if errors.Is(err, errUsage) || errors.Is(err, flag.ErrHelp) {
+			fmt.Fprintf(os.Stderr, "usage: usermgmt-admin [configuration flags] %s\n", cmd.usage)
+			return 2
+		}
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
+
+func printUsage() {
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	fmt.Fprintln(os.Stderr, "usage: usermgmt-admin [configuration flags] <command> [command flags] [arguments]")
+	fmt.Fprintln(os.Stderr, "\ncommands:")
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  %s\n", commands[name].usage)
+	}
+	fmt.Fprintln(os.Stderr, "\nthe configuration flags are the ones of the server, see usermgmt-admin -h")
+}
+
+// actor names the administrator in the audit log, after the system user
+func actor() string {
+	name := os.Getenv("USER")
+	if u, err := user.Current(); err == nil {
+		name = u.Username
+	}
+	if name == "" {
+		name = "unknown"
+	}
+	return "admin:" + name
+}
+
+// admin runs the commands
+type admin struct {
+	users  *services.UserService
+	actor  string
+	stdin  *bufio.Reader
+	stdout io.Writer
+	logger *slog.Logger
+}
+
+// recordEvent appends an event to the audit log, a failure is only logged
+func (a *admin) recordEvent(ctx context.Context, eventType, target string) {
+	event := models.AuditEvent{
+		Type:      eventType,
+		Actor:     a.actor,
+		Target:    target,
+		UserAgent: "usermgmt-admin",
+	}
+	if err := a.users.RecordEvent(ctx, event); err != nil {
+		a.logger.ErrorContext(ctx, "record audit event",
+			slog.String("type", eventType), slog.String("target", target), slog.Any("error", err))
+	}
+}
+
+// readPassword reads a password from the standard input, without echo on a terminal
+func (a *admin) readPassword(prompt string) (string, error) {
+	var password string
+	if fd := int(os.Stdin.Fd()); term.IsTerminal(fd) {
+		fmt.Fprint(os.Stderr, prompt)
+		b, err := term.ReadPassword(fd)
+		fmt.Fprintln(os.Stderr)
+		if err != nil {
+			return "", err
+		}
+		password = string(b)
+	} else {
+		line, err := a.stdin.ReadString('\n')
+		if err != nil && !(errors.Is(err, io.EOF) && line != "") {
+			return "", fmt.Errorf("read the password: %w", err)
+		}
+		password = strings.TrimRight(line, "\r\n")
+	}
+
+	if password == "" {
+		return "", &services.ValidationError{Field: "password", Reason: "must not be empty"}
+	}
+	return password, nil
+}
+
+// hashPassword reads a password and hashes it like POST /register
+func (a *admin) hashPassword(prompt string) (string, error) {
+	password, err := a.readPassword(prompt)
+	if err != nil {
+		return "", err
+	}
+	hashed, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", &services.ValidationError{Field: "password", Reason: err.Error()}
+	}
+	return string(hashed), nil
+}
+
+// oneArg returns the only positional argument of fs
+func oneArg(fs *flag.FlagSet) (string, error) {
+	if fs.NArg() != 1 || fs.Arg(0) == "" {
+		return "", errUsage
+	}
+	return fs.Arg(0), nil
+}
+
+func newFlagSet(name string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	return fs
+}
+
+func (a *admin) initDB(ctx context.Context, args []string) error {
+	if len(args) != 0 {
+		return errUsage
+	}
+	if err := a.users.SetupDB(ctx); err != nil {
+		return err
+	}
+	fmt.Fprintln(a.stdout, "database ready")
+	return nil
+}
+
+func (a *admin) schema(ctx context.Context, args []string) error {
+	if len(args) == 0 {
+		return errUsage
+	}
+	migrator, err := a.users.SchemaMigrator()
+	if err != nil {
+		return err
+	}
+
+	switch args[0] {
+	case "status":
+		fs := newFlagSet("schema status")
+		format := fs.String("format", "table", "table or json")
+		if err := fs.Parse(args[1:]); err != nil || fs.NArg() != 0 {
+			return errUsage
+		}
+		status, err := migrator.Status(ctx)
+		if err != nil {
+			return err
+		}
+		return a.printSchemaStatus(*format, status)
+	case "up":
+		target := 0
+		if len(args) > 2 {
+			return errUsage
+		}
+		if len(args) == 2 {
+			if target, err = strconv.Atoi(args[1]); err != nil || target <= 0 {
+				return errUsage
+			}
+		}
+		applied, err := migrator.Up(ctx, target)
+		for _, migration := range applied {
+			fmt.Fprintf(a.stdout, "applied %04d_%s\n", migration.Version, migration.Name)
+		}
+		if err != nil {
+			return err
+		}
+		if len(applied) == 0 {
+			fmt.Fprintln(a.stdout, "schema up to date")
+		}
+		return nil
+	case "down":
+		if len(args) != 2 {
+			return errUsage
+		}
+		target, err := strconv.Atoi(args[1])
+		if err != nil || target < 0 {
+			return errUsage
+		}
+		reverted, err := migrator.Down(ctx, target)
+		for _, migration := range reverted {
+			fmt.Fprintf(a.stdout, "reverted %04d_%s\n", migration.Version, migration.Name)
+		}
+		return err
+	default:
+		return errUsage
+	}
+}
+
+// printSchemaStatus prints the applied and pending migrations as a table or as JSON
+func (a *admin) printSchemaStatus(format string, status schema.Status) error {
+	switch format {
+	case "json":
+		encoder := json.NewEncoder(a.stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(status)
+	case "table":
+		w := tabwriter.NewWriter(a.stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "VERSION\tNAME\tAPPLIED AT")
+		for _, applied := range status.Applied {
+			fmt.Fprintf(w, "%04d\t%s\t%s\n", applied.Version, applied.Name, applied.AppliedAt.Format(time.RFC3339))
+		}
+		for _, pending := range status.Pending {
+			version, name, _ := strings.Cut(pending, "_")
+			fmt.Fprintf(w, "%s\t%s\tpending\n", version, name)
+		}
+		if err := w.Flush(); err != nil {
+			return err
+		}
+		fmt.Fprintf(a.stdout, "\nversion %d of %d\n", status.Version, status.Latest)
+		return nil
+	default:
+		return errUsage
+	}
+}
+
+func (a *admin) create(ctx context.Context, args []string) error {
+	fs := newFlagSet("create")
+	roles := fs.String("roles", "", "comma-separated roles")
+	locked := fs.Bool("locked", false, "create the user locked")
+	status := fs.String("status", string(models.StatusActive), "pending, active, suspended or deactivated")
+	if err := fs.Parse(args); err != nil {
+		return errUsage
+	}
+	username, err := oneArg(fs)
+	if err != nil {
+		return err
+	}
+	// before the password is asked
+	if err := services.ValidateStatus(models.UserStatus(*status)); err != nil {
+		return err
+	}
+
+	hashed, err := a.hashPassword("Password: ")
+	if err != nil {
+		return err
+	}
+	user := models.NewUser(username, hashed)
+	user.Roles = splitRoles(*roles)
+	user.Locked = *locked
+	user.Status = models.UserStatus(*status)
+
+	created, err := a.users.CreateUser(ctx, *user)
+	if err != nil {
+		return err
+	}
+	a.recordEvent(ctx, models.EventUserRegistered, username)
+	fmt.Fprintf(a.stdout, "created %s %s\n", created.ID.Hex(), username)
+	return nil
+}
+
+func (a *admin) resetPassword(ctx context.Context, args []string) error {
+	fs := newFlagSet("reset-password")
+	if err := fs.Parse(args); err != nil {
+		return errUsage
+	}
+	username, err := oneArg(fs)
+	if err != nil {
+		return err
+	}
+
+	hashed, err := a.hashPassword("New password: ")
+	if err != nil {
+		return err
+	}
+	if err := a.users.ResetPassword(ctx, username, hashed); err != nil {
+		return err
+	}
+	a.recordEvent(ctx, models.EventPasswordChanged, username)
+	fmt.Fprintf(a.stdout, "password of %s reset\n", username)
+	return nil
+}
+
+func (a *admin) setLocked(ctx context.Context, args []string, locked bool) error {
+	if len(args) != 1 || args[0] == "" {
+		return errUsage
+	}
+	username := args[0]
+
+	if err := a.users.SetLocked(ctx, username, locked); err != nil {
+		return err
+	}
+	if locked {
+		a.recordEvent(ctx, models.EventUserLocked, username)
+		fmt.Fprintf(a.stdout, "%s locked\n", username)
+	} else {
+		a.recordEvent(ctx, models.EventUserUnlocked, username)
+		fmt.Fprintf(a.stdout, "%s unlocked\n", username)
+	}
+	return nil
+}
+
+func (a *admin) setStatus(ctx context.Context, args []string) error {
+	if len(args) != 2 || args[0] == "" {
+		return errUsage
+	}
+	username, status := args[0], models.UserStatus(args[1])
+
+	if err := a.users.SetStatus(ctx, username, status); err != nil {
+		return err
+	}
+	a.recordEvent(ctx, models.EventStatusChanged, username)
+	fmt.Fprintf(a.stdout, "%s %s\n", username, status)
+	return nil
+}
+
+func (a *admin) setRoles(ctx context.Context, args []string) error {
+	if len(args) < 1 || len(args) > 2 || args[0] == "" {
+		return errUsage
+	}
+	username := args[0]
+	var roles []string
+	if len(args) == 2 {
+		roles = splitRoles(args[1])
+	}
+
+	if err := a.users.SetRoles(ctx, username, roles); err != nil {
+		return err
+	}
+	a.recordEvent(ctx, models.EventRolesChanged, username)
+	fmt.Fprintf(a.stdout, "roles of %s: %s\n", username, strings.Join(roles, ","))
+	return nil
+}
+
+// splitRoles splits comma-separated roles, ignoring the empty ones
+func splitRoles(value string) []string {
+	var roles []string
+	for _, role := range strings.Split(value, ",") {
+		if role = strings.TrimSpace(role); role != "" {
+			roles = append(roles, role)
+		}
+	}
+	return roles
+}
+
+func (a *admin) deleteUser(ctx context.Context, args []string) error {
+	if len(args) != 1 || args[0] == "" {
+		return errUsage
+	}
+	user, err := a.users.SearchUserByUsername(ctx, args[0])
+	if err != nil {
+		return err
+	}
+
+	if _, err := a.users.DeleteUser(ctx, user.ID.Hex()); err != nil {
+		return err
+	}
+	a.recordEvent(ctx, models.EventUserDeleted, user.Username)
+	fmt.Fprintf(a.stdout, "%s deleted, restore it with: usermgmt-admin restore %s\n", user.Username, user.ID.Hex())
+	return nil
+}
+
+func (a *admin) restoreUser(ctx context.Context, args []string) error {
+	if len(args) != 1 || args[0] == "" {
+		return errUsage
+	}
+
+	user, err := a.users.RestoreUser(ctx, args[0])
+	if err != nil {
+		return err
+	}
+	a.recordEvent(ctx, models.EventUserRestored, user.Username)
+	fmt.Fprintf(a.stdout, "%s restored\n", user.Username)
+	return nil
+}
+
+func (a *admin) purge(ctx context.Context, args []string) error {
+	if len(args) != 0 {
+		return errUsage
+	}
+
+	users, err := a.users.PurgeDeletedUsers(ctx)
+	if err != nil {
+		return err
+	}
+	for _, user := range users {
+		a.recordEvent(ctx, models.EventUserPurged, user.OriginalUsername())
+	}
+	fmt.Fprintf(a.stdout, "purged %d users\n", len(users))
+	return nil
+}
+
+func (a *admin) reindex(ctx context.Context, args []string) error {
+	if len(args) != 0 {
+		return errUsage
+	}
+
+	n, err := a.users.ReindexUsers(ctx)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(a.stdout, "indexed %d users\n", n)
+	return nil
+}
+
+func (a *admin) list(ctx context.Context, args []string) error {
+	fs := newFlagSet("list")
+	format := fs.String("format", "table", "table or json")
+	deleted := fs.Bool("deleted", false, "list the deleted users instead, the recently deleted first")
+	filter := fs.String("filter", "", `only list the users matching the filter, e.g. 'status eq "active" and createdAt gt "2026-01-01"'`)
+	if err := fs.Parse(args); err != nil || fs.NArg() != 0 || (*deleted && *filter != "") {
+		return errUsage
+	}
+
+	if *deleted {
+		users, err := a.users.DeletedUsers(ctx)
+		if err != nil {
+			return err
+		}
+		return a.printUsers(*format, users, true)
+	}
+	users, err := a.users.FilterUsers(ctx, *filter)
+	if err != nil {
+		return err
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].Username < users[j].Username })
+	return a.printUsers(*format, users, true)
+}
+
+func (a *admin) search(ctx context.Context, args []string) error {
+	fs := newFlagSet("search")
+	format := fs.String("format", "table", "table or json")
+	username := fs.String("username", "", "username of the user")
+	id := fs.String("id", "", "ID of the user")
+	if err := fs.Parse(args); err != nil || fs.NArg() != 0 || (*username == "") == (*id == "") {
+		return errUsage
+	}
+
+	var user models.User
+	var err error
+	if *username != "" {
+		user, err = a.users.SearchUserByUsername(ctx, *username)
+	} else {
+		user, err = a.users.SearchUserByID(ctx, *id)
+	}
+	if err != nil {
+		return err
+	}
+	return a.printUsers(*format, []models.User{user}, false)
+}
+
+// userView is a user without its password hash, as printed by list and search
+type userView struct {
+	ID          string            `json:"id"`
+	Username    string            `json:"username"`
+	Roles       []string          `json:"roles"`
+	Locked      bool              `json:"locked"`
+	Status      models.UserStatus `json:"status"`
+	CreatedAt   *time.Time        `json:"created_at"`
+	LastLoginAt *time.Time        `json:"last_login_at"`
+	DeletedAt   *time.Time        `json:"deleted_at,omitempty"`
+}
+
+// printUsers prints the users as a table or as JSON, an array if many is true
+func (a *admin) printUsers(format string, users []models.User, many bool) error {
+	views := make([]userView, 0, len(users))
+	for _, u := range users {
+		roles := u.Roles
+		if roles == nil {
+			roles = []string{}
+		}
+		view := userView{ID: u.ID.Hex(), Username: u.OriginalUsername(), Roles: roles, Locked: u.Locked, Status: u.CurrentStatus(),
+			LastLoginAt: u.LastLoginAt, DeletedAt: u.DeletedAt}
+		if !u.CreatedAt.IsZero() {
+			view.CreatedAt = &u.CreatedAt
+		}
+		views = append(views, view)
+	}
+
+	switch format {
+	case "json":
+		encoder := json.NewEncoder(a.stdout)
+		encoder.SetIndent("", "  ")
+		if many {
+			return encoder.Encode(views)
+		}
+		return encoder.Encode(views[0])
+	case "table":
+		w := tabwriter.NewWriter(a.stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tUSERNAME\tROLES\tLOCKED\tSTATUS\tCREATED\tLAST LOGIN\tDELETED")
+		for _, v := range views {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%t\t%s\t%s\t%s\t%s\n", v.ID, v.Username, strings.Join(v.Roles, ","), v.Locked, v.Status,
+				formatTime(v.CreatedAt), formatTime(v.LastLoginAt), formatTime(v.DeletedAt))
+		}
+		return w.Flush()
+	default:
+		return errUsage
+	}
+}
+
+// formatTime formats a time of the table, - if it's unknown
+func formatTime(t *time.Time) string {
+	if t == nil {
+		return "-"
+	}
+	return t.UTC().Format(time.RFC3339)
+}
+
+func (a *admin) export(ctx context.Context, args []string) error {
+	fs := newFlagSet("export")
+	formatName := fs.String("format", string(services.FormatNDJSON), "csv or ndjson")
+	output := fs.String("o", "", "output file, the standard output by default")
+	if err := fs.Parse(args); err != nil || fs.NArg() != 0 {
+		return errUsage
+	}
+	format, err := services.ParseFormat(*formatName)
+	if err != nil {
+		return err
+	}
+
+	w := a.stdout
+	if *output != "" {
+		// the file has the password hashes
+		file, err := os.OpenFile(*output, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		w = file
+	}
+
+	n, err := a.users.ExportUsers(ctx, w, format)
+	if err != nil {
+		return err
+	}
+	a.recordEvent(ctx, models.EventUsersExported, "")
+	if *output != "" {
+		fmt.Fprintf(os.Stderr, "exported %d users to %s\n", n, *output)
+	}
+	return nil
+}
+
+func (a *admin) importUsers(ctx context.Context, args []string) error {
+	fs := newFlagSet("import")
+	formatName := fs.String("format", string(services.FormatNDJSON), "csv or ndjson")
+	modeName := fs.String("mode", string(services.ImportCreate), "what to do with the existing users: create, skip-existing or upsert")
+	dryRun := fs.Bool("dry-run", false, "only validate the file and look up the existing users")
+	input := fs.String("i", "", "input file, the standard input by default")
+	if err := fs.Parse(args); err != nil || fs.NArg() != 0 {
+		return errUsage
+	}
+	opts := services.ImportOptions{DryRun: *dryRun}
+	var err error
+	if opts.Format, err = services.ParseFormat(*formatName); err != nil {
+		return err
+	}
+	if opts.Mode, err = services.ParseImportMode(*modeName); err != nil {
+		return err
+	}
+
+	var r io.Reader = a.stdin
+	if *input != "" {
+		file, err := os.Open(*input)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		r = file
+	}
+
+	result, err := a.users.ImportUsers(ctx, r, opts)
+	if !opts.DryRun && result.Created+result.Updated > 0 {
+		a.recordEvent(ctx, models.EventUsersImported, "")
+	}
+	for _, rowErr := range result.Errors {
+		fmt.Fprintf(os.Stderr, "row %d %s: %s\n", rowErr.Row, rowErr.Username, rowErr.Reason)
+	}
+	prefix := ""
+	if opts.DryRun {
+		prefix = "dry run: "
+	}
+	fmt.Fprintf(a.stdout, "%s%d rows: created %d, updated %d, skipped %d, failed %d\n",
+		prefix, result.Rows, result.Created, result.Updated, result.Skipped, result.Failed)
+	if err != nil {
+		return err
+	}
+	if result.Failed > 0 {
+		return fmt.Errorf("%d rows failed", result.Failed)
+	}
+	return nil
+}
@@ -0,0 +1,59 @@
+// verify-audit checks the hash chain of the audit log in the configured database.
+// It takes the same configuration as the server, e.g. `go run ./verify-audit -config ../config.example.yml` in cmd/,
+// and exits with 1 if an event was changed, inserted or removed.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"os"
+	"usermanagement/internal/config"
+	"usermanagement/internal/logging"
+	"usermanagement/internal/services"
+)
+
+func main() {
+	os.Exit(run())
+}
+
+func run() int {
+	cfg, err := config.Load(os.Args[1:])
+	if err != nil {
+		slog.New(slog.NewJSONHandler(os.Stderr, nil)).Error("load the configuration", slog.Any("error", err))
+		return 1
+	}
+	logger, err := logging.NewLogger(cfg.Log)
+	if err != nil {
+		slog.New(slog.NewJSONHandler(os.Stderr, nil)).Error("create the logger", slog.Any("error", err))
+		return 1
+	}
+
+	if cfg.Database.Backend() == config.BackendMemory {
+		logger.Error("verify-audit needs a database: set MONGO_URI, MYSQL_URI or DATA_FILE")
+		return 1
+	}
+
+	userService := services.NewUserService(cfg.Database, logger)
+	if err := userService.LoginDB(); err != nil {
+		logger.Error("connect to the database", slog.Any("error", err))
+		return 1
+	}
+	defer userService.CloseDB(context.Background())
+
+	result, err := userService.VerifyAuditLog(context.Background())
+	var chainErr *services.ChainError
+	if errors.As(err, &chainErr) {
+		logger.Error("audit log tampered", slog.Int64("seq", chainErr.Seq), slog.String("reason", chainErr.Reason))
+		return 1
+	}
+	if err != nil {
+		logger.Error("verify the audit log", slog.Any("error", err))
+		return 1
+	}
+
+	// compare last_hash with the one of the previous run: the removal of the last events can't be detected otherwise
+	logger.Info("audit log verified", slog.Int64("events", result.Events), slog.String("last_hash", result.LastHash))
+	return 0
+}
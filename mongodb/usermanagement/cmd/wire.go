@@ -4,13 +4,47 @@
 package main
 
 import (
+	"usermanagement/internal/config"
 	"usermanagement/internal/handlers"
+	"usermanagement/internal/logging"
 	"usermanagement/internal/services"
+	"usermanagement/internal/session"
 
 	"github.com/google/wire"
 )
 
-func InitializeServer() (*handlers.Server, error) {
-	wire.Build(handlers.NewServer, services.NewUserService)
+// serverSet builds the server on top of the services.Backend given by the provider set of a backend
+var serverSet = wire.NewSet(
+	wire.FieldsOf(new(*config.Config), "Server", "Database", "Deletion", "Attributes", "Cache", "Redis", "Log"),
+	logging.NewLogger,
+	services.NewUserCache,
+	services.NewAttributeSchema,
+	services.NewUserServiceWithBackend,
+	wire.Bind(new(services.UserServiceInterface), new(*services.UserService)),
+	session.New,
+	handlers.NewServerWithStore,
+)
+
+// InitializeMongoServer builds the server storing the users in MongoDB
+func InitializeMongoServer(cfg *config.Config) (*handlers.Server, error) {
+	wire.Build(serverSet, services.MongoSet)
+	return &handlers.Server{}, nil
+}
+
+// InitializeMySQLServer builds the server storing the users in MySQL
+func InitializeMySQLServer(cfg *config.Config) (*handlers.Server, error) {
+	wire.Build(serverSet, services.MySQLSet)
+	return &handlers.Server{}, nil
+}
+
+// InitializeJSONServer builds the server storing the users in a JSON file
+func InitializeJSONServer(cfg *config.Config) (*handlers.Server, error) {
+	wire.Build(serverSet, services.JSONSet)
+	return &handlers.Server{}, nil
+}
+
+// InitializeMemoryServer builds the server keeping the users in memory
+func InitializeMemoryServer(cfg *config.Config) (*handlers.Server, error) {
+	wire.Build(serverSet, services.MemorySet)
 	return &handlers.Server{}, nil
 }
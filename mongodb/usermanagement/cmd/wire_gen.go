@@ -7,14 +7,140 @@
 package main
 
 import (
+	"github.com/google/wire"
+	"usermanagement/internal/config"
 	"usermanagement/internal/handlers"
+	"usermanagement/internal/logging"
 	"usermanagement/internal/services"
+	"usermanagement/internal/session"
 )
 
 // Injectors from wire.go:
 
-func InitializeServer() (*handlers.Server, error) {
-	userService := services.NewUserService()
-	server := handlers.NewServer(userService)
+// InitializeMongoServer builds the server storing the users in MongoDB
+func InitializeMongoServer(cfg *config.Config) (*handlers.Server, error) {
+	databaseConfig := cfg.Database
+	logConfig := cfg.Log
+	logger, err := logging.NewLogger(logConfig)
+	if err != nil {
+		return nil, err
+	}
+	mongoBackend := services.NewMongoBackend(databaseConfig, logger)
+	cacheConfig := cfg.Cache
+	redisConfig := cfg.Redis
+	userCache, err := services.NewUserCache(cacheConfig, redisConfig, logger)
+	if err != nil {
+		return nil, err
+	}
+	deletionConfig := cfg.Deletion
+	attributesConfig := cfg.Attributes
+	attributeSchema, err := services.NewAttributeSchema(attributesConfig)
+	if err != nil {
+		return nil, err
+	}
+	userService := services.NewUserServiceWithBackend(mongoBackend, userCache, deletionConfig, attributeSchema, logger)
+	store, err := session.New(redisConfig)
+	if err != nil {
+		return nil, err
+	}
+	serverConfig := cfg.Server
+	server := handlers.NewServerWithStore(userService, store, serverConfig, logger)
 	return server, nil
 }
+
+// InitializeMySQLServer builds the server storing the users in MySQL
+func InitializeMySQLServer(cfg *config.Config) (*handlers.Server, error) {
+	databaseConfig := cfg.Database
+	logConfig := cfg.Log
+	logger, err := logging.NewLogger(logConfig)
+	if err != nil {
+		return nil, err
+	}
+	mySQLBackend := services.NewMySQLBackend(databaseConfig, logger)
+	cacheConfig := cfg.Cache
+	redisConfig := cfg.Redis
+	userCache, err := services.NewUserCache(cacheConfig, redisConfig, logger)
+	if err != nil {
+		return nil, err
+	}
+	deletionConfig := cfg.Deletion
+	attributesConfig := cfg.Attributes
+	attributeSchema, err := services.NewAttributeSchema(attributesConfig)
+	if err != nil {
+		return nil, err
+	}
+	userService := services.NewUserServiceWithBackend(mySQLBackend, userCache, deletionConfig, attributeSchema, logger)
+	store, err := session.New(redisConfig)
+	if err != nil {
+		return nil, err
+	}
+	serverConfig := cfg.Server
+	server := handlers.NewServerWithStore(userService, store, serverConfig, logger)
+	return server, nil
+}
+
+// InitializeJSONServer builds the server storing the users in a JSON file
+func InitializeJSONServer(cfg *config.Config) (*handlers.Server, error) {
+	databaseConfig := cfg.Database
+	logConfig := cfg.Log
+	logger, err := logging.NewLogger(logConfig)
+	if err != nil {
+		return nil, err
+	}
+	jsonBackend := services.NewJSONBackend(databaseConfig, logger)
+	cacheConfig := cfg.Cache
+	redisConfig := cfg.Redis
+	userCache, err := services.NewUserCache(cacheConfig, redisConfig, logger)
+	if err != nil {
+		return nil, err
+	}
+	deletionConfig := cfg.Deletion
+	attributesConfig := cfg.Attributes
+	attributeSchema, err := services.NewAttributeSchema(attributesConfig)
+	if err != nil {
+		return nil, err
+	}
+	userService := services.NewUserServiceWithBackend(jsonBackend, userCache, deletionConfig, attributeSchema, logger)
+	store, err := session.New(redisConfig)
+	if err != nil {
+		return nil, err
+	}
+	serverConfig := cfg.Server
+	server := handlers.NewServerWithStore(userService, store, serverConfig, logger)
+	return server, nil
+}
+
+// InitializeMemoryServer builds the server keeping the users in memory
+func InitializeMemoryServer(cfg *config.Config) (*handlers.Server, error) {
+	logConfig := cfg.Log
+	logger, err := logging.NewLogger(logConfig)
+	if err != nil {
+		return nil, err
+	}
+	memoryBackend := services.NewMemoryBackend(logger)
+	cacheConfig := cfg.Cache
+	redisConfig := cfg.Redis
+	userCache, err := services.NewUserCache(cacheConfig, redisConfig, logger)
+	if err != nil {
+		return nil, err
+	}
+	deletionConfig := cfg.Deletion
+	attributesConfig := cfg.Attributes
+	attributeSchema, err := services.NewAttributeSchema(attributesConfig)
+	if err != nil {
+		return nil, err
+	}
+	userService := services.NewUserServiceWithBackend(memoryBackend, userCache, deletionConfig, attributeSchema, logger)
+	store, err := session.New(redisConfig)
+	if err != nil {
+		return nil, err
+	}
+	serverConfig := cfg.Server
+	server := handlers.NewServerWithStore(userService, store, serverConfig, logger)
+	return server, nil
+}
+
+// wire.go:
+
+// serverSet builds the server on top of the services.Backend given by the provider set of a backend
+var serverSet = wire.NewSet(wire.FieldsOf(new(*config.Config), "Server", "Database", "Deletion", "Attributes", "Cache", "Redis", "Log"), logging.NewLogger, services.NewUserCache, services.NewAttributeSchema, services.NewUserServiceWithBackend, wire.Bind(new(services.UserServiceInterface), new(*services.UserService)), session.New, handlers.NewServerWithStore)
@@ -0,0 +1,22 @@
+// Package cache keeps values for a while in front of a slower store.
+// LRU is a cache in the process, Redis a cache shared by the replicas of the server;
+// another distributed cache only has to implement Cache.
+package cache
+
+import (
+	"context"
+	"time"
+)
+
+// Cache stores values by key until their TTL expires, or until they are evicted.
+// A value may disappear at any time, so a miss must always be served by the store.
+type Cache interface {
+	// Get returns the value of key, and false if it isn't cached
+	Get(ctx context.Context, key string) ([]byte, bool, error)
+	// Set caches value under key for ttl
+	Set(ctx context.Context, key string, value []byte, ttl time.Duration) error
+	// Delete removes the keys, the missing ones are ignored
+	Delete(ctx context.Context, keys ...string) error
+	// Close releases the connections, if any
+	Close() error
+}
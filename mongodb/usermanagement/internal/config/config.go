@@ -0,0 +1,612 @@
+package config
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"usermanagement/internal/models"
+
+	"github.com/santhosh-tekuri/jsonschema/v5"
+	"gopkg.in/yaml.v3"
+)
+
+// Config is the configuration of the server.
+// It's loaded by Load from, in increasing precedence:
+//  1. the defaults
+//  2. a YAML file, given by -config or CONFIG_FILE
+//  3. the environment variables
+//  4. the command-line flags
+type Config struct {
+	Server     ServerConfig     `yaml:"server"`
+	Database   DatabaseConfig   `yaml:"database"`
+	Deletion   DeletionConfig   `yaml:"deletion"`
+	Attributes AttributesConfig `yaml:"attributes"`
+	Cache      CacheConfig      `yaml:"cache"`
+	Redis      RedisConfig      `yaml:"redis"`
+	Log        LogConfig        `yaml:"log"`
+	Tracing    TracingConfig    `yaml:"tracing"`
+}
+
+// ServerConfig is the configuration of the HTTP server
+type ServerConfig struct {
+	Addr         string        `yaml:"addr"`
+	ReadTimeout  time.Duration `yaml:"read_timeout"`
+	WriteTimeout time.Duration `yaml:"write_timeout"`
+	IdleTimeout  time.Duration `yaml:"idle_timeout"`
+	// ShutdownTimeout is how long in-flight requests are drained on SIGTERM
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout"`
+	// ReadinessTimeout is the deadline of each dependency check of GET /readyz
+	ReadinessTimeout time.Duration `yaml:"readiness_timeout"`
+	// BulkTimeout replaces the read and write timeouts for the bulk import and export of the users
+	BulkTimeout time.Duration `yaml:"bulk_timeout"`
+	// AdminToken is the bearer token of the admin endpoints, e.g. GET /audit.
+	// They are disabled if it's empty.
+	AdminToken string      `yaml:"admin_token"`
+	Login      LoginConfig `yaml:"login"`
+}
+
+// LoginConfig is the throttling of POST /login.
+// The failures are counted in the Redis server if redis.url is set, so they're shared by the replicas.
+type LoginConfig struct {
+	// MaxFailures is the number of failed logins of a username in FailureWindow before it's throttled, 0 doesn't limit them
+	MaxFailures int `yaml:"max_failures"`
+	// MaxFailuresPerIP is the same for a client IP, trying many usernames
+	MaxFailuresPerIP int `yaml:"max_failures_per_ip"`
+	// FailureWindow starts at the first failure, the throttling ends with it
+	FailureWindow time.Duration `yaml:"failure_window"`
+}
+
+// DatabaseConfig is the configuration of the database.
+// One of Mongo.URI, MySQL.URI, JSON.DataFile and Memory is required, see Backend for the precedence.
+type DatabaseConfig struct {
+	Mongo          MongoConfig   `yaml:"mongo"`
+	MySQL          MySQLConfig   `yaml:"mysql"`
+	JSON           JSONConfig    `yaml:"json"`
+	ConnectTimeout time.Duration `yaml:"connect_timeout"`
+	ReadTimeout    time.Duration `yaml:"read_timeout"`
+	WriteTimeout   time.Duration `yaml:"write_timeout"`
+	// Memory keeps the users in memory, lost when the server stops, even if a database is configured.
+	// It's never chosen without being set, a missing database is an error.
+	Memory bool `yaml:"memory"`
+}
+
+type MongoConfig struct {
+	URI      string `yaml:"uri"`
+	Database string `yaml:"database"`
+}
+
+type MySQLConfig struct {
+	URI string `yaml:"uri"`
+	// AutoMigrate applies the pending schema migrations on startup,
+	// otherwise they are applied with `usermgmt-admin schema up`
+	AutoMigrate bool `yaml:"auto_migrate"`
+}
+
+// JSONConfig is the configuration of the JSON files, the storage without a database
+type JSONConfig struct {
+	// DataFile is the path of the JSON file storing the users, e.g. ../internal/services/data/users.json
+	DataFile string `yaml:"data_file"`
+}
+
+// AuditFile returns the path of the audit log, next to the data file: users.json gives users.audit.json
+func (j JSONConfig) AuditFile() string {
+	return strings.TrimSuffix(j.DataFile, filepath.Ext(j.DataFile)) + ".audit.json"
+}
+
+// The backends, see DatabaseConfig.Backend
+const (
+	BackendMongo  = "mongodb"
+	BackendMySQL  = "mysql"
+	BackendJSON   = "json"
+	BackendMemory = "memory"
+)
+
+// Backend returns the configured backend: the memory if Memory is set, else MongoDB, else MySQL, else the JSON file,
+// "" if none is set
+func (d DatabaseConfig) Backend() string {
+	switch {
+	case d.Memory:
+		return BackendMemory
+	case d.Mongo.URI != "":
+		return BackendMongo
+	case d.MySQL.URI != "":
+		return BackendMySQL
+	case d.JSON.DataFile != "":
+		return BackendJSON
+	default:
+		return ""
+	}
+}
+
+// CacheConfig is the configuration of the cache of the user lookups, in front of the database
+type CacheConfig struct {
+	// Backend is lru, a cache in each process, redis, a cache shared by the replicas, or none.
+	// If it's empty, it's redis when redis.url is set, so the replicas see the changes of each other, else lru.
+	Backend string `yaml:"backend"`
+	// Size is the number of lookups kept by the lru cache
+	Size int `yaml:"size"`
+	// TTL is how long a user is cached, the most a change made elsewhere can go unseen
+	TTL time.Duration `yaml:"ttl"`
+	// NegativeTTL is how long an unknown username or id is cached, 0 doesn't cache them
+	NegativeTTL time.Duration `yaml:"negative_ttl"`
+}
+
+// DeletionConfig is the soft deletion of the users: a deleted user is hidden,
+// can be restored during GracePeriod, then it's purged
+type DeletionConfig struct {
+	// GracePeriod is how long a deleted user can be restored, from its deletion
+	GracePeriod time.Duration `yaml:"grace_period"`
+	// PurgeInterval is how often the server purges the users deleted for more than GracePeriod, 0 doesn't purge them
+	PurgeInterval time.Duration `yaml:"purge_interval"`
+	// Username is reserve, the username of a deleted user can't be registered until it's purged,
+	// or free, it can be registered at once and the user can't be restored once it's taken
+	Username string `yaml:"username"`
+}
+
+// AttributesConfig declares the custom attributes of the users, e.g. department, phone or locale,
+// as the properties of a JSON Schema of the attributes object
+type AttributesConfig struct {
+	// SchemaFile is the path of the JSON Schema, the users have no attributes if it's empty
+	SchemaFile string `yaml:"schema_file"`
+}
+
+// Schema reads and compiles the JSON Schema of SchemaFile, it returns nil if there's none.
+// The schema must describe an object, the top-level properties are the attributes.
+func (a AttributesConfig) Schema() (*jsonschema.Schema, error) {
+	if a.SchemaFile == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(a.SchemaFile)
+	if err != nil {
+		return nil, err
+	}
+	compiler := jsonschema.NewCompiler()
+	if err := compiler.AddResource(a.SchemaFile, bytes.NewReader(data)); err != nil {
+		return nil, err
+	}
+	schema, err := compiler.Compile(a.SchemaFile)
+	if err != nil {
+		return nil, err
+	}
+	if !slices.Contains(schema.Types, "object") {
+		return nil, errors.New(`the schema must have "type": "object"`)
+	}
+	return schema, nil
+}
+
+// The policies of the usernames of the deleted users, see DeletionConfig.Username
+const (
+	UsernameReserve = "reserve"
+	UsernameFree    = "free"
+)
+
+// The caches, see CacheConfig.Backend
+const (
+	CacheLRU   = "lru"
+	CacheRedis = "redis"
+	CacheNone  = "none"
+)
+
+// RedisConfig is the configuration of the Redis server shared by the replicas
+type RedisConfig struct {
+	// URL is e.g. redis://:password@localhost:6379/0
+	URL string `yaml:"url"`
+}
+
+// LogConfig is the configuration of the logs
+type LogConfig struct {
+	// Level is the minimum level logged: debug, info, warn or error
+	Level string `yaml:"level"`
+	// Format is json, for the log collectors, or text, for humans
+	Format string `yaml:"format"`
+}
+
+// TracingConfig is the configuration of the OpenTelemetry traces
+type TracingConfig struct {
+	// Exporter is none, stdout, or otlp to send the spans to an OTLP/HTTP collector
+	Exporter string `yaml:"exporter"`
+	// Endpoint is the URL of the OTLP/HTTP collector, e.g. http://otel-collector:4318.
+	// If empty, the OTEL_EXPORTER_OTLP_* environment variables are used.
+	Endpoint    string `yaml:"endpoint"`
+	ServiceName string `yaml:"service_name"`
+}
+
+// Timeouts returns the deadlines of each database operation
+func (d DatabaseConfig) Timeouts() models.Timeouts {
+	return models.Timeouts{
+		Read:  d.ReadTimeout,
+		Write: d.WriteTimeout,
+	}
+}
+
+// Default returns the configuration used when nothing is set
+func Default() *Config {
+	return &Config{
+		Server: ServerConfig{
+			Addr:             ":8080",
+			ReadTimeout:      10 * time.Second,
+			WriteTimeout:     30 * time.Second,
+			IdleTimeout:      120 * time.Second,
+			ShutdownTimeout:  20 * time.Second,
+			ReadinessTimeout: 2 * time.Second,
+			BulkTimeout:      10 * time.Minute,
+			Login: LoginConfig{
+				MaxFailures:      5,
+				MaxFailuresPerIP: 50,
+				FailureWindow:    15 * time.Minute,
+			},
+		},
+		Database: DatabaseConfig{
+			MySQL:          MySQLConfig{AutoMigrate: true},
+			ConnectTimeout: 10 * time.Second,
+			ReadTimeout:    models.DefaultTimeouts.Read,
+			WriteTimeout:   models.DefaultTimeouts.Write,
+		},
+		Deletion: DeletionConfig{
+			GracePeriod:   30 * 24 * time.Hour,
+			PurgeInterval: time.Hour,
+			Username:      UsernameReserve,
+		},
+		Cache: CacheConfig{
+			Size:        10000,
+			TTL:         30 * time.Second,
+			NegativeTTL: 5 * time.Second,
+		},
+		Log: LogConfig{
+			Level:  "info",
+			Format: "json",
+		},
+		Tracing: TracingConfig{
+			Exporter:    "none",
+			ServiceName: "usermanagement",
+		},
+	}
+}
+
+// option binds a setting to its environment variable and command-line flag
+type option struct {
+	env   string
+	flag  string
+	usage string
+	set   func(c *Config, value string) error
+}
+
+func stringOption(env, flag, usage string, field func(c *Config) *string) option {
+	return option{env: env, flag: flag, usage: usage, set: func(c *Config, value string) error {
+		*field(c) = value
+		return nil
+	}}
+}
+
+func boolOption(env, flag, usage string, field func(c *Config) *bool) option {
+	return option{env: env, flag: flag, usage: usage, set: func(c *Config, value string) error {
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		*field(c) = b
+		return nil
+	}}
+}
+
+func intOption(env, flag, usage string, field func(c *Config) *int) option {
+	return option{env: env, flag: flag, usage: usage, set: func(c *Config, value string) error {
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return err
+		}
+		*field(c) = n
+		return nil
+	}}
+}
+
+func durationOption(env, flag, usage string, field func(c *Config) *time.Duration) option {
+	return option{env: env, flag: flag, usage: usage, set: func(c *Config, value string) error {
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return err
+		}
+		*field(c) = d
+		return nil
+	}}
+}
+
+var options = []option{
+	stringOption("SERVER_ADDR", "addr", "address the HTTP server listens on",
+		func(c *Config) *string { return &c.Server.Addr }),
+	durationOption("SERVER_READ_TIMEOUT", "read-timeout", "deadline to read a request",
+		func(c *Config) *time.Duration { return &c.Server.ReadTimeout }),
+	durationOption("SERVER_WRITE_TIMEOUT", "write-timeout", "deadline to write a response",
+		func(c *Config) *time.Duration { return &c.Server.WriteTimeout }),
+	durationOption("SERVER_IDLE_TIMEOUT", "idle-timeout", "how long an idle keep-alive connection is kept",
+		func(c *Config) *time.Duration { return &c.Server.IdleTimeout }),
+	durationOption("SERVER_SHUTDOWN_TIMEOUT", "shutdown-timeout", "how long in-flight requests are drained on shutdown",
+		func(c *Config) *time.Duration { return &c.Server.ShutdownTimeout }),
+	durationOption("SERVER_READINESS_TIMEOUT", "readiness-timeout", "deadline of each dependency check of GET /readyz",
+		func(c *Config) *time.Duration { return &c.Server.ReadinessTimeout }),
+	durationOption("SERVER_BULK_TIMEOUT", "bulk-timeout", "deadline to read and write a bulk import or export of the users",
+		func(c *Config) *time.Duration { return &c.Server.BulkTimeout }),
+	stringOption("ADMIN_TOKEN", "admin-token", "bearer token of the admin endpoints, disabled if empty",
+		func(c *Config) *string { return &c.Server.AdminToken }),
+	intOption("LOGIN_MAX_FAILURES", "login-max-failures", "failed logins of a username before it's throttled, 0 for no limit",
+		func(c *Config) *int { return &c.Server.Login.MaxFailures }),
+	intOption("LOGIN_MAX_FAILURES_PER_IP", "login-max-failures-per-ip", "failed logins of a client IP before it's throttled, 0 for no limit",
+		func(c *Config) *int { return &c.Server.Login.MaxFailuresPerIP }),
+	durationOption("LOGIN_FAILURE_WINDOW", "login-failure-window", "how long the failed logins are counted, from the first one",
+		func(c *Config) *time.Duration { return &c.Server.Login.FailureWindow }),
+	stringOption("MONGO_URI", "mongo-uri", "MongoDB connection URI",
+		func(c *Config) *string { return &c.Database.Mongo.URI }),
+	stringOption("MONGO_DATABASE", "mongo-database", "MongoDB database name",
+		func(c *Config) *string { return &c.Database.Mongo.Database }),
+	stringOption("MYSQL_URI", "mysql-uri", "MySQL data source name",
+		func(c *Config) *string { return &c.Database.MySQL.URI }),
+	stringOption("DATA_FILE", "data-file", "path of the JSON file storing the users",
+		func(c *Config) *string { return &c.Database.JSON.DataFile }),
+	boolOption("MEMORY", "memory", "keep the users in memory, without a database",
+		func(c *Config) *bool { return &c.Database.Memory }),
+	boolOption("MYSQL_AUTO_MIGRATE", "mysql-auto-migrate", "apply the pending MySQL schema migrations on startup",
+		func(c *Config) *bool { return &c.Database.MySQL.AutoMigrate }),
+	durationOption("DB_CONNECT_TIMEOUT", "db-connect-timeout", "deadline to connect to the database on startup",
+		func(c *Config) *time.Duration { return &c.Database.ConnectTimeout }),
+	durationOption("DB_READ_TIMEOUT", "db-read-timeout", "deadline of each database read",
+		func(c *Config) *time.Duration { return &c.Database.ReadTimeout }),
+	durationOption("DB_WRITE_TIMEOUT", "db-write-timeout", "deadline of each database write",
+		func(c *Config) *time.Duration { return &c.Database.WriteTimeout }),
+	durationOption("DELETION_GRACE_PERIOD", "deletion-grace-period", "how long a deleted user can be restored",
+		func(c *Config) *time.Duration { return &c.Deletion.GracePeriod }),
+	durationOption("DELETION_PURGE_INTERVAL", "deletion-purge-interval", "how often the users deleted for longer than the grace period are purged, 0 to not purge them",
+		func(c *Config) *time.Duration { return &c.Deletion.PurgeInterval }),
+	stringOption("DELETION_USERNAME", "deletion-username", "username of a deleted user: reserve until it's purged, or free at once",
+		func(c *Config) *string { return &c.Deletion.Username }),
+	stringOption("ATTRIBUTES_SCHEMA_FILE", "attributes-schema-file", "path of the JSON Schema of the custom attributes of the users",
+		func(c *Config) *string { return &c.Attributes.SchemaFile }),
+	stringOption("CACHE_BACKEND", "cache-backend", "cache of the user lookups: lru, redis or none, redis if REDIS_URL is set and lru otherwise by default",
+		func(c *Config) *string { return &c.Cache.Backend }),
+	intOption("CACHE_SIZE", "cache-size", "number of user lookups kept by the lru cache",
+		func(c *Config) *int { return &c.Cache.Size }),
+	durationOption("CACHE_TTL", "cache-ttl", "how long a user is cached",
+		func(c *Config) *time.Duration { return &c.Cache.TTL }),
+	durationOption("CACHE_NEGATIVE_TTL", "cache-negative-ttl", "how long an unknown user is cached, 0 to not cache them",
+		func(c *Config) *time.Duration { return &c.Cache.NegativeTTL }),
+	stringOption("REDIS_URL", "redis-url", "URL of the Redis server shared by the replicas",
+		func(c *Config) *string { return &c.Redis.URL }),
+	stringOption("LOG_LEVEL", "log-level", "minimum log level: debug, info, warn or error",
+		func(c *Config) *string { return &c.Log.Level }),
+	stringOption("LOG_FORMAT", "log-format", "log format: json or text",
+		func(c *Config) *string { return &c.Log.Format }),
+	stringOption("TRACING_EXPORTER", "tracing-exporter", "where the spans are exported: none, stdout or otlp",
+		func(c *Config) *string { return &c.Tracing.Exporter }),
+	stringOption("TRACING_ENDPOINT", "tracing-endpoint", "URL of the OTLP/HTTP collector",
+		func(c *Config) *string { return &c.Tracing.Endpoint }),
+	stringOption("TRACING_SERVICE_NAME", "tracing-service-name", "service name of the spans",
+		func(c *Config) *string { return &c.Tracing.ServiceName }),
+}
+
+// Load loads the configuration from the file, the environment variables and args,
+// the command-line arguments without the program name, and validates it.
+func Load(args []string) (*Config, error) {
+	c, _, err := LoadArgs(args)
+	return c, err
+}
+
+// LoadArgs is Load for the commands taking arguments after the flags,
+// it also returns the arguments left after the flags.
+func LoadArgs(args []string) (*Config, []string, error) {
+	fs := flag.NewFlagSet("usermanagement", flag.ContinueOnError)
+	configFile := fs.String("config", os.Getenv("CONFIG_FILE"), "path of the YAML configuration file")
+	flagValues := make(map[string]*string, len(options))
+	for _, o := range options {
+		flagValues[o.flag] = fs.String(o.flag, "", fmt.Sprintf("%s (env %s)", o.usage, o.env))
+	}
+	if err := fs.Parse(args); err != nil {
+		return nil, nil, err
+	}
+
+	c := Default()
+
+	// file
+	if *configFile != "" {
+		if err := c.loadFile(*configFile); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	// environment variables
+	for _, o := range options {
+		if value := os.Getenv(o.env); value != "" {
+			if err := o.set(c, value); err != nil {
+				return nil, nil, fmt.Errorf("invalid %s: %w", o.env, err)
+			}
+		}
+	}
+
+	// flags, only the ones given on the command line
+	var errs []error
+	fs.Visit(func(f *flag.Flag) {
+		for _, o := range options {
+			if o.flag == f.Name {
+				if err := o.set(c, *flagValues[o.flag]); err != nil {
+					errs = append(errs, fmt.Errorf("invalid -%s: %w", o.flag, err))
+				}
+			}
+		}
+	})
+	if len(errs) > 0 {
+		return nil, nil, errors.Join(errs...)
+	}
+
+	if c.Cache.Backend == "" {
+		// a cache in each process would serve the users changed by the other replicas until the TTL
+		c.Cache.Backend = CacheLRU
+		if c.Redis.URL != "" {
+			c.Cache.Backend = CacheRedis
+		}
+	}
+
+	if err := c.Validate(); err != nil {
+		return nil, nil, err
+	}
+	return c, fs.Args(), nil
+}
+
+// loadFile overrides c with the settings of the YAML file at path.
+// Unknown keys are reported, so a typo doesn't silently fall back to the default.
+func (c *Config) loadFile(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("read config file: %w", err)
+	}
+	defer file.Close()
+
+	decoder := yaml.NewDecoder(file)
+	decoder.KnownFields(true)
+	if err := decoder.Decode(c); err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("parse config file %s: %w", path, err)
+	}
+	return nil
+}
+
+// Validate checks the configuration, and returns all the problems found
+func (c *Config) Validate() error {
+	var errs []error
+
+	if _, _, err := net.SplitHostPort(c.Server.Addr); err != nil {
+		errs = append(errs, fmt.Errorf("server.addr: %q is not a valid address: %w", c.Server.Addr, err))
+	}
+
+	srv := c.Server
+	if srv.ReadTimeout <= 0 {
+		errs = append(errs, fmt.Errorf("server.read_timeout: must be positive, got %s", srv.ReadTimeout))
+	}
+	if srv.WriteTimeout <= 0 {
+		errs = append(errs, fmt.Errorf("server.write_timeout: must be positive, got %s", srv.WriteTimeout))
+	}
+	if srv.IdleTimeout <= 0 {
+		errs = append(errs, fmt.Errorf("server.idle_timeout: must be positive, got %s", srv.IdleTimeout))
+	}
+	if srv.ShutdownTimeout <= 0 {
+		errs = append(errs, fmt.Errorf("server.shutdown_timeout: must be positive, got %s", srv.ShutdownTimeout))
+	}
+	if srv.ReadinessTimeout <= 0 {
+		errs = append(errs, fmt.Errorf("server.readiness_timeout: must be positive, got %s", srv.ReadinessTimeout))
+	}
+	if srv.BulkTimeout <= 0 {
+		errs = append(errs, fmt.Errorf("server.bulk_timeout: must be positive, got %s", srv.BulkTimeout))
+	}
+	if srv.Login.MaxFailures < 0 {
+		errs = append(errs, fmt.Errorf("server.login.max_failures: must not be negative, got %d", srv.Login.MaxFailures))
+	}
+	if srv.Login.MaxFailuresPerIP < 0 {
+		errs = append(errs, fmt.Errorf("server.login.max_failures_per_ip: must not be negative, got %d", srv.Login.MaxFailuresPerIP))
+	}
+	if (srv.Login.MaxFailures > 0 || srv.Login.MaxFailuresPerIP > 0) && srv.Login.FailureWindow <= 0 {
+		errs = append(errs, fmt.Errorf("server.login.failure_window: must be positive, got %s", srv.Login.FailureWindow))
+	}
+
+	d := c.Database
+	switch d.Backend() {
+	case BackendMongo:
+		if d.Mongo.Database == "" {
+			errs = append(errs, errors.New("database.mongo.database: required when database.mongo.uri is set (MONGO_DATABASE)"))
+		}
+	case BackendMySQL:
+	case BackendJSON:
+		if info, err := os.Stat(filepath.Dir(d.JSON.DataFile)); err != nil || !info.IsDir() {
+			errs = append(errs, fmt.Errorf("database.json.data_file: directory of %q doesn't exist", d.JSON.DataFile))
+		}
+	case BackendMemory:
+	default:
+		errs = append(errs, errors.New("database: one of database.mongo.uri (MONGO_URI), database.mysql.uri (MYSQL_URI), "+
+			"database.json.data_file (DATA_FILE) or database.memory (MEMORY=true) is required"))
+	}
+
+	if d.ConnectTimeout <= 0 {
+		errs = append(errs, fmt.Errorf("database.connect_timeout: must be positive, got %s", d.ConnectTimeout))
+	}
+	if d.ReadTimeout < 0 {
+		errs = append(errs, fmt.Errorf("database.read_timeout: must not be negative, got %s", d.ReadTimeout))
+	}
+	if d.WriteTimeout < 0 {
+		errs = append(errs, fmt.Errorf("database.write_timeout: must not be negative, got %s", d.WriteTimeout))
+	}
+
+	deletion := c.Deletion
+	if deletion.GracePeriod <= 0 {
+		errs = append(errs, fmt.Errorf("deletion.grace_period: must be positive, got %s", deletion.GracePeriod))
+	}
+	if deletion.PurgeInterval < 0 {
+		errs = append(errs, fmt.Errorf("deletion.purge_interval: must not be negative, got %s", deletion.PurgeInterval))
+	}
+	if deletion.Username != UsernameReserve && deletion.Username != UsernameFree {
+		errs = append(errs, fmt.Errorf("deletion.username: %q is not one of reserve or free", deletion.Username))
+	}
+
+	if _, err := c.Attributes.Schema(); err != nil {
+		errs = append(errs, fmt.Errorf("attributes.schema_file: %w", err))
+	}
+
+	cache := c.Cache
+	switch cache.Backend {
+	case CacheLRU:
+		if cache.Size <= 0 {
+			errs = append(errs, fmt.Errorf("cache.size: must be positive, got %d", cache.Size))
+		}
+	case CacheRedis:
+		if c.Redis.URL == "" {
+			errs = append(errs, errors.New("redis.url: required when cache.backend is redis (REDIS_URL)"))
+		}
+	case CacheNone:
+	default:
+		errs = append(errs, fmt.Errorf("cache.backend: %q is not one of lru, redis or none", cache.Backend))
+	}
+	if cache.Backend != CacheNone && cache.TTL <= 0 {
+		errs = append(errs, fmt.Errorf("cache.ttl: must be positive, got %s", cache.TTL))
+	}
+	if cache.NegativeTTL < 0 {
+		errs = append(errs, fmt.Errorf("cache.negative_ttl: must not be negative, got %s", cache.NegativeTTL))
+	}
+	if c.Redis.URL != "" {
+		if u, err := url.Parse(c.Redis.URL); err != nil || (u.Scheme != "redis" && u.Scheme != "rediss") || u.Host == "" {
+			// the URL isn't printed, it may have the password
+			errs = append(errs, errors.New("redis.url: not a redis or rediss URL"))
+		}
+	}
+
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(c.Log.Level)); err != nil {
+		errs = append(errs, fmt.Errorf("log.level: %q is not one of debug, info, warn or error", c.Log.Level))
+	}
+	if c.Log.Format != "json" && c.Log.Format != "text" {
+		errs = append(errs, fmt.Errorf("log.format: %q is not one of json or text", c.Log.Format))
+	}
+
+	switch c.Tracing.Exporter {
+	case "none", "stdout", "otlp":
+	default:
+		errs = append(errs, fmt.Errorf("tracing.exporter: %q is not one of none, stdout or otlp", c.Tracing.Exporter))
+	}
+	if c.Tracing.Endpoint != "" {
+		if u, err := url.Parse(c.Tracing.Endpoint); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs = append(errs, fmt.Errorf("tracing.endpoint: %q is not an http or https URL", c.Tracing.Endpoint))
+		}
+	}
+	if c.Tracing.ServiceName == "" {
+		errs = append(errs, errors.New("tracing.service_name: must not be empty"))
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("invalid configuration:\n%w", errors.Join(errs...))
+	}
+	return nil
+}
@@ -0,0 +1,403 @@
+package filter
+
+import (
+	"encoding/json"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+	"unicode/utf8"
+	"usermanagement/internal/models"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// Type is the type of an attribute, it tells its operators and the type of its values
+type Type int
+
+const (
+	// String attributes are compared regardless of the case, with eq, ne, co, sw, ew and pr
+	String Type = iota
+	// Strings are multi-valued: eq matches the items with the value among them, ne the others, pr the non-empty ones
+	Strings
+	// Boolean attributes are compared with eq, ne and pr
+	Boolean
+	// Number attributes are compared with eq, ne, gt, ge, lt, le and pr
+	Number
+	// DateTime attributes are compared with eq, ne, gt, ge, lt, le and pr to a date, e.g. "2026-01-01",
+	// or an RFC 3339 time, e.g. "2026-01-01T12:00:00Z"
+	DateTime
+)
+
+// Attribute is an attribute of the items that can be filtered
+type Attribute struct {
+	Type Type
+	// Path is the field of the MongoDB documents, e.g. created_at
+	Path string
+	// Column is the column of the SQL tables, e.g. created_at
+	Column string
+	// JSONPath is the path in the JSON document of Column, e.g. $.department, for the attributes inside a JSON column.
+	// They are compared exactly, a String one only with eq, ne and pr.
+	JSONPath string
+	// Default is the value of a String attribute that is missing or empty, e.g. the status of the older users
+	Default string
+	// Value returns the value of the attribute of an item, in the type of the attribute:
+	// a string, a []string, a bool, a float64 or a time.Time, nil if it's missing
+	Value func(item interface{}) interface{}
+}
+
+// Schema returns the attribute of a name, false if there's none. The names are compared regardless of the case.
+type Schema func(name string) (Attribute, bool)
+
+// dateLayouts are the layouts of the values of the DateTime attributes, in UTC without a time zone
+var dateLayouts = []string{time.RFC3339Nano, "2006-01-02T15:04:05", "2006-01-02"}
+
+// resolve checks the attribute, the operator and the value of a comparison against the schema,
+// and converts the value to the type of the attribute
+func (s Schema) resolve(c *Comparison) error {
+	attribute, ok := s(c.Attribute.Text)
+	if !ok {
+		return c.Attribute.errorAt("unknown attribute")
+	}
+	c.attribute = attribute
+	op := c.Op()
+	if op == "pr" {
+		return nil
+	}
+
+	var allowed string
+	switch {
+	case attribute.Type == String && attribute.JSONPath == "":
+		allowed = "eq ne co sw ew"
+	case attribute.Type == String, attribute.Type == Strings, attribute.Type == Boolean:
+		allowed = "eq ne"
+	default:
+		allowed = "eq ne gt ge lt le"
+	}
+	if !slices.Contains(strings.Fields(allowed), op) {
+		return c.Operator.errorAt("the attribute %s only has the operators %s and pr", c.Attribute.Text, strings.ReplaceAll(allowed, " ", ", "))
+	}
+
+	value, err := literal(c.Value)
+	if err != nil {
+		return err
+	}
+	switch v := value.(type) {
+	case nil:
+		return c.Value.errorAt("null can't be compared, use pr for the attributes present")
+	case string:
+		switch attribute.Type {
+		case String, Strings:
+			c.value = v
+			return nil
+		case DateTime:
+			for _, layout := range dateLayouts {
+				if t, err := time.Parse(layout, v); err == nil {
+					c.value = t.UTC()
+					return nil
+				}
+			}
+			return c.Value.errorAt("expected a date, e.g. \"2026-01-01\", or an RFC 3339 time")
+		}
+	case float64:
+		if attribute.Type == Number {
+			c.value = v
+			return nil
+		}
+	case bool:
+		if attribute.Type == Boolean {
+			c.value = v
+			return nil
+		}
+	}
+	return c.Value.errorAt("expected a %s value", attribute.Type)
+}
+
+func (t Type) String() string {
+	switch t {
+	case String, Strings:
+		return "string"
+	case Boolean:
+		return "boolean"
+	case Number:
+		return "number"
+	default:
+		return "date"
+	}
+}
+
+// ----- MongoDB -----
+
+// mongoOperators are the MongoDB operators of the comparisons
+var mongoOperators = map[string]string{"gt": "$gt", "ge": "$gte", "lt": "$lt", "le": "$lte"}
+
+// BSON returns the MongoDB filter of the items matching the filter
+func (f *Filter) BSON() bson.M {
+	return toBSON(f.Expr)
+}
+
+func toBSON(expr Expr) bson.M {
+	switch e := expr.(type) {
+	case *And:
+		return bson.M{"$and": bson.A{toBSON(e.Left), toBSON(e.Right)}}
+	case *Or:
+		return bson.M{"$or": bson.A{toBSON(e.Left), toBSON(e.Right)}}
+	case *Not:
+		return bson.M{"$nor": bson.A{toBSON(e.Expr)}}
+	default:
+		return comparisonBSON(expr.(*Comparison))
+	}
+}
+
+func comparisonBSON(c *Comparison) bson.M {
+	a := c.attribute
+	switch op := c.Op(); {
+	case op == "pr" && a.Type == Strings:
+		return bson.M{a.Path: bson.M{"$exists": true, "$nin": bson.A{nil, bson.A{}}}}
+	case op == "pr" && a.Type == String:
+		return bson.M{a.Path: bson.M{"$exists": true, "$nin": bson.A{nil, ""}}}
+	case op == "pr":
+		return bson.M{a.Path: bson.M{"$exists": true, "$ne": nil}}
+	case op == "ne":
+		eq := *c
+		eq.Operator.Text = "eq"
+		return bson.M{"$nor": bson.A{comparisonBSON(&eq)}}
+	case a.Type == String && a.JSONPath == "":
+		pattern := regexp.QuoteMeta(c.value.(string))
+		switch op {
+		case "eq":
+			pattern = "^" + pattern + "$"
+		case "sw":
+			pattern = "^" + pattern
+		case "ew":
+			pattern = pattern + "$"
+		}
+		filter := bson.M{a.Path: bson.M{"$regex": pattern, "$options": "i"}}
+		if a.Default != "" && matchString(op, a.Default, c.value.(string)) {
+			filter = bson.M{"$or": bson.A{filter, bson.M{a.Path: bson.M{"$in": bson.A{nil, ""}}}}}
+		}
+		return filter
+	case op == "eq":
+		return bson.M{a.Path: c.value}
+	default:
+		return bson.M{a.Path: bson.M{mongoOperators[op]: c.value}}
+	}
+}
+
+// ----- SQL -----
+
+// sqlOperators are the SQL operators of the comparisons
+var sqlOperators = map[string]string{"eq": "=", "gt": ">", "ge": ">=", "lt": "<", "le": "<="}
+
+// SQL returns the condition of the WHERE clause of the rows matching the filter, with its arguments.
+// It's understood by MySQL and SQLite.
+func (f *Filter) SQL() (string, []interface{}) {
+	var args []interface{}
+	return toSQL(f.Expr, &args), args
+}
+
+func toSQL(expr Expr, args *[]interface{}) string {
+	switch e := expr.(type) {
+	case *And:
+		return "(" + toSQL(e.Left, args) + " AND " + toSQL(e.Right, args) + ")"
+	case *Or:
+		return "(" + toSQL(e.Left, args) + " OR " + toSQL(e.Right, args) + ")"
+	case *Not:
+		return not(toSQL(e.Expr, args))
+	default:
+		return comparisonSQL(expr.(*Comparison), args)
+	}
+}
+
+// not negates a condition, an unknown one, of a NULL column, being false like in MongoDB
+func not(condition string) string {
+	return "NOT COALESCE(" + condition + ", FALSE)"
+}
+
+func comparisonSQL(c *Comparison, args *[]interface{}) string {
+	a := c.attribute
+	add := func(values ...interface{}) { *args = append(*args, values...) }
+	op := c.Op()
+
+	if a.JSONPath != "" {
+		add(a.JSONPath)
+		column := "JSON_EXTRACT(" + a.Column + ", ?)"
+		if op == "pr" {
+			return column + " IS NOT NULL"
+		}
+		// the value is compared as JSON, e.g. true isn't "true"
+		encoded, _ := json.Marshal(c.value)
+		add(string(encoded))
+		if op == "ne" {
+			return not(column + " = JSON_EXTRACT(?, '$')")
+		}
+		return column + " " + sqlOperators[op] + " JSON_EXTRACT(?, '$')"
+	}
+
+	switch {
+	case op == "pr" && (a.Type == String || a.Type == Strings):
+		return "(" + a.Column + " IS NOT NULL AND " + a.Column + " <> '')"
+	case op == "pr":
+		return a.Column + " IS NOT NULL"
+	case op == "ne":
+		eq := *c
+		eq.Operator.Text = "eq"
+		return not(comparisonSQL(&eq, args))
+	case a.Type == String:
+		value := strings.ToLower(c.value.(string))
+		n := utf8.RuneCountInString(value)
+		var condition string
+		switch op {
+		case "eq":
+			condition = "LOWER(" + a.Column + ") = ?"
+			add(value)
+		case "co":
+			condition = "INSTR(LOWER(" + a.Column + "), ?) > 0"
+			add(value)
+		case "sw":
+			condition = "SUBSTR(LOWER(" + a.Column + "), 1, ?) = ?"
+			add(n, value)
+		case "ew":
+			condition = "SUBSTR(LOWER(" + a.Column + "), ?) = ?"
+			add(-n, value)
+		}
+		if a.Default != "" && matchString(op, a.Default, c.value.(string)) {
+			condition = "(" + condition + " OR " + a.Column + " IS NULL OR " + a.Column + " = '')"
+		}
+		return condition
+	case a.Type == Strings:
+		// the values are joined by commas
+		value := c.value.(string)
+		n := utf8.RuneCountInString(value)
+		add(value, n+1, value+",", -(n + 1), ","+value, ","+value+",")
+		return "(" + a.Column + " = ? OR SUBSTR(" + a.Column + ", 1, ?) = ? OR SUBSTR(" + a.Column + ", ?) = ? OR INSTR(" + a.Column + ", ?) > 0)"
+	case a.Type == DateTime:
+		t := c.value.(time.Time)
+		add(models.SQLTime(&t))
+		return a.Column + " " + sqlOperators[op] + " ?"
+	default:
+		add(c.value)
+		return a.Column + " " + sqlOperators[op] + " ?"
+	}
+}
+
+// ----- memory -----
+
+// Match tells whether the item matches the filter, with the Value of its attributes
+func (f *Filter) Match(item interface{}) bool {
+	return match(f.Expr, item)
+}
+
+func match(expr Expr, item interface{}) bool {
+	switch e := expr.(type) {
+	case *And:
+		return match(e.Left, item) && match(e.Right, item)
+	case *Or:
+		return match(e.Left, item) || match(e.Right, item)
+	case *Not:
+		return !match(e.Expr, item)
+	default:
+		return matchComparison(expr.(*Comparison), item)
+	}
+}
+
+func matchComparison(c *Comparison, item interface{}) bool {
+	a := c.attribute
+	value := a.Value(item)
+	if s, ok := value.(string); ok && s == "" && a.Default != "" {
+		value = a.Default
+	}
+	op := c.Op()
+	if op == "ne" {
+		eq := *c
+		eq.Operator.Text = "eq"
+		return !matchComparison(&eq, item)
+	}
+
+	switch v := value.(type) {
+	case nil:
+		return false
+	case string:
+		if op == "pr" {
+			return v != ""
+		}
+		if a.JSONPath != "" {
+			return v == c.value
+		}
+		return matchString(op, v, c.value.(string))
+	case []string:
+		if op == "pr" {
+			return len(v) > 0
+		}
+		for _, s := range v {
+			if s == c.value {
+				return true
+			}
+		}
+		return false
+	case time.Time:
+		if v.IsZero() {
+			return false
+		}
+		if op == "pr" {
+			return true
+		}
+		return compare(op, v.Compare(c.value.(time.Time)))
+	case float64:
+		if op == "pr" {
+			return true
+		}
+		n, ok := c.value.(float64)
+		if !ok {
+			return false
+		}
+		switch {
+		case v < n:
+			return compare(op, -1)
+		case v > n:
+			return compare(op, 1)
+		default:
+			return compare(op, 0)
+		}
+	case bool:
+		return op == "pr" || v == c.value
+	default:
+		// another type, e.g. an object in the JSON attributes
+		return op == "pr"
+	}
+}
+
+// matchString compares the strings of a String attribute regardless of the case
+func matchString(op, value, operand string) bool {
+	value, operand = strings.ToLower(value), strings.ToLower(operand)
+	switch op {
+	case "eq":
+		return value == operand
+	case "co":
+		return strings.Contains(value, operand)
+	case "sw":
+		return strings.HasPrefix(value, operand)
+	case "ew":
+		return strings.HasSuffix(value, operand)
+	default:
+		return false
+	}
+}
+
+// compare tells whether the result of a comparison, -1, 0 or 1, satisfies the operator
+func compare(op string, result int) bool {
+	switch op {
+	case "eq":
+		return result == 0
+	case "gt":
+		return result > 0
+	case "ge":
+		return result >= 0
+	case "lt":
+		return result < 0
+	case "le":
+		return result <= 0
+	default:
+		return false
+	}
+}
@@ -0,0 +1,348 @@
+// Package filter parses the filter expressions of the admin listing, in the syntax of the SCIM filters
+// (RFC 7644, section 3.4.2.2), e.g. status eq "active" and createdAt gt "2026-01-01".
+// A filter is parsed into an AST, checked against the attributes of a Schema, then compiled
+// into a MongoDB filter, a parameterized SQL condition or a predicate on the items in memory.
+package filter
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// MaxLength is the longest filter, in characters
+const MaxLength = 1000
+
+// maxDepth is the deepest nesting of the parentheses and the not operators
+const maxDepth = 32
+
+// Error is an invalid filter, with the position of the offending token
+type Error struct {
+	// Pos is the position of the token in the filter, in characters from 1
+	Pos int
+	// Token is the offending token, empty at the end of the filter
+	Token  string
+	Reason string
+}
+
+func (e *Error) Error() string {
+	if e.Token == "" {
+		return fmt.Sprintf("end of the filter at position %d: %s", e.Pos, e.Reason)
+	}
+	return fmt.Sprintf("%q at position %d: %s", e.Token, e.Pos, e.Reason)
+}
+
+// TokenKind is the kind of a token
+type TokenKind int
+
+const (
+	// TokenEnd ends the filter
+	TokenEnd TokenKind = iota
+	// TokenWord is an attribute, an operator, and, or, not, true, false or null
+	TokenWord
+	// TokenString is a JSON string, with its quotes
+	TokenString
+	// TokenNumber is a JSON number
+	TokenNumber
+	TokenOpen
+	TokenClose
+)
+
+// Token is a token of a filter
+type Token struct {
+	Kind TokenKind
+	Text string
+	// Pos is the position of the token in the filter, in characters from 1
+	Pos int
+}
+
+// errorAt returns the Error of the token
+func (t Token) errorAt(format string, args ...interface{}) *Error {
+	return &Error{Pos: t.Pos, Token: t.Text, Reason: fmt.Sprintf(format, args...)}
+}
+
+// is tells whether the token is the keyword, in any case
+func (t Token) is(keyword string) bool {
+	return t.Kind == TokenWord && strings.EqualFold(t.Text, keyword)
+}
+
+// isWordRune tells whether r is in the attributes, the operators and the keywords:
+// letters, digits, -, _ and . between an attribute and its sub-attribute
+func isWordRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r) || r == '-' || r == '_' || r == '.'
+}
+
+// tokenize splits filter into its tokens, the last one is TokenEnd
+func tokenize(filter string) ([]Token, error) {
+	var tokens []Token
+	pos := 1
+	for i := 0; i < len(filter); {
+		r, size := utf8.DecodeRuneInString(filter[i:])
+		start, startPos := i, pos
+		next := func() {
+			i += size
+			pos++
+			if i < len(filter) {
+				r, size = utf8.DecodeRuneInString(filter[i:])
+			}
+		}
+		switch {
+		case unicode.IsSpace(r):
+			next()
+			continue
+		case r == '(' || r == ')':
+			kind := TokenOpen
+			if r == ')' {
+				kind = TokenClose
+			}
+			next()
+			tokens = append(tokens, Token{Kind: kind, Text: filter[start:i], Pos: startPos})
+			continue
+		case r == '"':
+			next()
+			for i < len(filter) && r != '"' {
+				if r == '\\' {
+					next()
+				}
+				if i < len(filter) {
+					next()
+				}
+			}
+			if i >= len(filter) {
+				return nil, &Error{Pos: startPos, Token: filter[start:], Reason: "the string isn't closed"}
+			}
+			next()
+			tokens = append(tokens, Token{Kind: TokenString, Text: filter[start:i], Pos: startPos})
+			continue
+		case r == '-' || unicode.IsDigit(r):
+			for i < len(filter) && (strings.ContainsRune("+-.eE", r) || unicode.IsDigit(r)) {
+				next()
+			}
+			tokens = append(tokens, Token{Kind: TokenNumber, Text: filter[start:i], Pos: startPos})
+			continue
+		case isWordRune(r):
+			for i < len(filter) && isWordRune(r) {
+				next()
+			}
+			tokens = append(tokens, Token{Kind: TokenWord, Text: filter[start:i], Pos: startPos})
+			continue
+		default:
+			return nil, &Error{Pos: startPos, Token: string(r), Reason: "unexpected character"}
+		}
+	}
+	return append(tokens, Token{Kind: TokenEnd, Pos: pos}), nil
+}
+
+// Expr is a node of the AST of a filter: And, Or, Not or Comparison
+type Expr interface {
+	// First is the first token of the expression
+	First() Token
+}
+
+// And matches the items matching Left and Right
+type And struct {
+	Left, Right Expr
+}
+
+// Or matches the items matching Left or Right
+type Or struct {
+	Left, Right Expr
+}
+
+// Not matches the items not matching Expr
+type Not struct {
+	Keyword Token
+	Expr    Expr
+}
+
+// Comparison compares an attribute of the items to a value, e.g. status eq "active"
+type Comparison struct {
+	Attribute Token
+	Operator  Token
+	// Value is the literal, the zero Token for pr
+	Value Token
+	// attribute and value are resolved by the Schema: the value converted to the type of the attribute
+	attribute Attribute
+	value     interface{}
+}
+
+func (e *And) First() Token        { return e.Left.First() }
+func (e *Or) First() Token         { return e.Left.First() }
+func (e *Not) First() Token        { return e.Keyword }
+func (e *Comparison) First() Token { return e.Attribute }
+
+// Op returns the operator of the comparison, in lower case
+func (e *Comparison) Op() string {
+	return strings.ToLower(e.Operator.Text)
+}
+
+// operators are the operators of the comparisons, pr has no value
+var operators = map[string]bool{"eq": true, "ne": true, "co": true, "sw": true, "ew": true, "gt": true, "ge": true, "lt": true, "le": true, "pr": true}
+
+// Filter is a parsed filter, checked by its Schema
+type Filter struct {
+	Expr Expr
+}
+
+// Parse parses filter and checks its attributes, operators and values against schema.
+// The error is an *Error with the position of the offending token.
+// The and operator takes precedence over or, and not needs parentheses, e.g. not (locked eq true).
+func Parse(filter string, schema Schema) (*Filter, error) {
+	if utf8.RuneCountInString(filter) > MaxLength {
+		return nil, &Error{Pos: MaxLength + 1, Token: filter, Reason: fmt.Sprintf("the filter is longer than %d characters", MaxLength)}
+	}
+	tokens, err := tokenize(filter)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{tokens: tokens, schema: schema}
+	expr, err := p.or()
+	if err != nil {
+		return nil, err
+	}
+	if token := p.peek(); token.Kind != TokenEnd {
+		return nil, token.errorAt("expected and, or or the end of the filter")
+	}
+	return &Filter{Expr: expr}, nil
+}
+
+// parser is a recursive descent parser of the tokens of a filter
+type parser struct {
+	tokens []Token
+	i      int
+	depth  int
+	schema Schema
+}
+
+func (p *parser) peek() Token {
+	return p.tokens[p.i]
+}
+
+func (p *parser) next() Token {
+	token := p.tokens[p.i]
+	if token.Kind != TokenEnd {
+		p.i++
+	}
+	return token
+}
+
+// or parses the and expressions joined by or
+func (p *parser) or() (Expr, error) {
+	left, err := p.and()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek().is("or") {
+		p.next()
+		right, err := p.and()
+		if err != nil {
+			return nil, err
+		}
+		left = &Or{Left: left, Right: right}
+	}
+	return left, nil
+}
+
+// and parses the unary expressions joined by and
+func (p *parser) and() (Expr, error) {
+	left, err := p.unary()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek().is("and") {
+		p.next()
+		right, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		left = &And{Left: left, Right: right}
+	}
+	return left, nil
+}
+
+// unary parses a comparison, a filter in parentheses or its negation with not
+func (p *parser) unary() (Expr, error) {
+	token := p.peek()
+	switch {
+	case token.is("not"):
+		p.next()
+		if p.peek().Kind != TokenOpen {
+			return nil, p.peek().errorAt("expected ( after not")
+		}
+		expr, err := p.group()
+		if err != nil {
+			return nil, err
+		}
+		return &Not{Keyword: token, Expr: expr}, nil
+	case token.Kind == TokenOpen:
+		return p.group()
+	default:
+		return p.comparison()
+	}
+}
+
+// group parses a filter in parentheses
+func (p *parser) group() (Expr, error) {
+	open := p.next()
+	p.depth++
+	defer func() { p.depth-- }()
+	if p.depth > maxDepth {
+		return nil, open.errorAt("more than %d nested parentheses", maxDepth)
+	}
+	expr, err := p.or()
+	if err != nil {
+		return nil, err
+	}
+	if p.peek().Kind != TokenClose {
+		return nil, p.peek().errorAt("expected ) to close the ( at position %d", open.Pos)
+	}
+	p.next()
+	return expr, nil
+}
+
+// comparison parses an attribute, an operator and the value, unless the operator is pr
+func (p *parser) comparison() (Expr, error) {
+	attribute := p.next()
+	if attribute.Kind != TokenWord || attribute.is("and") || attribute.is("or") {
+		return nil, attribute.errorAt("expected an attribute")
+	}
+	operator := p.next()
+	if operator.Kind != TokenWord || !operators[strings.ToLower(operator.Text)] {
+		return nil, operator.errorAt("expected an operator: eq, ne, co, sw, ew, gt, ge, lt, le or pr")
+	}
+	expr := &Comparison{Attribute: attribute, Operator: operator}
+	if expr.Op() != "pr" {
+		expr.Value = p.next()
+	}
+	if err := p.schema.resolve(expr); err != nil {
+		return nil, err
+	}
+	return expr, nil
+}
+
+// literal returns the value of a value token: a string, a float64, a bool or nil for null
+func literal(token Token) (interface{}, error) {
+	switch {
+	case token.Kind == TokenString:
+		var s string
+		if err := json.Unmarshal([]byte(token.Text), &s); err != nil {
+			return nil, token.errorAt("invalid string")
+		}
+		return s, nil
+	case token.Kind == TokenNumber:
+		n, err := strconv.ParseFloat(token.Text, 64)
+		if err != nil {
+			return nil, token.errorAt("invalid number")
+		}
+		return n, nil
+	case token.is("true"), token.is("false"):
+		return strings.EqualFold(token.Text, "true"), nil
+	case token.is("null"):
+		return nil, nil
+	default:
+		return nil, token.errorAt("expected a value: a string, a number, true, false or null")
+	}
+}
@@ -0,0 +1,101 @@
+package handlers
+
+import (
+	"crypto/subtle"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"usermanagement/internal/models"
+	"usermanagement/internal/services"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ErrUnauthorized is returned when an admin endpoint is called without the admin token
+var ErrUnauthorized = errors.New("missing or invalid admin token")
+
+// requireAdmin is a middleware that only lets the requests with the admin token through.
+// Without configured token, every request is rejected.
+func (s *Server) requireAdmin(c *gin.Context) {
+	token, found := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+	if s.config.AdminToken == "" || !found ||
+		subtle.ConstantTimeCompare([]byte(token), []byte(s.config.AdminToken)) != 1 {
+		c.Header("WWW-Authenticate", `Bearer realm="admin"`)
+		_ = c.Error(ErrUnauthorized)
+		c.Abort()
+		return
+	}
+	c.Next()
+}
+
+// recordEvent appends an event of the request to the audit log.
+// A failure is logged but doesn't fail the request.
+func (s *Server) recordEvent(c *gin.Context, eventType, actor, target string) {
+	event := models.AuditEvent{
+		Type:      eventType,
+		Actor:     actor,
+		Target:    target,
+		IP:        c.ClientIP(),
+		UserAgent: c.Request.UserAgent(),
+	}
+	if err := s.userService.RecordEvent(c.Request.Context(), event); err != nil {
+		s.logger.ErrorContext(c.Request.Context(), "record audit event",
+			slog.String("type", eventType), slog.String("target", target), slog.Any("error", err))
+	}
+}
+
+// handleGetAudit handles the GET /audit API endpoint, for the administrators.
+// It responds with the audit events, the newest first, filtered by the optional query parameters:
+// type, actor, target, since and until (RFC 3339), before (a sequence number, for the next page) and limit.
+func (s *Server) handleGetAudit(c *gin.Context) {
+	filter := services.AuditFilter{
+		Type:   c.Query("type"),
+		Actor:  c.Query("actor"),
+		Target: c.Query("target"),
+	}
+
+	var err error
+	if filter.Since, err = parseTimeQuery(c, "since"); err != nil {
+		_ = c.Error(err)
+		return
+	}
+	if filter.Until, err = parseTimeQuery(c, "until"); err != nil {
+		_ = c.Error(err)
+		return
+	}
+	if before := c.Query("before"); before != "" {
+		if filter.BeforeSeq, err = strconv.ParseInt(before, 10, 64); err != nil {
+			_ = c.Error(&services.ValidationError{Field: "before", Reason: "must be a sequence number"})
+			return
+		}
+	}
+	if limit := c.Query("limit"); limit != "" {
+		if filter.Limit, err = strconv.Atoi(limit); err != nil {
+			_ = c.Error(&services.ValidationError{Field: "limit", Reason: "must be a number"})
+			return
+		}
+	}
+
+	events, err := s.userService.QueryEvents(c.Request.Context(), filter)
+	if err != nil {
+		_ = c.Error(err)
+		return
+	}
+	c.JSON(http.StatusOK, events)
+}
+
+// parseTimeQuery parses the RFC 3339 query parameter key, zero if it's absent
+func parseTimeQuery(c *gin.Context, key string) (time.Time, error) {
+	value := c.Query(key)
+	if value == "" {
+		return time.Time{}, nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, &services.ValidationError{Field: key, Reason: "must be an RFC 3339 time, e.g. 2023-09-01T00:00:00Z"}
+	}
+	return t, nil
+}
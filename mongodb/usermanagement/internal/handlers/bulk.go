@@ -0,0 +1,119 @@
+package handlers
+
+import (
+	"log/slog"
+	"mime"
+	"net/http"
+	"strconv"
+	"time"
+	"usermanagement/internal/models"
+	"usermanagement/internal/services"
+
+	"github.com/gin-gonic/gin"
+)
+
+// adminActor is the actor of the audit events of the admin endpoints, the token doesn't tell who uses it
+const adminActor = "admin"
+
+// bulkContentTypes are the media types of the import and export files, by format
+var bulkContentTypes = map[services.Format]string{
+	services.FormatCSV:    "text/csv; charset=utf-8",
+	services.FormatNDJSON: "application/x-ndjson",
+}
+
+// bulkFormats are the formats of the media types of an import
+var bulkFormats = map[string]services.Format{
+	"text/csv":             services.FormatCSV,
+	"application/x-ndjson": services.FormatNDJSON,
+	"application/jsonl":    services.FormatNDJSON,
+}
+
+// extendDeadlines is a middleware that gives the request the bulk timeout to be read and written,
+// instead of the read and write timeouts of the server
+func (s *Server) extendDeadlines(c *gin.Context) {
+	if s.config.BulkTimeout > 0 {
+		deadline := time.Now().Add(s.config.BulkTimeout)
+		controller := http.NewResponseController(c.Writer)
+		// not supported by the test recorders, the deadlines are only needed with a real connection
+		_ = controller.SetReadDeadline(deadline)
+		_ = controller.SetWriteDeadline(deadline)
+	}
+	c.Next()
+}
+
+// handleImportUsers handles the POST /admin/users/import API endpoint, for the administrators.
+// The body is a CSV or NDJSON file, given by the format query parameter or else by the Content-Type.
+// The optional query parameters are mode (create, skip-existing or upsert) and dry_run.
+// It responds with the counts of the rows by outcome and the errors of the invalid rows.
+func (s *Server) handleImportUsers(c *gin.Context) {
+	opts := services.ImportOptions{}
+
+	var err error
+	if format := c.Query("format"); format != "" {
+		if opts.Format, err = services.ParseFormat(format); err != nil {
+			_ = c.Error(err)
+			return
+		}
+	} else {
+		mediaType, _, _ := mime.ParseMediaType(c.ContentType())
+		var ok bool
+		if opts.Format, ok = bulkFormats[mediaType]; !ok {
+			_ = c.Error(&services.ValidationError{Field: "format", Reason: "set the format parameter, or a text/csv or application/x-ndjson Content-Type"})
+			return
+		}
+	}
+	if opts.Mode, err = services.ParseImportMode(c.Query("mode")); err != nil {
+		_ = c.Error(err)
+		return
+	}
+	if dryRun := c.Query("dry_run"); dryRun != "" {
+		if opts.DryRun, err = strconv.ParseBool(dryRun); err != nil {
+			_ = c.Error(&services.ValidationError{Field: "dry_run", Reason: "must be true or false"})
+			return
+		}
+	}
+
+	result, err := s.userService.ImportUsers(c.Request.Context(), c.Request.Body, opts)
+	if !opts.DryRun && result.Created+result.Updated > 0 {
+		s.recordEvent(c, models.EventUsersImported, adminActor, "")
+	}
+	if err != nil {
+		// the batches before the error are imported
+		s.logger.ErrorContext(c.Request.Context(), "import users",
+			slog.Int("rows", result.Rows), slog.Int("created", result.Created), slog.Int("updated", result.Updated), slog.Any("error", err))
+		_ = c.Error(err)
+		return
+	}
+	c.JSON(http.StatusOK, result)
+}
+
+// handleExportUsers handles the GET /admin/users/export API endpoint, for the administrators.
+// It streams every user with the password hash, as NDJSON or as CSV with the format query parameter.
+func (s *Server) handleExportUsers(c *gin.Context) {
+	format := services.FormatNDJSON
+	if f := c.Query("format"); f != "" {
+		var err error
+		if format, err = services.ParseFormat(f); err != nil {
+			_ = c.Error(err)
+			return
+		}
+	}
+
+	c.Header("Content-Type", bulkContentTypes[format])
+	c.Header("Content-Disposition", `attachment; filename="users.`+string(format)+`"`)
+	// the password hashes must not stay in a cache
+	c.Header("Cache-Control", "no-store")
+	c.Status(http.StatusOK)
+
+	n, err := s.userService.ExportUsers(c.Request.Context(), c.Writer, format)
+	if err != nil {
+		if !c.Writer.Written() {
+			c.Writer.Header().Del("Content-Disposition")
+			_ = c.Error(err)
+			return
+		}
+		// too late for an error response, the client gets a truncated file
+		s.logger.ErrorContext(c.Request.Context(), "export users", slog.Int("users", n), slog.Any("error", err))
+	}
+	s.recordEvent(c, models.EventUsersExported, adminActor, "")
+}
@@ -0,0 +1,85 @@
+package handlers
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"time"
+	"usermanagement/internal/models"
+
+	"github.com/gin-gonic/gin"
+)
+
+// purgerActor is the actor of the audit events of the purges
+const purgerActor = "purger"
+
+// handleDeleteUser handles the DELETE /users/:id API endpoint, for the administrators.
+// The user is deleted softly, it can be restored during the grace period.
+// It responds with the deleted user.
+func (s *Server) handleDeleteUser(c *gin.Context) {
+	user, err := s.userService.DeleteUser(c.Request.Context(), c.Param("id"))
+	if err != nil {
+		_ = c.Error(err)
+		return
+	}
+	s.recordEvent(c, models.EventUserDeleted, adminActor, user.Username)
+	c.JSON(http.StatusOK, user)
+}
+
+// handleRestoreUser handles the POST /users/:id/restore API endpoint, for the administrators.
+// It responds with the restored user, or 410 Gone after the grace period.
+func (s *Server) handleRestoreUser(c *gin.Context) {
+	user, err := s.userService.RestoreUser(c.Request.Context(), c.Param("id"))
+	if err != nil {
+		_ = c.Error(err)
+		return
+	}
+	s.recordEvent(c, models.EventUserRestored, adminActor, user.Username)
+	c.JSON(http.StatusOK, user)
+}
+
+// handleGetDeletedUsers handles the GET /admin/users/deleted API endpoint, for the administrators.
+// It responds with the deleted users not purged yet, the recently deleted first.
+func (s *Server) handleGetDeletedUsers(c *gin.Context) {
+	users, err := s.userService.DeletedUsers(c.Request.Context())
+	if err != nil {
+		_ = c.Error(err)
+		return
+	}
+	c.JSON(http.StatusOK, users)
+}
+
+// RunPurger purges the users deleted for longer than the grace period every interval, until ctx is done.
+// Run it in a goroutine next to RunServer; with several replicas, a user is purged by the first one.
+func (s *Server) RunPurger(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.purge(ctx)
+		}
+	}
+}
+
+// purge purges the expired deleted users once, and records an audit event for each one
+func (s *Server) purge(ctx context.Context) {
+	users, err := s.userService.PurgeDeletedUsers(ctx)
+	if err != nil {
+		s.logger.ErrorContext(ctx, "purge the deleted users", slog.Any("error", err))
+		return
+	}
+	for _, user := range users {
+		username := user.OriginalUsername()
+		event := models.AuditEvent{Type: models.EventUserPurged, Actor: purgerActor, Target: username}
+		if err := s.userService.RecordEvent(ctx, event); err != nil {
+			s.logger.ErrorContext(ctx, "record audit event",
+				slog.String("type", event.Type), slog.String("target", username), slog.Any("error", err))
+		}
+	}
+	if len(users) > 0 {
+		s.logger.InfoContext(ctx, "purged the deleted users", slog.Int("count", len(users)))
+	}
+}
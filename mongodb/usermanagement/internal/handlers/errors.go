@@ -0,0 +1,156 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"usermanagement/internal/services"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ProblemContentType is the media type of the error responses, see RFC 7807
+const ProblemContentType = "application/problem+json"
+
+// Problem is an RFC 7807 problem details object.
+// Type is stable for every kind of error, so clients can branch on it.
+type Problem struct {
+	Type          string         `json:"type"`
+	Title         string         `json:"title"`
+	Status        int            `json:"status"`
+	Detail        string         `json:"detail,omitempty"`
+	Instance      string         `json:"instance,omitempty"`
+	InvalidParams []InvalidParam `json:"invalid-params,omitempty"`
+}
+
+// InvalidParam describes one invalid field of a validation problem
+type InvalidParam struct {
+	Name   string `json:"name"`
+	Reason string `json:"reason"`
+}
+
+// ErrorHandler is a middleware that renders the last error attached to the context
+// with c.Error as a problem response. Handlers should attach the error and return
+// without writing a body.
+func ErrorHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Next()
+
+		if len(c.Errors) == 0 || c.Writer.Written() {
+			return
+		}
+
+		problem := newProblem(c.Errors.Last().Err)
+		problem.Instance = c.Request.URL.Path
+		c.Header("Content-Type", ProblemContentType)
+		c.JSON(problem.Status, problem)
+	}
+}
+
+// newProblem maps an error returned by the services to a problem
+func newProblem(err error) Problem {
+	var validationErr *services.ValidationError
+
+	switch {
+	case errors.As(err, &validationErr):
+		return Problem{
+			Type:   "/problems/validation",
+			Title:  "Invalid request",
+			Status: http.StatusBadRequest,
+			Detail: validationErr.Error(),
+			InvalidParams: []InvalidParam{
+				{Name: validationErr.Field, Reason: validationErr.Reason},
+			},
+		}
+	case errors.Is(err, services.ErrNotFound):
+		return Problem{
+			Type:   "/problems/not-found",
+			Title:  "User not found",
+			Status: http.StatusNotFound,
+			Detail: err.Error(),
+		}
+	case errors.Is(err, services.ErrConflict):
+		return Problem{
+			Type:   "/problems/conflict",
+			Title:  "User already exists",
+			Status: http.StatusConflict,
+			Detail: err.Error(),
+		}
+	case errors.Is(err, services.ErrInvalidCredentials):
+		return Problem{
+			Type:   "/problems/invalid-credentials",
+			Title:  "Invalid credentials",
+			Status: http.StatusUnauthorized,
+			Detail: err.Error(),
+		}
+	case errors.Is(err, services.ErrLocked):
+		return Problem{
+			Type:   "/problems/locked",
+			Title:  "Account locked",
+			Status: http.StatusForbidden,
+			Detail: err.Error(),
+		}
+	case errors.Is(err, services.ErrInactive):
+		return Problem{
+			Type:   "/problems/inactive",
+			Title:  "Account not active",
+			Status: http.StatusForbidden,
+			Detail: err.Error(),
+		}
+	case errors.Is(err, services.ErrNotDeleted):
+		return Problem{
+			Type:   "/problems/not-deleted",
+			Title:  "User not deleted",
+			Status: http.StatusConflict,
+			Detail: err.Error(),
+		}
+	case errors.Is(err, services.ErrRestoreExpired):
+		return Problem{
+			Type:   "/problems/restore-expired",
+			Title:  "Restore period expired",
+			Status: http.StatusGone,
+			Detail: err.Error(),
+		}
+	case errors.Is(err, services.ErrVersionMismatch):
+		return Problem{
+			Type:   "/problems/precondition-failed",
+			Title:  "User changed",
+			Status: http.StatusPreconditionFailed,
+			Detail: err.Error(),
+		}
+	case errors.Is(err, ErrPreconditionRequired):
+		return Problem{
+			Type:   "/problems/precondition-required",
+			Title:  "If-Match required",
+			Status: http.StatusPreconditionRequired,
+			Detail: err.Error(),
+		}
+	case errors.Is(err, ErrTooManyAttempts):
+		return Problem{
+			Type:   "/problems/too-many-attempts",
+			Title:  "Too many failed logins",
+			Status: http.StatusTooManyRequests,
+			Detail: err.Error(),
+		}
+	case errors.Is(err, ErrUnauthorized):
+		return Problem{
+			Type:   "/problems/unauthorized",
+			Title:  "Unauthorized",
+			Status: http.StatusUnauthorized,
+			Detail: err.Error(),
+		}
+	case errors.Is(err, services.ErrUnavailable):
+		// don't leak the database error to the client
+		return Problem{
+			Type:   "/problems/unavailable",
+			Title:  "Service unavailable",
+			Status: http.StatusServiceUnavailable,
+			Detail: services.ErrUnavailable.Error(),
+		}
+	default:
+		return Problem{
+			Type:   "about:blank",
+			Title:  http.StatusText(http.StatusInternalServerError),
+			Status: http.StatusInternalServerError,
+		}
+	}
+}
@@ -1,30 +1,104 @@
 package handlers
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"log/slog"
+	"math"
+	"net"
 	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"usermanagement/internal/config"
+	"usermanagement/internal/logging"
+	"usermanagement/internal/metrics"
 	"usermanagement/internal/models"
 	"usermanagement/internal/services"
+	"usermanagement/internal/session"
+	"usermanagement/internal/tracing"
 
 	"github.com/gin-gonic/gin"
 	"golang.org/x/crypto/bcrypt"
 )
 
+var (
+	dummyHashOnce  sync.Once
+	dummyHashValue string
+)
+
+// dummyHash returns a bcrypt hash with the same cost as the stored passwords.
+// It's generated once, when the first server is created.
+func dummyHash() string {
+	dummyHashOnce.Do(func() {
+		hashed, err := bcrypt.GenerateFromPassword([]byte("dummy password"), bcrypt.DefaultCost)
+		if err != nil {
+			panic(err)
+		}
+		dummyHashValue = string(hashed)
+	})
+	return dummyHashValue
+}
+
 type Server struct {
-	router      *gin.Engine
-	userService services.UserServiceInterface
+	router          *gin.Engine
+	userService     services.UserServiceInterface
+	state           session.Store
+	config          config.ServerConfig
+	logger          *slog.Logger
+	readinessChecks map[string]ReadinessCheck
+	shuttingDown    atomic.Bool
+}
+
+// NewServer returns a server keeping the state of the logins in the memory of the process
+func NewServer(userService services.UserServiceInterface, cfg config.ServerConfig, logger *slog.Logger) *Server {
+	return NewServerWithStore(userService, session.NewMemory(), cfg, logger)
 }
 
-func NewServer(userService services.UserServiceInterface) *Server {
+// NewServerWithStore returns a server keeping the state of the logins, e.g. the failed attempts, in state
+func NewServerWithStore(userService services.UserServiceInterface, state session.Store, cfg config.ServerConfig, logger *slog.Logger) *Server {
+	router := gin.New()
+	router.Use(
+		logging.RequestID(),
+		tracing.Middleware(),
+		logging.AccessLog(logger),
+		metrics.Middleware(),
+		logging.Recovery(logger),
+		ErrorHandler(),
+	)
+
+	// generate the hash now, so the first login of an unknown user isn't slower
+	dummyHash()
+
+	metrics.SetRegisteredUsersFunc(func() (int64, error) {
+		ctx, cancel := context.WithTimeout(context.Background(), cfg.ReadinessTimeout)
+		defer cancel()
+		return userService.CountUsers(ctx)
+	})
+
 	return &Server{
-		router:      gin.Default(),
+		router:      router,
 		userService: userService,
+		state:       state,
+		config:      cfg,
+		logger:      logger,
+		readinessChecks: map[string]ReadinessCheck{
+			"database": userService.PingDB,
+		},
 	}
 }
 
 // login database
-func (s *Server) LoginDB() {
-	s.userService.LoginDB()
+func (s *Server) LoginDB() error {
+	return s.userService.LoginDB()
+}
+
+// CloseDB closes the connections to the database and to the login state, call it after RunServer returns
+func (s *Server) CloseDB(ctx context.Context) error {
+	return errors.Join(s.userService.CloseDB(ctx), s.state.Close())
 }
 
 // SetupRoute sets up routes on the server
@@ -33,80 +107,190 @@ func (s *Server) SetupRoute() {
 	s.router.POST("/register", s.handleRegister)
 	s.router.POST("/login", s.handleLogin)
 	s.router.GET("/search", s.handleSearchUser)
+	s.router.GET("/healthz", s.handleHealthz)
+	s.router.GET("/readyz", s.handleReadyz)
+	s.router.GET("/metrics", gin.WrapH(metrics.Handler()))
+	s.router.GET("/audit", s.requireAdmin, s.handleGetAudit)
+	s.router.GET("/users/:id", s.handleGetUser)
+	s.router.PATCH("/users/:id", s.requireAdmin, s.handleUpdateUser)
+	s.router.DELETE("/users/:id", s.requireAdmin, s.handleDeleteUser)
+	s.router.POST("/users/:id/restore", s.requireAdmin, s.handleRestoreUser)
+
+	admin := s.router.Group("/admin", s.requireAdmin)
+	admin.GET("/users", s.handleFilterUsers)
+	admin.POST("/users/import", s.extendDeadlines, s.handleImportUsers)
+	admin.GET("/users/export", s.extendDeadlines, s.handleExportUsers)
+	admin.GET("/users/deleted", s.handleGetDeletedUsers)
 }
 
 func (s *Server) GetRouter() *gin.Engine {
 	return s.router
 }
 
-// Run: run server
-func (s *Server) RunServer() {
-	s.router.Run()
+// Logger returns the logger of the server
+func (s *Server) Logger() *slog.Logger {
+	return s.logger
+}
+
+// RunServer runs the server on the configured address until ctx is done,
+// then it stops accepting connections and drains the in-flight requests.
+func (s *Server) RunServer(ctx context.Context) error {
+	listener, err := net.Listen("tcp", s.config.Addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(ctx, listener)
+}
+
+// Serve is RunServer on an existing listener
+func (s *Server) Serve(ctx context.Context, listener net.Listener) error {
+	srv := &http.Server{
+		Handler:      s.router,
+		ReadTimeout:  s.config.ReadTimeout,
+		WriteTimeout: s.config.WriteTimeout,
+		IdleTimeout:  s.config.IdleTimeout,
+	}
+
+	serveErr := make(chan error, 1)
+	go func() {
+		s.logger.Info("listening", slog.String("addr", listener.Addr().String()))
+		serveErr <- srv.Serve(listener)
+	}()
+
+	select {
+	case err := <-serveErr:
+		// the server stopped by itself
+		return err
+	case <-ctx.Done():
+	}
+
+	s.logger.Info("shutting down, draining in-flight requests")
+	s.shuttingDown.Store(true)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), s.config.ShutdownTimeout)
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		return fmt.Errorf("shutdown: %w", err)
+	}
+	return nil
 }
 
 // ----- APIs start -----
 
 // handleRegister handles the user registration process for the POST /register API endpoint.
-// It expects a JSON payload containing a username and password.
+// It expects a JSON payload containing a username and password, and optionally the attributes of the user.
 func (s *Server) handleRegister(c *gin.Context) {
 	var data models.User
 	if err := c.ShouldBindJSON(&data); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{
-			"error": err.Error(),
-		})
+		_ = c.Error(&services.ValidationError{Field: "body", Reason: err.Error()})
+		return
+	}
+	if err := services.ValidateUsername(data.Username); err != nil {
+		_ = c.Error(err)
+		return
+	}
+	if data.Password == "" {
+		_ = c.Error(&services.ValidationError{Field: "password", Reason: "must not be empty"})
 		return
 	}
 
 	// hash password
 	password := data.Password
+	_, span := tracing.Start(c.Request.Context(), "bcrypt.GenerateFromPassword")
+	start := time.Now()
 	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	metrics.ObservePasswordHash("hash", start)
+	span.End()
 	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{
-			"error": err.Error(),
-		})
+		// bcrypt only fails on passwords longer than 72 bytes
+		_ = c.Error(&services.ValidationError{Field: "password", Reason: err.Error()})
 		return
 	}
 	data.Password = string(hashedPassword)
 
 	user := models.NewUser(data.Username, data.Password)
-	if err := s.userService.CreateUser(*user); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{
-			"error": err.Error(),
-		})
+	user.Attributes = data.Attributes
+	created, err := s.userService.CreateUser(c.Request.Context(), *user)
+	if err != nil {
+		_ = c.Error(err)
 		return
 	}
-	c.JSON(http.StatusOK, user)
+	s.recordEvent(c, models.EventUserRegistered, created.Username, created.Username)
+	c.JSON(http.StatusOK, created)
 }
 
 // handleLogin handles the user authentication process for the POST /login API endpoint.
 // It expects a JSON payload containing a username and password.
+// An unknown username and a wrong password get the same response, and both run bcrypt,
+// so a client can't tell which usernames exist from the message or the response time.
+// Every attempt is counted before the password is checked, and uncounted if it matches:
+// after too many failures of the username or of the client IP, it's throttled until the window ends.
 func (s *Server) handleLogin(c *gin.Context) {
 	var userInput models.User
 	if err := c.ShouldBindJSON(&userInput); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{
-			"error": err.Error(),
-		})
+		_ = c.Error(&services.ValidationError{Field: "body", Reason: err.Error()})
 		return
 	}
 
-	foundUser, err := s.userService.SearchUserByUsername(userInput.Username)
-	if err != nil {
-		// not found user in the database
-		c.JSON(http.StatusBadRequest, gin.H{
-			"error": "user doesn't exists",
-		})
+	if wait := s.takeLoginAttempt(c, userInput.Username); wait > 0 {
+		metrics.Logins.WithLabelValues(metrics.LoginThrottled).Inc()
+		c.Header("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		_ = c.Error(ErrTooManyAttempts)
+		return
+	}
+
+	// without the cache, a lock or a new password made elsewhere applies at once
+	foundUser, err := s.userService.SearchUserForLogin(c.Request.Context(), userInput.Username)
+	if err != nil && !errors.Is(err, services.ErrNotFound) {
+		metrics.Logins.WithLabelValues(metrics.LoginError).Inc()
+		_ = c.Error(err)
 		return
 	}
 
-	// compare password
-	err = bcrypt.CompareHashAndPassword([]byte(foundUser.Password), []byte(userInput.Password))
+	hash := foundUser.Password
 	if err != nil {
-		// wrong password
-		c.JSON(http.StatusBadRequest, gin.H{
-			"error": "invalid password",
-		})
+		// not found user in the database, compare with a dummy hash to spend the same time
+		hash = dummyHash()
+	}
+
+	// compare password, imported users may have an argon2 hash
+	spanName := "bcrypt.CompareHashAndPassword"
+	if services.IsArgon2Hash(hash) {
+		spanName = "argon2.IDKey"
+	}
+	_, span := tracing.Start(c.Request.Context(), spanName)
+	start := time.Now()
+	mismatch := services.ComparePassword(hash, userInput.Password)
+	metrics.ObservePasswordHash("compare", start)
+	span.End()
+	if mismatch != nil || err != nil {
+		// the attempt stays counted
+		metrics.Logins.WithLabelValues(metrics.LoginFailure).Inc()
+		s.recordEvent(c, models.EventLoginFailed, userInput.Username, userInput.Username)
+		_ = c.Error(services.ErrInvalidCredentials)
+		return
+	}
+	s.releaseLoginAttempt(c, userInput.Username)
+	// only tell that the account is locked or not active to the ones knowing the password
+	if foundUser.Locked {
+		metrics.Logins.WithLabelValues(metrics.LoginFailure).Inc()
+		s.recordEvent(c, models.EventLoginFailed, userInput.Username, userInput.Username)
+		_ = c.Error(services.ErrLocked)
+		return
+	}
+	if status := foundUser.CurrentStatus(); status != models.StatusActive {
+		metrics.Logins.WithLabelValues(metrics.LoginFailure).Inc()
+		s.recordEvent(c, models.EventLoginFailed, userInput.Username, userInput.Username)
+		_ = c.Error(services.InactiveError(status))
 		return
 	}
+	metrics.Logins.WithLabelValues(metrics.LoginSuccess).Inc()
+	s.resetLoginFailures(c, userInput.Username)
+	s.recordEvent(c, models.EventLoginSucceeded, userInput.Username, userInput.Username)
+	if err := s.userService.RecordLogin(c.Request.Context(), foundUser); err != nil {
+		// the login succeeded, only its time is missing
+		s.logger.ErrorContext(c.Request.Context(), "record login",
+			slog.String("username", foundUser.Username), slog.Any("error", err))
+	}
 
 	c.JSON(http.StatusOK, gin.H{
 		"message": "login success",
@@ -117,12 +301,21 @@ func (s *Server) handleLogin(c *gin.Context) {
 // It retrieves all users from the userService and responds with a 200 OK status
 // and a JSON array of all user details.
 func (s *Server) handleGetAllUsers(c *gin.Context) {
-	users, err := s.userService.GetAllUsers()
+	users, err := s.userService.GetAllUsers(c.Request.Context())
 	if err != nil {
-		fmt.Println(err)
-		c.JSON(http.StatusBadRequest, gin.H{
-			"error": err.Error(),
-		})
+		_ = c.Error(err)
+		return
+	}
+	c.JSON(http.StatusOK, users)
+}
+
+// handleFilterUsers handles the GET /admin/users API endpoint, for the administrators.
+// It responds with the users matching the filter parameter, e.g. status eq "active" and createdAt gt "2026-01-01",
+// all of them without a filter, and with 400 Bad Request and the position of the offending token for an invalid filter.
+func (s *Server) handleFilterUsers(c *gin.Context) {
+	users, err := s.userService.FilterUsers(c.Request.Context(), c.Query("filter"))
+	if err != nil {
+		_ = c.Error(err)
 		return
 	}
 	c.JSON(http.StatusOK, users)
@@ -132,35 +325,73 @@ func (s *Server) handleGetAllUsers(c *gin.Context) {
 // The function searches for a user based on the provided username or id.
 // - If a username is provided, it attempts to find the user by username.
 // - If an id is provided, it attempts to find the user by id.
-// If neither a username nor an id is provided, it responds with a 200 OK status and an empty JSON object.
+// - If a q is provided, it responds with the array of the best matches of the text search, at most limit of them.
+// - If attributes are provided, e.g. attributes.department=sales, it responds with the array of the users having them.
+// If neither a username, an id, a q nor attributes are provided, it responds with a 200 OK status and an empty JSON object.
+// The user found comes with its ETag, for the If-Match of PATCH /users/:id.
 func (s *Server) handleSearchUser(c *gin.Context) {
 	username := c.Query("username")
 	id := c.Query("id")
+	q := c.Query("q")
+	attributes := attributeQuery(c)
 
 	if username != "" {
 		// search by username
-		foundUser, err := s.userService.SearchUserByUsername(username)
+		foundUser, err := s.userService.SearchUserByUsername(c.Request.Context(), username)
 		if err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{
-				"error": err.Error(),
-			})
+			_ = c.Error(err)
 			return
 		}
+		setETag(c, foundUser)
 		c.JSON(http.StatusOK, foundUser)
 
 	} else if id != "" {
 		// search by id
-		foundUser, err := s.userService.SearchUserByID(id)
+		foundUser, err := s.userService.SearchUserByID(c.Request.Context(), id)
 		if err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{
-				"error": err.Error(),
-			})
+			_ = c.Error(err)
 			return
 		}
+		setETag(c, foundUser)
 		c.JSON(http.StatusOK, foundUser)
+	} else if q != "" {
+		// text search
+		limit := 0
+		if value := c.Query("limit"); value != "" {
+			var err error
+			if limit, err = strconv.Atoi(value); err != nil {
+				_ = c.Error(&services.ValidationError{Field: "limit", Reason: "must be a number"})
+				return
+			}
+		}
+		results, err := s.userService.SearchUsers(c.Request.Context(), q, limit)
+		if err != nil {
+			_ = c.Error(err)
+			return
+		}
+		c.JSON(http.StatusOK, results)
+	} else if len(attributes) > 0 {
+		// search by attributes
+		foundUsers, err := s.userService.SearchUsersByAttributes(c.Request.Context(), attributes)
+		if err != nil {
+			_ = c.Error(err)
+			return
+		}
+		c.JSON(http.StatusOK, foundUsers)
 	} else {
 		c.JSON(http.StatusOK, gin.H{})
 	}
 }
 
+// attributeQuery returns the attributes searched by the query string, attributes.<name>=<value>, by name
+func attributeQuery(c *gin.Context) map[string]string {
+	attributes := make(map[string]string)
+	for key, values := range c.Request.URL.Query() {
+		if name, ok := strings.CutPrefix(key, "attributes."); ok && len(values) > 0 {
+			attributes[name] = values[0]
+		}
+	}
+	return attributes
+}
+
 // ----- APIs end -----
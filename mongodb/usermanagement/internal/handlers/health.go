@@ -0,0 +1,120 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	statusUp   = "up"
+	statusDown = "down"
+)
+
+// ReadinessCheck checks that a dependency of the server can serve requests
+type ReadinessCheck func(ctx context.Context) error
+
+// ComponentStatus is the status of one dependency in the GET /readyz response.
+// The error of a failed check is only logged, it may tell the addresses or the credentials of the dependency.
+type ComponentStatus struct {
+	Status    string `json:"status"`
+	Error     string `json:"error,omitempty"`
+	LatencyMS int64  `json:"latency_ms"`
+}
+
+// ReadinessResponse is the body of the GET /readyz response
+type ReadinessResponse struct {
+	Status     string                     `json:"status"`
+	Components map[string]ComponentStatus `json:"components"`
+}
+
+// AddReadinessCheck adds a dependency checked by GET /readyz
+func (s *Server) AddReadinessCheck(name string, check ReadinessCheck) {
+	s.readinessChecks[name] = check
+}
+
+// PingLoginState checks that the store of the login state can serve requests, e.g. the Redis server
+func (s *Server) PingLoginState(ctx context.Context) error {
+	return s.state.Ping(ctx)
+}
+
+// handleHealthz handles the GET /healthz API endpoint.
+// It only tells that the process is alive and serving HTTP, so it never checks the dependencies:
+// a database outage must not make Kubernetes restart the pods.
+func (s *Server) handleHealthz(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{
+		"status": statusUp,
+	})
+}
+
+// handleReadyz handles the GET /readyz API endpoint.
+// It runs every readiness check concurrently, each with the readiness timeout,
+// and responds with 200 OK if all of them pass, otherwise 503 Service Unavailable.
+// It also fails once the server is shutting down, so no new traffic is sent to it.
+func (s *Server) handleReadyz(c *gin.Context) {
+	response := ReadinessResponse{
+		Status:     statusUp,
+		Components: make(map[string]ComponentStatus, len(s.readinessChecks)),
+	}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for name, check := range s.readinessChecks {
+		wg.Add(1)
+		go func(name string, check ReadinessCheck) {
+			defer wg.Done()
+			status, err := runReadinessCheck(c.Request.Context(), check, s.config.ReadinessTimeout)
+			if err != nil {
+				s.logger.WarnContext(c.Request.Context(), "readiness check failed", slog.String("component", name), slog.Any("error", err))
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			response.Components[name] = status
+			if status.Status != statusUp {
+				response.Status = statusDown
+			}
+		}(name, check)
+	}
+	wg.Wait()
+
+	if s.shuttingDown.Load() {
+		response.Status = statusDown
+		response.Components["server"] = ComponentStatus{Status: statusDown, Error: "shutting down"}
+	}
+
+	code := http.StatusOK
+	if response.Status != statusUp {
+		code = http.StatusServiceUnavailable
+	}
+	c.JSON(code, response)
+}
+
+// runReadinessCheck runs check with the given timeout and reports its status, with the error of a failure
+func runReadinessCheck(ctx context.Context, check ReadinessCheck, timeout time.Duration) (ComponentStatus, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	start := time.Now()
+	err := check(ctx)
+	if err == nil {
+		// the check succeeded, but too late
+		err = ctx.Err()
+	}
+	status := ComponentStatus{
+		Status:    statusUp,
+		LatencyMS: time.Since(start).Milliseconds(),
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		status.Status = statusDown
+		status.Error = "timeout after " + timeout.String()
+	} else if err != nil {
+		status.Status = statusDown
+	}
+	return status, err
+}
@@ -0,0 +1,89 @@
+package handlers
+
+import (
+	"errors"
+	"log/slog"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ErrTooManyAttempts is returned by POST /login while the username or the client IP is throttled
+var ErrTooManyAttempts = errors.New("too many failed logins, try again later")
+
+// loginLimit is a counter of failed logins and its maximum
+type loginLimit struct {
+	key string
+	max int
+}
+
+// loginLimits returns the counters of a login: the ones of its username and of its client IP
+func (s *Server) loginLimits(c *gin.Context, username string) []loginLimit {
+	return []loginLimit{
+		{key: "login:user:" + username, max: s.config.Login.MaxFailures},
+		{key: "login:ip:" + c.ClientIP(), max: s.config.Login.MaxFailuresPerIP},
+	}
+}
+
+// takeLoginAttempt counts a login of username from the client IP before its password is checked,
+// and returns how long it must wait, 0 if it isn't throttled. The count and the check are one step of the store,
+// so concurrent guesses can't all pass the check before any of them is counted.
+// A throttled attempt isn't counted, so a client throttled by one counter doesn't use up the others,
+// e.g. the attempts left for its IP while a username is throttled.
+// The attempt stays counted as a failure unless releaseLoginAttempt is called.
+// If the store fails, e.g. Redis is down, the login isn't throttled rather than locking everyone out.
+func (s *Server) takeLoginAttempt(c *gin.Context, username string) time.Duration {
+	var wait time.Duration
+	var taken []loginLimit
+	for _, limit := range s.loginLimits(c, username) {
+		if limit.max <= 0 {
+			continue
+		}
+		_, retryAfter, err := s.state.AddAttempt(c.Request.Context(), limit.key, int64(limit.max), s.config.Login.FailureWindow)
+		if err != nil {
+			s.logger.ErrorContext(c.Request.Context(), "count a login attempt", slog.String("key", limit.key), slog.Any("error", err))
+			continue
+		}
+		taken = append(taken, limit)
+		if retryAfter > wait {
+			wait = retryAfter
+		}
+	}
+	if wait > 0 {
+		s.releaseLimits(c, taken)
+	}
+	return wait
+}
+
+// releaseLoginAttempt uncounts the attempt of takeLoginAttempt once the password matched,
+// so the logins of the ones knowing it aren't failures, even when the account is locked
+func (s *Server) releaseLoginAttempt(c *gin.Context, username string) {
+	var limits []loginLimit
+	for _, limit := range s.loginLimits(c, username) {
+		if limit.max > 0 {
+			limits = append(limits, limit)
+		}
+	}
+	s.releaseLimits(c, limits)
+}
+
+// releaseLimits uncounts an attempt of each limit
+func (s *Server) releaseLimits(c *gin.Context, limits []loginLimit) {
+	for _, limit := range limits {
+		if err := s.state.ReleaseAttempt(c.Request.Context(), limit.key); err != nil {
+			s.logger.ErrorContext(c.Request.Context(), "release a login attempt", slog.String("key", limit.key), slog.Any("error", err))
+		}
+	}
+}
+
+// resetLoginFailures forgets the failures of username after it logged in.
+// The ones of the client IP are kept, a valid account must not reset the guessing of the others.
+func (s *Server) resetLoginFailures(c *gin.Context, username string) {
+	if s.config.Login.MaxFailures <= 0 {
+		return
+	}
+	key := s.loginLimits(c, username)[0].key
+	if err := s.state.ResetFailures(c.Request.Context(), key); err != nil {
+		s.logger.ErrorContext(c.Request.Context(), "reset the failed logins", slog.String("key", key), slog.Any("error", err))
+	}
+}
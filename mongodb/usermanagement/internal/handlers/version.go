@@ -0,0 +1,97 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"usermanagement/internal/models"
+	"usermanagement/internal/services"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ErrPreconditionRequired is returned when a user is updated without the If-Match header
+var ErrPreconditionRequired = errors.New("the If-Match header with the ETag of the user is required")
+
+// etag returns the ETag of a user, its version
+func etag(user models.User) string {
+	return `"` + strconv.FormatInt(user.Version, 10) + `"`
+}
+
+// setETag sets the ETag header of a response with user
+func setETag(c *gin.Context, user models.User) {
+	c.Header("ETag", etag(user))
+}
+
+// ifMatchVersion returns the version of the If-Match header, an ETag given by setETag.
+// The weak ETags never match, like in RFC 9110.
+func ifMatchVersion(c *gin.Context) (int64, error) {
+	header := strings.TrimSpace(c.GetHeader("If-Match"))
+	if header == "" {
+		return 0, ErrPreconditionRequired
+	}
+	quoted, ok := strings.CutPrefix(header, `"`)
+	if ok {
+		quoted, ok = strings.CutSuffix(quoted, `"`)
+	}
+	version, err := strconv.ParseInt(quoted, 10, 64)
+	if !ok || err != nil || version < 0 {
+		return 0, services.ErrVersionMismatch
+	}
+	return version, nil
+}
+
+// handleGetUser handles the GET /users/:id API endpoint.
+// It responds with the user and its ETag, for the If-Match of PATCH /users/:id.
+func (s *Server) handleGetUser(c *gin.Context) {
+	user, err := s.userService.SearchUserByID(c.Request.Context(), c.Param("id"))
+	if err != nil {
+		_ = c.Error(err)
+		return
+	}
+	setETag(c, user)
+	c.JSON(http.StatusOK, user)
+}
+
+// handleUpdateUser handles the PATCH /users/:id API endpoint, for the administrators.
+// The body has the roles, locked and status to change, the others are kept.
+// The If-Match header must be the ETag of the user: it responds with 428 Precondition Required without it,
+// and 412 Precondition Failed if the user was changed since, e.g. by another administrator.
+// It responds with the changed user and its new ETag.
+func (s *Server) handleUpdateUser(c *gin.Context) {
+	version, err := ifMatchVersion(c)
+	if err != nil {
+		_ = c.Error(err)
+		return
+	}
+	var changes services.UserChanges
+	if err := c.ShouldBindJSON(&changes); err != nil {
+		_ = c.Error(&services.ValidationError{Field: "body", Reason: err.Error()})
+		return
+	}
+
+	user, err := s.userService.UpdateUser(c.Request.Context(), c.Param("id"), version, changes)
+	if err != nil {
+		_ = c.Error(err)
+		return
+	}
+	if changes.Roles != nil {
+		s.recordEvent(c, models.EventRolesChanged, adminActor, user.Username)
+	}
+	if changes.Locked != nil {
+		eventType := models.EventUserUnlocked
+		if *changes.Locked {
+			eventType = models.EventUserLocked
+		}
+		s.recordEvent(c, eventType, adminActor, user.Username)
+	}
+	if changes.Status != nil {
+		s.recordEvent(c, models.EventStatusChanged, adminActor, user.Username)
+	}
+	if changes.Attributes != nil {
+		s.recordEvent(c, models.EventAttributesChanged, adminActor, user.Username)
+	}
+	setETag(c, user)
+	c.JSON(http.StatusOK, user)
+}
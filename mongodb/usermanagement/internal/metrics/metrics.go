@@ -0,0 +1,164 @@
+package metrics
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "usermanagement"
+
+// Registry holds every metric of the server, plus the Go runtime and process metrics
+var Registry = prometheus.NewRegistry()
+
+var (
+	// HTTPRequests counts the handled requests by route and status
+	HTTPRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "http_requests_total",
+		Help:      "Number of HTTP requests by method, route and status.",
+	}, []string{"method", "route", "status"})
+
+	// HTTPDuration observes the latency of the requests by route and status
+	HTTPDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "http_request_duration_seconds",
+		Help:      "Latency of HTTP requests by method, route and status.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"method", "route", "status"})
+
+	// StorageDuration observes the latency of each storage operation
+	StorageDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "storage_operation_duration_seconds",
+		Help:      "Latency of storage operations by backend and operation.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"backend", "operation"})
+
+	// StorageErrors counts the failed storage operations
+	StorageErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "storage_errors_total",
+		Help:      "Number of failed storage operations by backend and operation.",
+	}, []string{"backend", "operation"})
+
+	// Logins counts the login attempts by result: success, failure, throttled or error
+	Logins = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "logins_total",
+		Help:      "Number of login attempts by result.",
+	}, []string{"result"})
+
+	// PasswordHashDuration observes the time spent in bcrypt, to hash or to compare a password
+	PasswordHashDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "password_hash_duration_seconds",
+		Help:      "Time spent in bcrypt by operation.",
+		Buckets:   []float64{.01, .025, .05, .1, .25, .5, 1, 2.5},
+	}, []string{"operation"})
+
+	// CacheLookups counts the lookups of the user cache by cache and result: hit, miss or error
+	CacheLookups = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "cache_lookups_total",
+		Help:      "Number of user cache lookups by cache and result.",
+	}, []string{"cache", "result"})
+
+	// registeredUsers is read on every scrape, see SetRegisteredUsersFunc
+	registeredUsers atomic.Value
+)
+
+const (
+	LoginSuccess   = "success"
+	LoginFailure   = "failure"
+	LoginThrottled = "throttled"
+	LoginError     = "error"
+)
+
+const (
+	CacheHit   = "hit"
+	CacheMiss  = "miss"
+	CacheError = "error"
+)
+
+func init() {
+	Registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		HTTPRequests,
+		HTTPDuration,
+		StorageDuration,
+		StorageErrors,
+		Logins,
+		PasswordHashDuration,
+		CacheLookups,
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "registered_users",
+			Help:      "Number of users in the database, NaN if it cannot be counted.",
+		}, countRegisteredUsers),
+	)
+}
+
+// SetRegisteredUsersFunc sets the function counting the users on every scrape.
+// The last server created wins.
+func SetRegisteredUsersFunc(count func() (int64, error)) {
+	registeredUsers.Store(count)
+}
+
+func countRegisteredUsers() float64 {
+	count, ok := registeredUsers.Load().(func() (int64, error))
+	if !ok {
+		return math.NaN()
+	}
+	n, err := count()
+	if err != nil {
+		return math.NaN()
+	}
+	return float64(n)
+}
+
+// Handler serves the metrics in the Prometheus format
+func Handler() http.Handler {
+	return promhttp.HandlerFor(Registry, promhttp.HandlerOpts{Registry: Registry})
+}
+
+// Middleware records the count and the latency of every request.
+// The route is the pattern registered in gin, e.g. /users, so the cardinality stays bounded.
+func Middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+
+		route := c.FullPath()
+		if route == "" {
+			route = "unmatched"
+		}
+		status := strconv.Itoa(c.Writer.Status())
+		HTTPRequests.WithLabelValues(c.Request.Method, route, status).Inc()
+		HTTPDuration.WithLabelValues(c.Request.Method, route, status).Observe(time.Since(start).Seconds())
+	}
+}
+
+// ObserveStorage records a storage operation that started at start and returned err.
+// Use it with defer and a named error result:
+//
+//	defer func() { metrics.ObserveStorage("mongodb", "read", start, err) }()
+func ObserveStorage(backend, operation string, start time.Time, err error) {
+	StorageDuration.WithLabelValues(backend, operation).Observe(time.Since(start).Seconds())
+	if err != nil {
+		StorageErrors.WithLabelValues(backend, operation).Inc()
+	}
+}
+
+// ObservePasswordHash records the time spent in bcrypt since start
+func ObservePasswordHash(operation string, start time.Time) {
+	PasswordHashDuration.WithLabelValues(operation).Observe(time.Since(start).Seconds())
+}
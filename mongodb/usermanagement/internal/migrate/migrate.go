@@ -0,0 +1,393 @@
+package migrate
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+	"usermanagement/internal/models"
+	"usermanagement/internal/services"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	// DefaultBatchSize is the number of users read and inserted at once
+	DefaultBatchSize = 500
+	// maxMismatches is the number of differences reported by Verify, the next ones are only counted
+	maxMismatches = 100
+)
+
+// Options are the options of Run
+type Options struct {
+	// BatchSize is the number of users copied at once, DefaultBatchSize if it's zero
+	BatchSize int
+	// Checkpoint is the file where the progress is saved after each batch, none if it's empty.
+	// A migration with the checkpoint of an interrupted one goes on after its last batch.
+	Checkpoint string
+	Logger     *slog.Logger
+}
+
+// Result counts the users of a migration
+type Result struct {
+	// Copied are the users inserted in the destination
+	Copied int
+	// Skipped are the users already in the destination with the same id, copied before a restart
+	Skipped int
+	// Hashed are the copied users whose plain password was hashed
+	Hashed int
+}
+
+// ConflictError is returned when a username of the source belongs to another user in the destination
+type ConflictError struct {
+	Username      string
+	SourceID      primitive.ObjectID
+	DestinationID primitive.ObjectID
+}
+
+func (e *ConflictError) Error() string {
+	return fmt.Sprintf("%s: %s has the id %s in the source and %s in the destination",
+		services.ErrConflict, e.Username, e.SourceID.Hex(), e.DestinationID.Hex())
+}
+
+func (e *ConflictError) Unwrap() error {
+	return services.ErrConflict
+}
+
+// checkpoint is the progress of a migration, saved after each batch
+type checkpoint struct {
+	Source      string             `json:"source"`
+	Destination string             `json:"destination"`
+	LastID      primitive.ObjectID `json:"last_id"`
+	Copied      int                `json:"copied"`
+	Skipped     int                `json:"skipped"`
+	Hashed      int                `json:"hashed"`
+}
+
+// loadCheckpoint reads the checkpoint at path, a new one if the file doesn't exist.
+// It must be the one of the same source and destination.
+func loadCheckpoint(path, source, destination string) (checkpoint, error) {
+	cp := checkpoint{Source: source, Destination: destination}
+	if path == "" {
+		return cp, nil
+	}
+	content, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return cp, nil
+	}
+	if err != nil {
+		return cp, err
+	}
+
+	var saved checkpoint
+	if err := json.Unmarshal(content, &saved); err != nil {
+		return cp, fmt.Errorf("parse checkpoint %s: %w", path, err)
+	}
+	if saved.Source != source || saved.Destination != destination {
+		return cp, fmt.Errorf("checkpoint %s is the one of %s to %s, remove it to start over", path, saved.Source, saved.Destination)
+	}
+	return saved, nil
+}
+
+func (cp checkpoint) save(path string) error {
+	if path == "" {
+		return nil
+	}
+	content, err := json.MarshalIndent(cp, "", "  ")
+	if err != nil {
+		return err
+	}
+	return models.WriteFile(path, content, 0644)
+}
+
+// Run copies the users of src to dst, by batches in the order of their id.
+// The ids and the usernames are kept, the plain passwords of the JSON version are hashed with bcrypt.
+// The users already in dst with the same id are skipped, so a migration can run again;
+// a username in dst with another id stops it with a *ConflictError.
+// The names of the source and destination identify the migration in the checkpoint, without the credentials.
+func Run(ctx context.Context, src, dst Store, source, destination string, opts Options) (Result, error) {
+	batchSize := opts.BatchSize
+	if batchSize <= 0 {
+		batchSize = DefaultBatchSize
+	}
+
+	cp, err := loadCheckpoint(opts.Checkpoint, source, destination)
+	if err != nil {
+		return Result{}, err
+	}
+	if !cp.LastID.IsZero() {
+		opts.Logger.InfoContext(ctx, "resume from the checkpoint", slog.String("last_id", cp.LastID.Hex()), slog.Int("copied", cp.Copied))
+	}
+
+	for {
+		users, err := src.UsersAfter(ctx, cp.LastID, batchSize)
+		if err != nil {
+			return cp.result(), fmt.Errorf("read the source: %w", err)
+		}
+		if len(users) == 0 {
+			return cp.result(), nil
+		}
+
+		usernames := make([]string, len(users))
+		for i, user := range users {
+			usernames[i] = user.Username
+		}
+		existing, err := dst.FindUsers(ctx, usernames)
+		if err != nil {
+			return cp.result(), fmt.Errorf("read the destination: %w", err)
+		}
+
+		missing := make([]models.User, 0, len(users))
+		for _, user := range users {
+			found, ok := existing[user.Username]
+			switch {
+			case !ok:
+				missing = append(missing, user)
+			case found.ID == user.ID:
+				cp.Skipped++
+			default:
+				return cp.result(), &ConflictError{Username: user.Username, SourceID: user.ID, DestinationID: found.ID}
+			}
+		}
+
+		hashed, err := hashPlainPasswords(missing)
+		if err != nil {
+			return cp.result(), err
+		}
+		if len(missing) > 0 {
+			if err := dst.InsertUsers(ctx, missing); err != nil {
+				return cp.result(), fmt.Errorf("write the destination: %w", err)
+			}
+		}
+
+		cp.Copied += len(missing)
+		cp.Hashed += hashed
+		cp.LastID = users[len(users)-1].ID
+		if err := cp.save(opts.Checkpoint); err != nil {
+			return cp.result(), fmt.Errorf("save the checkpoint: %w", err)
+		}
+		opts.Logger.InfoContext(ctx, "batch copied", slog.String("last_id", cp.LastID.Hex()),
+			slog.Int("copied", cp.Copied), slog.Int("skipped", cp.Skipped))
+	}
+}
+
+func (cp checkpoint) result() Result {
+	return Result{Copied: cp.Copied, Skipped: cp.Skipped, Hashed: cp.Hashed}
+}
+
+// hashPlainPasswords hashes the passwords that aren't bcrypt or argon2 hashes yet, on every CPU,
+// and returns how many it hashed
+func hashPlainPasswords(users []models.User) (int, error) {
+	plain := make([]int, 0)
+	for i, user := range users {
+		if services.ValidatePasswordHash(user.Password) != nil {
+			plain = append(plain, i)
+		}
+	}
+
+	err := services.Parallel(len(plain), func(j int) error {
+		user := &users[plain[j]]
+		hashed, err := bcrypt.GenerateFromPassword([]byte(user.Password), bcrypt.DefaultCost)
+		if err != nil {
+			return fmt.Errorf("hash the password of %s: %w", user.Username, err)
+		}
+		user.Password = string(hashed)
+		return nil
+	})
+	return len(plain), err
+}
+
+// Verification is the comparison of the users of the source with the ones of the destination
+type Verification struct {
+	SourceUsers      int64 `json:"source_users"`
+	DestinationUsers int64 `json:"destination_users"`
+	// Missing are the users of the source that aren't in the destination
+	Missing int `json:"missing"`
+	// Different are the users of the source with another id, password, roles, lock, status, time, deletion, version
+	// or attributes in the destination
+	Different int `json:"different"`
+	// The checksums are the SHA-256 of the users of the source, and of the same users in the destination,
+	// in the order of their id
+	SourceChecksum      string `json:"source_checksum"`
+	DestinationChecksum string `json:"destination_checksum"`
+	// Mismatches describe the first missing and different users
+	Mismatches []string `json:"mismatches"`
+}
+
+// OK tells whether every user of the source is in the destination, as is
+func (v Verification) OK() bool {
+	return v.Missing == 0 && v.Different == 0 && v.SourceChecksum == v.DestinationChecksum
+}
+
+func (v *Verification) mismatch(format string, args ...interface{}) {
+	if len(v.Mismatches) < maxMismatches {
+		v.Mismatches = append(v.Mismatches, fmt.Sprintf(format, args...))
+	}
+}
+
+// Verify compares every user of src with the one of the same username in dst.
+// The destination may have more users, e.g. the ones registered since the migration.
+// A plain password of the source matches its bcrypt hash in the destination.
+func Verify(ctx context.Context, src, dst Store, batchSize int) (Verification, error) {
+	if batchSize <= 0 {
+		batchSize = DefaultBatchSize
+	}
+	v := Verification{Mismatches: []string{}}
+
+	var err error
+	if v.SourceUsers, err = src.CountUsers(ctx); err != nil {
+		return v, fmt.Errorf("count the source: %w", err)
+	}
+	if v.DestinationUsers, err = dst.CountUsers(ctx); err != nil {
+		return v, fmt.Errorf("count the destination: %w", err)
+	}
+
+	srcSum, dstSum := sha256.New(), sha256.New()
+	after := primitive.NilObjectID
+	for {
+		users, err := src.UsersAfter(ctx, after, batchSize)
+		if err != nil {
+			return v, fmt.Errorf("read the source: %w", err)
+		}
+		if len(users) == 0 {
+			break
+		}
+		usernames := make([]string, len(users))
+		for i, user := range users {
+			usernames[i] = user.Username
+		}
+		existing, err := dst.FindUsers(ctx, usernames)
+		if err != nil {
+			return v, fmt.Errorf("read the destination: %w", err)
+		}
+
+		// the plain passwords are compared with their hash on every CPU, bcrypt is slow
+		samePassword := make([]bool, len(users))
+		_ = services.Parallel(len(users), func(i int) error {
+			found, ok := existing[users[i].Username]
+			samePassword[i] = ok && passwordMatches(users[i].Password, found.Password)
+			return nil
+		})
+
+		for i, user := range users {
+			writeUser(srcSum, user, user.Password)
+			found, ok := existing[user.Username]
+			if !ok {
+				v.Missing++
+				v.mismatch("%s: missing in the destination", user.Username)
+				continue
+			}
+
+			// the hash of a plain password is summed as the plain password, if it matches
+			password := found.Password
+			if samePassword[i] {
+				password = user.Password
+			}
+			found = withDestinationDefaults(user, found)
+			writeUser(dstSum, found, password)
+
+			var diffs []string
+			srcFields, dstFields := userFields(user, user.Password), userFields(found, password)
+			for j, field := range srcFields {
+				switch {
+				case dstFields[j].value == field.value:
+				case field.name == "password":
+					diffs = append(diffs, "another password")
+				default:
+					diffs = append(diffs, fmt.Sprintf("%s %q instead of %q", field.name, dstFields[j].value, field.value))
+				}
+			}
+			if len(diffs) > 0 {
+				v.Different++
+				v.mismatch("%s: %s", user.Username, strings.Join(diffs, ", "))
+			}
+		}
+		after = users[len(users)-1].ID
+	}
+
+	v.SourceChecksum = hex.EncodeToString(srcSum.Sum(nil))
+	v.DestinationChecksum = hex.EncodeToString(dstSum.Sum(nil))
+	return v, nil
+}
+
+// passwordMatches tells whether the password of the destination is the one of the source:
+// the same hash, or the hash of the plain password
+func passwordMatches(source, destination string) bool {
+	if source == destination {
+		return true
+	}
+	if services.ValidatePasswordHash(source) == nil {
+		return false
+	}
+	return services.ComparePassword(destination, source) == nil
+}
+
+// withDestinationDefaults returns the user of the destination without the times the source doesn't have:
+// the destination sets the ones of a new user, see UserService.InsertUsers
+func withDestinationDefaults(source, destination models.User) models.User {
+	if source.CreatedAt.IsZero() {
+		destination.CreatedAt = time.Time{}
+	}
+	if source.UpdatedAt.IsZero() {
+		destination.UpdatedAt = time.Time{}
+	}
+	if source.PasswordChangedAt == nil {
+		destination.PasswordChangedAt = nil
+	}
+	return destination
+}
+
+// userField is a field of a user compared by Verify, formatted for the checksums and the mismatches
+type userField struct {
+	name, value string
+}
+
+// userFields returns the fields of a user compared by Verify, with the given password
+func userFields(user models.User, password string) []userField {
+	attributes, _ := user.Attributes.Value()
+	attributesJSON, _ := attributes.(string)
+	return []userField{
+		{"id", user.ID.Hex()},
+		{"username", user.Username},
+		{"password", password},
+		{"roles", strings.Join(user.Roles, ",")},
+		{"locked", strconv.FormatBool(user.Locked)},
+		{"status", string(user.CurrentStatus())},
+		{"created_at", formatTime(&user.CreatedAt)},
+		{"updated_at", formatTime(&user.UpdatedAt)},
+		{"last_login_at", formatTime(user.LastLoginAt)},
+		{"password_changed_at", formatTime(user.PasswordChangedAt)},
+		{"deleted_at", formatTime(user.DeletedAt)},
+		{"deleted_username", user.DeletedUsername},
+		{"version", strconv.FormatInt(user.Version, 10)},
+		{"attributes", attributesJSON},
+	}
+}
+
+// formatTime formats a time to the millisecond, the precision of MongoDB and of MySQL DATETIME(3),
+// empty if it's nil or zero
+func formatTime(t *time.Time) string {
+	if t == nil || t.IsZero() {
+		return ""
+	}
+	return t.UTC().Truncate(time.Millisecond).Format("2006-01-02T15:04:05.000Z")
+}
+
+// writeUser adds a user to a checksum, with the given password
+func writeUser(h hash.Hash, user models.User, password string) {
+	fields := userFields(user, password)
+	values := make([]string, len(fields))
+	for i, field := range fields {
+		values[i] = field.value
+	}
+	fmt.Fprintf(h, "%s\n", strings.Join(values, "\x00"))
+}
@@ -0,0 +1,266 @@
+// Package migrate copies the users from one backend to another,
+// e.g. from the users.json file of the JSON version to MongoDB.
+package migrate
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+	"usermanagement/internal/config"
+	"usermanagement/internal/models"
+	"usermanagement/internal/services"
+
+	mysqldriver "github.com/go-sql-driver/mysql"
+	"github.com/rs/xid"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/x/mongo/driver/connstring"
+)
+
+// Store is a backend the users are copied from or to.
+// *services.UserService is the store of MongoDB and MySQL.
+type Store interface {
+	// UsersAfter returns at most limit users with an id greater than after, in the order of their id
+	UsersAfter(ctx context.Context, after primitive.ObjectID, limit int) ([]models.User, error)
+	// FindUsers returns the users with one of the usernames, by username
+	FindUsers(ctx context.Context, usernames []string) (map[string]models.User, error)
+	InsertUsers(ctx context.Context, users []models.User) error
+	CountUsers(ctx context.Context) (int64, error)
+	CloseDB(ctx context.Context) error
+}
+
+// Open opens the store of a location:
+//
+//	json:<path>             the users.json file of the JSON version, created if it doesn't exist
+//	mongodb://<host>/<database>?<options>
+//	mysql:<data source name>, e.g. mysql:root:password@tcp(127.0.0.1:3306)/users
+//
+// With create, for a destination, the MySQL database and tables or the MongoDB index are created if they are missing,
+// and the pending MySQL schema migrations are applied.
+func Open(ctx context.Context, location string, create bool, logger *slog.Logger) (Store, error) {
+	if path, ok := strings.CutPrefix(location, "json:"); ok {
+		return OpenJSONFile(path)
+	}
+
+	cfg := config.Default().Database
+	switch {
+	case strings.HasPrefix(location, "mongodb://"), strings.HasPrefix(location, "mongodb+srv://"):
+		cs, err := connstring.ParseAndValidate(location)
+		if err != nil {
+			return nil, fmt.Errorf("parse MongoDB URI: %w", err)
+		}
+		if cs.Database == "" {
+			return nil, errors.New("the MongoDB URI has no database, e.g. mongodb://localhost:27017/user")
+		}
+		cfg.Mongo = config.MongoConfig{URI: location, Database: cs.Database}
+	case strings.HasPrefix(location, "mysql:"):
+		// a source is never migrated, SetupDB migrates a destination below
+		cfg.MySQL = config.MySQLConfig{URI: strings.TrimPrefix(location, "mysql:")}
+		if create {
+			if err := services.CreateMySQLDatabase(ctx, cfg); err != nil {
+				return nil, err
+			}
+		}
+	default:
+		return nil, fmt.Errorf("unknown location %q, expected json:<path>, mongodb://... or mysql:<dsn>", location)
+	}
+
+	users := services.NewUserService(cfg, logger)
+	if err := users.LoginDB(); err != nil {
+		return nil, err
+	}
+	if !create {
+		return users, nil
+	}
+	if err := users.SetupDB(ctx); err != nil {
+		_ = users.CloseDB(ctx)
+		return nil, err
+	}
+	return users, nil
+}
+
+// Redact returns the location without its password, e.g. for the logs
+func Redact(location string) string {
+	if dsn, ok := strings.CutPrefix(location, "mysql:"); ok {
+		cfg, err := mysqldriver.ParseDSN(dsn)
+		if err != nil {
+			return "mysql:<invalid>"
+		}
+		if cfg.Passwd != "" {
+			cfg.Passwd = "xxxxx"
+		}
+		return "mysql:" + cfg.FormatDSN()
+	}
+	if strings.HasPrefix(location, "mongodb") {
+		u, err := url.Parse(location)
+		if err != nil {
+			// e.g. several hosts with ports, keep the part after the credentials
+			if at := strings.LastIndex(location, "@"); at >= 0 {
+				return location[:strings.Index(location, "://")+3] + "xxxxx@" + location[at+1:]
+			}
+			return location
+		}
+		return u.Redacted()
+	}
+	return location
+}
+
+// ParseID parses an id of the JSON version, an xid, or a hex ObjectID.
+// An xid and an ObjectID are both 12 bytes starting with the creation time,
+// so the conversion keeps the order and the time of the ids.
+func ParseID(id string) (primitive.ObjectID, error) {
+	if len(id) == 2*len(primitive.NilObjectID) {
+		if _, err := hex.DecodeString(id); err == nil {
+			return primitive.ObjectIDFromHex(id)
+		}
+	}
+	x, err := xid.FromString(id)
+	if err != nil {
+		return primitive.NilObjectID, fmt.Errorf("%q is neither an xid nor an ObjectID", id)
+	}
+	return primitive.ObjectID(x), nil
+}
+
+// FormatXID returns the xid of an ObjectID, the id of the JSON version
+func FormatXID(id primitive.ObjectID) string {
+	return xid.ID(id).String()
+}
+
+// jsonUser is a user in the file of the JSON version.
+// The roles, the lock, the status, the times, the deletion, the version and the attributes are kept for the way back, the JSON version doesn't use them.
+type jsonUser struct {
+	ID                string            `json:"id"`
+	Username          string            `json:"username"`
+	Password          string            `json:"password"`
+	Roles             []string          `json:"roles,omitempty"`
+	Locked            bool              `json:"locked,omitempty"`
+	Status            models.UserStatus `json:"status,omitempty"`
+	CreatedAt         *time.Time        `json:"created_at,omitempty"`
+	UpdatedAt         *time.Time        `json:"updated_at,omitempty"`
+	LastLoginAt       *time.Time        `json:"last_login_at,omitempty"`
+	PasswordChangedAt *time.Time        `json:"password_changed_at,omitempty"`
+	DeletedAt         *time.Time        `json:"deleted_at,omitempty"`
+	DeletedUsername   string            `json:"deleted_username,omitempty"`
+	Version           int64             `json:"version,omitempty"`
+	Attributes        models.Attributes `json:"attributes,omitempty"`
+}
+
+func newJSONUser(u models.User) jsonUser {
+	file := jsonUser{ID: FormatXID(u.ID), Username: u.Username, Password: u.Password, Roles: u.Roles, Locked: u.Locked,
+		Status: u.Status, LastLoginAt: u.LastLoginAt, PasswordChangedAt: u.PasswordChangedAt,
+		DeletedAt: u.DeletedAt, DeletedUsername: u.DeletedUsername, Version: u.Version, Attributes: u.Attributes}
+	if !u.CreatedAt.IsZero() {
+		file.CreatedAt = &u.CreatedAt
+	}
+	if !u.UpdatedAt.IsZero() {
+		file.UpdatedAt = &u.UpdatedAt
+	}
+	return file
+}
+
+func (u jsonUser) user(id primitive.ObjectID) models.User {
+	user := models.User{ID: id, Username: u.Username, Password: u.Password, Roles: u.Roles, Locked: u.Locked,
+		Status: u.Status, LastLoginAt: u.LastLoginAt, PasswordChangedAt: u.PasswordChangedAt,
+		DeletedAt: u.DeletedAt, DeletedUsername: u.DeletedUsername, Version: u.Version, Attributes: u.Attributes}
+	if u.CreatedAt != nil {
+		user.CreatedAt = *u.CreatedAt
+	}
+	if u.UpdatedAt != nil {
+		user.UpdatedAt = *u.UpdatedAt
+	}
+	return user
+}
+
+// JSONFile is the users.json file of the JSON version, all the users are kept in memory
+type JSONFile struct {
+	path string
+	// users are sorted by id
+	users []models.User
+}
+
+// OpenJSONFile reads the users of the file at path, none if it doesn't exist
+func OpenJSONFile(path string) (*JSONFile, error) {
+	f := &JSONFile{path: path}
+	content, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return f, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(strings.TrimSpace(string(content))) == 0 {
+		return f, nil
+	}
+
+	var users []jsonUser
+	if err := json.Unmarshal(content, &users); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+	for _, u := range users {
+		id, err := ParseID(u.ID)
+		if err != nil {
+			return nil, fmt.Errorf("user %s: %w", u.Username, err)
+		}
+		f.users = append(f.users, u.user(id))
+	}
+	f.sort()
+	return f, nil
+}
+
+func (f *JSONFile) sort() {
+	sort.Slice(f.users, func(i, j int) bool { return f.users[i].ID.Hex() < f.users[j].ID.Hex() })
+}
+
+func (f *JSONFile) UsersAfter(ctx context.Context, after primitive.ObjectID, limit int) ([]models.User, error) {
+	i := sort.Search(len(f.users), func(i int) bool { return f.users[i].ID.Hex() > after.Hex() })
+	end := min(i+limit, len(f.users))
+	return append([]models.User(nil), f.users[i:end]...), ctx.Err()
+}
+
+func (f *JSONFile) FindUsers(ctx context.Context, usernames []string) (map[string]models.User, error) {
+	wanted := make(map[string]bool, len(usernames))
+	for _, username := range usernames {
+		wanted[username] = true
+	}
+	found := make(map[string]models.User)
+	for _, user := range f.users {
+		if wanted[user.Username] {
+			found[user.Username] = user
+		}
+	}
+	return found, ctx.Err()
+}
+
+// InsertUsers adds the users and rewrites the file
+func (f *JSONFile) InsertUsers(ctx context.Context, users []models.User) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	f.users = append(f.users, users...)
+	f.sort()
+
+	file := make([]jsonUser, len(f.users))
+	for i, u := range f.users {
+		file[i] = newJSONUser(u)
+	}
+	encoded, err := json.Marshal(file)
+	if err != nil {
+		return err
+	}
+	return models.WriteFile(f.path, encoded, 0644)
+}
+
+func (f *JSONFile) CountUsers(ctx context.Context) (int64, error) {
+	return int64(len(f.users)), ctx.Err()
+}
+
+func (f *JSONFile) CloseDB(ctx context.Context) error {
+	return nil
+}
@@ -0,0 +1,74 @@
+package models
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"time"
+)
+
+// Types of the audit events
+const (
+	EventUserRegistered    = "user.registered"
+	EventLoginSucceeded    = "login.succeeded"
+	EventLoginFailed       = "login.failed"
+	EventPasswordChanged   = "password.changed"
+	EventRolesChanged      = "roles.changed"
+	EventUserLocked        = "user.locked"
+	EventUserUnlocked      = "user.unlocked"
+	EventStatusChanged     = "status.changed"
+	EventAttributesChanged = "attributes.changed"
+	EventUserDeleted       = "user.deleted"
+	EventUserRestored      = "user.restored"
+	EventUserPurged        = "user.purged"
+	EventUsersImported     = "users.imported"
+	EventUsersExported     = "users.exported"
+)
+
+// AuditEvent is an entry of the audit log.
+// The events form a hash chain: each one has the hash of the previous one,
+// so changing, inserting or removing an event breaks every following hash.
+type AuditEvent struct {
+	// Seq is the position of the event in the chain, starting at 1
+	Seq  int64  `json:"seq" bson:"seq"`
+	Type string `json:"type" bson:"type"`
+	// Actor is who did it, e.g. the user logging in or an administrator
+	Actor string `json:"actor" bson:"actor"`
+	// Target is the username of the affected user
+	Target    string    `json:"target" bson:"target"`
+	IP        string    `json:"ip" bson:"ip"`
+	UserAgent string    `json:"user_agent" bson:"user_agent"`
+	Timestamp time.Time `json:"timestamp" bson:"timestamp"`
+	PrevHash  string    `json:"prev_hash" bson:"prev_hash"`
+	Hash      string    `json:"hash" bson:"hash"`
+}
+
+// ComputeHash returns the hex SHA-256 of the event, without its own hash.
+// The timestamp is hashed with a millisecond precision, the one of MongoDB and of MySQL DATETIME(3).
+func (e *AuditEvent) ComputeHash() string {
+	content, err := json.Marshal(struct {
+		Seq       int64  `json:"seq"`
+		Type      string `json:"type"`
+		Actor     string `json:"actor"`
+		Target    string `json:"target"`
+		IP        string `json:"ip"`
+		UserAgent string `json:"user_agent"`
+		Timestamp string `json:"timestamp"`
+		PrevHash  string `json:"prev_hash"`
+	}{
+		Seq:       e.Seq,
+		Type:      e.Type,
+		Actor:     e.Actor,
+		Target:    e.Target,
+		IP:        e.IP,
+		UserAgent: e.UserAgent,
+		Timestamp: e.Timestamp.UTC().Truncate(time.Millisecond).Format(time.RFC3339Nano),
+		PrevHash:  e.PrevHash,
+	})
+	if err != nil {
+		// only strings and numbers, it can't fail
+		panic(err)
+	}
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:])
+}
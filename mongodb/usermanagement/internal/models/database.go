@@ -4,53 +4,226 @@ import (
 	"context"
 	"database/sql"
 	"errors"
-	"fmt"
+	"strings"
+	"time"
+	"usermanagement/internal/metrics"
+	"usermanagement/internal/tracing"
 
+	mysqldriver "github.com/go-sql-driver/mysql"
+	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
+	"go.opentelemetry.io/otel/attribute"
+	semconv "go.opentelemetry.io/otel/semconv/v1.21.0"
+	"go.opentelemetry.io/otel/trace"
 )
 
+// CURDInterface is implemented by every database.
+// Every method takes the context of the caller, usually the one of the HTTP request,
+// so the query is cancelled when the client goes away.
 type CURDInterface interface {
-	Create(interface{}) error
-	Read(interface{}, func() interface{}) ([]interface{}, error)
-	Update(interface{}, interface{}) error
-	Delete(interface{}) error
+	Create(context.Context, interface{}) error
+	Read(context.Context, interface{}, func() interface{}) ([]interface{}, error)
+	Update(context.Context, interface{}, interface{}) error
+	// CompareAndSwap is Update of one item whose filter holds the expected values, e.g. a version,
+	// in one atomic operation. It tells whether an item matched.
+	CompareAndSwap(context.Context, interface{}, interface{}) (bool, error)
+	Delete(context.Context, interface{}) error
+	// Count counts the items matching the filter
+	Count(context.Context, interface{}) (int64, error)
+	// Ping checks that the database is reachable
+	Ping(context.Context) error
+}
+
+// Timeouts are the deadlines of each database operation, on top of the deadline of the caller's context.
+// A zero value means no extra deadline.
+type Timeouts struct {
+	Read  time.Duration
+	Write time.Duration
+}
+
+// DefaultTimeouts are used when the timeouts aren't configured
+var DefaultTimeouts = Timeouts{
+	Read:  5 * time.Second,
+	Write: 5 * time.Second,
+}
+
+// MongoQuery is a filter with its find options, MongoDB.Read accepts it instead of a bare filter
+type MongoQuery struct {
+	Filter interface{}
+	// Sort is the sort document, e.g. bson.D{{Key: "seq", Value: -1}}, nil to keep the natural order
+	Sort interface{}
+	// Skip is the number of documents skipped before the first one returned, to read them by pages
+	Skip int64
+	// Limit is the maximum number of documents, 0 for no limit
+	Limit int64
+	// Projection leaves fields out of the documents, e.g. bson.M{"password": 0}, nil for the whole documents
+	Projection bson.M
+}
+
+// SQLQuery is a statement with its arguments, the MySQL methods accept it instead of a bare statement.
+// Use it for anything coming from a client, the arguments are never interpolated.
+type SQLQuery struct {
+	Statement string
+	Args      []interface{}
+}
+
+// IsDuplicateKey tells whether err is the violation of a unique index, by MongoDB, MySQL, SQLite or a Memory store
+func IsDuplicateKey(err error) bool {
+	if mongo.IsDuplicateKeyError(err) || errors.Is(err, ErrDuplicateKey) {
+		return true
+	}
+	var mysqlErr *mysqldriver.MySQLError
+	if errors.As(err, &mysqlErr) {
+		return mysqlErr.Number == 1062 // ER_DUP_ENTRY
+	}
+	// the SQL statements of MySQL also run on SQLite, whose driver errors have the extended result code
+	var sqliteErr interface{ Code() int }
+	if errors.As(err, &sqliteErr) {
+		code := sqliteErr.Code()
+		return code == 1555 || code == 2067 // SQLITE_CONSTRAINT_PRIMARYKEY, SQLITE_CONSTRAINT_UNIQUE
+	}
+	return false
+}
+
+// observe records the latency and the error of a storage operation, call it with defer
+func observe(backend, operation string, start time.Time, err *error) {
+	metrics.ObserveStorage(backend, operation, start, *err)
+}
+
+// withTimeout derives a context with the given timeout, if any
+func withTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, timeout)
 }
 
 // ----- MongoDB -----
 
 type MongoDB struct {
-	Ctx        context.Context
 	Client     *mongo.Client
 	Collection *mongo.Collection
+	Timeouts   Timeouts
 }
 
 func NewMongoDB() *MongoDB {
 	return &MongoDB{
-		Ctx:        context.Background(),
 		Client:     nil,
 		Collection: nil,
+		Timeouts:   DefaultTimeouts,
 	}
 }
 
-func (m *MongoDB) Create(item interface{}) error {
-	_, err := m.Collection.InsertOne(m.Ctx, item)
+// startSpan starts the span of a MongoDB command, end it with tracing.End
+func (m *MongoDB) startSpan(ctx context.Context, operation string) (context.Context, trace.Span) {
+	name := operation
+	attrs := []attribute.KeyValue{semconv.DBSystemMongoDB, semconv.DBOperation(operation)}
+	if m.Collection != nil {
+		name = operation + " " + m.Collection.Name()
+		attrs = append(attrs,
+			semconv.DBName(m.Collection.Database().Name()),
+			semconv.DBMongoDBCollection(m.Collection.Name()),
+		)
+	}
+	return tracing.StartClient(ctx, name, attrs...)
+}
+
+// Close disconnects the client from MongoDB
+func (m *MongoDB) Close(ctx context.Context) error {
+	return m.Client.Disconnect(ctx)
+}
+
+func (m *MongoDB) Ping(ctx context.Context) (err error) {
+	defer observe("mongodb", "ping", time.Now(), &err)
+
+	ctx, span := m.startSpan(ctx, "ping")
+	defer tracing.End(span, &err)
+
+	return m.Client.Ping(ctx, readpref.Primary())
+}
+
+// Create inserts item, or every document of a []interface{} with one command.
+// The documents of a batch are inserted even if some of them fail, e.g. on a duplicate key.
+func (m *MongoDB) Create(ctx context.Context, item interface{}) (err error) {
+	defer observe("mongodb", "create", time.Now(), &err)
+
+	ctx, span := m.startSpan(ctx, "insert")
+	defer tracing.End(span, &err)
+
+	ctx, cancel := withTimeout(ctx, m.Timeouts.Write)
+	defer cancel()
+
+	if documents, ok := item.([]interface{}); ok {
+		_, err = m.Collection.InsertMany(ctx, documents, options.InsertMany().SetOrdered(false))
+		return err
+	}
+	_, err = m.Collection.InsertOne(ctx, item)
 	return err
 }
 
-func (m *MongoDB) Read(filter interface{}, callback func() interface{}) ([]interface{}, error) {
+func (m *MongoDB) Read(ctx context.Context, filter interface{}, callback func() interface{}) (_ []interface{}, err error) {
+	defer observe("mongodb", "read", time.Now(), &err)
+
+	ctx, span := m.startSpan(ctx, "find")
+	defer tracing.End(span, &err)
+
 	// callback is a function that returns an empty interface
 	// this is used to create a new instance of the struct that we want to decode the result into
 	// e.g. callback := func() interface{} { return &models.User{} }
 
-	cur, err := m.Collection.Find(m.Ctx, filter)
+	ctx, cancel := withTimeout(ctx, m.Timeouts.Read)
+	defer cancel()
+
+	opts := options.Find()
+	if q, ok := filter.(MongoQuery); ok {
+		filter = q.Filter
+		if q.Sort != nil {
+			opts.SetSort(q.Sort)
+		}
+		if q.Skip > 0 {
+			opts.SetSkip(q.Skip)
+		}
+		if q.Limit > 0 {
+			opts.SetLimit(q.Limit)
+		}
+		if q.Projection != nil {
+			opts.SetProjection(q.Projection)
+		}
+	}
+
+	cur, err := m.Collection.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	return decodeAll(ctx, cur, callback)
+}
+
+// Aggregate runs the aggregation pipeline and returns its documents decoded into callback(), like Read
+func (m *MongoDB) Aggregate(ctx context.Context, pipeline interface{}, callback func() interface{}) (_ []interface{}, err error) {
+	defer observe("mongodb", "aggregate", time.Now(), &err)
+
+	ctx, span := m.startSpan(ctx, "aggregate")
+	defer tracing.End(span, &err)
+
+	ctx, cancel := withTimeout(ctx, m.Timeouts.Read)
+	defer cancel()
+
+	cur, err := m.Collection.Aggregate(ctx, pipeline)
 	if err != nil {
 		return nil, err
 	}
-	defer cur.Close(m.Ctx)
+	return decodeAll(ctx, cur, callback)
+}
+
+// decodeAll decodes the documents of cur into callback() and closes it
+func decodeAll(ctx context.Context, cur *mongo.Cursor, callback func() interface{}) ([]interface{}, error) {
+	defer cur.Close(ctx)
 
 	items := make([]interface{}, 0)
-	for cur.Next(m.Ctx) {
+	for cur.Next(ctx) {
 		result := callback()
 		err := cur.Decode(result)
 		if err != nil {
@@ -58,20 +231,68 @@ func (m *MongoDB) Read(filter interface{}, callback func() interface{}) ([]inter
 		}
 		items = append(items, result)
 	}
-	fmt.Println(items)
+	if err := cur.Err(); err != nil {
+		return nil, err
+	}
 	return items, nil
 }
 
-func (m *MongoDB) Update(filter interface{}, update interface{}) error {
-	_, err := m.Collection.UpdateMany(m.Ctx, filter, update)
+// Count counts the documents matching filter
+func (m *MongoDB) Count(ctx context.Context, filter interface{}) (_ int64, err error) {
+	defer observe("mongodb", "count", time.Now(), &err)
+
+	ctx, span := m.startSpan(ctx, "count")
+	defer tracing.End(span, &err)
+
+	ctx, cancel := withTimeout(ctx, m.Timeouts.Read)
+	defer cancel()
+
+	return m.Collection.CountDocuments(ctx, filter)
+}
+
+func (m *MongoDB) Update(ctx context.Context, filter interface{}, update interface{}) (err error) {
+	defer observe("mongodb", "update", time.Now(), &err)
+
+	ctx, span := m.startSpan(ctx, "update")
+	defer tracing.End(span, &err)
+
+	ctx, cancel := withTimeout(ctx, m.Timeouts.Write)
+	defer cancel()
+
+	_, err = m.Collection.UpdateMany(ctx, filter, update)
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
-func (m *MongoDB) Delete(filter interface{}) error {
-	_, err := m.Collection.DeleteMany(m.Ctx, filter)
+// CompareAndSwap updates the first document matching filter, which holds the expected values
+func (m *MongoDB) CompareAndSwap(ctx context.Context, filter interface{}, update interface{}) (_ bool, err error) {
+	defer observe("mongodb", "update", time.Now(), &err)
+
+	ctx, span := m.startSpan(ctx, "update")
+	defer tracing.End(span, &err)
+
+	ctx, cancel := withTimeout(ctx, m.Timeouts.Write)
+	defer cancel()
+
+	result, err := m.Collection.UpdateOne(ctx, filter, update)
+	if err != nil {
+		return false, err
+	}
+	return result.MatchedCount > 0, nil
+}
+
+func (m *MongoDB) Delete(ctx context.Context, filter interface{}) (err error) {
+	defer observe("mongodb", "delete", time.Now(), &err)
+
+	ctx, span := m.startSpan(ctx, "delete")
+	defer tracing.End(span, &err)
+
+	ctx, cancel := withTimeout(ctx, m.Timeouts.Write)
+	defer cancel()
+
+	_, err = m.Collection.DeleteMany(ctx, filter)
 	if err != nil {
 		return err
 	}
@@ -81,35 +302,111 @@ func (m *MongoDB) Delete(filter interface{}) error {
 // ----- MySQL -----
 
 type MySQL struct {
-	DB *sql.DB
+	DB       *sql.DB
+	Timeouts Timeouts
 }
 
 func NewMySQL() *MySQL {
 	return &MySQL{
-		DB: nil,
+		DB:       nil,
+		Timeouts: DefaultTimeouts,
 	}
 }
 
-func (m *MySQL) Create(query interface{}) error {
-	q, ok := query.(string)
-	if !ok {
-		return errors.New("type assertion failed")
+// startSpan starts the span of a MySQL statement, end it with tracing.End.
+// The statement itself isn't recorded, it may contain password hashes.
+func (m *MySQL) startSpan(ctx context.Context, operation string) (context.Context, trace.Span) {
+	return tracing.StartClient(ctx, operation, semconv.DBSystemMySQL, semconv.DBOperation(operation))
+}
+
+// sqlOperation returns the first keyword of query, e.g. SELECT
+func sqlOperation(query string) string {
+	fields := strings.Fields(query)
+	if len(fields) == 0 {
+		return "unknown"
+	}
+	return strings.ToUpper(fields[0])
+}
+
+// sqlStatement returns the statement and the arguments of query, a string or an SQLQuery
+func sqlStatement(query interface{}) (string, []interface{}, error) {
+	switch q := query.(type) {
+	case string:
+		return q, nil, nil
+	case SQLQuery:
+		return q.Statement, q.Args, nil
+	default:
+		return "", nil, errors.New("type assertion failed")
+	}
+}
+
+// ParseSQLTime parses a DATETIME column, scanned as a string with or without parseTime in the DSN
+func ParseSQLTime(value string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339Nano, value); err == nil {
+		return t, nil
+	}
+	return time.ParseInLocation("2006-01-02 15:04:05.999999", value, time.UTC)
+}
+
+// SQLTime is the argument of a nullable DATETIME(3) column: NULL for a nil or zero time,
+// else the time in UTC as text, which MySQL and SQLite store alike
+func SQLTime(t *time.Time) interface{} {
+	if t == nil || t.IsZero() {
+		return nil
+	}
+	return t.UTC().Format("2006-01-02 15:04:05.000")
+}
+
+// Close closes the connection pool, after the running queries are finished
+func (m *MySQL) Close(ctx context.Context) error {
+	return m.DB.Close()
+}
+
+func (m *MySQL) Ping(ctx context.Context) (err error) {
+	defer observe("mysql", "ping", time.Now(), &err)
+
+	ctx, span := m.startSpan(ctx, "ping")
+	defer tracing.End(span, &err)
+
+	return m.DB.PingContext(ctx)
+}
+
+func (m *MySQL) Create(ctx context.Context, query interface{}) (err error) {
+	defer observe("mysql", "create", time.Now(), &err)
+
+	q, args, err := sqlStatement(query)
+	if err != nil {
+		return err
 	}
-	_, err := m.DB.Exec(q)
+
+	ctx, span := m.startSpan(ctx, sqlOperation(q))
+	defer tracing.End(span, &err)
+
+	ctx, cancel := withTimeout(ctx, m.Timeouts.Write)
+	defer cancel()
+
+	_, err = m.DB.ExecContext(ctx, q, args...)
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
-func (m *MySQL) Read(query interface{}, callback func() interface{}) ([]interface{}, error) {
-	s, ok := query.(string)
+func (m *MySQL) Read(ctx context.Context, query interface{}, callback func() interface{}) (_ []interface{}, err error) {
+	defer observe("mysql", "read", time.Now(), &err)
 
-	if !ok {
-		return nil, errors.New("type assertion failed")
+	s, args, err := sqlStatement(query)
+	if err != nil {
+		return nil, err
 	}
 
-	rows, err := m.DB.Query(s)
+	ctx, span := m.startSpan(ctx, sqlOperation(s))
+	defer tracing.End(span, &err)
+
+	ctx, cancel := withTimeout(ctx, m.Timeouts.Read)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, s, args...)
 	if err != nil {
 		return nil, err
 	}
@@ -121,11 +418,37 @@ func (m *MySQL) Read(query interface{}, callback func() interface{}) ([]interfac
 		switch v := result.(type) {
 
 		case *User:
-			var idString string
-			err := rows.Scan(&idString, &v.Username, &v.Password)
+			var idString, roles, status string
+			var createdAt, updatedAt, lastLoginAt, passwordChangedAt, deletedAt, deletedUsername sql.NullString
+			err := rows.Scan(&idString, &v.Username, &v.Password, &roles, &v.Locked,
+				&status, &createdAt, &updatedAt, &lastLoginAt, &passwordChangedAt, &deletedAt, &deletedUsername, &v.Version, &v.Attributes)
 			if err != nil {
 				return nil, err
 			}
+			if roles != "" {
+				v.Roles = strings.Split(roles, ",")
+			}
+			v.Status = UserStatus(status)
+			v.DeletedUsername = deletedUsername.String
+			for _, column := range []struct {
+				value sql.NullString
+				set   func(t time.Time)
+			}{
+				{createdAt, func(t time.Time) { v.CreatedAt = t }},
+				{updatedAt, func(t time.Time) { v.UpdatedAt = t }},
+				{lastLoginAt, func(t time.Time) { v.LastLoginAt = &t }},
+				{passwordChangedAt, func(t time.Time) { v.PasswordChangedAt = &t }},
+				{deletedAt, func(t time.Time) { v.DeletedAt = &t }},
+			} {
+				if !column.value.Valid {
+					continue
+				}
+				t, err := ParseSQLTime(column.value.String)
+				if err != nil {
+					return nil, err
+				}
+				column.set(t)
+			}
 
 			v.ID, err = primitive.ObjectIDFromHex(idString)
 			if err != nil {
@@ -134,6 +457,20 @@ func (m *MySQL) Read(query interface{}, callback func() interface{}) ([]interfac
 
 			items = append(items, v)
 
+		case *AuditEvent:
+			var timestamp string
+			err := rows.Scan(&v.Seq, &v.Type, &v.Actor, &v.Target, &v.IP, &v.UserAgent, &timestamp, &v.PrevHash, &v.Hash)
+			if err != nil {
+				return nil, err
+			}
+
+			v.Timestamp, err = ParseSQLTime(timestamp)
+			if err != nil {
+				return nil, err
+			}
+
+			items = append(items, v)
+
 		default:
 			return nil, errors.New("unknown type")
 
@@ -146,28 +483,89 @@ func (m *MySQL) Read(query interface{}, callback func() interface{}) ([]interfac
 	return items, nil
 }
 
-// 这里因为API没有用到Update和Delete，所以没有实现
-// 下面的代码都没有用，如果以后有API需要，再实现
-func (m *MySQL) Update(filter interface{}, update interface{}) error {
-	user, ok := filter.(User)
-	if !ok {
-		return errors.New("type assertion failed")
+// Count runs query, a SELECT COUNT(*) statement, and returns the count
+func (m *MySQL) Count(ctx context.Context, query interface{}) (_ int64, err error) {
+	defer observe("mysql", "count", time.Now(), &err)
+
+	q, args, err := sqlStatement(query)
+	if err != nil {
+		return 0, err
 	}
-	_, err := m.DB.Exec("UPDATE user SET password = ? WHERE username = ?", user.Password, user.Username)
+
+	ctx, span := m.startSpan(ctx, sqlOperation(q))
+	defer tracing.End(span, &err)
+
+	ctx, cancel := withTimeout(ctx, m.Timeouts.Read)
+	defer cancel()
+
+	var count int64
+	err = m.DB.QueryRowContext(ctx, q, args...).Scan(&count)
+	return count, err
+}
+
+// Update runs query, an UPDATE statement given as a string or an SQLQuery.
+// The statement has the changes, so update is ignored.
+func (m *MySQL) Update(ctx context.Context, query interface{}, update interface{}) (err error) {
+	defer observe("mysql", "update", time.Now(), &err)
+
+	q, args, err := sqlStatement(query)
 	if err != nil {
 		return err
 	}
-	return nil
+
+	ctx, span := m.startSpan(ctx, sqlOperation(q))
+	defer tracing.End(span, &err)
+
+	ctx, cancel := withTimeout(ctx, m.Timeouts.Write)
+	defer cancel()
+
+	_, err = m.DB.ExecContext(ctx, q, args...)
+	return err
 }
 
-func (m *MySQL) Delete(filter interface{}) error {
-	user, ok := filter.(User)
-	if !ok {
-		return errors.New("type assertion failed")
+// CompareAndSwap runs query, an UPDATE statement whose WHERE clause holds the expected values,
+// e.g. `UPDATE ... WHERE id = ? AND version = ?`. The statement has the changes, so update is ignored.
+// It must change the row it matches, e.g. increment the version: MySQL doesn't count the rows left unchanged.
+func (m *MySQL) CompareAndSwap(ctx context.Context, query interface{}, update interface{}) (_ bool, err error) {
+	defer observe("mysql", "update", time.Now(), &err)
+
+	q, args, err := sqlStatement(query)
+	if err != nil {
+		return false, err
 	}
-	_, err := m.DB.Exec("DELETE FROM user WHERE username = ?", user.Username)
+
+	ctx, span := m.startSpan(ctx, sqlOperation(q))
+	defer tracing.End(span, &err)
+
+	ctx, cancel := withTimeout(ctx, m.Timeouts.Write)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, q, args...)
+	if err != nil {
+		return false, err
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return rows > 0, nil
+}
+
+// Delete runs query, a DELETE statement given as a string or an SQLQuery
+func (m *MySQL) Delete(ctx context.Context, query interface{}) (err error) {
+	defer observe("mysql", "delete", time.Now(), &err)
+
+	q, args, err := sqlStatement(query)
 	if err != nil {
 		return err
 	}
-	return nil
+
+	ctx, span := m.startSpan(ctx, sqlOperation(q))
+	defer tracing.End(span, &err)
+
+	ctx, cancel := withTimeout(ctx, m.Timeouts.Write)
+	defer cancel()
+
+	_, err = m.DB.ExecContext(ctx, q, args...)
+	return err
 }
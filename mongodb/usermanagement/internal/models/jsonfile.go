@@ -0,0 +1,245 @@
+package models
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/rs/xid"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// ----- JSON file -----
+
+// LazySaveDelay is the longest time a lazy update of a JSONFile waits to be saved, see SetLazyFields
+const LazySaveDelay = time.Second
+
+// JSONFile is a Memory collection saved in a JSON file after each write, the storage without a database.
+// The file is an array of the documents, encoded with their JSON tags,
+// e.g. internal/services/data/users.json, whose xid ids are read as ObjectIDs.
+// A file is written by one process only, the replicas of a server can't share it.
+type JSONFile struct {
+	*Memory
+	path string
+	// lazy are the fields of the lazy updates, see SetLazyFields
+	lazy map[string]bool
+	// pending saves the lazy updates not saved yet, nil if there's none. It's guarded by the lock of Memory.
+	pending *time.Timer
+	// lazyErr is the error of the last failed save of the lazy updates, returned by Close
+	lazyErr error
+}
+
+// NewJSONFile opens the collection saved at path, empty if the file doesn't exist yet.
+// newItem returns a pointer to the type of the documents, the one given to Create.
+func NewJSONFile(path string, newItem func() interface{}, unique ...string) (*JSONFile, error) {
+	f := &JSONFile{Memory: NewMemory(newItem, unique...), path: path}
+	f.backend = "json"
+	f.persist = f.persistDocs
+
+	content, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return f, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(bytes.TrimSpace(content)) == 0 {
+		return f, nil
+	}
+
+	var items []json.RawMessage
+	if err := json.Unmarshal(content, &items); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+	for i, raw := range items {
+		raw, err := convertXID(raw)
+		if err != nil {
+			return nil, fmt.Errorf("parse %s, item %d: %w", path, i, err)
+		}
+		item := newItem()
+		if err := json.Unmarshal(raw, item); err != nil {
+			return nil, fmt.Errorf("parse %s, item %d: %w", path, i, err)
+		}
+		doc, err := toDocument(item)
+		if err != nil {
+			return nil, err
+		}
+		if err := f.checkUnique(doc, -1); err != nil {
+			return nil, fmt.Errorf("parse %s, item %d: %w", path, i, err)
+		}
+		f.docs = append(f.docs, doc)
+		if err := f.add(len(f.docs)-1, doc); err != nil {
+			return nil, err
+		}
+	}
+	return f, nil
+}
+
+// SetLazyFields makes the updates setting only fields lazy: they are saved with the next write,
+// or after LazySaveDelay at the latest, e.g. the login times, so a login doesn't rewrite the whole file.
+// Close saves the lazy updates not saved yet.
+func (f *JSONFile) SetLazyFields(fields ...string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.lazy = make(map[string]bool, len(fields))
+	for _, field := range fields {
+		f.lazy[field] = true
+	}
+}
+
+// isLazy tells whether the update changes only lazy fields, with $set
+func (f *JSONFile) isLazy(changes bson.M) bool {
+	if len(f.lazy) == 0 || len(changes) != 1 {
+		return false
+	}
+	set, ok := asDocument(changes["$set"])
+	if !ok || len(set) == 0 {
+		return false
+	}
+	for field := range set {
+		if !f.lazy[field] {
+			return false
+		}
+	}
+	return true
+}
+
+// persistDocs is the persist of the Memory: it saves docs, or waits a little for a lazy update.
+// It's called with the lock held.
+func (f *JSONFile) persistDocs(docs []bson.M, changes bson.M) error {
+	if changes != nil && f.isLazy(changes) {
+		if f.pending == nil {
+			f.pending = time.AfterFunc(LazySaveDelay, f.saveLazy)
+		}
+		return nil
+	}
+	if err := f.save(docs); err != nil {
+		return err
+	}
+	// the lazy updates are saved too
+	if f.pending != nil {
+		f.pending.Stop()
+		f.pending = nil
+	}
+	f.lazyErr = nil
+	return nil
+}
+
+// saveLazy saves the lazy updates not saved yet, it's retried after LazySaveDelay if it fails
+func (f *JSONFile) saveLazy() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.pending == nil {
+		return
+	}
+	f.lazyErr = f.save(f.docs)
+	if f.lazyErr != nil {
+		f.pending = time.AfterFunc(LazySaveDelay, f.saveLazy)
+		return
+	}
+	f.pending = nil
+}
+
+// Close saves the lazy updates not saved yet
+func (f *JSONFile) Close(ctx context.Context) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.pending == nil {
+		return nil
+	}
+	f.pending.Stop()
+	if err := f.save(f.docs); err != nil {
+		f.pending = time.AfterFunc(LazySaveDelay, f.saveLazy)
+		return errors.Join(f.lazyErr, err)
+	}
+	f.pending, f.lazyErr = nil, nil
+	return nil
+}
+
+// convertXID replaces an xid in the id of an item by the ObjectID of the same 12 bytes
+func convertXID(raw json.RawMessage) (json.RawMessage, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &fields); err != nil {
+		return nil, err
+	}
+	var id string
+	if json.Unmarshal(fields["id"], &id) != nil || len(id) != 20 {
+		return raw, nil
+	}
+	x, err := xid.FromString(id)
+	if err != nil {
+		return raw, nil
+	}
+	fields["id"], _ = json.Marshal(fmt.Sprintf("%x", x.Bytes()))
+	return json.Marshal(fields)
+}
+
+// save writes docs to the file, through a temporary file so the file is never half written
+func (f *JSONFile) save(docs []bson.M) error {
+	items := make([]interface{}, len(docs))
+	for i, doc := range docs {
+		item := f.newItem()
+		if err := fromDocument(doc, item); err != nil {
+			return err
+		}
+		items[i] = item
+	}
+	content, err := json.Marshal(items)
+	if err != nil {
+		return err
+	}
+	return WriteFile(f.path, content, 0644)
+}
+
+// WriteFile replaces the file at path with content, through a temporary file in the same directory
+// renamed over it, so a reader never sees a half written file
+func WriteFile(path string, content []byte, perm os.FileMode) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(content); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(perm); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// Ping checks that the file can still be read, or created in its directory
+func (f *JSONFile) Ping(ctx context.Context) (err error) {
+	defer observe("json", "ping", time.Now(), &err)
+
+	file, err := os.Open(f.path)
+	if errors.Is(err, os.ErrNotExist) {
+		info, err := os.Stat(filepath.Dir(f.path))
+		if err == nil && !info.IsDir() {
+			err = fmt.Errorf("%s isn't a directory", filepath.Dir(f.path))
+		}
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	// read one byte, so a directory or an unreadable file is reported
+	if _, err := file.Read(make([]byte, 1)); err != nil && err != io.EOF {
+		return err
+	}
+	return ctx.Err()
+}
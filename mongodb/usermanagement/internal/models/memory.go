@@ -0,0 +1,565 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// ErrDuplicateKey is returned by the stores without a database when a write breaks a unique field
+var ErrDuplicateKey = errors.New("duplicate key")
+
+// ----- memory -----
+
+// Memory is a collection of documents kept in memory, the store without a database.
+//
+// It understands the MongoDB filters, sorts and updates built by the UserService:
+// the fields compared with equality, $eq, $ne, $in, $nin, $gt, $gte, $lt, $lte, $exists or $regex,
+// $and, $or and $nor, and the updates with $set, $unset and $inc.
+// It can keep inverted indexes of keys computed from the documents, see Index.
+type Memory struct {
+	// newItem returns a pointer to the type of the documents, e.g. &User{}
+	newItem func() interface{}
+	// unique are the fields without duplicates, _id included
+	unique []string
+	// backend labels the metrics, e.g. memory
+	backend string
+	// persist saves the documents after a write, before it returns: changes is the update of an update, nil for the other writes.
+	// If it fails, the write is undone. Nil keeps the documents in memory only.
+	persist func(docs []bson.M, changes bson.M) error
+
+	mu sync.RWMutex
+	// docs are in the order of insertion, the natural order of the collection.
+	// A write replaces a document rather than changing it, the readers may hold the old one.
+	docs []bson.M
+	// uniques are the positions in docs of the values of each unique field, by field and uniqueKey
+	uniques map[string]map[string]int
+	// indexes are the indexes by name, see Index
+	indexes map[string]*memoryIndex
+}
+
+// memoryIndex is an inverted index of the keys of the documents
+type memoryIndex struct {
+	keys func(item interface{}) []string
+	// docKeys are the keys of each document, by position in docs
+	docKeys [][]string
+	// positions are the positions in docs of the documents of each key
+	positions map[string]map[int]struct{}
+}
+
+// NewMemory returns an empty collection.
+// newItem returns a pointer to the type of the documents, the one given to Create.
+func NewMemory(newItem func() interface{}, unique ...string) *Memory {
+	return &Memory{
+		newItem: newItem,
+		unique:  append([]string{"_id"}, unique...),
+		backend: "memory",
+		uniques: make(map[string]map[string]int),
+	}
+}
+
+// Index keeps the index name of the keys of each document, decoded into the type of newItem,
+// e.g. the trigrams of the usernames. It's updated by each write. An existing index is kept.
+func (m *Memory) Index(name string, keys func(item interface{}) []string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.indexes[name]; ok {
+		return nil
+	}
+	if m.indexes == nil {
+		m.indexes = make(map[string]*memoryIndex)
+	}
+	index := &memoryIndex{keys: keys, positions: make(map[string]map[int]struct{})}
+	for i, doc := range m.docs {
+		if err := index.add(m.newItem, i, doc); err != nil {
+			return err
+		}
+	}
+	m.indexes[name] = index
+	return nil
+}
+
+// add indexes the keys of doc, at position i: the next one, or one whose document was removed
+func (index *memoryIndex) add(newItem func() interface{}, i int, doc bson.M) error {
+	item := newItem()
+	if err := fromDocument(doc, item); err != nil {
+		return err
+	}
+	keys := index.keys(item)
+	if i == len(index.docKeys) {
+		index.docKeys = append(index.docKeys, keys)
+	} else {
+		index.docKeys[i] = keys
+	}
+	for _, key := range keys {
+		index.insert(key, i)
+	}
+	return nil
+}
+
+// insert adds the position i to the documents of key
+func (index *memoryIndex) insert(key string, i int) {
+	positions, ok := index.positions[key]
+	if !ok {
+		positions = make(map[int]struct{})
+		index.positions[key] = positions
+	}
+	positions[i] = struct{}{}
+}
+
+// remove removes the keys of the document at position i
+func (index *memoryIndex) remove(i int) {
+	for _, key := range index.docKeys[i] {
+		delete(index.positions[key], i)
+		if len(index.positions[key]) == 0 {
+			delete(index.positions, key)
+		}
+	}
+	index.docKeys[i] = nil
+}
+
+// ReadIndex returns the documents having one of keys in the index name and matching filter,
+// in their natural order, decoded into callback()
+func (m *Memory) ReadIndex(ctx context.Context, name string, keys []string, filter interface{}, callback func() interface{}) (_ []interface{}, err error) {
+	defer observe(m.backend, "read", time.Now(), &err)
+
+	conditions, _, err := query(filter)
+	if err != nil {
+		return nil, err
+	}
+
+	m.mu.RLock()
+	index, ok := m.indexes[name]
+	if !ok {
+		m.mu.RUnlock()
+		return nil, fmt.Errorf("no index %s", name)
+	}
+	candidates := make(map[int]struct{})
+	for _, key := range keys {
+		for i := range index.positions[key] {
+			candidates[i] = struct{}{}
+		}
+	}
+	positions := make([]int, 0, len(candidates))
+	for i := range candidates {
+		positions = append(positions, i)
+	}
+	sort.Ints(positions)
+	var matched []bson.M
+	for _, i := range positions {
+		ok, err := matches(m.docs[i], conditions)
+		if err != nil {
+			m.mu.RUnlock()
+			return nil, err
+		}
+		if ok {
+			matched = append(matched, m.docs[i])
+		}
+	}
+	m.mu.RUnlock()
+
+	items := make([]interface{}, 0, len(matched))
+	for _, doc := range matched {
+		item := callback()
+		if err := fromDocument(doc, item); err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+	return items, ctx.Err()
+}
+
+// uniqueKey returns the key of a value of a unique field in uniques, the same for the equal values
+func uniqueKey(value interface{}) string {
+	if n, ok := number(value); ok {
+		return fmt.Sprintf("n%v", n)
+	}
+	switch v := value.(type) {
+	case string:
+		return "s" + v
+	case primitive.ObjectID:
+		return "o" + v.Hex()
+	default:
+		return fmt.Sprintf("%T %v", value, value)
+	}
+}
+
+// checkUnique checks that doc doesn't share a unique field with a document, except the one at skip.
+// Call it with the lock held.
+func (m *Memory) checkUnique(doc bson.M, skip int) error {
+	for _, field := range m.unique {
+		value, ok := lookup(doc, field)
+		if !ok {
+			continue
+		}
+		if i, ok := m.uniques[field][uniqueKey(value)]; ok && i != skip {
+			return fmt.Errorf("%w: %s %v", ErrDuplicateKey, field, value)
+		}
+	}
+	return nil
+}
+
+// add records doc, at position i in docs, in uniques and in the indexes. Call it with the lock held.
+func (m *Memory) add(i int, doc bson.M) error {
+	m.addUnique(i, doc)
+	for _, index := range m.indexes {
+		if err := index.add(m.newItem, i, doc); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addUnique records the unique values of doc, at position i in docs
+func (m *Memory) addUnique(i int, doc bson.M) {
+	for _, field := range m.unique {
+		value, ok := lookup(doc, field)
+		if !ok {
+			continue
+		}
+		values, ok := m.uniques[field]
+		if !ok {
+			values = make(map[string]int)
+			m.uniques[field] = values
+		}
+		values[uniqueKey(value)] = i
+	}
+}
+
+// remove forgets the document at position i in uniques and in the indexes, before it's replaced.
+// Call it with the lock held.
+func (m *Memory) remove(i int) {
+	for _, field := range m.unique {
+		value, ok := lookup(m.docs[i], field)
+		if !ok {
+			continue
+		}
+		key := uniqueKey(value)
+		if position, ok := m.uniques[field][key]; ok && position == i {
+			delete(m.uniques[field], key)
+		}
+	}
+	for _, index := range m.indexes {
+		index.remove(i)
+	}
+}
+
+// save persists the documents after a write of changes, see persist. Call it with the lock held.
+func (m *Memory) save(changes bson.M) error {
+	if m.persist == nil {
+		return nil
+	}
+	return m.persist(m.docs, changes)
+}
+
+// rollback undoes a write that failed with err: it drops the documents created after the first n
+// and puts back the documents replaced, by position, then records every document again.
+// It returns err. Call it with the lock held.
+func (m *Memory) rollback(err error, n int, replaced map[int]bson.M) error {
+	m.docs = m.docs[:n]
+	for i, doc := range replaced {
+		m.docs[i] = doc
+	}
+	m.uniques = make(map[string]map[string]int)
+	for _, index := range m.indexes {
+		index.docKeys, index.positions = nil, make(map[string]map[int]struct{})
+	}
+	for i, doc := range m.docs {
+		if addErr := m.add(i, doc); addErr != nil {
+			return errors.Join(err, addErr)
+		}
+	}
+	return err
+}
+
+// compact replaces the documents by the ones at the positions kept, in their order, after a delete.
+// Their unique values and keys move with them, no document is decoded. Call it with the lock held.
+func (m *Memory) compact(docs []bson.M, kept []int) {
+	m.docs = docs
+	m.uniques = make(map[string]map[string]int)
+	for i, doc := range docs {
+		m.addUnique(i, doc)
+	}
+	for _, index := range m.indexes {
+		docKeys := make([][]string, len(kept))
+		for j, i := range kept {
+			docKeys[j] = index.docKeys[i]
+		}
+		index.docKeys, index.positions = docKeys, make(map[string]map[int]struct{})
+		for i, keys := range docKeys {
+			for _, key := range keys {
+				index.insert(key, i)
+			}
+		}
+	}
+}
+
+// query returns the normalized filter and the find options of a filter or a MongoQuery
+func query(filter interface{}) (bson.M, MongoQuery, error) {
+	var q MongoQuery
+	if mq, ok := filter.(MongoQuery); ok {
+		q = mq
+		filter = mq.Filter
+	}
+	if filter == nil {
+		return bson.M{}, q, nil
+	}
+	normalized, err := toDocument(filter)
+	if err != nil {
+		return nil, q, fmt.Errorf("invalid filter: %w", err)
+	}
+	return normalized, q, nil
+}
+
+// project returns doc without the fields excluded by projection, the only projection of the memory stores
+func project(doc bson.M, projection bson.M) bson.M {
+	projected := make(bson.M, len(doc))
+	for key, value := range doc {
+		if _, excluded := projection[key]; !excluded {
+			projected[key] = value
+		}
+	}
+	return projected
+}
+
+// find returns the indexes of the documents matching filter
+func find(docs []bson.M, filter bson.M) ([]int, error) {
+	var found []int
+	for i, doc := range docs {
+		ok, err := matches(doc, filter)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			found = append(found, i)
+		}
+	}
+	return found, nil
+}
+
+// Close does nothing, there's no connection
+func (m *Memory) Close(ctx context.Context) error {
+	return nil
+}
+
+// Ping always succeeds, unless ctx is done
+func (m *Memory) Ping(ctx context.Context) (err error) {
+	defer observe(m.backend, "ping", time.Now(), &err)
+
+	return ctx.Err()
+}
+
+// Create inserts item, or every document of a []interface{}.
+// Like MongoDB, the documents of a batch are inserted even if some of them are duplicates.
+func (m *Memory) Create(ctx context.Context, item interface{}) (err error) {
+	defer observe(m.backend, "create", time.Now(), &err)
+
+	items, ok := item.([]interface{})
+	if !ok {
+		items = []interface{}{item}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	docs := make([]bson.M, len(items))
+	for i, item := range items {
+		doc, err := toDocument(item)
+		if err != nil {
+			return err
+		}
+		docs[i] = doc
+	}
+
+	n := len(m.docs)
+	var duplicateErr error
+	for _, doc := range docs {
+		if err := m.checkUnique(doc, -1); err != nil {
+			duplicateErr = err
+			continue
+		}
+		m.docs = append(m.docs, doc)
+		if err := m.add(len(m.docs)-1, doc); err != nil {
+			return m.rollback(err, n, nil)
+		}
+	}
+	if len(m.docs) > n {
+		if err := m.save(nil); err != nil {
+			return m.rollback(err, n, nil)
+		}
+	}
+	return duplicateErr
+}
+
+// Read returns the documents matching filter, a filter document or a MongoQuery, decoded into callback()
+func (m *Memory) Read(ctx context.Context, filter interface{}, callback func() interface{}) (_ []interface{}, err error) {
+	defer observe(m.backend, "read", time.Now(), &err)
+
+	conditions, q, err := query(filter)
+	if err != nil {
+		return nil, err
+	}
+
+	m.mu.RLock()
+	found, err := find(m.docs, conditions)
+	matched := make([]bson.M, len(found))
+	for i, index := range found {
+		matched[i] = m.docs[index]
+	}
+	m.mu.RUnlock()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := sortDocuments(matched, q.Sort); err != nil {
+		return nil, err
+	}
+	matched = matched[min(q.Skip, int64(len(matched))):]
+	if q.Limit > 0 && int64(len(matched)) > q.Limit {
+		matched = matched[:q.Limit]
+	}
+
+	items := make([]interface{}, 0, len(matched))
+	for _, doc := range matched {
+		if len(q.Projection) > 0 {
+			doc = project(doc, q.Projection)
+		}
+		item := callback()
+		if err := fromDocument(doc, item); err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+	return items, ctx.Err()
+}
+
+// Count counts the documents matching filter
+func (m *Memory) Count(ctx context.Context, filter interface{}) (_ int64, err error) {
+	defer observe(m.backend, "count", time.Now(), &err)
+
+	conditions, _, err := query(filter)
+	if err != nil {
+		return 0, err
+	}
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	found, err := find(m.docs, conditions)
+	return int64(len(found)), err
+}
+
+// Update applies update, with $set or $unset, to every document matching filter
+func (m *Memory) Update(ctx context.Context, filter interface{}, update interface{}) (err error) {
+	defer observe(m.backend, "update", time.Now(), &err)
+
+	_, err = m.update(ctx, filter, update, false)
+	return err
+}
+
+// CompareAndSwap updates the first document matching filter, which holds the expected values.
+// The documents are matched and changed under the lock, no other write comes in between.
+func (m *Memory) CompareAndSwap(ctx context.Context, filter interface{}, update interface{}) (_ bool, err error) {
+	defer observe(m.backend, "update", time.Now(), &err)
+
+	updated, err := m.update(ctx, filter, update, true)
+	return updated > 0, err
+}
+
+// update applies update to the documents matching filter, only the first one if one is true,
+// and returns the number of documents updated
+func (m *Memory) update(ctx context.Context, filter interface{}, update interface{}, one bool) (int, error) {
+	conditions, _, err := query(filter)
+	if err != nil {
+		return 0, err
+	}
+	changes, err := toDocument(update)
+	if err != nil {
+		return 0, fmt.Errorf("invalid update: %w", err)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	found, err := find(m.docs, conditions)
+	if err != nil || len(found) == 0 {
+		return 0, err
+	}
+	if one {
+		found = found[:1]
+	}
+	replaced := make(map[int]bson.M, len(found))
+	for _, i := range found {
+		// the changes are made on a copy, the readers may hold the old document
+		doc, err := toDocument(m.docs[i])
+		if err != nil {
+			return 0, m.rollback(err, len(m.docs), replaced)
+		}
+		if err := applyUpdate(doc, changes); err != nil {
+			return 0, m.rollback(err, len(m.docs), replaced)
+		}
+		if err := m.checkUnique(doc, i); err != nil {
+			return 0, m.rollback(err, len(m.docs), replaced)
+		}
+		replaced[i] = m.docs[i]
+		m.remove(i)
+		m.docs[i] = doc
+		if err := m.add(i, doc); err != nil {
+			return 0, m.rollback(err, len(m.docs), replaced)
+		}
+	}
+	if err := m.save(changes); err != nil {
+		return 0, m.rollback(err, len(m.docs), replaced)
+	}
+	return len(found), nil
+}
+
+// Delete removes every document matching filter
+func (m *Memory) Delete(ctx context.Context, filter interface{}) (err error) {
+	defer observe(m.backend, "delete", time.Now(), &err)
+
+	conditions, _, err := query(filter)
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	found, err := find(m.docs, conditions)
+	if err != nil || len(found) == 0 {
+		return err
+	}
+	docs := make([]bson.M, 0, len(m.docs)-len(found))
+	kept := make([]int, 0, len(m.docs)-len(found))
+	next := 0
+	for i, doc := range m.docs {
+		if next < len(found) && found[next] == i {
+			next++
+			continue
+		}
+		docs = append(docs, doc)
+		kept = append(kept, i)
+	}
+	if m.persist != nil {
+		if err := m.persist(docs, nil); err != nil {
+			return err
+		}
+	}
+	m.compact(docs, kept)
+	return nil
+}
@@ -0,0 +1,436 @@
+package models
+
+import (
+	"bytes"
+	"cmp"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// This file evaluates MongoDB queries on documents in memory, for the stores without a query engine.
+// The documents and the queries are normalized through BSON first, so a value compares the same
+// whether it comes from a struct, a bson.M or a filter built by the UserService.
+
+// toDocument converts a struct, a bson.M or a bson.D into a bson.M of BSON values
+func toDocument(v interface{}) (bson.M, error) {
+	raw, err := bson.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var doc bson.M
+	if err := bson.Unmarshal(raw, &doc); err != nil {
+		return nil, err
+	}
+	return doc, nil
+}
+
+// fromDocument decodes doc into item, a pointer to a struct
+func fromDocument(doc bson.M, item interface{}) error {
+	raw, err := bson.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	return bson.Unmarshal(raw, item)
+}
+
+// asDocument returns v as a bson.M if it's an embedded document
+func asDocument(v interface{}) (bson.M, bool) {
+	switch d := v.(type) {
+	case bson.M:
+		return d, true
+	case bson.D:
+		return d.Map(), true
+	default:
+		return nil, false
+	}
+}
+
+// lookup returns the value at path in doc, e.g. attributes.department, and whether it's set
+func lookup(doc bson.M, path string) (interface{}, bool) {
+	var value interface{} = doc
+	for _, key := range strings.Split(path, ".") {
+		d, ok := asDocument(value)
+		if !ok {
+			return nil, false
+		}
+		if value, ok = d[key]; !ok {
+			return nil, false
+		}
+	}
+	return value, true
+}
+
+// setPath sets the value at path in doc, creating the embedded documents on the way
+func setPath(doc bson.M, path string, value interface{}) {
+	keys := strings.Split(path, ".")
+	for _, key := range keys[:len(keys)-1] {
+		next, ok := asDocument(doc[key])
+		if !ok {
+			next = bson.M{}
+		}
+		doc[key] = next
+		doc = next
+	}
+	doc[keys[len(keys)-1]] = value
+}
+
+// unsetPath removes the value at path in doc
+func unsetPath(doc bson.M, path string) {
+	keys := strings.Split(path, ".")
+	for _, key := range keys[:len(keys)-1] {
+		next, ok := asDocument(doc[key])
+		if !ok {
+			return
+		}
+		doc = next
+	}
+	delete(doc, keys[len(keys)-1])
+}
+
+// compareValues orders two BSON values, ok is false if they aren't of comparable types
+func compareValues(a, b interface{}) (int, bool) {
+	if x, ok := number(a); ok {
+		y, ok := number(b)
+		return cmp.Compare(x, y), ok
+	}
+	switch x := a.(type) {
+	case nil:
+		return 0, b == nil
+	case string:
+		y, ok := b.(string)
+		return strings.Compare(x, y), ok
+	case primitive.ObjectID:
+		y, ok := b.(primitive.ObjectID)
+		return bytes.Compare(x[:], y[:]), ok
+	case primitive.DateTime:
+		y, ok := b.(primitive.DateTime)
+		return cmp.Compare(x, y), ok
+	case bool:
+		y, ok := b.(bool)
+		switch {
+		case !ok || x == y:
+			return 0, ok
+		case y:
+			return -1, true
+		default:
+			return 1, true
+		}
+	default:
+		return 0, false
+	}
+}
+
+func number(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case int32:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case float64:
+		return n, true
+	default:
+		return 0, false
+	}
+}
+
+// equalValues tells whether two BSON values are equal, the arrays element by element
+func equalValues(a, b interface{}) bool {
+	x, aIsArray := a.(primitive.A)
+	y, bIsArray := b.(primitive.A)
+	if aIsArray || bIsArray {
+		if !aIsArray || !bIsArray || len(x) != len(y) {
+			return false
+		}
+		for i := range x {
+			if !equalValues(x[i], y[i]) {
+				return false
+			}
+		}
+		return true
+	}
+	if c, ok := compareValues(a, b); ok {
+		return c == 0
+	}
+	return false
+}
+
+// anyValue tells whether value, or one of its elements if it's an array, satisfies fn, like MongoDB
+func anyValue(value interface{}, fn func(v interface{}) bool) bool {
+	if fn(value) {
+		return true
+	}
+	if array, ok := value.(primitive.A); ok {
+		for _, element := range array {
+			if fn(element) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// matches tells whether doc matches filter, a normalized MongoDB filter
+func matches(doc bson.M, filter bson.M) (bool, error) {
+	for key, condition := range filter {
+		var ok bool
+		var err error
+		switch key {
+		case "$and", "$or", "$nor":
+			ok, err = matchClauses(doc, key, condition)
+		default:
+			if strings.HasPrefix(key, "$") {
+				return false, fmt.Errorf("unsupported query operator %s", key)
+			}
+			value, found := lookup(doc, key)
+			ok, err = matchField(value, found, condition)
+		}
+		if err != nil || !ok {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+func matchClauses(doc bson.M, operator string, condition interface{}) (bool, error) {
+	clauses, ok := condition.(primitive.A)
+	if !ok {
+		return false, fmt.Errorf("%s needs an array", operator)
+	}
+	matched := 0
+	for _, clause := range clauses {
+		filter, ok := asDocument(clause)
+		if !ok {
+			return false, fmt.Errorf("%s needs an array of documents", operator)
+		}
+		ok, err := matches(doc, filter)
+		if err != nil {
+			return false, err
+		}
+		if ok {
+			matched++
+		}
+	}
+	switch operator {
+	case "$and":
+		return matched == len(clauses), nil
+	case "$or":
+		return matched > 0, nil
+	default:
+		return matched == 0, nil
+	}
+}
+
+// matchField tells whether the value of a field matches its condition,
+// a value to be equal to or a document of operators
+func matchField(value interface{}, found bool, condition interface{}) (bool, error) {
+	operators, ok := asDocument(condition)
+	if !ok || len(operators) == 0 || !isOperatorDocument(operators) {
+		return anyValue(value, func(v interface{}) bool { return equalValues(v, condition) }), nil
+	}
+
+	for operator, operand := range operators {
+		var ok bool
+		switch operator {
+		case "$eq":
+			ok = anyValue(value, func(v interface{}) bool { return equalValues(v, operand) })
+		case "$ne":
+			ok = !anyValue(value, func(v interface{}) bool { return equalValues(v, operand) })
+		case "$in", "$nin":
+			candidates, isArray := operand.(primitive.A)
+			if !isArray {
+				return false, fmt.Errorf("%s needs an array", operator)
+			}
+			in := anyValue(value, func(v interface{}) bool {
+				for _, candidate := range candidates {
+					if equalValues(v, candidate) {
+						return true
+					}
+				}
+				return false
+			})
+			ok = in == (operator == "$in")
+		case "$gt", "$gte", "$lt", "$lte":
+			ok = found && anyValue(value, func(v interface{}) bool {
+				c, comparable := compareValues(v, operand)
+				if !comparable {
+					return false
+				}
+				switch operator {
+				case "$gt":
+					return c > 0
+				case "$gte":
+					return c >= 0
+				case "$lt":
+					return c < 0
+				default:
+					return c <= 0
+				}
+			})
+		case "$exists":
+			exists, isBool := operand.(bool)
+			if !isBool {
+				return false, fmt.Errorf("$exists needs a boolean")
+			}
+			ok = found == exists
+		case "$regex":
+			re, err := compileRegex(operand, operators["$options"])
+			if err != nil {
+				return false, err
+			}
+			ok = anyValue(value, func(v interface{}) bool {
+				s, isString := v.(string)
+				return isString && re.MatchString(s)
+			})
+		case "$options":
+			ok = true
+		default:
+			return false, fmt.Errorf("unsupported query operator %s", operator)
+		}
+		if !ok {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// isOperatorDocument tells whether every key of d is an operator, e.g. {"$gt": 1}
+func isOperatorDocument(d bson.M) bool {
+	for key := range d {
+		if !strings.HasPrefix(key, "$") {
+			return false
+		}
+	}
+	return true
+}
+
+// compileRegex compiles the pattern of $regex, with the i, m and s options of MongoDB
+func compileRegex(pattern, options interface{}) (*regexp.Regexp, error) {
+	var expr string
+	switch p := pattern.(type) {
+	case string:
+		expr = p
+	case primitive.Regex:
+		expr, options = p.Pattern, p.Options
+	default:
+		return nil, fmt.Errorf("$regex needs a string")
+	}
+	if flags, _ := options.(string); flags != "" {
+		expr = "(?" + strings.Map(func(r rune) rune {
+			if strings.ContainsRune("ims", r) {
+				return r
+			}
+			return -1
+		}, flags) + ")" + expr
+	}
+	return regexp.Compile(expr)
+}
+
+// sortDocuments sorts docs by the keys of a sort document, e.g. bson.D{{Key: "seq", Value: -1}}.
+// The order of the documents with equal keys is kept.
+func sortDocuments(docs []bson.M, order interface{}) error {
+	var keys bson.D
+	switch o := order.(type) {
+	case nil:
+		return nil
+	case bson.D:
+		keys = o
+	case bson.M:
+		if len(o) > 1 {
+			return fmt.Errorf("a sort on several keys needs a bson.D, a bson.M has no order")
+		}
+		for key, direction := range o {
+			keys = append(keys, bson.E{Key: key, Value: direction})
+		}
+	default:
+		return fmt.Errorf("unsupported sort %T", order)
+	}
+
+	directions := make([]float64, len(keys))
+	for i, key := range keys {
+		normalized, err := toDocument(bson.M{"v": key.Value})
+		if err != nil {
+			return err
+		}
+		direction, ok := number(normalized["v"])
+		if !ok || (direction != 1 && direction != -1) {
+			return fmt.Errorf("the sort direction of %s must be 1 or -1", key.Key)
+		}
+		directions[i] = direction
+	}
+
+	sort.SliceStable(docs, func(i, j int) bool {
+		for k, key := range keys {
+			a, _ := lookup(docs[i], key.Key)
+			b, _ := lookup(docs[j], key.Key)
+			if c, _ := compareValues(a, b); c != 0 {
+				return float64(c)*directions[k] < 0
+			}
+		}
+		return false
+	})
+	return nil
+}
+
+// applyUpdate applies a normalized update document, with $set, $unset and $inc, to doc
+func applyUpdate(doc bson.M, update bson.M) error {
+	if len(update) == 0 || !isOperatorDocument(update) {
+		return fmt.Errorf("the update needs $set, $unset or $inc, replacing a document isn't supported")
+	}
+	for operator, operand := range update {
+		fields, ok := asDocument(operand)
+		if !ok {
+			return fmt.Errorf("%s needs a document", operator)
+		}
+		for path, value := range fields {
+			switch operator {
+			case "$set":
+				setPath(doc, path, value)
+			case "$unset":
+				unsetPath(doc, path)
+			case "$inc":
+				current, _ := lookup(doc, path)
+				sum, err := increment(current, value)
+				if err != nil {
+					return fmt.Errorf("$inc %s: %w", path, err)
+				}
+				setPath(doc, path, sum)
+			default:
+				return fmt.Errorf("unsupported update operator %s", operator)
+			}
+		}
+	}
+	return nil
+}
+
+// increment returns value plus n, both integers, a missing value counting as 0 like MongoDB
+func increment(value, n interface{}) (int64, error) {
+	a, ok := integer(value)
+	if !ok {
+		return 0, fmt.Errorf("%v isn't an integer", value)
+	}
+	b, ok := integer(n)
+	if !ok {
+		return 0, fmt.Errorf("%v isn't an integer", n)
+	}
+	return a + b, nil
+}
+
+// integer returns an integer BSON value as an int64, nil as 0
+func integer(v interface{}) (int64, bool) {
+	switch n := v.(type) {
+	case nil:
+		return 0, true
+	case int32:
+		return int64(n), true
+	case int64:
+		return n, true
+	case int:
+		return int64(n), true
+	}
+	return 0, false
+}
@@ -1,13 +1,126 @@
 package models
 
 import (
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
+// UserStatus is the stage of the lifecycle of a user
+type UserStatus string
+
+const (
+	// StatusPending users are created but can't log in yet, e.g. until they are verified
+	StatusPending UserStatus = "pending"
+	// StatusActive users can log in
+	StatusActive UserStatus = "active"
+	// StatusSuspended users can't log in until an administrator activates them again, e.g. after an abuse
+	StatusSuspended UserStatus = "suspended"
+	// StatusDeactivated users closed their account, or it was closed for them
+	StatusDeactivated UserStatus = "deactivated"
+)
+
+// UserStatuses are the valid statuses
+var UserStatuses = []UserStatus{StatusPending, StatusActive, StatusSuspended, StatusDeactivated}
+
+// Valid tells whether s is one of UserStatuses
+func (s UserStatus) Valid() bool {
+	for _, status := range UserStatuses {
+		if s == status {
+			return true
+		}
+	}
+	return false
+}
+
 type User struct {
 	ID       primitive.ObjectID `json:"id" bson:"_id"`
 	Username string             `json:"username" bson:"username"`
 	Password string             `json:"password" bson:"password"`
+	// Roles are given by the administrators, e.g. admin
+	Roles []string `json:"roles,omitempty" bson:"roles,omitempty"`
+	// Locked users can't log in
+	Locked bool `json:"locked" bson:"locked"`
+	// Status is empty for the users stored before it existed, they are active, see CurrentStatus
+	Status UserStatus `json:"status,omitempty" bson:"status,omitempty"`
+	// CreatedAt and UpdatedAt are zero for the users stored before they were recorded.
+	// UpdatedAt changes with the password, the roles, the lock and the status, not with a login.
+	CreatedAt time.Time `json:"created_at" bson:"created_at,omitempty"`
+	UpdatedAt time.Time `json:"updated_at" bson:"updated_at,omitempty"`
+	// LastLoginAt is nil until the first successful login
+	LastLoginAt       *time.Time `json:"last_login_at,omitempty" bson:"last_login_at,omitempty"`
+	PasswordChangedAt *time.Time `json:"password_changed_at,omitempty" bson:"password_changed_at,omitempty"`
+	// DeletedAt is set when the user is deleted, it's hidden until it's restored or purged
+	DeletedAt *time.Time `json:"deleted_at,omitempty" bson:"deleted_at,omitempty"`
+	// DeletedUsername is the username of a deleted user whose username was freed,
+	// it's replaced by a tombstone until the user is restored
+	DeletedUsername string `json:"deleted_username,omitempty" bson:"deleted_username,omitempty"`
+	// Version is incremented by each change of the user, the login excepted.
+	// It's 0 for a new user and for the users stored before it existed.
+	Version int64 `json:"version" bson:"version"`
+	// Attributes are the custom attributes declared by the schema of the configuration, e.g. department
+	Attributes Attributes `json:"attributes,omitempty" bson:"attributes,omitempty"`
+}
+
+// Attributes are the custom attributes of a user, as decoded from JSON: the numbers are float64.
+// They are a subdocument in MongoDB and a JSON column in MySQL.
+type Attributes map[string]interface{}
+
+// UnmarshalBSONValue decodes the attributes subdocument like JSON, so the nested documents are maps
+// and the arrays are slices whatever the backend
+func (a *Attributes) UnmarshalBSONValue(t bsontype.Type, data []byte) error {
+	if t == bsontype.Null {
+		*a = nil
+		return nil
+	}
+	if t != bsontype.EmbeddedDocument {
+		return fmt.Errorf("attributes: unsupported BSON type %s", t)
+	}
+	extJSON, err := bson.MarshalExtJSON(bson.Raw(data), false, false)
+	if err != nil {
+		return fmt.Errorf("attributes: %w", err)
+	}
+	return a.Scan(extJSON)
+}
+
+// Value is the JSON of the attributes column, NULL without attributes
+func (a Attributes) Value() (driver.Value, error) {
+	if len(a) == 0 {
+		return nil, nil
+	}
+	data, err := json.Marshal(map[string]interface{}(a))
+	if err != nil {
+		return nil, fmt.Errorf("attributes: %w", err)
+	}
+	return string(data), nil
+}
+
+// Scan reads the attributes column
+func (a *Attributes) Scan(src interface{}) error {
+	var data []byte
+	switch v := src.(type) {
+	case nil:
+		*a = nil
+		return nil
+	case string:
+		data = []byte(v)
+	case []byte:
+		data = v
+	default:
+		return fmt.Errorf("attributes: unsupported column type %T", src)
+	}
+	var attributes map[string]interface{}
+	if err := json.Unmarshal(data, &attributes); err != nil {
+		return fmt.Errorf("attributes: %w", err)
+	}
+	*a = attributes
+	return nil
 }
 
 func NewUser(username string, password string) *User {
@@ -16,5 +129,38 @@ func NewUser(username string, password string) *User {
 		ID:       id,
 		Username: username,
 		Password: password,
+		Status:   StatusActive,
+	}
+}
+
+// CurrentStatus returns the status of the user, active if it has none
+func (u User) CurrentStatus() UserStatus {
+	if u.Status == "" {
+		return StatusActive
+	}
+	return u.Status
+}
+
+// Deleted tells whether the user is deleted
+func (u User) Deleted() bool {
+	return u.DeletedAt != nil
+}
+
+// OriginalUsername returns the username of the user, before it was freed by its deletion
+func (u User) OriginalUsername() string {
+	if u.DeletedUsername != "" {
+		return u.DeletedUsername
 	}
+	return u.Username
+}
+
+// LogValue logs the user without the password hash
+func (u User) LogValue() slog.Value {
+	return slog.GroupValue(
+		slog.String("id", u.ID.Hex()),
+		slog.String("username", u.Username),
+		slog.Any("roles", u.Roles),
+		slog.Bool("locked", u.Locked),
+		slog.String("status", string(u.CurrentStatus())),
+	)
 }
@@ -0,0 +1,7 @@
+-- the ids are the hex ObjectIDs, the passwords bcrypt or argon2 hashes
+CREATE TABLE IF NOT EXISTS users(
+    id CHAR(24) NOT NULL,
+    username VARCHAR(255) NOT NULL,
+    password VARCHAR(255) NOT NULL,
+    PRIMARY KEY (id),
+    UNIQUE KEY (username));
@@ -0,0 +1,3 @@
+ALTER TABLE users
+    DROP COLUMN roles,
+    DROP COLUMN locked;
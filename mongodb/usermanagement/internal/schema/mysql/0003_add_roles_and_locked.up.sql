@@ -0,0 +1,16 @@
+-- the tables created by hand from the first README had no unique key of the usernames: it's added first,
+-- so with duplicate usernames the migration stops before changing anything, they must be removed by hand.
+-- The tables of 0001 already have it, it isn't added twice.
+SET @add_username_key = IF((SELECT COUNT(*) FROM information_schema.statistics
+        WHERE table_schema = DATABASE() AND table_name = 'users' AND column_name = 'username' AND non_unique = 0) = 0,
+    'ALTER TABLE users ADD UNIQUE KEY (username)', 'SELECT 1');
+PREPARE add_username_key FROM @add_username_key;
+EXECUTE add_username_key;
+DEALLOCATE PREPARE add_username_key;
+-- they also had CHAR(30) ids, CHAR(50) usernames and CHAR(65) passwords, too short for the argon2 hashes
+ALTER TABLE users
+    MODIFY id CHAR(24) NOT NULL,
+    MODIFY username VARCHAR(255) NOT NULL,
+    MODIFY password VARCHAR(255) NOT NULL,
+    ADD COLUMN roles VARCHAR(255) NOT NULL DEFAULT '',
+    ADD COLUMN locked BOOLEAN NOT NULL DEFAULT FALSE;
@@ -0,0 +1,7 @@
+-- the existing users are active, their times are unknown
+ALTER TABLE users
+    ADD COLUMN status VARCHAR(16) NOT NULL DEFAULT 'active',
+    ADD COLUMN created_at DATETIME(3) NULL,
+    ADD COLUMN updated_at DATETIME(3) NULL,
+    ADD COLUMN last_login_at DATETIME(3) NULL,
+    ADD COLUMN password_changed_at DATETIME(3) NULL;
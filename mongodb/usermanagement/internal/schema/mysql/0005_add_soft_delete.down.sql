@@ -0,0 +1,5 @@
+-- the deleted users would be seen as active ones
+DELETE FROM users WHERE deleted_at IS NOT NULL;
+ALTER TABLE users
+    DROP COLUMN deleted_at,
+    DROP COLUMN deleted_username;
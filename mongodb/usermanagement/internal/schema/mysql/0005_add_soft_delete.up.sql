@@ -0,0 +1,4 @@
+-- the deleted users are kept until they are purged, after the grace period of their restore
+ALTER TABLE users
+    ADD COLUMN deleted_at DATETIME(3) NULL,
+    ADD COLUMN deleted_username VARCHAR(255) NULL;
@@ -0,0 +1,3 @@
+-- incremented by each change of a user, for the conditional updates; the existing users are at version 0
+ALTER TABLE users
+    ADD COLUMN version BIGINT NOT NULL DEFAULT 0;
@@ -0,0 +1,3 @@
+-- the custom attributes of a user, a JSON object validated by the schema of the configuration
+ALTER TABLE users
+    ADD COLUMN attributes JSON NULL;
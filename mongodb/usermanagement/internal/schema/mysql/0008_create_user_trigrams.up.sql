@@ -0,0 +1,7 @@
+-- the search index of the users: the trigrams of their username, display_name and email, written by the service
+-- and rebuilt by usermgmt-admin reindex; in a binary collation, so the trigrams differing by an accent are distinct keys
+CREATE TABLE IF NOT EXISTS user_trigrams(
+    user_id CHAR(24) NOT NULL,
+    trigram VARCHAR(3) CHARACTER SET utf8mb4 COLLATE utf8mb4_bin NOT NULL,
+    PRIMARY KEY (trigram, user_id),
+    KEY (user_id));
@@ -0,0 +1,402 @@
+// Package schema migrates the tables of MySQL.
+// The migrations are the SQL files of mysql/, embedded in the binary:
+// <version>_<name>.up.sql applies a version and <version>_<name>.down.sql reverts it.
+// They are applied in the order of their version and recorded in the schema_version table.
+package schema
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"usermanagement/internal/models"
+
+	mysqldriver "github.com/go-sql-driver/mysql"
+)
+
+//go:embed mysql/*.sql
+var mysqlFiles embed.FS
+
+// DefaultLockTimeout is how long Up and Down wait for another process migrating the same database
+const DefaultLockTimeout = time.Minute
+
+// lockPrefix names the lock of a database, with the name of the database after it
+const lockPrefix = "schema_version:"
+
+// ErrLocked is returned when another process, e.g. another replica starting, holds the lock for too long
+var ErrLocked = errors.New("another process is migrating the database")
+
+var fileName = regexp.MustCompile(`^(\d+)_([a-z0-9_]+)\.(up|down)\.sql$`)
+
+// Migration is a version of the schema
+type Migration struct {
+	Version int
+	Name    string
+	// Up and Down are the statements applying and reverting the version
+	Up   []string
+	Down []string
+}
+
+// MySQLMigrations returns the migrations of MySQL, in the order of their version
+func MySQLMigrations() ([]Migration, error) {
+	return Load(mysqlFiles, "mysql")
+}
+
+// Load reads the migrations of the directory dir of fsys.
+// The versions start at 1 without gaps, and every version has an up and a down file.
+func Load(fsys fs.FS, dir string) ([]Migration, error) {
+	entries, err := fs.ReadDir(fsys, dir)
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := make(map[int]*Migration)
+	for _, entry := range entries {
+		match := fileName.FindStringSubmatch(entry.Name())
+		if match == nil {
+			return nil, fmt.Errorf("migration %s: the name isn't <version>_<name>.up.sql or <version>_<name>.down.sql", entry.Name())
+		}
+		version, err := strconv.Atoi(match[1])
+		if err != nil {
+			return nil, fmt.Errorf("migration %s: %w", entry.Name(), err)
+		}
+		content, err := fs.ReadFile(fsys, path.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+
+		migration, ok := byVersion[version]
+		if !ok {
+			migration = &Migration{Version: version, Name: match[2]}
+			byVersion[version] = migration
+		}
+		if migration.Name != match[2] {
+			return nil, fmt.Errorf("migration %d is named both %s and %s", version, migration.Name, match[2])
+		}
+		if match[3] == "up" {
+			migration.Up = SplitStatements(string(content))
+		} else {
+			migration.Down = SplitStatements(string(content))
+		}
+	}
+
+	migrations := make([]Migration, 0, len(byVersion))
+	for version := 1; version <= len(byVersion); version++ {
+		migration, ok := byVersion[version]
+		if !ok {
+			return nil, fmt.Errorf("migration %d is missing", version)
+		}
+		if len(migration.Up) == 0 || len(migration.Down) == 0 {
+			return nil, fmt.Errorf("migration %d %s needs statements in its up and down files", version, migration.Name)
+		}
+		migrations = append(migrations, *migration)
+	}
+	return migrations, nil
+}
+
+// SplitStatements splits a migration file into its statements, ended by ;.
+// The lines starting with -- are comments. A ; can't be in a string or a comment.
+func SplitStatements(content string) []string {
+	var lines []string
+	for _, line := range strings.Split(content, "\n") {
+		if !strings.HasPrefix(strings.TrimSpace(line), "--") {
+			lines = append(lines, line)
+		}
+	}
+
+	var statements []string
+	for _, statement := range strings.Split(strings.Join(lines, "\n"), ";") {
+		if statement = strings.TrimSpace(statement); statement != "" {
+			statements = append(statements, statement)
+		}
+	}
+	return statements
+}
+
+// Migrator applies the migrations to a MySQL database.
+// Up and Down hold a lock of the database while they run,
+// so the replicas starting at the same time migrate one after the other.
+type Migrator struct {
+	db         *sql.DB
+	migrations []Migration
+	logger     *slog.Logger
+	// LockTimeout is how long Up and Down wait for the lock, DefaultLockTimeout by default
+	LockTimeout time.Duration
+}
+
+// NewMySQLMigrator returns the migrator of db with the embedded migrations
+func NewMySQLMigrator(db *sql.DB, logger *slog.Logger) (*Migrator, error) {
+	migrations, err := MySQLMigrations()
+	if err != nil {
+		return nil, err
+	}
+	return &Migrator{db: db, migrations: migrations, logger: logger, LockTimeout: DefaultLockTimeout}, nil
+}
+
+// Latest returns the version of the last migration
+func (m *Migrator) Latest() int {
+	return len(m.migrations)
+}
+
+// AppliedMigration is a migration recorded in schema_version
+type AppliedMigration struct {
+	Version   int       `json:"version"`
+	Name      string    `json:"name"`
+	AppliedAt time.Time `json:"applied_at"`
+}
+
+// Status is the version of a database
+type Status struct {
+	// Version is the last migration applied. A database made before the migrations,
+	// by hand or by an older `usermgmt-admin init`, has the version of its tables until Up records it.
+	Version int                `json:"version"`
+	Latest  int                `json:"latest"`
+	Applied []AppliedMigration `json:"applied"`
+	// Pending are the migrations to apply, as <version>_<name>
+	Pending []string `json:"pending"`
+}
+
+// Status reads the version of the database, without changing it
+func (m *Migrator) Status(ctx context.Context) (Status, error) {
+	status := Status{Latest: m.Latest(), Applied: []AppliedMigration{}, Pending: []string{}}
+
+	rows, err := m.db.QueryContext(ctx, "SELECT version, name, applied_at FROM schema_version ORDER BY version")
+	var mysqlErr *mysqldriver.MySQLError
+	switch {
+	case errors.As(err, &mysqlErr) && mysqlErr.Number == 1146: // ER_NO_SUCH_TABLE, never migrated
+	case err != nil:
+		return status, fmt.Errorf("read schema_version: %w", err)
+	default:
+		defer rows.Close()
+		for rows.Next() {
+			var applied AppliedMigration
+			var appliedAt string
+			if err := rows.Scan(&applied.Version, &applied.Name, &appliedAt); err != nil {
+				return status, fmt.Errorf("read schema_version: %w", err)
+			}
+			if applied.AppliedAt, err = models.ParseSQLTime(appliedAt); err != nil {
+				return status, fmt.Errorf("read schema_version: %w", err)
+			}
+			status.Applied = append(status.Applied, applied)
+			status.Version = max(status.Version, applied.Version)
+		}
+		if err := rows.Err(); err != nil {
+			return status, fmt.Errorf("read schema_version: %w", err)
+		}
+	}
+
+	if len(status.Applied) == 0 {
+		conn, err := m.db.Conn(ctx)
+		if err != nil {
+			return status, err
+		}
+		defer conn.Close()
+		if status.Version, err = existingVersion(ctx, conn); err != nil {
+			return status, err
+		}
+	}
+	for _, migration := range m.migrations[min(status.Version, m.Latest()):] {
+		status.Pending = append(status.Pending, fmt.Sprintf("%04d_%s", migration.Version, migration.Name))
+	}
+	return status, nil
+}
+
+// Up applies the migrations up to the version target, the latest one if target is 0,
+// and returns the ones it applied. A database at target or after it is left as is.
+// MySQL doesn't roll back the changes of the tables: if a statement fails,
+// the ones before it in the same migration stay applied and need to be fixed by hand.
+func (m *Migrator) Up(ctx context.Context, target int) ([]Migration, error) {
+	if target == 0 {
+		target = m.Latest()
+	}
+	if target < 0 || target > m.Latest() {
+		return nil, fmt.Errorf("unknown version %d, the latest is %d", target, m.Latest())
+	}
+
+	var applied []Migration
+	err := m.locked(ctx, func(conn *sql.Conn) error {
+		version, err := m.version(ctx, conn)
+		if err != nil {
+			return err
+		}
+		if version > m.Latest() {
+			m.logger.WarnContext(ctx, "the database was migrated by a newer release",
+				slog.Int("version", version), slog.Int("latest", m.Latest()))
+			return nil
+		}
+
+		for _, migration := range m.migrations[min(version, target):target] {
+			if err := m.run(ctx, conn, migration, "up", migration.Up); err != nil {
+				return err
+			}
+			_, err := conn.ExecContext(ctx, "INSERT INTO schema_version(version, name, applied_at) VALUES (?, ?, ?)",
+				migration.Version, migration.Name, time.Now().UTC())
+			if err != nil {
+				return fmt.Errorf("record migration %d: %w", migration.Version, err)
+			}
+			applied = append(applied, migration)
+		}
+		return nil
+	})
+	return applied, err
+}
+
+// Down reverts the migrations after the version target, the last one first,
+// and returns the ones it reverted. Only the release of target can use the database afterwards.
+func (m *Migrator) Down(ctx context.Context, target int) ([]Migration, error) {
+	if target < 0 || target > m.Latest() {
+		return nil, fmt.Errorf("unknown version %d, the latest is %d", target, m.Latest())
+	}
+
+	var reverted []Migration
+	err := m.locked(ctx, func(conn *sql.Conn) error {
+		version, err := m.version(ctx, conn)
+		if err != nil {
+			return err
+		}
+		if version > m.Latest() {
+			return fmt.Errorf("the database is at version %d, only the release with its migrations can revert them", version)
+		}
+
+		for i := version - 1; i >= target; i-- {
+			migration := m.migrations[i]
+			if err := m.run(ctx, conn, migration, "down", migration.Down); err != nil {
+				return err
+			}
+			if _, err := conn.ExecContext(ctx, "DELETE FROM schema_version WHERE version = ?", migration.Version); err != nil {
+				return fmt.Errorf("record the revert of migration %d: %w", migration.Version, err)
+			}
+			reverted = append(reverted, migration)
+		}
+		return nil
+	})
+	return reverted, err
+}
+
+// run runs the statements of a migration
+func (m *Migrator) run(ctx context.Context, conn *sql.Conn, migration Migration, direction string, statements []string) error {
+	start := time.Now()
+	for i, statement := range statements {
+		if _, err := conn.ExecContext(ctx, statement); err != nil {
+			var mysqlErr *mysqldriver.MySQLError
+			if errors.As(err, &mysqlErr) && mysqlErr.Number == 1062 { // ER_DUP_ENTRY
+				err = fmt.Errorf("%w, remove the duplicates and migrate again", err)
+			}
+			return fmt.Errorf("migration %d %s %s, statement %d of %d: %w",
+				migration.Version, migration.Name, direction, i+1, len(statements), err)
+		}
+	}
+	m.logger.InfoContext(ctx, "schema migrated", slog.String("direction", direction),
+		slog.Int("version", migration.Version), slog.String("name", migration.Name), slog.Duration("duration", time.Since(start)))
+	return nil
+}
+
+// locked runs fn on a connection holding the lock of the database.
+// GET_LOCK is released when the connection is closed, even if the process dies.
+func (m *Migrator) locked(ctx context.Context, fn func(conn *sql.Conn) error) error {
+	conn, err := m.db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	timeout := m.LockTimeout
+	if timeout <= 0 {
+		timeout = DefaultLockTimeout
+	}
+	var acquired sql.NullInt64
+	err = conn.QueryRowContext(ctx, "SELECT GET_LOCK(CONCAT(?, DATABASE()), ?)", lockPrefix, int(timeout.Seconds())).Scan(&acquired)
+	if err != nil {
+		return fmt.Errorf("lock the schema: %w", err)
+	}
+	if acquired.Int64 != 1 {
+		return fmt.Errorf("%w, waited %s", ErrLocked, timeout)
+	}
+	defer func() {
+		_, _ = conn.ExecContext(context.Background(), "DO RELEASE_LOCK(CONCAT(?, DATABASE()))", lockPrefix)
+	}()
+
+	return fn(conn)
+}
+
+// version creates schema_version if it's missing and returns the last version applied.
+// The version of a database made before the migrations is recorded on the first run.
+func (m *Migrator) version(ctx context.Context, conn *sql.Conn) (int, error) {
+	_, err := conn.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_version(
+		version INT NOT NULL,
+		name VARCHAR(255) NOT NULL,
+		applied_at DATETIME(3) NOT NULL,
+		PRIMARY KEY (version))`)
+	if err != nil {
+		return 0, fmt.Errorf("create schema_version: %w", err)
+	}
+
+	var version int
+	if err := conn.QueryRowContext(ctx, "SELECT COALESCE(MAX(version), 0) FROM schema_version").Scan(&version); err != nil {
+		return 0, fmt.Errorf("read schema_version: %w", err)
+	}
+	if version > 0 {
+		return version, nil
+	}
+
+	existing, err := existingVersion(ctx, conn)
+	if err != nil {
+		return 0, err
+	}
+	now := time.Now().UTC()
+	for _, migration := range m.migrations[:existing] {
+		_, err := conn.ExecContext(ctx, "INSERT INTO schema_version(version, name, applied_at) VALUES (?, ?, ?)",
+			migration.Version, migration.Name, now)
+		if err != nil {
+			return 0, fmt.Errorf("record migration %d: %w", migration.Version, err)
+		}
+	}
+	if existing > 0 {
+		m.logger.InfoContext(ctx, "recorded the version of the existing tables", slog.Int("version", existing))
+	}
+	return existing, nil
+}
+
+// existingVersion returns the version of the tables made before the migrations,
+// after the tables and the columns of the first migrations
+func existingVersion(ctx context.Context, conn *sql.Conn) (int, error) {
+	rows, err := conn.QueryContext(ctx, `SELECT table_name, column_name FROM information_schema.columns
+		WHERE table_schema = DATABASE() AND table_name IN ('users', 'audit_events')`)
+	if err != nil {
+		return 0, fmt.Errorf("read the existing tables: %w", err)
+	}
+	defer rows.Close()
+
+	tables := make(map[string]bool)
+	columns := make(map[string]bool)
+	for rows.Next() {
+		var table, column string
+		if err := rows.Scan(&table, &column); err != nil {
+			return 0, fmt.Errorf("read the existing tables: %w", err)
+		}
+		tables[table] = true
+		columns[table+"."+column] = true
+	}
+	if err := rows.Err(); err != nil {
+		return 0, fmt.Errorf("read the existing tables: %w", err)
+	}
+
+	switch {
+	case !tables["users"]:
+		return 0, nil
+	case !tables["audit_events"]:
+		return 1, nil
+	case !columns["users.roles"]:
+		return 2, nil
+	default:
+		return 3, nil
+	}
+}
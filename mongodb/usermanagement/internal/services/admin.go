@@ -0,0 +1,179 @@
+package services
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+	"usermanagement/internal/config"
+	"usermanagement/internal/models"
+	"usermanagement/internal/schema"
+	"usermanagement/internal/tracing"
+
+	mysqldriver "github.com/go-sql-driver/mysql"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// validRole restricts the role names, they are stored comma-separated in MySQL
+var validRole = regexp.MustCompile(`^[a-z][a-z0-9_-]{0,31}$`)
+
+// CreateMySQLDatabase creates the database of the MySQL data source name, if it doesn't exist.
+// It's needed before LoginDB, which can't connect to a missing database.
+func CreateMySQLDatabase(ctx context.Context, cfg config.DatabaseConfig) error {
+	dsn, err := mysqldriver.ParseDSN(cfg.MySQL.URI)
+	if err != nil {
+		return fmt.Errorf("parse MySQL URI: %w", err)
+	}
+	name := dsn.DBName
+	if name == "" {
+		return errors.New("no database in the MySQL URI")
+	}
+	dsn.DBName = ""
+
+	db, err := sql.Open("mysql", dsn.FormatDSN())
+	if err != nil {
+		return fmt.Errorf("open MySQL: %w", err)
+	}
+	defer db.Close()
+
+	ctx, cancel := context.WithTimeout(ctx, cfg.ConnectTimeout)
+	defer cancel()
+	if _, err := db.ExecContext(ctx, "CREATE DATABASE IF NOT EXISTS `"+strings.ReplaceAll(name, "`", "``")+"`"); err != nil {
+		return fmt.Errorf("create database %s: %w", name, err)
+	}
+	return nil
+}
+
+// ValidateRoles checks the names of the roles
+func ValidateRoles(roles []string) error {
+	for _, role := range roles {
+		if !validRole.MatchString(role) {
+			return &ValidationError{Field: "roles", Reason: fmt.Sprintf("%q must be lower case letters, digits, _ or -", role)}
+		}
+	}
+	return nil
+}
+
+// SchemaMigrator returns the migrator of the MySQL tables, MongoDB has no schema
+func (u *UserService) SchemaMigrator() (*schema.Migrator, error) {
+	db, ok := u.Database.(*models.MySQL)
+	if !ok {
+		return nil, errors.New("only MySQL has schema migrations")
+	}
+	return schema.NewMySQLMigrator(db.DB, u.logger)
+}
+
+// SetupDB creates what the database needs: the tables in MySQL, by applying the schema migrations,
+// the unique index of the usernames and the index of the search trigrams in MongoDB,
+// which LoginDB creates too, so a server started without `usermgmt-admin init` has them.
+// It can run again, it only creates what is missing.
+func (u *UserService) SetupDB(ctx context.Context) error {
+	switch db := u.Database.(type) {
+	case *models.MySQL:
+		migrator, err := u.SchemaMigrator()
+		if err != nil {
+			return err
+		}
+		if _, err := migrator.Up(ctx, 0); err != nil {
+			return err
+		}
+	case *models.MongoDB:
+		if err := createUserIndexes(ctx, db.Collection); err != nil {
+			return err
+		}
+	case *models.JSONFile, *models.Memory:
+		// nothing to create, the usernames are unique in memory
+	default:
+		return errors.New("no database connection")
+	}
+	return nil
+}
+
+// ResetPassword replaces the password hash of the user
+func (u *UserService) ResetPassword(ctx context.Context, username, hashedPassword string) (err error) {
+	ctx, span := tracing.Start(ctx, "UserService.ResetPassword")
+	defer tracing.End(span, &err)
+
+	if hashedPassword == "" {
+		return &ValidationError{Field: "password", Reason: "must not be empty"}
+	}
+	at := now()
+	return u.updateUser(ctx, username, at, bson.M{"password": hashedPassword, "password_changed_at": at},
+		"password = ?, password_changed_at = ?", hashedPassword, models.SQLTime(&at))
+}
+
+// SetLocked locks or unlocks the user, a locked user can't log in
+func (u *UserService) SetLocked(ctx context.Context, username string, locked bool) (err error) {
+	ctx, span := tracing.Start(ctx, "UserService.SetLocked")
+	defer tracing.End(span, &err)
+
+	return u.updateUser(ctx, username, now(), bson.M{"locked": locked}, "locked = ?", locked)
+}
+
+// SetRoles replaces the roles of the user, no roles removes them all
+func (u *UserService) SetRoles(ctx context.Context, username string, roles []string) (err error) {
+	ctx, span := tracing.Start(ctx, "UserService.SetRoles")
+	defer tracing.End(span, &err)
+
+	if err := ValidateRoles(roles); err != nil {
+		return err
+	}
+	if len(roles) == 0 {
+		// an empty array rather than null
+		return u.updateUser(ctx, username, now(), bson.M{"roles": []string{}}, "roles = ''")
+	}
+	return u.updateUser(ctx, username, now(), bson.M{"roles": roles}, "roles = ?", strings.Join(roles, ","))
+}
+
+// updateUser changes the fields of the user, given as MongoDB fields and as SQL assignments with their arguments,
+// sets its UpdatedAt to at and increments its version. It returns ErrNotFound if the user doesn't exist.
+func (u *UserService) updateUser(ctx context.Context, username string, at time.Time, fields bson.M, assignments string, args ...interface{}) error {
+	// not through the cache, the user may have been created since it was cached as not found
+	user, err := u.findUserByUsername(ctx, username)
+	if err != nil {
+		return err
+	}
+	fields["updated_at"] = at
+	return u.changeUserFields(ctx, user, fields, assignments+", updated_at = ?", append(args, models.SQLTime(&at))...)
+}
+
+// changeUserFields is setUserFields for a change of the user, which increments its version
+func (u *UserService) changeUserFields(ctx context.Context, user models.User, fields bson.M, assignments string, args ...interface{}) error {
+	return u.writeUserFields(ctx, user, bson.M{"$set": fields, "$inc": bson.M{"version": 1}},
+		assignments+", version = version + 1", args...)
+}
+
+// setUserFields is changeUserFields without a new version, e.g. for a login.
+// The fields must change the user, MySQL doesn't count a row left unchanged as found.
+func (u *UserService) setUserFields(ctx context.Context, user models.User, fields bson.M, assignments string, args ...interface{}) error {
+	return u.writeUserFields(ctx, user, bson.M{"$set": fields}, assignments, args...)
+}
+
+// writeUserFields updates the user, as found by the caller, with the MongoDB update or the SQL assignments.
+// The user is matched by its id, so another user given its username meanwhile isn't changed,
+// and only if it isn't deleted: it returns ErrNotFound if it was deleted since it was found.
+func (u *UserService) writeUserFields(ctx context.Context, user models.User, update bson.M, assignments string, args ...interface{}) error {
+	var updated bool
+	var err error
+	if _, ok := u.Database.(*models.MySQL); ok {
+		updated, err = u.Database.CompareAndSwap(ctx, models.SQLQuery{
+			Statement: "UPDATE users SET " + assignments + " WHERE id = ? AND deleted_at IS NULL",
+			Args:      append(args, user.ID.Hex()),
+		}, nil)
+	} else {
+		// MongoDB, JSON file and memory
+		updated, err = u.Database.CompareAndSwap(ctx, bson.M{"_id": user.ID, "deleted_at": nil}, update)
+	}
+	// even after an error, the update may have been applied
+	u.cache.forget(ctx, user)
+	if err != nil {
+		return &StorageError{Op: "update", Err: err}
+	}
+	if !updated {
+		return ErrNotFound
+	}
+	return nil
+}
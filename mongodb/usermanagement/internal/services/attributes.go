@@ -0,0 +1,163 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"usermanagement/internal/config"
+	"usermanagement/internal/models"
+	"usermanagement/internal/tracing"
+
+	"github.com/santhosh-tekuri/jsonschema/v5"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// AttributeSchema is the JSON Schema of the custom attributes of the users, from the configuration
+type AttributeSchema struct {
+	schema *jsonschema.Schema
+}
+
+// NewAttributeSchema compiles the schema of cfg. It returns nil if there's none, the users then have no attributes.
+func NewAttributeSchema(cfg config.AttributesConfig) (*AttributeSchema, error) {
+	schema, err := cfg.Schema()
+	if err != nil || schema == nil {
+		return nil, err
+	}
+	return &AttributeSchema{schema: schema}, nil
+}
+
+// validate checks the attributes of a user against the schema, no attributes are always valid.
+// The error is a ValidationError of the first invalid attribute, e.g. attributes.phone.
+func (s *AttributeSchema) validate(attributes models.Attributes) error {
+	if len(attributes) == 0 {
+		return nil
+	}
+	if s == nil {
+		return &ValidationError{Field: "attributes", Reason: "no attributes are configured"}
+	}
+	err := s.schema.Validate(map[string]interface{}(attributes))
+	var invalid *jsonschema.ValidationError
+	if !errors.As(err, &invalid) {
+		if err != nil {
+			return &ValidationError{Field: "attributes", Reason: err.Error()}
+		}
+		return nil
+	}
+	// the causes are the failed keywords, down to the value
+	for len(invalid.Causes) > 0 {
+		invalid = invalid.Causes[0]
+	}
+	return &ValidationError{
+		Field:  "attributes" + strings.ReplaceAll(invalid.InstanceLocation, "/", "."),
+		Reason: invalid.Message,
+	}
+}
+
+// searchableName is the name of an attribute that can be searched, it's a path in MongoDB and in MySQL
+var searchableName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// property returns the schema of the top-level attribute name, following its $ref,
+// nil if it isn't declared or its name can't be searched
+func (s *AttributeSchema) property(name string) *jsonschema.Schema {
+	if s == nil || !searchableName.MatchString(name) {
+		return nil
+	}
+	property := s.schema.Properties[name]
+	for property != nil && property.Ref != nil && len(property.Types) == 0 {
+		property = property.Ref
+	}
+	return property
+}
+
+// searchValue converts value, from a query string, to the type of the attribute name.
+// Only the attributes declared by the schema with a type string, integer, number or boolean can be searched.
+func (s *AttributeSchema) searchValue(name string, value string) (interface{}, error) {
+	field := "attributes." + name
+	property := s.property(name)
+	if property == nil {
+		return nil, &ValidationError{Field: field, Reason: "is not a declared attribute"}
+	}
+
+	for _, t := range property.Types {
+		switch t {
+		case "string":
+			return value, nil
+		case "integer":
+			if n, err := strconv.ParseInt(value, 10, 64); err == nil {
+				return float64(n), nil
+			}
+		case "number":
+			if n, err := strconv.ParseFloat(value, 64); err == nil {
+				return n, nil
+			}
+		case "boolean":
+			if b, err := strconv.ParseBool(value); err == nil {
+				return b, nil
+			}
+		}
+	}
+	return nil, &ValidationError{Field: field, Reason: "must be a " + strings.Join(property.Types, " or ") + " attribute and value"}
+}
+
+// SearchUsersByAttributes returns the users whose attributes have the values of query, by attribute name.
+// The values are converted to the types of the schema, e.g. 42 is a number for an integer attribute.
+// A deleted user isn't found.
+func (u *UserService) SearchUsersByAttributes(ctx context.Context, query map[string]string) (_ []models.User, err error) {
+	ctx, span := tracing.Start(ctx, "UserService.SearchUsersByAttributes")
+	defer tracing.End(span, &err)
+
+	if len(query) == 0 {
+		return nil, &ValidationError{Field: "attributes", Reason: "must search at least one attribute"}
+	}
+	names := make([]string, 0, len(query))
+	for name := range query {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	filter := bson.M{"deleted_at": nil}
+	conditions := []string{"deleted_at IS NULL"}
+	var args []interface{}
+	for _, name := range names {
+		value, err := u.attributes.searchValue(name, query[name])
+		if err != nil {
+			return nil, err
+		}
+		filter["attributes."+name] = value
+		// the value is compared as JSON, e.g. true isn't "true"
+		conditions = append(conditions, "JSON_EXTRACT(attributes, ?) = JSON_EXTRACT(?, '$')")
+		encoded, err := json.Marshal(value)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, "$."+name, string(encoded))
+	}
+
+	var found []interface{}
+	if _, ok := u.Database.(*models.MySQL); ok {
+		found, err = u.Database.Read(ctx, models.SQLQuery{
+			Statement: "SELECT " + userColumns + " FROM users WHERE " + strings.Join(conditions, " AND "),
+			Args:      args,
+		}, func() interface{} { return &models.User{} })
+	} else {
+		// MongoDB, JSON file and memory
+		found, err = u.Database.Read(ctx, filter, func() interface{} { return &models.User{} })
+	}
+	if err != nil {
+		return nil, &StorageError{Op: "read", Err: err}
+	}
+
+	users := make([]models.User, 0, len(found))
+	for _, item := range found {
+		user, ok := item.(*models.User)
+		if !ok {
+			return nil, errors.New("type assertion failed")
+		}
+		users = append(users, *user)
+	}
+	return users, nil
+}
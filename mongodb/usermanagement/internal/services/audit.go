@@ -0,0 +1,351 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"strings"
+	"time"
+	"unicode/utf8"
+	"usermanagement/internal/models"
+	"usermanagement/internal/tracing"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+const (
+	// maxAppendAttempts bounds the retries when other requests or replicas append to the chain at the same time
+	maxAppendAttempts = 20
+	// DefaultAuditLimit is the number of events returned by QueryEvents without limit
+	DefaultAuditLimit = 100
+	// MaxAuditLimit is the maximum number of events returned by QueryEvents
+	MaxAuditLimit = 1000
+	// verifyBatchSize is the number of events read at once to verify the chain
+	verifyBatchSize = 1000
+
+	// the lengths of the columns of audit_events, in characters
+	maxActorLength     = 255
+	maxTargetLength    = 255
+	maxIPLength        = 45
+	maxUserAgentLength = 512
+)
+
+// auditColumns are the columns of the audit_events table, in the order scanned by MySQL.Read
+const auditColumns = "seq, type, actor, target, ip, user_agent, timestamp, prev_hash, hash"
+
+// AuditFilter selects audit events, the zero value selects the last DefaultAuditLimit events
+type AuditFilter struct {
+	Type   string
+	Actor  string
+	Target string
+	// Since and Until bound the timestamp, Since included and Until excluded
+	Since time.Time
+	Until time.Time
+	// BeforeSeq selects the events before this one, to get the next page
+	BeforeSeq int64
+	Limit     int
+}
+
+// AuditVerification is the result of a successful verification of the audit log
+type AuditVerification struct {
+	// Events is the number of events checked
+	Events int64
+	// LastHash is the hash of the last event, keep it elsewhere to detect a truncation of the log later
+	LastHash string
+}
+
+// ChainError reports the first event breaking the hash chain of the audit log
+type ChainError struct {
+	Seq    int64
+	Reason string
+}
+
+func (e *ChainError) Error() string {
+	return fmt.Sprintf("audit log broken at event %d: %s", e.Seq, e.Reason)
+}
+
+// RecordEvent appends event to the audit log, setting its sequence number, hashes and,
+// if unset, its timestamp. Its actor, target, IP and user agent are truncated to the lengths of the MySQL columns.
+// The event is chained on the newest stored event, then inserted with the next sequence number.
+// The requests of this process and the other replicas appending at the same time compete for it,
+// the losers get a duplicate key error and retry after the winner, at most maxAppendAttempts times.
+// The lock only guards the tail of the chain kept in memory, never a round trip to the database, so the appends don't queue up.
+func (u *UserService) RecordEvent(ctx context.Context, event models.AuditEvent) (err error) {
+	ctx, span := tracing.Start(ctx, "UserService.RecordEvent")
+	defer tracing.End(span, &err)
+
+	if u.Audit == nil {
+		return errors.New("no database connection")
+	}
+
+	if event.Timestamp.IsZero() {
+		event.Timestamp = time.Now()
+	}
+	event.Timestamp = event.Timestamp.UTC().Truncate(time.Millisecond)
+	// the fields given by the clients are cut to the columns of MySQL, before they are hashed
+	event.Actor = truncate(event.Actor, maxActorLength)
+	event.Target = truncate(event.Target, maxTargetLength)
+	event.IP = truncate(event.IP, maxIPLength)
+	event.UserAgent = truncate(event.UserAgent, maxUserAgentLength)
+
+	for attempt := 0; attempt < maxAppendAttempts; attempt++ {
+		if attempt > 0 {
+			// spread the losers, so they don't collide again
+			select {
+			case <-ctx.Done():
+				return &StorageError{Op: "create audit event", Err: ctx.Err()}
+			case <-time.After(time.Duration(rand.Int63n(int64(attempt) * int64(time.Millisecond)))):
+			}
+		}
+
+		tail, ok := u.auditChainTail()
+		if !ok {
+			last, err := u.lastEvent(ctx)
+			if err != nil {
+				return err
+			}
+			tail = u.advanceAuditTail(last)
+		}
+		event.Seq = tail.Seq + 1
+		event.PrevHash = tail.Hash
+		event.Hash = event.ComputeHash()
+
+		err = u.insertEvent(ctx, event)
+		if err == nil {
+			u.advanceAuditTail(event)
+			return nil
+		}
+		if !models.IsDuplicateKey(err) {
+			return &StorageError{Op: "create audit event", Err: err}
+		}
+		// another request took the sequence number, the tail is read again
+		u.forgetAuditTail(tail)
+	}
+	return &StorageError{Op: "create audit event",
+		Err: fmt.Errorf("too many concurrent appends, gave up after %d attempts", maxAppendAttempts)}
+}
+
+// truncate returns the first n characters of s
+func truncate(s string, n int) string {
+	if utf8.RuneCountInString(s) <= n {
+		return s
+	}
+	return string([]rune(s)[:n])
+}
+
+// auditChainTail returns the newest stored event known by this process, false if it must be read
+func (u *UserService) auditChainTail() (models.AuditEvent, bool) {
+	u.auditMu.Lock()
+	defer u.auditMu.Unlock()
+	if u.auditTail == nil {
+		return models.AuditEvent{}, false
+	}
+	return *u.auditTail, true
+}
+
+// advanceAuditTail records event as the newest stored one, unless a newer one is known,
+// and returns the newest
+func (u *UserService) advanceAuditTail(event models.AuditEvent) models.AuditEvent {
+	u.auditMu.Lock()
+	defer u.auditMu.Unlock()
+	if u.auditTail == nil || event.Seq > u.auditTail.Seq {
+		u.auditTail = &event
+	}
+	return *u.auditTail
+}
+
+// forgetAuditTail forgets the tail found stale, unless a newer one replaced it meanwhile
+func (u *UserService) forgetAuditTail(stale models.AuditEvent) {
+	u.auditMu.Lock()
+	defer u.auditMu.Unlock()
+	if u.auditTail != nil && u.auditTail.Seq <= stale.Seq {
+		u.auditTail = nil
+	}
+}
+
+// lastEvent returns the last event of the audit log, or a zero event if the log is empty
+func (u *UserService) lastEvent(ctx context.Context) (models.AuditEvent, error) {
+	var query interface{}
+	if _, ok := u.Audit.(*models.MySQL); ok {
+		query = "SELECT " + auditColumns + " FROM audit_events ORDER BY seq DESC LIMIT 1"
+	} else {
+		// MongoDB, JSON file and memory
+		query = models.MongoQuery{Filter: bson.M{}, Sort: bson.D{{Key: "seq", Value: -1}}, Limit: 1}
+	}
+
+	events, err := u.readEvents(ctx, query)
+	if err != nil {
+		return models.AuditEvent{}, err
+	}
+	if len(events) == 0 {
+		return models.AuditEvent{}, nil
+	}
+	return events[0], nil
+}
+
+func (u *UserService) insertEvent(ctx context.Context, event models.AuditEvent) error {
+	if _, ok := u.Audit.(*models.MySQL); ok {
+		return u.Audit.Create(ctx, models.SQLQuery{
+			Statement: "INSERT INTO audit_events (" + auditColumns + ") VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)",
+			Args: []interface{}{
+				event.Seq, event.Type, event.Actor, event.Target, event.IP, event.UserAgent,
+				event.Timestamp, event.PrevHash, event.Hash,
+			},
+		})
+	}
+	// MongoDB, JSON file and memory
+	return u.Audit.Create(ctx, event)
+}
+
+// readEvents runs a query of the audit log
+func (u *UserService) readEvents(ctx context.Context, query interface{}) ([]models.AuditEvent, error) {
+	found, err := u.Audit.Read(ctx, query, func() interface{} { return &models.AuditEvent{} })
+	if err != nil {
+		return nil, &StorageError{Op: "read audit events", Err: err}
+	}
+
+	events := make([]models.AuditEvent, 0, len(found))
+	for _, item := range found {
+		event, ok := item.(*models.AuditEvent)
+		if !ok {
+			return nil, errors.New("type assertion failed")
+		}
+		events = append(events, *event)
+	}
+	return events, nil
+}
+
+// QueryEvents returns the audit events matching filter, the newest first
+func (u *UserService) QueryEvents(ctx context.Context, filter AuditFilter) (_ []models.AuditEvent, err error) {
+	ctx, span := tracing.Start(ctx, "UserService.QueryEvents")
+	defer tracing.End(span, &err)
+
+	if u.Audit == nil {
+		return nil, errors.New("no database connection")
+	}
+
+	limit := filter.Limit
+	if limit == 0 {
+		limit = DefaultAuditLimit
+	}
+	if limit < 0 || limit > MaxAuditLimit {
+		return nil, &ValidationError{Field: "limit", Reason: fmt.Sprintf("must be between 1 and %d", MaxAuditLimit)}
+	}
+
+	if _, ok := u.Audit.(*models.MySQL); ok {
+		var conditions []string
+		var args []interface{}
+		where := func(condition string, arg interface{}) {
+			conditions = append(conditions, condition)
+			args = append(args, arg)
+		}
+		if filter.Type != "" {
+			where("type = ?", filter.Type)
+		}
+		if filter.Actor != "" {
+			where("actor = ?", filter.Actor)
+		}
+		if filter.Target != "" {
+			where("target = ?", filter.Target)
+		}
+		if !filter.Since.IsZero() {
+			where("timestamp >= ?", filter.Since.UTC())
+		}
+		if !filter.Until.IsZero() {
+			where("timestamp < ?", filter.Until.UTC())
+		}
+		if filter.BeforeSeq > 0 {
+			where("seq < ?", filter.BeforeSeq)
+		}
+
+		statement := "SELECT " + auditColumns + " FROM audit_events"
+		if len(conditions) > 0 {
+			statement += " WHERE " + strings.Join(conditions, " AND ")
+		}
+		statement += fmt.Sprintf(" ORDER BY seq DESC LIMIT %d", limit)
+		return u.readEvents(ctx, models.SQLQuery{Statement: statement, Args: args})
+	}
+
+	// MongoDB, JSON file and memory
+	query := bson.M{}
+	if filter.Type != "" {
+		query["type"] = filter.Type
+	}
+	if filter.Actor != "" {
+		query["actor"] = filter.Actor
+	}
+	if filter.Target != "" {
+		query["target"] = filter.Target
+	}
+	timestamp := bson.M{}
+	if !filter.Since.IsZero() {
+		timestamp["$gte"] = filter.Since.UTC()
+	}
+	if !filter.Until.IsZero() {
+		timestamp["$lt"] = filter.Until.UTC()
+	}
+	if len(timestamp) > 0 {
+		query["timestamp"] = timestamp
+	}
+	if filter.BeforeSeq > 0 {
+		query["seq"] = bson.M{"$lt": filter.BeforeSeq}
+	}
+	return u.readEvents(ctx, models.MongoQuery{
+		Filter: query,
+		Sort:   bson.D{{Key: "seq", Value: -1}},
+		Limit:  int64(limit),
+	})
+}
+
+// VerifyAuditLog reads the whole audit log in order and checks the hash chain.
+// It returns a *ChainError at the first event that was changed, inserted or removed.
+// Removing the last events can't be detected from the log itself: compare the returned
+// LastHash with one kept from an earlier verification.
+func (u *UserService) VerifyAuditLog(ctx context.Context) (_ AuditVerification, err error) {
+	ctx, span := tracing.Start(ctx, "UserService.VerifyAuditLog")
+	defer tracing.End(span, &err)
+
+	if u.Audit == nil {
+		return AuditVerification{}, errors.New("no database connection")
+	}
+
+	var previous models.AuditEvent
+	for {
+		var query interface{}
+		if _, ok := u.Audit.(*models.MySQL); ok {
+			query = models.SQLQuery{
+				Statement: fmt.Sprintf("SELECT %s FROM audit_events WHERE seq > ? ORDER BY seq LIMIT %d", auditColumns, verifyBatchSize),
+				Args:      []interface{}{previous.Seq},
+			}
+		} else {
+			// MongoDB, JSON file and memory
+			query = models.MongoQuery{
+				Filter: bson.M{"seq": bson.M{"$gt": previous.Seq}},
+				Sort:   bson.D{{Key: "seq", Value: 1}},
+				Limit:  verifyBatchSize,
+			}
+		}
+
+		events, err := u.readEvents(ctx, query)
+		if err != nil {
+			return AuditVerification{}, err
+		}
+
+		for _, event := range events {
+			switch {
+			case event.Seq != previous.Seq+1:
+				return AuditVerification{}, &ChainError{Seq: event.Seq, Reason: fmt.Sprintf("expected event %d", previous.Seq+1)}
+			case event.PrevHash != previous.Hash:
+				return AuditVerification{}, &ChainError{Seq: event.Seq, Reason: "previous hash doesn't match the previous event"}
+			case event.Hash != event.ComputeHash():
+				return AuditVerification{}, &ChainError{Seq: event.Seq, Reason: "hash doesn't match the content"}
+			}
+			previous = event
+		}
+
+		if len(events) < verifyBatchSize {
+			return AuditVerification{Events: previous.Seq, LastHash: previous.Hash}, nil
+		}
+	}
+}
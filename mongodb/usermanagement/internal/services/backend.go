@@ -0,0 +1,291 @@
+package services
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"usermanagement/internal/config"
+	"usermanagement/internal/models"
+	"usermanagement/internal/schema"
+
+	_ "github.com/go-sql-driver/mysql"
+	"github.com/google/wire"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Backend is a database the users and the audit log are stored in.
+// The UserService is the same for every backend, LoginDB connects to the one it's given.
+type Backend interface {
+	// Name names the backend in the logs, e.g. mongodb
+	Name() string
+	// Connect connects to the database and returns its stores
+	Connect(ctx context.Context) (Stores, error)
+}
+
+// Stores are the stores of a backend
+type Stores struct {
+	Users models.CURDInterface
+	Audit models.CURDInterface
+}
+
+// The provider sets of the backends, one of them is given to the injectors of cmd/wire.go
+var (
+	MongoSet  = wire.NewSet(NewMongoBackend, wire.Bind(new(Backend), new(*MongoBackend)))
+	MySQLSet  = wire.NewSet(NewMySQLBackend, wire.Bind(new(Backend), new(*MySQLBackend)))
+	JSONSet   = wire.NewSet(NewJSONBackend, wire.Bind(new(Backend), new(*JSONBackend)))
+	MemorySet = wire.NewSet(NewMemoryBackend, wire.Bind(new(Backend), new(*MemoryBackend)))
+)
+
+// NewBackend returns the backend configured in cfg, nil if none is, so LoginDB fails.
+// It's the choice of cmd/main.go for the commands without injector.
+func NewBackend(cfg config.DatabaseConfig, logger *slog.Logger) Backend {
+	switch cfg.Backend() {
+	case config.BackendMongo:
+		return NewMongoBackend(cfg, logger)
+	case config.BackendMySQL:
+		return NewMySQLBackend(cfg, logger)
+	case config.BackendJSON:
+		return NewJSONBackend(cfg, logger)
+	case config.BackendMemory:
+		return NewMemoryBackend(logger)
+	default:
+		return nil
+	}
+}
+
+// ----- MongoDB -----
+
+type MongoBackend struct {
+	config config.DatabaseConfig
+	logger *slog.Logger
+}
+
+func NewMongoBackend(cfg config.DatabaseConfig, logger *slog.Logger) *MongoBackend {
+	return &MongoBackend{config: cfg, logger: logger}
+}
+
+func (b *MongoBackend) Name() string {
+	return config.BackendMongo
+}
+
+// Connect connects to MongoDB, the users are in the user collection and the audit log in the audit collection
+func (b *MongoBackend) Connect(ctx context.Context) (Stores, error) {
+	db := models.NewMongoDB()
+	db.Timeouts = b.config.Timeouts()
+
+	ctx, cancel := context.WithTimeout(ctx, b.config.ConnectTimeout)
+	defer cancel()
+
+	client, err := mongo.Connect(ctx, options.Client().ApplyURI(b.config.Mongo.URI))
+	if err != nil {
+		return Stores{}, fmt.Errorf("connect to MongoDB: %w", err)
+	}
+	if err := client.Ping(ctx, readpref.Primary()); err != nil {
+		_ = client.Disconnect(context.Background())
+		return Stores{}, fmt.Errorf("ping MongoDB: %w", err)
+	}
+
+	db.Client = client
+	db.Collection = client.Database(b.config.Mongo.Database).Collection("user")
+	if err := createUserIndexes(ctx, db.Collection); err != nil {
+		_ = client.Disconnect(context.Background())
+		return Stores{}, err
+	}
+
+	audit := models.NewMongoDB()
+	audit.Timeouts = db.Timeouts
+	audit.Client = client
+	audit.Collection = client.Database(b.config.Mongo.Database).Collection("audit")
+	// the sequence numbers are unique, so concurrent appends can't fork the chain
+	_, err = audit.Collection.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "seq", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	})
+	if err != nil {
+		_ = client.Disconnect(context.Background())
+		return Stores{}, fmt.Errorf("create the index of the audit log: %w", err)
+	}
+
+	return Stores{Users: db, Audit: audit}, nil
+}
+
+// createUserIndexes creates the indexes of the user collection, if they're missing:
+// the unique index of the usernames, without which two users could have the same,
+// and the index of the search trigrams
+func createUserIndexes(ctx context.Context, collection *mongo.Collection) error {
+	_, err := collection.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "username", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	})
+	if err != nil {
+		return fmt.Errorf("create the index of the usernames: %w", err)
+	}
+	// a multikey index, one key per trigram of a user
+	_, err = collection.Indexes().CreateOne(ctx, mongo.IndexModel{Keys: bson.D{{Key: searchIndex, Value: 1}}})
+	if err != nil {
+		return fmt.Errorf("create the index of the search: %w", err)
+	}
+	return nil
+}
+
+// ----- MySQL -----
+
+type MySQLBackend struct {
+	config config.DatabaseConfig
+	logger *slog.Logger
+}
+
+func NewMySQLBackend(cfg config.DatabaseConfig, logger *slog.Logger) *MySQLBackend {
+	return &MySQLBackend{config: cfg, logger: logger}
+}
+
+func (b *MySQLBackend) Name() string {
+	return config.BackendMySQL
+}
+
+// Connect connects to MySQL, then applies the pending schema migrations if AutoMigrate is set
+func (b *MySQLBackend) Connect(ctx context.Context) (Stores, error) {
+	mysql := models.NewMySQL()
+	mysql.Timeouts = b.config.Timeouts()
+
+	connectCtx, cancel := context.WithTimeout(ctx, b.config.ConnectTimeout)
+	defer cancel()
+
+	db, err := sql.Open("mysql", b.config.MySQL.URI)
+	if err != nil {
+		return Stores{}, fmt.Errorf("open MySQL: %w", err)
+	}
+	if err := db.PingContext(connectCtx); err != nil {
+		db.Close()
+		return Stores{}, fmt.Errorf("ping MySQL: %w", err)
+	}
+	mysql.DB = db
+
+	audit := models.NewMySQL()
+	audit.Timeouts = mysql.Timeouts
+	audit.DB = db
+
+	if err := b.checkSchema(ctx, db); err != nil {
+		db.Close()
+		return Stores{}, err
+	}
+	return Stores{Users: mysql, Audit: audit}, nil
+}
+
+// checkSchema applies the pending migrations of MySQL if AutoMigrate is set,
+// otherwise it warns about them. The replicas starting together wait for each other.
+func (b *MySQLBackend) checkSchema(ctx context.Context, db *sql.DB) error {
+	migrator, err := schema.NewMySQLMigrator(db, b.logger)
+	if err != nil {
+		return err
+	}
+
+	if b.config.MySQL.AutoMigrate {
+		if _, err := migrator.Up(ctx, 0); err != nil {
+			return fmt.Errorf("migrate the schema: %w", err)
+		}
+		return nil
+	}
+
+	status, err := migrator.Status(ctx)
+	if err != nil {
+		return fmt.Errorf("read the schema version: %w", err)
+	}
+	if len(status.Pending) > 0 {
+		b.logger.Warn("the schema has pending migrations, apply them with `usermgmt-admin schema up`",
+			slog.Int("version", status.Version), slog.Int("latest", status.Latest))
+	}
+	return nil
+}
+
+// ----- JSON file -----
+
+type JSONBackend struct {
+	config config.DatabaseConfig
+	logger *slog.Logger
+}
+
+func NewJSONBackend(cfg config.DatabaseConfig, logger *slog.Logger) *JSONBackend {
+	return &JSONBackend{config: cfg, logger: logger}
+}
+
+func (b *JSONBackend) Name() string {
+	return config.BackendJSON
+}
+
+// Connect reads the users and the audit log from their JSON files.
+// The plain-text passwords of the older files are hashed and saved first, so they can log in.
+func (b *JSONBackend) Connect(ctx context.Context) (Stores, error) {
+	users, err := models.NewJSONFile(b.config.JSON.DataFile, func() interface{} { return &models.User{} }, "username")
+	if err != nil {
+		return Stores{}, fmt.Errorf("open the data file: %w", err)
+	}
+	audit, err := models.NewJSONFile(b.config.JSON.AuditFile(), func() interface{} { return &models.AuditEvent{} }, "seq")
+	if err != nil {
+		return Stores{}, fmt.Errorf("open the audit file: %w", err)
+	}
+
+	if err := b.hashPlainPasswords(ctx, users); err != nil {
+		return Stores{}, err
+	}
+	// a login doesn't rewrite the whole file, its time is saved with the next write
+	users.SetLazyFields("last_login_at")
+	return Stores{Users: users, Audit: audit}, nil
+}
+
+// hashPlainPasswords replaces the passwords that aren't bcrypt or argon2 hashes by their bcrypt hash
+func (b *JSONBackend) hashPlainPasswords(ctx context.Context, users *models.JSONFile) error {
+	found, err := users.Read(ctx, bson.M{}, func() interface{} { return &models.User{} })
+	if err != nil {
+		return err
+	}
+
+	hashed := 0
+	for _, item := range found {
+		user := item.(*models.User)
+		if ValidatePasswordHash(user.Password) == nil {
+			continue
+		}
+		hash, err := bcrypt.GenerateFromPassword([]byte(user.Password), bcrypt.DefaultCost)
+		if err != nil {
+			return fmt.Errorf("hash the password of %s: %w", user.Username, err)
+		}
+		if err := users.Update(ctx, bson.M{"_id": user.ID}, bson.M{"$set": bson.M{"password": string(hash)}}); err != nil {
+			return fmt.Errorf("save the password of %s: %w", user.Username, err)
+		}
+		hashed++
+	}
+	if hashed > 0 {
+		b.logger.Warn("hashed the plain-text passwords of the data file", slog.Int("users", hashed))
+	}
+	return nil
+}
+
+// ----- memory -----
+
+type MemoryBackend struct {
+	logger *slog.Logger
+}
+
+func NewMemoryBackend(logger *slog.Logger) *MemoryBackend {
+	return &MemoryBackend{logger: logger}
+}
+
+func (b *MemoryBackend) Name() string {
+	return config.BackendMemory
+}
+
+// Connect returns empty stores in memory, for the demos and the tests
+func (b *MemoryBackend) Connect(ctx context.Context) (Stores, error) {
+	b.logger.Warn("database.memory is set: the users are kept in memory, they are lost when the server stops " +
+		"and each replica has its own, don't use it in production")
+	return Stores{
+		Users: models.NewMemory(func() interface{} { return &models.User{} }, "username"),
+		Audit: models.NewMemory(func() interface{} { return &models.AuditEvent{} }, "seq"),
+	}, nil
+}
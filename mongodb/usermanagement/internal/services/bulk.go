@@ -0,0 +1,785 @@
+package services
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"usermanagement/internal/models"
+	"usermanagement/internal/tracing"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	// importBatchSize is the number of rows looked up and inserted with one query
+	importBatchSize = 500
+	// exportPageSize is the number of users read with one query
+	exportPageSize = 1000
+	// maxRowErrors is the number of row errors reported by an import, the next ones are only counted
+	maxRowErrors = 1000
+	// maxNDJSONLine is the longest line of an NDJSON import
+	maxNDJSONLine = 1024 * 1024
+)
+
+// Format is the file format of the bulk import and export
+type Format string
+
+const (
+	FormatCSV    Format = "csv"
+	FormatNDJSON Format = "ndjson"
+)
+
+// ParseFormat parses the name of a format, csv or ndjson
+func ParseFormat(name string) (Format, error) {
+	switch f := Format(strings.ToLower(name)); f {
+	case FormatCSV, FormatNDJSON:
+		return f, nil
+	default:
+		return "", &ValidationError{Field: "format", Reason: "must be csv or ndjson"}
+	}
+}
+
+// ImportMode tells what an import does with the users that already exist
+type ImportMode string
+
+const (
+	// ImportCreate reports the existing users as row errors
+	ImportCreate ImportMode = "create"
+	// ImportSkipExisting leaves the existing users unchanged
+	ImportSkipExisting ImportMode = "skip-existing"
+	// ImportUpsert replaces the password of the existing users and the other fields in the file, their id is kept
+	ImportUpsert ImportMode = "upsert"
+)
+
+// ParseImportMode parses the name of an import mode, create if it's empty
+func ParseImportMode(name string) (ImportMode, error) {
+	switch m := ImportMode(name); m {
+	case "":
+		return ImportCreate, nil
+	case ImportCreate, ImportSkipExisting, ImportUpsert:
+		return m, nil
+	default:
+		return "", &ValidationError{Field: "mode", Reason: "must be create, skip-existing or upsert"}
+	}
+}
+
+// ImportOptions are the options of ImportUsers
+type ImportOptions struct {
+	Format Format
+	Mode   ImportMode
+	// DryRun validates the rows and looks up the existing users, without writing anything
+	DryRun bool
+}
+
+// UserRecord is a user in an import or export file.
+// The CSV files have a header with the names of the JSON fields, the roles are comma-separated.
+type UserRecord struct {
+	// ID is optional on import, a new one is generated if it's empty
+	ID       string `json:"id,omitempty"`
+	Username string `json:"username"`
+	// Password is a plain password, hashed with bcrypt on import. It's never exported.
+	Password string `json:"password,omitempty"`
+	// PasswordHash is a bcrypt or an argon2 hash, imported as is
+	PasswordHash string   `json:"password_hash,omitempty"`
+	Roles        []string `json:"roles,omitempty"`
+	Locked       bool     `json:"locked"`
+	// Status is active if it's empty
+	Status models.UserStatus `json:"status,omitempty"`
+	// Attributes are only in the NDJSON files
+	Attributes models.Attributes `json:"attributes,omitempty"`
+
+	// fields are the CSV columns or the JSON fields of the record, the ones an upsert replaces
+	fields map[string]bool
+}
+
+// csvColumns are the columns of a CSV import, the ones of an export without password
+var csvColumns = []string{"id", "username", "password", "password_hash", "roles", "locked", "status"}
+
+// RowError is a row of an import that isn't imported
+type RowError struct {
+	// Row is the line of the row in the file, starting at 1
+	Row      int    `json:"row"`
+	Username string `json:"username,omitempty"`
+	Reason   string `json:"error"`
+}
+
+func (e *RowError) Error() string {
+	return fmt.Sprintf("row %d: %s", e.Row, e.Reason)
+}
+
+// ImportResult counts the rows of an import by outcome.
+// With DryRun, the counts are the outcomes the import would have.
+type ImportResult struct {
+	Rows    int  `json:"rows"`
+	Created int  `json:"created"`
+	Updated int  `json:"updated"`
+	Skipped int  `json:"skipped"`
+	Failed  int  `json:"failed"`
+	DryRun  bool `json:"dry_run"`
+	// Errors are the first failed rows, at most maxRowErrors
+	Errors []RowError `json:"errors"`
+}
+
+func (r *ImportResult) fail(row int, username string, reason string) {
+	r.Failed++
+	if len(r.Errors) < maxRowErrors {
+		r.Errors = append(r.Errors, RowError{Row: row, Username: username, Reason: reason})
+	}
+}
+
+// importRow is a valid row waiting in a batch
+type importRow struct {
+	row  int
+	user models.User
+	// password is the plain password, hashed only when the user is written
+	password string
+	fields   map[string]bool
+}
+
+// recordReader reads the records of an import file one by one.
+// next returns the record and its row, a *RowError if the row is invalid and io.EOF at the end;
+// the reading can go on after a *RowError but not after another error.
+type recordReader interface {
+	next() (UserRecord, int, error)
+}
+
+func newRecordReader(r io.Reader, format Format) (recordReader, error) {
+	switch format {
+	case FormatCSV:
+		return newCSVReader(r)
+	case FormatNDJSON:
+		scanner := bufio.NewScanner(r)
+		scanner.Buffer(make([]byte, 64*1024), maxNDJSONLine)
+		return &ndjsonReader{scanner: scanner}, nil
+	default:
+		return nil, &ValidationError{Field: "format", Reason: "must be csv or ndjson"}
+	}
+}
+
+type csvReader struct {
+	reader  *csv.Reader
+	columns map[string]int
+	// fields are the names of the columns, the same for every record
+	fields map[string]bool
+}
+
+func newCSVReader(r io.Reader) (*csvReader, error) {
+	reader := csv.NewReader(r)
+	header, err := reader.Read()
+	if errors.Is(err, io.EOF) {
+		return nil, &ValidationError{Field: "body", Reason: "empty CSV, the first line must be the header"}
+	}
+	if err != nil {
+		var parseErr *csv.ParseError
+		if errors.As(err, &parseErr) {
+			return nil, &ValidationError{Field: "body", Reason: err.Error()}
+		}
+		return nil, err
+	}
+
+	columns := make(map[string]int, len(header))
+	fields := make(map[string]bool, len(header))
+	for i, name := range header {
+		if i == 0 {
+			// spreadsheets write a byte order mark
+			name = strings.TrimPrefix(name, "\ufeff")
+		}
+		name = strings.ToLower(strings.TrimSpace(name))
+		if !slices.Contains(csvColumns, name) {
+			return nil, &ValidationError{Field: "body", Reason: fmt.Sprintf("unknown CSV column %q, expected %s", name, strings.Join(csvColumns, ", "))}
+		}
+		if _, ok := columns[name]; ok {
+			return nil, &ValidationError{Field: "body", Reason: fmt.Sprintf("duplicate CSV column %q", name)}
+		}
+		columns[name] = i
+		fields[name] = true
+	}
+	if _, ok := columns["username"]; !ok {
+		return nil, &ValidationError{Field: "body", Reason: "the CSV header has no username column"}
+	}
+	return &csvReader{reader: reader, columns: columns, fields: fields}, nil
+}
+
+func (r *csvReader) next() (UserRecord, int, error) {
+	fields, err := r.reader.Read()
+	if err != nil {
+		var parseErr *csv.ParseError
+		if errors.As(err, &parseErr) {
+			return UserRecord{}, parseErr.StartLine, &RowError{Row: parseErr.StartLine, Reason: parseErr.Err.Error()}
+		}
+		return UserRecord{}, 0, err
+	}
+	row, _ := r.reader.FieldPos(0)
+
+	field := func(name string) string {
+		if i, ok := r.columns[name]; ok {
+			return fields[i]
+		}
+		return ""
+	}
+	record := UserRecord{
+		ID:           strings.TrimSpace(field("id")),
+		Username:     strings.TrimSpace(field("username")),
+		Password:     field("password"),
+		PasswordHash: strings.TrimSpace(field("password_hash")),
+		Status:       models.UserStatus(strings.TrimSpace(field("status"))),
+		fields:       r.fields,
+	}
+	for _, role := range strings.Split(field("roles"), ",") {
+		if role = strings.TrimSpace(role); role != "" {
+			record.Roles = append(record.Roles, role)
+		}
+	}
+	if locked := strings.TrimSpace(field("locked")); locked != "" {
+		if record.Locked, err = strconv.ParseBool(locked); err != nil {
+			return record, row, &RowError{Row: row, Username: record.Username, Reason: "locked must be true or false"}
+		}
+	}
+	return record, row, nil
+}
+
+type ndjsonReader struct {
+	scanner *bufio.Scanner
+	line    int
+}
+
+func (r *ndjsonReader) next() (UserRecord, int, error) {
+	for r.scanner.Scan() {
+		r.line++
+		line := strings.TrimSpace(r.scanner.Text())
+		if line == "" {
+			continue
+		}
+
+		var record UserRecord
+		decoder := json.NewDecoder(strings.NewReader(line))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&record); err != nil {
+			return record, r.line, &RowError{Row: r.line, Username: record.Username, Reason: err.Error()}
+		}
+		var fields map[string]json.RawMessage
+		if err := json.Unmarshal([]byte(line), &fields); err != nil {
+			return record, r.line, &RowError{Row: r.line, Username: record.Username, Reason: err.Error()}
+		}
+		record.fields = make(map[string]bool, len(fields))
+		for name := range fields {
+			record.fields[name] = true
+		}
+		return record, r.line, nil
+	}
+	if err := r.scanner.Err(); err != nil {
+		return UserRecord{}, 0, err
+	}
+	return UserRecord{}, 0, io.EOF
+}
+
+// newImportedUser validates a record and returns its user, the password isn't hashed yet
+func newImportedUser(record UserRecord) (models.User, error) {
+	if err := ValidateUsername(record.Username); err != nil {
+		return models.User{}, err
+	}
+	if err := ValidateRoles(record.Roles); err != nil {
+		return models.User{}, err
+	}
+	if err := ValidateStatus(record.Status); err != nil {
+		return models.User{}, err
+	}
+
+	switch {
+	case record.Password != "" && record.PasswordHash != "":
+		return models.User{}, &ValidationError{Field: "password", Reason: "set either password or password_hash"}
+	case record.PasswordHash != "":
+		if err := ValidatePasswordHash(record.PasswordHash); err != nil {
+			return models.User{}, &ValidationError{Field: "password_hash", Reason: err.Error()}
+		}
+	case record.Password != "":
+		// e.g. an old export, the hash would become the password
+		if ValidatePasswordHash(record.Password) == nil {
+			return models.User{}, &ValidationError{Field: "password", Reason: "looks like a hash, use password_hash"}
+		}
+		if len(record.Password) > 72 {
+			return models.User{}, &ValidationError{Field: "password", Reason: "must be at most 72 bytes"}
+		}
+	default:
+		return models.User{}, &ValidationError{Field: "password", Reason: "one of password or password_hash is required"}
+	}
+
+	user := models.NewUser(record.Username, record.PasswordHash)
+	if record.ID != "" {
+		id, err := primitive.ObjectIDFromHex(record.ID)
+		if err != nil {
+			return models.User{}, &ValidationError{Field: "id", Reason: err.Error()}
+		}
+		user.ID = id
+	}
+	user.Roles = record.Roles
+	user.Locked = record.Locked
+	if record.Status != "" {
+		user.Status = record.Status
+	}
+	user.Attributes = record.Attributes
+	return *user, nil
+}
+
+// ImportUsers reads the users of r and creates them, looking up and inserting them by batches.
+// The invalid rows are reported in the result and don't stop the import.
+// An error stops the import, the batches before it are written and counted in the result.
+func (u *UserService) ImportUsers(ctx context.Context, r io.Reader, opts ImportOptions) (result ImportResult, err error) {
+	ctx, span := tracing.Start(ctx, "UserService.ImportUsers")
+	defer tracing.End(span, &err)
+
+	result = ImportResult{DryRun: opts.DryRun, Errors: []RowError{}}
+	reader, err := newRecordReader(r, opts.Format)
+	if err != nil {
+		return result, err
+	}
+
+	// the first row of every username, a second one would conflict with it
+	seen := make(map[string]int)
+	batch := make([]importRow, 0, importBatchSize)
+	for {
+		record, row, err := reader.next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		var rowErr *RowError
+		if errors.As(err, &rowErr) {
+			result.Rows++
+			result.fail(rowErr.Row, rowErr.Username, rowErr.Reason)
+			continue
+		}
+		if err != nil {
+			return result, fmt.Errorf("read the import: %w", err)
+		}
+
+		result.Rows++
+		user, err := newImportedUser(record)
+		if err == nil {
+			err = u.attributes.validate(user.Attributes)
+		}
+		if err != nil {
+			result.fail(row, record.Username, err.Error())
+			continue
+		}
+		if first, ok := seen[user.Username]; ok {
+			result.fail(row, user.Username, fmt.Sprintf("same username as the row %d", first))
+			continue
+		}
+		seen[user.Username] = row
+
+		batch = append(batch, importRow{row: row, user: user, password: record.Password, fields: record.fields})
+		if len(batch) == importBatchSize {
+			if err := u.importBatch(ctx, batch, opts, &result); err != nil {
+				return result, err
+			}
+			batch = batch[:0]
+		}
+	}
+	if len(batch) > 0 {
+		if err := u.importBatch(ctx, batch, opts, &result); err != nil {
+			return result, err
+		}
+	}
+	return result, nil
+}
+
+// importBatch writes the rows of a batch, the existing users are looked up with one query
+// and the new ones are inserted with one query. The passwords of the rows written are hashed in parallel.
+func (u *UserService) importBatch(ctx context.Context, batch []importRow, opts ImportOptions, result *ImportResult) error {
+	usernames := make([]string, len(batch))
+	for i, row := range batch {
+		usernames[i] = row.user.Username
+	}
+	existing, err := u.FindUsers(ctx, usernames)
+	if err != nil {
+		return err
+	}
+
+	// the rows to write, the upserts first
+	write := make([]importRow, 0, len(batch))
+	upserts := 0
+	for _, row := range batch {
+		found, ok := existing[row.user.Username]
+		switch {
+		case !ok:
+			write = append(write, row)
+		case found.Deleted():
+			// the username is reserved until the deleted user is purged, whatever the mode
+			result.fail(row.row, row.user.Username, fmt.Sprintf("%s, the username of the deleted user %s", ErrConflict, found.ID.Hex()))
+		case opts.Mode == ImportSkipExisting:
+			result.Skipped++
+		case opts.Mode == ImportUpsert:
+			write = slices.Insert(write, upserts, row)
+			upserts++
+		default:
+			result.fail(row.row, row.user.Username, fmt.Sprintf("%s, id %s", ErrConflict, found.ID.Hex()))
+		}
+	}
+	if opts.DryRun {
+		result.Updated += upserts
+		result.Created += len(write) - upserts
+		return nil
+	}
+
+	hashErrs := hashPasswords(write)
+	for i, row := range write[:upserts] {
+		err := hashErrs[i]
+		if err == nil {
+			err = u.upsertUser(ctx, existing[row.user.Username], row)
+		}
+		if err != nil {
+			// ErrNotFound if the user was deleted since the lookup
+			var validationErr *ValidationError
+			if !errors.As(err, &validationErr) && !errors.Is(err, ErrNotFound) {
+				return err
+			}
+			result.fail(row.row, row.user.Username, err.Error())
+			continue
+		}
+		result.Updated++
+	}
+
+	users := make([]models.User, 0, len(write)-upserts)
+	created := make([]importRow, 0, len(write)-upserts)
+	for i, row := range write[upserts:] {
+		if err := hashErrs[upserts+i]; err != nil {
+			result.fail(row.row, row.user.Username, err.Error())
+			continue
+		}
+		users = append(users, row.user)
+		created = append(created, row)
+	}
+	if len(users) == 0 {
+		return nil
+	}
+
+	err = u.InsertUsers(ctx, users)
+	if err == nil {
+		result.Created += len(users)
+		return nil
+	}
+	if !models.IsDuplicateKey(err) {
+		return err
+	}
+
+	// another writer created some of the users since the lookup, and MongoDB may have inserted the others:
+	// find which ones are in and insert the missing ones one by one
+	for i, user := range users {
+		usernames[i] = user.Username
+	}
+	existing, err = u.FindUsers(ctx, usernames[:len(users)])
+	if err != nil {
+		return err
+	}
+	for _, row := range created {
+		if found, ok := existing[row.user.Username]; ok {
+			if found.ID == row.user.ID {
+				result.Created++
+			} else {
+				result.fail(row.row, row.user.Username, ErrConflict.Error())
+			}
+			continue
+		}
+		err := u.InsertUsers(ctx, []models.User{row.user})
+		if models.IsDuplicateKey(err) {
+			result.fail(row.row, row.user.Username, ErrConflict.Error())
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		result.Created++
+	}
+	return nil
+}
+
+// hashPasswords hashes the plain passwords of the rows on every CPU, bcrypt is slow,
+// and returns the error of each row
+func hashPasswords(rows []importRow) []error {
+	errs := make([]error, len(rows))
+	_ = Parallel(len(rows), func(i int) error {
+		errs[i] = rows[i].hashPassword()
+		return nil
+	})
+	return errs
+}
+
+// hashPassword hashes the plain password of the row, if it has one
+func (row *importRow) hashPassword() error {
+	if row.password == "" {
+		return nil
+	}
+	hashed, err := bcrypt.GenerateFromPassword([]byte(row.password), bcrypt.DefaultCost)
+	if err != nil {
+		return &ValidationError{Field: "password", Reason: err.Error()}
+	}
+	row.user.Password = string(hashed)
+	return nil
+}
+
+// Parallel calls fn with 0 to n-1 on GOMAXPROCS goroutines, and returns the first error
+func Parallel(n int, fn func(i int) error) error {
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		firstErr error
+	)
+	indexes := make(chan int)
+	for w := 0; w < min(runtime.GOMAXPROCS(0), n); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				if err := fn(i); err != nil {
+					mu.Lock()
+					if firstErr == nil {
+						firstErr = err
+					}
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+	for i := 0; i < n; i++ {
+		indexes <- i
+	}
+	close(indexes)
+	wg.Wait()
+	return firstErr
+}
+
+// upsertUser replaces the password of the existing user, as found, with the one of the row, and its roles, lock, status
+// and attributes with the ones of the row if they're among its fields; the others are kept.
+// The password of the row is already hashed.
+func (u *UserService) upsertUser(ctx context.Context, existing models.User, row importRow) error {
+	user := row.user
+	at := now()
+	fields := bson.M{"password": user.Password, "updated_at": at, "password_changed_at": at}
+	assignments := "password = ?, updated_at = ?, password_changed_at = ?"
+	args := []interface{}{user.Password, models.SQLTime(&at), models.SQLTime(&at)}
+	set := func(field string, value, column interface{}) {
+		fields[field] = value
+		assignments += ", " + field + " = ?"
+		args = append(args, column)
+	}
+	if row.fields["roles"] {
+		roles := user.Roles
+		if roles == nil {
+			// an empty array rather than null
+			roles = []string{}
+		}
+		set("roles", roles, strings.Join(roles, ","))
+	}
+	if row.fields["locked"] {
+		set("locked", user.Locked, user.Locked)
+	}
+	if row.fields["status"] {
+		set("status", user.Status, string(user.Status))
+	}
+	if row.fields["attributes"] {
+		set("attributes", user.Attributes, user.Attributes)
+	}
+	if err := u.changeUserFields(ctx, existing, fields, assignments, args...); err != nil || !row.fields["attributes"] {
+		return err
+	}
+	return u.reindexUser(ctx, user.Username)
+}
+
+// FindUsers returns the users with one of the usernames, by username, the deleted ones holding their username too
+func (u *UserService) FindUsers(ctx context.Context, usernames []string) (map[string]models.User, error) {
+	var query interface{}
+	if _, ok := u.Database.(*models.MySQL); ok {
+		args := make([]interface{}, len(usernames))
+		for i, username := range usernames {
+			args[i] = username
+		}
+		query = models.SQLQuery{
+			Statement: "SELECT " + userColumns + " FROM users WHERE username IN (" + placeholders(len(usernames)) + ")",
+			Args:      args,
+		}
+	} else {
+		// MongoDB, JSON file and memory
+		query = bson.M{"username": bson.M{"$in": usernames}}
+	}
+
+	found, err := u.Database.Read(ctx, query, func() interface{} { return &models.User{} })
+	if err != nil {
+		return nil, &StorageError{Op: "read", Err: err}
+	}
+	users := make(map[string]models.User, len(found))
+	for _, item := range found {
+		user, ok := item.(*models.User)
+		if !ok {
+			return nil, errors.New("type assertion failed")
+		}
+		users[user.Username] = *user
+	}
+	return users, nil
+}
+
+// InsertUsers inserts the users with one query.
+// The users without a status or times get the ones of a new user, in place.
+// The error matches models.IsDuplicateKey if one of the usernames exists, with a unique index.
+func (u *UserService) InsertUsers(ctx context.Context, users []models.User) error {
+	at := now()
+	for i := range users {
+		initLifecycle(&users[i], at)
+	}
+
+	var err error
+	if _, ok := u.Database.(*models.MySQL); ok {
+		args := make([]interface{}, 0, len(users)*(strings.Count(userColumns, ",")+1))
+		values := make([]string, len(users))
+		for i, user := range users {
+			values[i] = userPlaceholders
+			args = append(args, userArgs(user)...)
+		}
+		err = u.Database.Create(ctx, models.SQLQuery{
+			Statement: "INSERT INTO users (" + userColumns + ") VALUES " + strings.Join(values, ", "),
+			Args:      args,
+		})
+		if err == nil {
+			u.indexCreatedUsers(ctx, users...)
+		}
+	} else if _, ok := u.Database.(*models.MongoDB); ok {
+		// with the keys of the search index
+		documents := make([]interface{}, len(users))
+		for i, user := range users {
+			documents[i] = newIndexedUser(user)
+		}
+		err = u.Database.Create(ctx, documents)
+	} else {
+		// JSON file and memory
+		documents := make([]interface{}, len(users))
+		for i, user := range users {
+			documents[i] = user
+		}
+		err = u.Database.Create(ctx, documents)
+	}
+	// some users may be inserted even after an error, and cached as not found
+	u.cache.forget(ctx, users...)
+	if err != nil {
+		return &StorageError{Op: "create", Err: err}
+	}
+	return nil
+}
+
+// placeholders returns n comma-separated SQL placeholders
+func placeholders(n int) string {
+	return strings.TrimSuffix(strings.Repeat("?, ", n), ", ")
+}
+
+// ExportUsers writes every user with the password hash to w, reading them page by page in the order of their id.
+// The deleted users aren't written. It returns the number of users written.
+func (u *UserService) ExportUsers(ctx context.Context, w io.Writer, format Format) (n int, err error) {
+	ctx, span := tracing.Start(ctx, "UserService.ExportUsers")
+	defer tracing.End(span, &err)
+
+	// begin writes the header, once the first page is read so a failed read leaves w untouched
+	var begin, flush func() error
+	var write func(UserRecord) error
+	switch format {
+	case FormatCSV:
+		writer := csv.NewWriter(w)
+		begin = func() error {
+			return writer.Write([]string{"id", "username", "password_hash", "roles", "locked", "status"})
+		}
+		write = func(r UserRecord) error {
+			return writer.Write([]string{r.ID, r.Username, r.PasswordHash, strings.Join(r.Roles, ","), strconv.FormatBool(r.Locked), string(r.Status)})
+		}
+		flush = func() error {
+			writer.Flush()
+			return writer.Error()
+		}
+	case FormatNDJSON:
+		encoder := json.NewEncoder(w)
+		begin = func() error { return nil }
+		write = func(r UserRecord) error { return encoder.Encode(r) }
+		flush = func() error { return nil }
+	default:
+		return 0, &ValidationError{Field: "format", Reason: "must be csv or ndjson"}
+	}
+
+	after := primitive.NilObjectID
+	for {
+		users, err := u.UsersAfter(ctx, after, exportPageSize)
+		if err != nil {
+			return n, err
+		}
+		if after.IsZero() {
+			if err := begin(); err != nil {
+				return n, err
+			}
+		}
+		for _, user := range users {
+			if user.Deleted() {
+				continue
+			}
+			record := UserRecord{
+				ID:           user.ID.Hex(),
+				Username:     user.Username,
+				PasswordHash: user.Password,
+				Roles:        user.Roles,
+				Locked:       user.Locked,
+				Status:       user.CurrentStatus(),
+				Attributes:   user.Attributes,
+			}
+			if err := write(record); err != nil {
+				return n, err
+			}
+			n++
+		}
+		// one flush per page, so a large export is streamed
+		if err := flush(); err != nil {
+			return n, err
+		}
+		if len(users) < exportPageSize {
+			return n, nil
+		}
+		after = users[len(users)-1].ID
+	}
+}
+
+// UsersAfter returns at most limit users with an id greater than after, in the order of their id,
+// the deleted ones too so a migration copies them
+func (u *UserService) UsersAfter(ctx context.Context, after primitive.ObjectID, limit int) ([]models.User, error) {
+	var query interface{}
+	if _, ok := u.Database.(*models.MySQL); ok {
+		query = models.SQLQuery{
+			Statement: "SELECT " + userColumns + " FROM users WHERE id > ? ORDER BY id LIMIT ?",
+			Args:      []interface{}{after.Hex(), limit},
+		}
+	} else {
+		// MongoDB, JSON file and memory
+		query = models.MongoQuery{
+			Filter: bson.M{"_id": bson.M{"$gt": after}},
+			Sort:   bson.D{{Key: "_id", Value: 1}},
+			Limit:  int64(limit),
+		}
+	}
+
+	found, err := u.Database.Read(ctx, query, func() interface{} { return &models.User{} })
+	if err != nil {
+		return nil, &StorageError{Op: "read", Err: err}
+	}
+	users := make([]models.User, 0, len(found))
+	for _, item := range found {
+		user, ok := item.(*models.User)
+		if !ok {
+			return nil, errors.New("type assertion failed")
+		}
+		users = append(users, *user)
+	}
+	return users, nil
+}
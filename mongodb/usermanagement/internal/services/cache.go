@@ -0,0 +1,182 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"time"
+	"usermanagement/internal/cache"
+	"usermanagement/internal/config"
+	"usermanagement/internal/metrics"
+	"usermanagement/internal/models"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// UserCache is the read-through cache of SearchUserByUsername and SearchUserByID, in front of the user store.
+//
+// A user is cached under its username, and its id only points to the username:
+//
+//	user:<username> -> the user, or not found
+//	id:<id>         -> the username, or not found
+//
+// so a change of a user, known by its username, removes one key.
+// The errors of the cache are logged and the store is read instead, the cache never fails a request.
+// A nil *UserCache caches nothing.
+type UserCache struct {
+	cache cache.Cache
+	// name labels the metrics: lru or redis
+	name        string
+	ttl         time.Duration
+	negativeTTL time.Duration
+	logger      *slog.Logger
+}
+
+// redisCachePrefix is the prefix of the keys of the user cache in Redis
+const redisCachePrefix = "usermanagement:user-cache:"
+
+// NewUserCache returns the cache configured in cfg, nil if cfg.Backend is none
+func NewUserCache(cfg config.CacheConfig, redisCfg config.RedisConfig, logger *slog.Logger) (*UserCache, error) {
+	c := &UserCache{name: cfg.Backend, ttl: cfg.TTL, negativeTTL: cfg.NegativeTTL, logger: logger}
+	switch cfg.Backend {
+	case config.CacheLRU:
+		c.cache = cache.NewLRU(cfg.Size)
+	case config.CacheRedis:
+		client, err := cache.NewRedisClient(redisCfg.URL)
+		if err != nil {
+			return nil, err
+		}
+		c.cache = cache.NewRedis(client, redisCachePrefix)
+	default:
+		return nil, nil
+	}
+	return c, nil
+}
+
+func userKey(username string) string {
+	return "user:" + username
+}
+
+func idKey(id primitive.ObjectID) string {
+	return "id:" + id.Hex()
+}
+
+// cachedUser is the value of a key, not found if both fields are empty
+type cachedUser struct {
+	// User is the user of a username
+	User *models.User `json:"user,omitempty"`
+	// Username is the username of an id
+	Username string `json:"username,omitempty"`
+}
+
+// result returns the cached user of a username, ErrNotFound if it's cached as not found
+func (e cachedUser) result() (models.User, error) {
+	if e.User == nil {
+		return models.User{}, ErrNotFound
+	}
+	return *e.User, nil
+}
+
+// get returns the value of key, false on a miss or an error
+func (c *UserCache) get(ctx context.Context, key string) (cachedUser, bool) {
+	if c == nil {
+		return cachedUser{}, false
+	}
+	value, ok, err := c.cache.Get(ctx, key)
+	var entry cachedUser
+	if err == nil && ok {
+		err = json.Unmarshal(value, &entry)
+	}
+	switch {
+	case err != nil:
+		metrics.CacheLookups.WithLabelValues(c.name, metrics.CacheError).Inc()
+		c.logger.WarnContext(ctx, "read the user cache", slog.String("key", key), slog.Any("error", err))
+		return cachedUser{}, false
+	case !ok:
+		metrics.CacheLookups.WithLabelValues(c.name, metrics.CacheMiss).Inc()
+		return cachedUser{}, false
+	default:
+		metrics.CacheLookups.WithLabelValues(c.name, metrics.CacheHit).Inc()
+		return entry, true
+	}
+}
+
+// set caches entry under key, for the negative TTL if it's a not found
+func (c *UserCache) set(ctx context.Context, key string, entry cachedUser) {
+	ttl := c.ttl
+	if entry.User == nil && entry.Username == "" {
+		ttl = c.negativeTTL
+	}
+	if ttl <= 0 {
+		return
+	}
+	value, err := json.Marshal(entry)
+	if err == nil {
+		err = c.cache.Set(ctx, key, value, ttl)
+	}
+	if err != nil {
+		c.logger.WarnContext(ctx, "write the user cache", slog.String("key", key), slog.Any("error", err))
+	}
+}
+
+// byUsername returns the cached lookup of username, false if it isn't cached
+func (c *UserCache) byUsername(ctx context.Context, username string) (cachedUser, bool) {
+	return c.get(ctx, userKey(username))
+}
+
+// byID returns the cached lookup of id, false if it isn't cached
+func (c *UserCache) byID(ctx context.Context, id primitive.ObjectID) (cachedUser, bool) {
+	entry, ok := c.get(ctx, idKey(id))
+	if !ok || entry.Username == "" {
+		return cachedUser{}, ok
+	}
+	entry, ok = c.get(ctx, userKey(entry.Username))
+	if !ok || entry.User == nil || entry.User.ID != id {
+		// the user expired, or the username has another user now
+		return cachedUser{}, false
+	}
+	return entry, true
+}
+
+// store caches the result of a lookup in the store, a user or ErrNotFound.
+// The other errors aren't cached. The password hash is never cached, e.g. in a Redis server shared by other services.
+func (c *UserCache) store(ctx context.Context, key string, user models.User, err error) {
+	if c == nil {
+		return
+	}
+	switch {
+	case err == nil:
+		user.Password = ""
+		c.set(ctx, userKey(user.Username), cachedUser{User: &user})
+		c.set(ctx, idKey(user.ID), cachedUser{Username: user.Username})
+	case errors.Is(err, ErrNotFound):
+		c.set(ctx, key, cachedUser{})
+	}
+}
+
+// forget removes the cached lookups of the users, after they are created or changed
+func (c *UserCache) forget(ctx context.Context, users ...models.User) {
+	if c == nil || len(users) == 0 {
+		return
+	}
+	keys := make([]string, 0, 2*len(users))
+	for _, user := range users {
+		keys = append(keys, userKey(user.Username))
+		if !user.ID.IsZero() {
+			keys = append(keys, idKey(user.ID))
+		}
+	}
+	if err := c.cache.Delete(ctx, keys...); err != nil {
+		// the users are seen again after the TTL
+		c.logger.ErrorContext(ctx, "invalidate the user cache", slog.Any("keys", keys), slog.Any("error", err))
+	}
+}
+
+// Close closes the connections of the cache, if any
+func (c *UserCache) Close() error {
+	if c == nil {
+		return nil
+	}
+	return c.cache.Close()
+}
@@ -0,0 +1,247 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"usermanagement/internal/config"
+	"usermanagement/internal/models"
+	"usermanagement/internal/tracing"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// tombstonePrefix starts the tombstones, no user can register such a username
+const tombstonePrefix = "deleted:"
+
+// tombstone returns the username replacing the one of a deleted user when its username is freed,
+// unique like the ids
+func tombstone(id primitive.ObjectID) string {
+	return tombstonePrefix + id.Hex()
+}
+
+// ValidateUsername checks the username of a new user: it can't be empty nor look like a tombstone,
+// which would take the username of a user deleted later
+func ValidateUsername(username string) error {
+	if username == "" {
+		return &ValidationError{Field: "username", Reason: "must not be empty"}
+	}
+	if strings.HasPrefix(username, tombstonePrefix) {
+		return &ValidationError{Field: "username", Reason: fmt.Sprintf("must not start with %q", tombstonePrefix)}
+	}
+	return nil
+}
+
+// nullString is the argument of a nullable VARCHAR column, NULL for an empty string
+func nullString(s string) interface{} {
+	if s == "" {
+		return nil
+	}
+	return s
+}
+
+// DeleteUser deletes the user of id softly: it's hidden from the lookups and the list of the users
+// until it's restored by RestoreUser, or purged by PurgeDeletedUsers after the grace period.
+// With the free username policy its username is replaced by a tombstone, so it can be registered at once.
+// It returns the deleted user, ErrNotFound if there's none or it's already deleted.
+func (u *UserService) DeleteUser(ctx context.Context, id string) (_ models.User, err error) {
+	ctx, span := tracing.Start(ctx, "UserService.DeleteUser")
+	defer tracing.End(span, &err)
+
+	objectID, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return models.User{}, &ValidationError{Field: "id", Reason: err.Error()}
+	}
+	user, err := u.findUserByID(ctx, objectID)
+	if err != nil {
+		return models.User{}, err
+	}
+
+	at := now()
+	fields := bson.M{"deleted_at": at}
+	assignments := "deleted_at = ?"
+	args := []interface{}{models.SQLTime(&at)}
+	if u.deletion.Username == config.UsernameFree {
+		fields["username"] = tombstone(user.ID)
+		fields["deleted_username"] = user.Username
+		assignments += ", username = ?, deleted_username = ?"
+		args = append(args, tombstone(user.ID), user.Username)
+	}
+	if err := u.changeUserFields(ctx, user, fields, assignments, args...); err != nil {
+		return models.User{}, err
+	}
+
+	user.DeletedAt = &at
+	user.Version++
+	return user, nil
+}
+
+// RestoreUser restores the deleted user of id, with its username.
+// It returns the restored user, ErrNotFound if there's no user of id or it was restored or purged meanwhile,
+// ErrNotDeleted if it isn't deleted,
+// ErrRestoreExpired after the grace period and ErrConflict if its freed username was registered meanwhile.
+func (u *UserService) RestoreUser(ctx context.Context, id string) (_ models.User, err error) {
+	ctx, span := tracing.Start(ctx, "UserService.RestoreUser")
+	defer tracing.End(span, &err)
+
+	objectID, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return models.User{}, &ValidationError{Field: "id", Reason: err.Error()}
+	}
+	user, err := u.findAnyUserByID(ctx, objectID)
+	if err != nil {
+		return models.User{}, err
+	}
+	if !user.Deleted() {
+		return models.User{}, ErrNotDeleted
+	}
+	if now().Sub(*user.DeletedAt) > u.deletion.GracePeriod {
+		return models.User{}, ErrRestoreExpired
+	}
+
+	// only while it's still deleted: a concurrent restore, or a delete and a restore, must not be overwritten
+	username := user.OriginalUsername()
+	var restored bool
+	if _, ok := u.Database.(*models.MySQL); ok {
+		restored, err = u.Database.CompareAndSwap(ctx, models.SQLQuery{
+			Statement: "UPDATE users SET deleted_at = NULL, deleted_username = NULL, username = ?, version = version + 1 WHERE id = ? AND deleted_at IS NOT NULL",
+			Args:      []interface{}{username, user.ID.Hex()},
+		}, nil)
+	} else {
+		// MongoDB, JSON file and memory
+		update := bson.M{
+			"$unset": bson.M{"deleted_at": "", "deleted_username": ""},
+			"$inc":   bson.M{"version": 1},
+		}
+		// only a freed username is set back: FerretDB may skip an update with a $set of the same value
+		if user.Username != username {
+			update["$set"] = bson.M{"username": username}
+		}
+		restored, err = u.Database.CompareAndSwap(ctx, bson.M{"_id": user.ID, "deleted_at": bson.M{"$ne": nil}}, update)
+	}
+	// the username and the id may be cached as not found
+	user.Username = username
+	u.cache.forget(ctx, user)
+	if models.IsDuplicateKey(err) {
+		return models.User{}, ErrConflict
+	}
+	if err != nil {
+		return models.User{}, &StorageError{Op: "update", Err: err}
+	}
+	if !restored {
+		return models.User{}, ErrNotFound
+	}
+
+	user.DeletedAt, user.DeletedUsername = nil, ""
+	user.Version++
+	return user, nil
+}
+
+// DeletedUsers returns the deleted users not purged yet, the recently deleted first
+func (u *UserService) DeletedUsers(ctx context.Context) (_ []models.User, err error) {
+	ctx, span := tracing.Start(ctx, "UserService.DeletedUsers")
+	defer tracing.End(span, &err)
+
+	var query interface{}
+	if _, ok := u.Database.(*models.MySQL); ok {
+		query = "SELECT " + userColumns + " FROM users WHERE deleted_at IS NOT NULL ORDER BY deleted_at DESC"
+	} else {
+		// MongoDB, JSON file and memory
+		query = models.MongoQuery{
+			Filter: bson.M{"deleted_at": bson.M{"$ne": nil}},
+			Sort:   bson.D{{Key: "deleted_at", Value: -1}},
+		}
+	}
+	return u.readUsers(ctx, query)
+}
+
+// PurgeDeletedUsers removes for good the users deleted for longer than the grace period, with CURDInterface.Delete.
+// It returns the purged users.
+func (u *UserService) PurgeDeletedUsers(ctx context.Context) (_ []models.User, err error) {
+	ctx, span := tracing.Start(ctx, "UserService.PurgeDeletedUsers")
+	defer tracing.End(span, &err)
+
+	before := now().Add(-u.deletion.GracePeriod)
+	var query interface{}
+	if _, ok := u.Database.(*models.MySQL); ok {
+		query = models.SQLQuery{Statement: "SELECT " + userColumns + " FROM users WHERE deleted_at < ?", Args: []interface{}{models.SQLTime(&before)}}
+	} else {
+		// MongoDB, JSON file and memory
+		query = bson.M{"deleted_at": bson.M{"$lt": before}}
+	}
+	users, err := u.readUsers(ctx, query)
+	if err != nil || len(users) == 0 {
+		return nil, err
+	}
+
+	// only the users read, and only if they are still deleted: a user restored meanwhile isn't purged,
+	// and the users deleted meanwhile are purged by the next purge
+	var filter, trigrams interface{}
+	if _, ok := u.Database.(*models.MySQL); ok {
+		args := make([]interface{}, 0, len(users)+1)
+		for _, user := range users {
+			args = append(args, user.ID.Hex())
+		}
+		args = append(args, models.SQLTime(&before))
+		where := "WHERE id IN (" + placeholders(len(users)) + ") AND deleted_at < ?"
+		filter = models.SQLQuery{Statement: "DELETE FROM users " + where, Args: args}
+		// the search index first, it's found by the users
+		trigrams = models.SQLQuery{
+			Statement: "DELETE FROM user_trigrams WHERE user_id IN (SELECT id FROM users " + where + ")",
+			Args:      args,
+		}
+	} else {
+		ids := make([]primitive.ObjectID, 0, len(users))
+		for _, user := range users {
+			ids = append(ids, user.ID)
+		}
+		filter = bson.M{"_id": bson.M{"$in": ids}, "deleted_at": bson.M{"$lt": before}}
+	}
+	if trigrams != nil {
+		if err := u.Database.Delete(ctx, trigrams); err != nil {
+			return nil, &StorageError{Op: "delete", Err: err}
+		}
+	}
+	if err := u.Database.Delete(ctx, filter); err != nil {
+		return nil, &StorageError{Op: "delete", Err: err}
+	}
+	return users, nil
+}
+
+// findAnyUserByID reads the user of id in the store, deleted or not
+func (u *UserService) findAnyUserByID(ctx context.Context, objectID primitive.ObjectID) (models.User, error) {
+	var query interface{}
+	if _, ok := u.Database.(*models.MySQL); ok {
+		query = models.SQLQuery{Statement: "SELECT " + userColumns + " FROM users WHERE id = ?", Args: []interface{}{objectID.Hex()}}
+	} else {
+		// MongoDB, JSON file and memory
+		query = bson.M{"_id": objectID}
+	}
+	users, err := u.readUsers(ctx, query)
+	if err != nil {
+		return models.User{}, err
+	}
+	if len(users) == 0 {
+		return models.User{}, ErrNotFound
+	}
+	return users[0], nil
+}
+
+// readUsers reads the users of query
+func (u *UserService) readUsers(ctx context.Context, query interface{}) ([]models.User, error) {
+	found, err := u.Database.Read(ctx, query, func() interface{} { return &models.User{} })
+	if err != nil {
+		return nil, &StorageError{Op: "read", Err: err}
+	}
+	users := make([]models.User, 0, len(found))
+	for _, item := range found {
+		user, ok := item.(*models.User)
+		if !ok {
+			return nil, errors.New("type assertion failed")
+		}
+		users = append(users, *user)
+	}
+	return users, nil
+}
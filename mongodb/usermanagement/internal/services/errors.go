@@ -0,0 +1,67 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"usermanagement/internal/models"
+)
+
+// Sentinel errors returned by UserService. Callers should compare with errors.Is,
+// since the service may wrap them with more context.
+var (
+	// ErrNotFound is returned when the requested user doesn't exist
+	ErrNotFound = errors.New("not found")
+	// ErrConflict is returned when a user with the same username already exists
+	ErrConflict = errors.New("user already exist")
+	// ErrInvalidCredentials is returned when the username or password doesn't match
+	ErrInvalidCredentials = errors.New("invalid username or password")
+	// ErrLocked is returned when a locked user logs in with the right password
+	ErrLocked = errors.New("account locked")
+	// ErrInactive is returned when a user that isn't active logs in with the right password,
+	// wrapped with the status by InactiveError
+	ErrInactive = errors.New("account not active")
+	// ErrNotDeleted is returned when a user that isn't deleted is restored
+	ErrNotDeleted = errors.New("user not deleted")
+	// ErrVersionMismatch is returned when a user is updated from another version than its current one,
+	// it was changed meanwhile
+	ErrVersionMismatch = errors.New("user changed since it was read")
+	// ErrRestoreExpired is returned when a user is restored after the grace period, it's about to be purged
+	ErrRestoreExpired = errors.New("restore period expired")
+	// ErrUnavailable is returned when the database cannot serve the request
+	ErrUnavailable = errors.New("database unavailable")
+)
+
+// InactiveError returns ErrInactive with the status of the user, e.g. "account not active: suspended"
+func InactiveError(status models.UserStatus) error {
+	return fmt.Errorf("%w: %s", ErrInactive, status)
+}
+
+// ValidationError reports an invalid input from the client, e.g. an empty username
+// or a malformed id.
+type ValidationError struct {
+	Field  string
+	Reason string
+}
+
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("invalid %s: %s", e.Field, e.Reason)
+}
+
+// StorageError wraps an error returned by the database.
+// It matches ErrUnavailable with errors.Is, and unwraps to the original error.
+type StorageError struct {
+	Op  string
+	Err error
+}
+
+func (e *StorageError) Error() string {
+	return fmt.Sprintf("%s: %s: %v", ErrUnavailable, e.Op, e.Err)
+}
+
+func (e *StorageError) Unwrap() error {
+	return e.Err
+}
+
+func (e *StorageError) Is(target error) bool {
+	return target == ErrUnavailable
+}
@@ -0,0 +1,122 @@
+package services
+
+import (
+	"context"
+	"strings"
+	"time"
+	"usermanagement/internal/filter"
+	"usermanagement/internal/models"
+	"usermanagement/internal/tracing"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// userAttributes are the attributes of the users in the filters, by lower-case name
+var userAttributes = map[string]filter.Attribute{
+	"username": {Type: filter.String, Path: "username", Column: "username",
+		Value: func(item interface{}) interface{} { return item.(*models.User).Username }},
+	"status": {Type: filter.String, Path: "status", Column: "status", Default: string(models.StatusActive),
+		Value: func(item interface{}) interface{} { return string(item.(*models.User).Status) }},
+	"locked": {Type: filter.Boolean, Path: "locked", Column: "locked",
+		Value: func(item interface{}) interface{} { return item.(*models.User).Locked }},
+	"roles": {Type: filter.Strings, Path: "roles", Column: "roles",
+		Value: func(item interface{}) interface{} { return item.(*models.User).Roles }},
+	"version": {Type: filter.Number, Path: "version", Column: "version",
+		Value: func(item interface{}) interface{} { return float64(item.(*models.User).Version) }},
+	"createdat": {Type: filter.DateTime, Path: "created_at", Column: "created_at",
+		Value: func(item interface{}) interface{} { return item.(*models.User).CreatedAt }},
+	"updatedat": {Type: filter.DateTime, Path: "updated_at", Column: "updated_at",
+		Value: func(item interface{}) interface{} { return item.(*models.User).UpdatedAt }},
+	"lastloginat": {Type: filter.DateTime, Path: "last_login_at", Column: "last_login_at",
+		Value: func(item interface{}) interface{} { return timeValue(item.(*models.User).LastLoginAt) }},
+	"passwordchangedat": {Type: filter.DateTime, Path: "password_changed_at", Column: "password_changed_at",
+		Value: func(item interface{}) interface{} { return timeValue(item.(*models.User).PasswordChangedAt) }},
+}
+
+// timeValue returns the value of an optional time, nil if it's missing
+func timeValue(t *time.Time) interface{} {
+	if t == nil {
+		return nil
+	}
+	return *t
+}
+
+// attributesPrefix prefixes the custom attributes in the filters, e.g. attributes.department
+const attributesPrefix = "attributes."
+
+// filterAttribute returns the attribute of name in the filters: one of userAttributes,
+// or a custom attribute declared by the schema with a type string, integer, number or boolean
+func (u *UserService) filterAttribute(name string) (filter.Attribute, bool) {
+	if attribute, ok := userAttributes[strings.ToLower(name)]; ok {
+		return attribute, true
+	}
+	if len(name) <= len(attributesPrefix) || !strings.EqualFold(name[:len(attributesPrefix)], attributesPrefix) {
+		return filter.Attribute{}, false
+	}
+	name = name[len(attributesPrefix):]
+	property := u.attributes.property(name)
+	if property == nil {
+		return filter.Attribute{}, false
+	}
+	attribute := filter.Attribute{
+		Path:     attributesPrefix + name,
+		Column:   "attributes",
+		JSONPath: "$." + name,
+		Value:    func(item interface{}) interface{} { return item.(*models.User).Attributes[name] },
+	}
+	for _, t := range property.Types {
+		switch t {
+		case "string":
+			attribute.Type = filter.String
+			return attribute, true
+		case "integer", "number":
+			attribute.Type = filter.Number
+			return attribute, true
+		case "boolean":
+			attribute.Type = filter.Boolean
+			return attribute, true
+		}
+	}
+	return filter.Attribute{}, false
+}
+
+// FilterUsers returns the users matching a filter expression, in the syntax of the SCIM filters,
+// e.g. status eq "active" and createdAt gt "2026-01-01", all of them for an empty one. A deleted user isn't found.
+// The filter is compiled into a MongoDB filter or a SQL condition, and matched in memory for the JSON file and the memory store.
+// An invalid filter is a ValidationError with the position of the offending token.
+func (u *UserService) FilterUsers(ctx context.Context, expression string) (_ []models.User, err error) {
+	ctx, span := tracing.Start(ctx, "UserService.FilterUsers")
+	defer tracing.End(span, &err)
+
+	if strings.TrimSpace(expression) == "" {
+		return u.GetAllUsers(ctx)
+	}
+	parsed, err := filter.Parse(expression, u.filterAttribute)
+	if err != nil {
+		return nil, &ValidationError{Field: "filter", Reason: err.Error()}
+	}
+
+	switch u.Database.(type) {
+	case *models.MySQL:
+		condition, args := parsed.SQL()
+		return u.readUsers(ctx, models.SQLQuery{
+			Statement: "SELECT " + userColumns + " FROM users WHERE deleted_at IS NULL AND " + condition,
+			Args:      args,
+		})
+	case *models.MongoDB:
+		return u.readUsers(ctx, bson.M{"$and": bson.A{bson.M{"deleted_at": nil}, parsed.BSON()}})
+	default:
+		// JSON file and memory
+		users, err := u.readUsers(ctx, bson.M{"deleted_at": nil})
+		if err != nil {
+			return nil, err
+		}
+		matched := make([]models.User, 0, len(users))
+		for i := range users {
+			if parsed.Match(&users[i]) {
+				matched = append(matched, users[i])
+			}
+		}
+		return matched, nil
+	}
+}
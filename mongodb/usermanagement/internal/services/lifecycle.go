@@ -0,0 +1,66 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"time"
+	"usermanagement/internal/models"
+	"usermanagement/internal/tracing"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// now returns the time of a change, to the millisecond like MongoDB and the DATETIME(3) columns
+func now() time.Time {
+	return time.Now().UTC().Truncate(time.Millisecond)
+}
+
+// initLifecycle sets the status and the times of a new user, the ones it doesn't have yet,
+// e.g. a user copied from another store keeps its own
+func initLifecycle(user *models.User, at time.Time) {
+	if user.Status == "" {
+		user.Status = models.StatusActive
+	}
+	if user.CreatedAt.IsZero() {
+		user.CreatedAt = at
+	}
+	if user.UpdatedAt.IsZero() {
+		user.UpdatedAt = user.CreatedAt
+	}
+	if user.PasswordChangedAt == nil && user.Password != "" {
+		changed := user.CreatedAt
+		user.PasswordChangedAt = &changed
+	}
+}
+
+// ValidateStatus checks a status given by a client, empty for the default one
+func ValidateStatus(status models.UserStatus) error {
+	if status != "" && !status.Valid() {
+		return &ValidationError{Field: "status", Reason: fmt.Sprintf("%q must be pending, active, suspended or deactivated", status)}
+	}
+	return nil
+}
+
+// SetStatus changes the status of the user, only the active users can log in
+func (u *UserService) SetStatus(ctx context.Context, username string, status models.UserStatus) (err error) {
+	ctx, span := tracing.Start(ctx, "UserService.SetStatus")
+	defer tracing.End(span, &err)
+
+	if status == "" {
+		return &ValidationError{Field: "status", Reason: "must not be empty"}
+	}
+	if err := ValidateStatus(status); err != nil {
+		return err
+	}
+	return u.updateUser(ctx, username, now(), bson.M{"status": status}, "status = ?", string(status))
+}
+
+// RecordLogin sets the time of the last login of the user, as found by the login, after a successful login.
+// It isn't a change of the user, its UpdatedAt is kept.
+func (u *UserService) RecordLogin(ctx context.Context, user models.User) (err error) {
+	ctx, span := tracing.Start(ctx, "UserService.RecordLogin")
+	defer tracing.End(span, &err)
+
+	at := now()
+	return u.setUserFields(ctx, user, bson.M{"last_login_at": at}, "last_login_at = ?", models.SQLTime(&at))
+}
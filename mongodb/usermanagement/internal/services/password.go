@@ -0,0 +1,119 @@
+package services
+
+import (
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// The limits of the argon2 parameters accepted in an imported hash,
+// so a crafted hash can't make every login of the user use gigabytes of memory
+const (
+	maxArgon2Memory  = 1 << 20 // KiB, 1 GiB
+	maxArgon2Time    = 16
+	maxArgon2Threads = 64
+)
+
+// ErrPasswordMismatch is returned by ComparePassword when the password doesn't match the hash
+var ErrPasswordMismatch = errors.New("password doesn't match")
+
+// argon2Hash is a hash in the PHC string format, e.g. $argon2id$v=19$m=65536,t=3,p=4$<salt>$<key>
+type argon2Hash struct {
+	variant string
+	memory  uint32
+	time    uint32
+	threads uint8
+	salt    []byte
+	key     []byte
+}
+
+// IsArgon2Hash tells whether hash is an argon2i or argon2id hash rather than a bcrypt one
+func IsArgon2Hash(hash string) bool {
+	return strings.HasPrefix(hash, "$argon2")
+}
+
+// ValidatePasswordHash checks that hash is a bcrypt hash or an argon2i or argon2id hash in the PHC string format,
+// the hashes ComparePassword can check
+func ValidatePasswordHash(hash string) error {
+	if IsArgon2Hash(hash) {
+		_, err := parseArgon2Hash(hash)
+		return err
+	}
+	if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+		return errors.New("not a bcrypt or argon2 hash")
+	}
+	return nil
+}
+
+// ComparePassword compares password with a hash accepted by ValidatePasswordHash.
+// It returns ErrPasswordMismatch if they don't match.
+func ComparePassword(hash, password string) error {
+	if !IsArgon2Hash(hash) {
+		err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+		if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+			return ErrPasswordMismatch
+		}
+		return err
+	}
+
+	h, err := parseArgon2Hash(hash)
+	if err != nil {
+		return err
+	}
+	var key []byte
+	if h.variant == "argon2id" {
+		key = argon2.IDKey([]byte(password), h.salt, h.time, h.memory, h.threads, uint32(len(h.key)))
+	} else {
+		key = argon2.Key([]byte(password), h.salt, h.time, h.memory, h.threads, uint32(len(h.key)))
+	}
+	if subtle.ConstantTimeCompare(key, h.key) != 1 {
+		return ErrPasswordMismatch
+	}
+	return nil
+}
+
+func parseArgon2Hash(hash string) (argon2Hash, error) {
+	var h argon2Hash
+	invalid := func(reason string) (argon2Hash, error) {
+		return argon2Hash{}, fmt.Errorf("invalid argon2 hash: %s", reason)
+	}
+
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 || parts[0] != "" {
+		return invalid("expected $<variant>$v=<version>$m=<memory>,t=<time>,p=<threads>$<salt>$<key>")
+	}
+
+	h.variant = parts[1]
+	if h.variant != "argon2id" && h.variant != "argon2i" {
+		return invalid("only argon2id and argon2i are supported")
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return invalid(fmt.Sprintf("only the version %d is supported", argon2.Version))
+	}
+
+	var threads uint32
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &h.memory, &h.time, &threads); err != nil {
+		return invalid("malformed parameters")
+	}
+	if h.memory == 0 || h.memory > maxArgon2Memory || h.time == 0 || h.time > maxArgon2Time ||
+		threads == 0 || threads > maxArgon2Threads {
+		return invalid("parameters out of range")
+	}
+	h.threads = uint8(threads)
+
+	var err error
+	if h.salt, err = base64.RawStdEncoding.DecodeString(parts[4]); err != nil || len(h.salt) < 8 {
+		return invalid("malformed salt")
+	}
+	if h.key, err = base64.RawStdEncoding.DecodeString(parts[5]); err != nil || len(h.key) < 16 {
+		return invalid("malformed key")
+	}
+	return h, nil
+}
@@ -0,0 +1,486 @@
+package services
+
+import (
+	"context"
+	"html"
+	"log/slog"
+	"sort"
+	"strings"
+	"unicode"
+	"usermanagement/internal/models"
+	"usermanagement/internal/tracing"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// The limits of SearchUsers
+const (
+	DefaultSearchLimit = 20
+	MaxSearchLimit     = 100
+	// maxSearchQuery is the longest query, in characters
+	maxSearchQuery = 100
+	// trigramBatchSize is the number of trigrams written by one INSERT into user_trigrams
+	trigramBatchSize = 500
+	// maxSearchCandidates is the number of users read by a search from MySQL or MongoDB to be ranked,
+	// the ones sharing the most trigrams with the query
+	maxSearchCandidates = 500
+)
+
+// searchIndex is the name of the trigram index of the users, the field of the MongoDB documents and the index of the memory stores
+const searchIndex = "search_trigrams"
+
+// searchColumns are the userColumns read by a search, without the password hash
+var searchColumns = strings.Replace(userColumns, "password,", "'' AS password,", 1)
+
+// searchFields are the fields matched by SearchUsers: the username and the custom attributes display_name and email
+var searchFields = []string{"username", "display_name", "email"}
+
+// SearchResult is a user found by SearchUsers
+type SearchResult struct {
+	User models.User `json:"user"`
+	// Score ranks the results: 1 for an exact match, then a prefix, a substring, and the words with typos
+	Score float64 `json:"score"`
+	// Field is the field of the best match: username, display_name or email
+	Field string `json:"field"`
+	// Highlight is the value of Field, HTML-escaped, with the matched parts between <em> and </em>
+	Highlight string `json:"highlight"`
+}
+
+// searchValues returns the values of the searchFields of user, by field, the missing ones empty
+func searchValues(user models.User) []string {
+	values := []string{user.OriginalUsername(), "", ""}
+	for i, field := range searchFields[1:] {
+		if value, ok := user.Attributes[field].(string); ok {
+			values[i+1] = value
+		}
+	}
+	return values
+}
+
+// lowerRunes returns the runes of s in lower case, one for one, so the positions are the ones of s
+func lowerRunes(s string) []rune {
+	runes := []rune(s)
+	for i, r := range runes {
+		runes[i] = unicode.ToLower(r)
+	}
+	return runes
+}
+
+// span is a range of runes, from start to end excluded
+type span struct {
+	start, end int
+}
+
+// wordSpans returns the words of runes, the runs of letters and digits
+func wordSpans(runes []rune) []span {
+	var words []span
+	start := -1
+	for i, r := range runes {
+		inWord := unicode.IsLetter(r) || unicode.IsNumber(r)
+		switch {
+		case inWord && start < 0:
+			start = i
+		case !inWord && start >= 0:
+			words = append(words, span{start, i})
+			start = -1
+		}
+	}
+	if start >= 0 {
+		words = append(words, span{start, len(runes)})
+	}
+	return words
+}
+
+// addTrigrams adds the trigrams of word to set. The word is padded like in pg_trgm, two spaces before
+// and one after, so its prefixes and the words shorter than 3 characters have trigrams too.
+func addTrigrams(set map[string]struct{}, word []rune) {
+	padded := append(append([]rune("  "), word...), ' ')
+	for i := 0; i+3 <= len(padded); i++ {
+		set[string(padded[i:i+3])] = struct{}{}
+	}
+}
+
+// trigrams returns the trigrams of the words of values, sorted
+func trigrams(values ...string) []string {
+	set := make(map[string]struct{})
+	for _, value := range values {
+		runes := lowerRunes(value)
+		for _, word := range wordSpans(runes) {
+			addTrigrams(set, runes[word.start:word.end])
+		}
+	}
+	keys := make([]string, 0, len(set))
+	for key := range set {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// minSharedTrigrams returns the fewest trigrams of the query shared by any user it matches, at least 1.
+// A word of the query in a substring keeps its trigrams but the padded ones,
+// and a typo changes at most 4 of its trigrams, for a transposition.
+func minSharedTrigrams(query []rune) int {
+	shared := 1
+	for _, word := range wordSpans(query) {
+		runes := query[word.start:word.end]
+		inner := make(map[string]struct{})
+		for i := 0; i+3 <= len(runes); i++ {
+			inner[string(runes[i:i+3])] = struct{}{}
+		}
+		padded := make(map[string]struct{})
+		addTrigrams(padded, runes)
+		shared = max(shared, min(len(inner), len(padded)-4*typos(runes)))
+	}
+	return shared
+}
+
+// searchCandidate is a user sharing trigrams with the query, as grouped by MongoDB
+type searchCandidate struct {
+	ID primitive.ObjectID `bson:"_id"`
+}
+
+// searchTrigrams returns the keys of user in the search index, the trigrams of its searchFields
+func searchTrigrams(user models.User) []string {
+	return trigrams(searchValues(user)...)
+}
+
+// typos returns the number of typos tolerated in a word, like the AUTO fuzziness of Elasticsearch:
+// none up to 2 characters, 1 up to 5, else 2
+func typos(word []rune) int {
+	switch {
+	case len(word) <= 2:
+		return 0
+	case len(word) <= 5:
+		return 1
+	default:
+		return 2
+	}
+}
+
+// editDistance returns the optimal string alignment distance of a and b: the insertions, deletions,
+// substitutions and transpositions of two adjacent characters
+func editDistance(a, b []rune) int {
+	d := make([][]int, len(a)+1)
+	for i := range d {
+		d[i] = make([]int, len(b)+1)
+		d[i][0] = i
+	}
+	for j := range d[0] {
+		d[0][j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			d[i][j] = min(d[i-1][j]+1, d[i][j-1]+1, d[i-1][j-1]+cost)
+			if i > 1 && j > 1 && a[i-1] == b[j-2] && a[i-2] == b[j-1] {
+				d[i][j] = min(d[i][j], d[i-2][j-2]+1)
+			}
+		}
+	}
+	return d[len(a)][len(b)]
+}
+
+// indexRunes returns the position of sub in runes, -1 if it's not in it
+func indexRunes(runes, sub []rune) int {
+	for i := 0; i+len(sub) <= len(runes); i++ {
+		if string(runes[i:i+len(sub)]) == string(sub) {
+			return i
+		}
+	}
+	return -1
+}
+
+// match scores value against the query, in lower case, and returns the matched spans of value.
+// The whole query is matched first, then each of its words, the last one as a prefix,
+// with the typos of its length; every word must match.
+func match(value string, query []rune) (float64, []span) {
+	runes := lowerRunes(value)
+	if len(runes) == 0 {
+		return 0, nil
+	}
+	if i := indexRunes(runes, query); i >= 0 {
+		matched := []span{{i, i + len(query)}}
+		switch {
+		case len(query) == len(runes):
+			return 1, matched
+		case i == 0:
+			return 0.9, matched
+		default:
+			return 0.8, matched
+		}
+	}
+
+	queryWords := wordSpans(query)
+	valueWords := wordSpans(runes)
+	if len(queryWords) == 0 {
+		return 0, nil
+	}
+	var total float64
+	var matched []span
+	for n, q := range queryWords {
+		queryWord := query[q.start:q.end]
+		last := n == len(queryWords)-1
+		best, bestSpan := 0.0, span{}
+		for _, v := range valueWords {
+			valueWord := runes[v.start:v.end]
+			score := 0.0
+			if string(valueWord) == string(queryWord) {
+				score = 1
+			} else if last && len(valueWord) > len(queryWord) && string(valueWord[:len(queryWord)]) == string(queryWord) {
+				score = 0.9
+			} else if d := editDistance(queryWord, valueWord); d <= typos(queryWord) {
+				score = 1 - 0.2*float64(d)
+			}
+			if score > best {
+				best, bestSpan = score, v
+			}
+		}
+		if best == 0 {
+			return 0, nil
+		}
+		total += best
+		matched = append(matched, bestSpan)
+	}
+	// below the matches of the whole query
+	return 0.7 * total / float64(len(queryWords)), matched
+}
+
+// highlight returns value, HTML-escaped, with the spans between <em> and </em>
+func highlight(value string, spans []span) string {
+	runes := []rune(value)
+	sort.Slice(spans, func(i, j int) bool { return spans[i].start < spans[j].start })
+	var b strings.Builder
+	at := 0
+	for _, s := range spans {
+		if s.start < at {
+			// the same word matched twice
+			continue
+		}
+		b.WriteString(html.EscapeString(string(runes[at:s.start])))
+		b.WriteString("<em>" + html.EscapeString(string(runes[s.start:s.end])) + "</em>")
+		at = s.end
+	}
+	b.WriteString(html.EscapeString(string(runes[at:])))
+	return b.String()
+}
+
+// rank returns the result of user for the query, in lower case, with a zero score if it doesn't match
+func rank(user models.User, query []rune) SearchResult {
+	result := SearchResult{User: user}
+	for i, value := range searchValues(user) {
+		score, spans := match(value, query)
+		if score > result.Score {
+			result.Score = score
+			result.Field = searchFields[i]
+			result.Highlight = highlight(value, spans)
+		}
+	}
+	return result
+}
+
+// SearchUsers returns the users whose username, display_name or email attributes match q, at most limit of them,
+// the best matches first. A match is a prefix, a substring of 3 characters or more, or words with a few typos.
+// The candidates are found by the trigram index of the backend and ranked here, without their password hash:
+// in MySQL and MongoDB the maxSearchCandidates users sharing the most trigrams with q. A deleted user isn't found.
+func (u *UserService) SearchUsers(ctx context.Context, q string, limit int) (_ []SearchResult, err error) {
+	ctx, span := tracing.Start(ctx, "UserService.SearchUsers")
+	defer tracing.End(span, &err)
+
+	query := lowerRunes(strings.TrimSpace(q))
+	if len(query) > maxSearchQuery {
+		return nil, &ValidationError{Field: "q", Reason: "must be at most 100 characters"}
+	}
+	keys := trigrams(string(query))
+	if len(keys) == 0 {
+		return nil, &ValidationError{Field: "q", Reason: "must have a letter or a digit"}
+	}
+	if limit == 0 {
+		limit = DefaultSearchLimit
+	}
+	if limit < 0 || limit > MaxSearchLimit {
+		return nil, &ValidationError{Field: "limit", Reason: "must be between 1 and 100"}
+	}
+
+	// the candidates must share enough trigrams with the query, MySQL and MongoDB read the ones sharing the most
+	shared := minSharedTrigrams(query)
+	var found []interface{}
+	newUser := func() interface{} { return &models.User{} }
+	switch db := u.Database.(type) {
+	case *models.MySQL:
+		args := make([]interface{}, 0, len(keys)+2)
+		for _, key := range keys {
+			args = append(args, key)
+		}
+		args = append(args, shared, maxSearchCandidates)
+		found, err = db.Read(ctx, models.SQLQuery{
+			Statement: "SELECT " + searchColumns + " FROM users JOIN " +
+				"(SELECT user_id, COUNT(*) AS shared FROM user_trigrams WHERE trigram IN (" + placeholders(len(keys)) + ") " +
+				"GROUP BY user_id HAVING COUNT(*) >= ?) AS candidates ON candidates.user_id = users.id " +
+				"WHERE deleted_at IS NULL ORDER BY candidates.shared DESC, id LIMIT ?",
+			Args: args,
+		}, newUser)
+	case *models.MongoDB:
+		var candidates []interface{}
+		candidates, err = db.Aggregate(ctx, bson.A{
+			bson.M{"$match": bson.M{searchIndex: bson.M{"$in": keys}, "deleted_at": nil}},
+			bson.M{"$unwind": "$" + searchIndex},
+			bson.M{"$match": bson.M{searchIndex: bson.M{"$in": keys}}},
+			bson.M{"$group": bson.M{"_id": "$_id", "shared": bson.M{"$sum": 1}}},
+			bson.M{"$match": bson.M{"shared": bson.M{"$gte": shared}}},
+			bson.M{"$sort": bson.D{{Key: "shared", Value: -1}, {Key: "_id", Value: 1}}},
+			bson.M{"$limit": maxSearchCandidates},
+		}, func() interface{} { return &searchCandidate{} })
+		if err != nil {
+			break
+		}
+		ids := make([]primitive.ObjectID, len(candidates))
+		for i, candidate := range candidates {
+			ids[i] = candidate.(*searchCandidate).ID
+		}
+		found, err = db.Read(ctx, models.MongoQuery{
+			Filter:     bson.M{"_id": bson.M{"$in": ids}},
+			Projection: bson.M{"password": 0, searchIndex: 0},
+		}, newUser)
+	case interface {
+		Index(name string, keys func(item interface{}) []string) error
+		ReadIndex(ctx context.Context, name string, keys []string, filter interface{}, callback func() interface{}) ([]interface{}, error)
+	}:
+		// JSON file and memory, the index is built on the first search, every candidate is ranked
+		if err := db.Index(searchIndex, func(item interface{}) []string { return searchTrigrams(*item.(*models.User)) }); err != nil {
+			return nil, &StorageError{Op: "index", Err: err}
+		}
+		found, err = db.ReadIndex(ctx, searchIndex, keys, bson.M{"deleted_at": nil}, newUser)
+	default:
+		found, err = db.Read(ctx, bson.M{"deleted_at": nil}, newUser)
+	}
+	if err != nil {
+		return nil, &StorageError{Op: "read", Err: err}
+	}
+
+	results := make([]SearchResult, 0, len(found))
+	for _, item := range found {
+		user, ok := item.(*models.User)
+		if !ok {
+			continue
+		}
+		user.Password = ""
+		if result := rank(*user, query); result.Score > 0 {
+			results = append(results, result)
+		}
+	}
+	sort.SliceStable(results, func(i, j int) bool {
+		if results[i].Score != results[j].Score {
+			return results[i].Score > results[j].Score
+		}
+		return results[i].User.Username < results[j].User.Username
+	})
+	if len(results) > limit {
+		results = results[:limit]
+	}
+	return results, nil
+}
+
+// indexedUser is a MongoDB document of a user with the keys of the search index
+type indexedUser struct {
+	models.User `bson:",inline"`
+	// SearchTrigrams are the trigrams of the searchFields, with a multikey index
+	SearchTrigrams []string `bson:"search_trigrams"`
+}
+
+// newIndexedUser returns the document of user, with its search trigrams
+func newIndexedUser(user models.User) indexedUser {
+	return indexedUser{User: user, SearchTrigrams: searchTrigrams(user)}
+}
+
+// indexUsers writes the search trigrams of users after their username or their attributes changed:
+// the search_trigrams of their MongoDB documents or their rows of the user_trigrams table in MySQL.
+// The memory stores derive their index from the users.
+func (u *UserService) indexUsers(ctx context.Context, users ...models.User) error {
+	if len(users) == 0 {
+		return nil
+	}
+	switch db := u.Database.(type) {
+	case *models.MySQL:
+		ids := make([]interface{}, len(users))
+		var rows []interface{}
+		for i, user := range users {
+			ids[i] = user.ID.Hex()
+			for _, trigram := range searchTrigrams(user) {
+				rows = append(rows, user.ID.Hex(), trigram)
+			}
+		}
+		err := db.Delete(ctx, models.SQLQuery{
+			Statement: "DELETE FROM user_trigrams WHERE user_id IN (" + placeholders(len(ids)) + ")",
+			Args:      ids,
+		})
+		if err != nil {
+			return &StorageError{Op: "index", Err: err}
+		}
+		for len(rows) > 0 {
+			batch := rows[:min(len(rows), 2*trigramBatchSize)]
+			rows = rows[len(batch):]
+			values := strings.TrimSuffix(strings.Repeat("(?, ?), ", len(batch)/2), ", ")
+			err := db.Create(ctx, models.SQLQuery{Statement: "INSERT INTO user_trigrams (user_id, trigram) VALUES " + values, Args: batch})
+			if err != nil {
+				return &StorageError{Op: "index", Err: err}
+			}
+		}
+	case *models.MongoDB:
+		for _, user := range users {
+			err := db.Update(ctx, bson.M{"_id": user.ID}, bson.M{"$set": bson.M{searchIndex: searchTrigrams(user)}})
+			if err != nil {
+				return &StorageError{Op: "index", Err: err}
+			}
+		}
+	}
+	return nil
+}
+
+// reindexUser indexes the user of username after a change of its attributes
+func (u *UserService) reindexUser(ctx context.Context, username string) error {
+	user, err := u.SearchUserByUsername(ctx, username)
+	if err != nil {
+		return err
+	}
+	return u.indexUsers(ctx, user)
+}
+
+// indexCreatedUsers indexes the users inserted in MySQL, the MongoDB documents are inserted with their trigrams.
+// A failure is only logged: the users are created, `usermgmt-admin reindex` makes them searchable.
+func (u *UserService) indexCreatedUsers(ctx context.Context, users ...models.User) {
+	if _, ok := u.Database.(*models.MySQL); !ok {
+		return
+	}
+	if err := u.indexUsers(ctx, users...); err != nil {
+		u.logger.ErrorContext(ctx, "index the created users, run usermgmt-admin reindex",
+			slog.Int("users", len(users)), slog.Any("error", err))
+	}
+}
+
+// ReindexUsers rewrites the search trigrams of every user, e.g. for the users stored before the search,
+// page by page in the order of their id. It returns the number of users indexed.
+func (u *UserService) ReindexUsers(ctx context.Context) (n int, err error) {
+	ctx, span := tracing.Start(ctx, "UserService.ReindexUsers")
+	defer tracing.End(span, &err)
+
+	after := primitive.NilObjectID
+	for {
+		users, err := u.UsersAfter(ctx, after, exportPageSize)
+		if err != nil {
+			return n, err
+		}
+		if err := u.indexUsers(ctx, users...); err != nil {
+			return n, err
+		}
+		n += len(users)
+		if len(users) < exportPageSize {
+			return n, nil
+		}
+		after = users[len(users)-1].ID
+	}
+}
@@ -2,92 +2,155 @@ package services
 
 import (
 	"context"
-	"database/sql"
 	"errors"
-	"fmt"
-	"log"
-	"os"
+	"io"
+	"log/slog"
+	"strings"
+	"sync"
+	"usermanagement/internal/config"
 	"usermanagement/internal/models"
-
-	_ "github.com/go-sql-driver/mysql"
+	"usermanagement/internal/tracing"
 
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
-	"go.mongodb.org/mongo-driver/mongo"
-	"go.mongodb.org/mongo-driver/mongo/options"
-	"go.mongodb.org/mongo-driver/mongo/readpref"
 )
 
+// userColumns are the columns of the users table, in the order scanned by MySQL.Read
+const userColumns = "id, username, password, roles, locked, status, created_at, updated_at, last_login_at, password_changed_at, deleted_at, deleted_username, version, attributes"
+
+// userPlaceholders are the placeholders of the userColumns of a user in an INSERT
+var userPlaceholders = "(" + placeholders(strings.Count(userColumns, ",")+1) + ")"
+
+// userArgs are the values of the userColumns of user
+func userArgs(user models.User) []interface{} {
+	return []interface{}{
+		user.ID.Hex(), user.Username, user.Password, strings.Join(user.Roles, ","), user.Locked,
+		string(user.Status), models.SQLTime(&user.CreatedAt), models.SQLTime(&user.UpdatedAt),
+		models.SQLTime(user.LastLoginAt), models.SQLTime(user.PasswordChangedAt),
+		models.SQLTime(user.DeletedAt), nullString(user.DeletedUsername), user.Version, user.Attributes,
+	}
+}
+
 type UserService struct {
 	Database models.CURDInterface
+	// Audit stores the audit log, in the same database
+	Audit   models.CURDInterface
+	backend Backend
+	// cache caches the lookups of SearchUserByUsername and SearchUserByID, nil if disabled
+	cache *UserCache
+	// deletion is the policy of DeleteUser, RestoreUser and PurgeDeletedUsers
+	deletion config.DeletionConfig
+	// attributes validates the custom attributes of the users, nil if none are configured
+	attributes *AttributeSchema
+	logger     *slog.Logger
+	// auditTail is the newest event of the audit log known to be stored, the base of the next one,
+	// nil until it's read. auditMu guards it, it's never held during a round trip to the database.
+	auditTail *models.AuditEvent
+	auditMu   sync.Mutex
 }
 
+// UserServiceInterface is the interface of the user service used by the handlers.
+// Every method takes the context of the request, and passes it to the database.
 type UserServiceInterface interface {
-	LoginDB()
-	GetAllUsers() ([]models.User, error)
-	CreateUser(user models.User) error
-	SearchUserByID(ID string) (models.User, error)
-	SearchUserByUsername(username string) (models.User, error)
+	LoginDB() error
+	CloseDB(ctx context.Context) error
+	PingDB(ctx context.Context) error
+	GetAllUsers(ctx context.Context) ([]models.User, error)
+	CountUsers(ctx context.Context) (int64, error)
+	CreateUser(ctx context.Context, user models.User) (models.User, error)
+	SearchUserByID(ctx context.Context, ID string) (models.User, error)
+	SearchUserByUsername(ctx context.Context, username string) (models.User, error)
+	SearchUserForLogin(ctx context.Context, username string) (models.User, error)
+	RecordLogin(ctx context.Context, user models.User) error
+	RecordEvent(ctx context.Context, event models.AuditEvent) error
+	QueryEvents(ctx context.Context, filter AuditFilter) ([]models.AuditEvent, error)
+	VerifyAuditLog(ctx context.Context) (AuditVerification, error)
+	ImportUsers(ctx context.Context, r io.Reader, opts ImportOptions) (ImportResult, error)
+	ExportUsers(ctx context.Context, w io.Writer, format Format) (int, error)
+	DeleteUser(ctx context.Context, id string) (models.User, error)
+	RestoreUser(ctx context.Context, id string) (models.User, error)
+	DeletedUsers(ctx context.Context) ([]models.User, error)
+	PurgeDeletedUsers(ctx context.Context) ([]models.User, error)
+	UpdateUser(ctx context.Context, id string, version int64, changes UserChanges) (models.User, error)
+	SearchUsersByAttributes(ctx context.Context, query map[string]string) ([]models.User, error)
+	SearchUsers(ctx context.Context, q string, limit int) ([]SearchResult, error)
+	FilterUsers(ctx context.Context, expression string) ([]models.User, error)
+}
+
+// NewUserService returns the service of the database configured in cfg, by NewBackend, without cache,
+// with the default deletion policy and without attributes
+func NewUserService(cfg config.DatabaseConfig, logger *slog.Logger) *UserService {
+	return NewUserServiceWithBackend(NewBackend(cfg, logger), nil, config.Default().Deletion, nil, logger)
 }
 
-func NewUserService() *UserService {
+// NewUserServiceWithBackend returns the service of a backend, the one given by the provider set of cmd/wire.go,
+// with the cache of NewUserCache, nil to read every user from the store,
+// and the schema of NewAttributeSchema, nil to reject any attribute.
+// Without backend LoginDB fails, the tests set the Database themselves.
+func NewUserServiceWithBackend(backend Backend, cache *UserCache, deletion config.DeletionConfig, attributes *AttributeSchema, logger *slog.Logger) *UserService {
 	return &UserService{
-		Database: nil,
+		Database:   nil,
+		backend:    backend,
+		cache:      cache,
+		deletion:   deletion,
+		attributes: attributes,
+		logger:     logger,
 	}
 }
 
 // LoginDB: login database
-func (u *UserService) LoginDB() {
-	if os.Getenv("MONGO_URI") != "" {
-		u.loginMongo()
-	} else if os.Getenv("MYSQL_URI") != "" {
-		u.loginMySQL()
-	} else {
-		panic("No database connection")
+func (u *UserService) LoginDB() error {
+	if u.backend == nil {
+		return errors.New("no database connection")
 	}
-}
-
-// loginMongo: login MongoDB
-func (u *UserService) loginMongo() {
-	db := models.NewMongoDB()
-	client, _ := mongo.Connect(db.Ctx, options.Client().ApplyURI(os.Getenv("MONGO_URI")))
-	if err := client.Ping(context.TODO(), readpref.Primary()); err != nil {
-		log.Fatal(err)
+	stores, err := u.backend.Connect(context.Background())
+	if err != nil {
+		return err
 	}
-	log.Println("Connected to MongoDB")
+	u.logger.Info("connected to the database", slog.String("backend", u.backend.Name()))
+	u.Database = stores.Users
+	u.Audit = stores.Audit
+	return nil
+}
 
-	db.Client = client
-	db.Collection = client.Database(os.Getenv("MONGO_DATABASE")).Collection("user")
+// PingDB checks that the database is reachable
+func (u *UserService) PingDB(ctx context.Context) (err error) {
+	ctx, span := tracing.Start(ctx, "UserService.PingDB")
+	defer tracing.End(span, &err)
 
-	u.Database = db
+	if u.Database == nil {
+		return errors.New("no database connection")
+	}
+	if err := u.Database.Ping(ctx); err != nil {
+		return &StorageError{Op: "ping", Err: err}
+	}
+	return nil
 }
 
-// loginMySQL: login MySQL
-func (u *UserService) loginMySQL() {
-	mysql := models.NewMySQL()
-	db, _ := sql.Open("mysql", os.Getenv("MYSQL_URI"))
-	err := db.Ping()
-	if err != nil {
-		log.Fatal(err)
+// CloseDB closes the connection to the database and to the cache, if any
+func (u *UserService) CloseDB(ctx context.Context) error {
+	cacheErr := u.cache.Close()
+	closer, ok := u.Database.(interface{ Close(context.Context) error })
+	if !ok {
+		return cacheErr
 	}
-	log.Println("Connected to MySQL")
-
-	mysql.DB = db
-	u.Database = mysql
+	return errors.Join(closer.Close(ctx), cacheErr)
 }
 
 // ----- implement functions for Web API -----
 
-// GetAllUsers get all users in the database and return a list of user
-func (u *UserService) GetAllUsers() ([]models.User, error) {
+// GetAllUsers get all users in the database and return a list of user, without the deleted ones
+func (u *UserService) GetAllUsers(ctx context.Context) (_ []models.User, err error) {
+	ctx, span := tracing.Start(ctx, "UserService.GetAllUsers")
+	defer tracing.End(span, &err)
 
 	users := make([]models.User, 0)
 
 	if _, ok := u.Database.(*models.MongoDB); ok {
 		// search data from MongoDB
-		found, err := u.Database.Read(bson.M{}, func() interface{} { return &models.User{} })
+		found, err := u.Database.Read(ctx, bson.M{"deleted_at": nil}, func() interface{} { return &models.User{} })
 		if err != nil {
-			return nil, err
+			return nil, &StorageError{Op: "read", Err: err}
 		}
 		for _, user := range found {
 			u, ok := user.(*models.User)
@@ -98,9 +161,9 @@ func (u *UserService) GetAllUsers() ([]models.User, error) {
 		}
 	} else if _, ok := u.Database.(*models.MySQL); ok {
 		// search data from MySQL
-		found, err := u.Database.Read("SELECT * FROM users", func() interface{} { return &models.User{} })
+		found, err := u.Database.Read(ctx, "SELECT "+userColumns+" FROM users WHERE deleted_at IS NULL", func() interface{} { return &models.User{} })
 		if err != nil {
-			return nil, err
+			return nil, &StorageError{Op: "read", Err: err}
 		}
 		for _, user := range found {
 			u, ok := user.(*models.User)
@@ -110,10 +173,10 @@ func (u *UserService) GetAllUsers() ([]models.User, error) {
 			users = append(users, *u)
 		}
 	} else {
-		// for unit test
-		found, err := u.Database.Read(bson.M{}, func() interface{} { return &models.User{} })
+		// JSON file and memory
+		found, err := u.Database.Read(ctx, bson.M{"deleted_at": nil}, func() interface{} { return &models.User{} })
 		if err != nil {
-			return nil, err
+			return nil, &StorageError{Op: "read", Err: err}
 		}
 		for _, user := range found {
 			u, ok := user.(*models.User)
@@ -127,55 +190,124 @@ func (u *UserService) GetAllUsers() ([]models.User, error) {
 	return users, nil
 }
 
-// CreateUser adds a new user to the UserService.
+// CountUsers counts the users in the database, without the deleted ones
+func (u *UserService) CountUsers(ctx context.Context) (_ int64, err error) {
+	ctx, span := tracing.Start(ctx, "UserService.CountUsers")
+	defer tracing.End(span, &err)
+
+	var count int64
+	if _, ok := u.Database.(*models.MySQL); ok {
+		count, err = u.Database.Count(ctx, "SELECT COUNT(*) FROM users WHERE deleted_at IS NULL")
+	} else {
+		// MongoDB, JSON file and memory
+		count, err = u.Database.Count(ctx, bson.M{"deleted_at": nil})
+	}
+	if err != nil {
+		return 0, &StorageError{Op: "count", Err: err}
+	}
+	return count, nil
+}
+
+// CreateUser adds a new user to the UserService and returns it as stored, with its lifecycle fields.
 // If the user with the same username already exists, it returns an error.
-func (u *UserService) CreateUser(user models.User) error {
+func (u *UserService) CreateUser(ctx context.Context, user models.User) (_ models.User, err error) {
+	ctx, span := tracing.Start(ctx, "UserService.CreateUser")
+	defer tracing.End(span, &err)
 
-	// if the user already exists, return error
-	_, err := u.SearchUserByUsername(user.Username)
+	if err := ValidateUsername(user.Username); err != nil {
+		return models.User{}, err
+	}
+	if err := ValidateRoles(user.Roles); err != nil {
+		return models.User{}, err
+	}
+	if err := ValidateStatus(user.Status); err != nil {
+		return models.User{}, err
+	}
+	if err := u.attributes.validate(user.Attributes); err != nil {
+		return models.User{}, err
+	}
+	initLifecycle(&user, now())
+
+	// if the user already exists, return error.
+	// The store is read without the cache, which may hold a not found, e.g. of a username registered by another replica
+	_, err = u.findUserByUsername(ctx, user.Username)
 	if err == nil {
-		return errors.New("user already exist")
+		return models.User{}, ErrConflict
+	}
+	if !errors.Is(err, ErrNotFound) {
+		return models.User{}, err
 	}
 
 	if _, ok := u.Database.(*models.MongoDB); ok {
-		// insert to MongoDB
-		err = u.Database.Create(user)
+		// insert to MongoDB, with the keys of the search index
+		err = u.Database.Create(ctx, newIndexedUser(user))
 		if err != nil {
-			return err
+			return models.User{}, createError(err)
 		}
 	} else if _, ok := u.Database.(*models.MySQL); ok {
 		// insert into MySQL
-		err = u.Database.Create(fmt.Sprintf("INSERT INTO users VALUES ('%s', '%s', '%s')", user.ID.Hex(), user.Username, user.Password))
+		err = u.Database.Create(ctx, models.SQLQuery{
+			Statement: "INSERT INTO users (" + userColumns + ") VALUES " + userPlaceholders,
+			Args:      userArgs(user),
+		})
 		if err != nil {
-			return err
+			return models.User{}, createError(err)
 		}
+		u.indexCreatedUsers(ctx, user)
 	} else {
-		// for unit test
-		err = u.Database.Create(user)
+		// JSON file and memory
+		err = u.Database.Create(ctx, user)
 		if err != nil {
-			return err
+			return models.User{}, createError(err)
 		}
 	}
 
-	return nil
+	// the username and the id may be cached as not found
+	u.cache.forget(ctx, user)
+	return user, nil
+}
+
+// createError is the error of a failed insert of a user: ErrConflict if the username was taken meanwhile,
+// e.g. by another replica while it was cached as not found
+func createError(err error) error {
+	if models.IsDuplicateKey(err) {
+		return ErrConflict
+	}
+	return &StorageError{Op: "create", Err: err}
 }
 
 // SearchUserByID searches for a user in the database by the given ID.
 // It returns the matched user and nil error if found, otherwise it returns an empty User model
 // and an error indicating the user was not found.
-func (u *UserService) SearchUserByID(ID string) (models.User, error) {
+// The user has no password hash, like the cached ones, see SearchUserForLogin.
+func (u *UserService) SearchUserByID(ctx context.Context, ID string) (_ models.User, err error) {
+	ctx, span := tracing.Start(ctx, "UserService.SearchUserByID")
+	defer tracing.End(span, &err)
+
 	// convert id from string to MongoDB ObjectID
 	objectID, err := primitive.ObjectIDFromHex(ID)
 	if err != nil {
-		return models.User{}, err
+		return models.User{}, &ValidationError{Field: "id", Reason: err.Error()}
 	}
 
+	if entry, ok := u.cache.byID(ctx, objectID); ok {
+		return entry.result()
+	}
+	user, err := u.findUserByID(ctx, objectID)
+	user.Password = ""
+	u.cache.store(ctx, idKey(objectID), user, err)
+	return user, err
+}
+
+// findUserByID reads the user of id in the store, without the cache. A deleted user isn't found.
+func (u *UserService) findUserByID(ctx context.Context, objectID primitive.ObjectID) (models.User, error) {
+	ID := objectID.Hex()
 	if _, ok := u.Database.(*models.MongoDB); ok {
 		// search from MongoDB
-		filter := bson.M{"_id": objectID}
-		found, err := u.Database.Read(filter, func() interface{} { return &models.User{} })
+		filter := bson.M{"_id": objectID, "deleted_at": nil}
+		found, err := u.Database.Read(ctx, filter, func() interface{} { return &models.User{} })
 		if err != nil {
-			return models.User{}, err
+			return models.User{}, &StorageError{Op: "read", Err: err}
 		}
 		// found one
 		if len(found) > 0 {
@@ -186,9 +318,9 @@ func (u *UserService) SearchUserByID(ID string) (models.User, error) {
 			return *user, nil
 		}
 	} else if _, ok := u.Database.(*models.MySQL); ok {
-		found, err := u.Database.Read(fmt.Sprintf("SELECT * FROM users WHERE id = '%s'", ID), func() interface{} { return &models.User{} })
+		found, err := u.Database.Read(ctx, models.SQLQuery{Statement: "SELECT " + userColumns + " FROM users WHERE id = ? AND deleted_at IS NULL", Args: []interface{}{ID}}, func() interface{} { return &models.User{} })
 		if err != nil {
-			return models.User{}, err
+			return models.User{}, &StorageError{Op: "read", Err: err}
 		}
 		// found one
 		if len(found) > 0 {
@@ -199,11 +331,11 @@ func (u *UserService) SearchUserByID(ID string) (models.User, error) {
 			return *user, nil
 		}
 	} else {
-		// for unit test
-		filter := bson.M{"_id": objectID}
-		found, err := u.Database.Read(filter, func() interface{} { return &models.User{} })
+		// JSON file and memory
+		filter := bson.M{"_id": objectID, "deleted_at": nil}
+		found, err := u.Database.Read(ctx, filter, func() interface{} { return &models.User{} })
 		if err != nil {
-			return models.User{}, err
+			return models.User{}, &StorageError{Op: "read", Err: err}
 		}
 		// found one
 		if len(found) > 0 {
@@ -216,20 +348,44 @@ func (u *UserService) SearchUserByID(ID string) (models.User, error) {
 	}
 
 	// not found
-	return models.User{}, errors.New("not found")
+	return models.User{}, ErrNotFound
 }
 
 // SearchUserByUsername searches for a user in the database by the given username.
 // It returns the matched user and nil error if found, otherwise it returns an empty User model
 // and an error indicating the user was not found.
-func (u *UserService) SearchUserByUsername(username string) (models.User, error) {
+// The user has no password hash, like the cached ones, see SearchUserForLogin.
+func (u *UserService) SearchUserByUsername(ctx context.Context, username string) (_ models.User, err error) {
+	ctx, span := tracing.Start(ctx, "UserService.SearchUserByUsername")
+	defer tracing.End(span, &err)
 
+	if entry, ok := u.cache.byUsername(ctx, username); ok {
+		return entry.result()
+	}
+	user, err := u.findUserByUsername(ctx, username)
+	user.Password = ""
+	u.cache.store(ctx, userKey(username), user, err)
+	return user, err
+}
+
+// SearchUserForLogin is SearchUserByUsername without the cache and with the password hash, for the logins:
+// the password, the lock and the status are read from the store, so a change made by another replica
+// or by usermgmt-admin applies at once, not after the TTL of the cache.
+func (u *UserService) SearchUserForLogin(ctx context.Context, username string) (_ models.User, err error) {
+	ctx, span := tracing.Start(ctx, "UserService.SearchUserForLogin")
+	defer tracing.End(span, &err)
+
+	return u.findUserByUsername(ctx, username)
+}
+
+// findUserByUsername reads the user of username in the store, without the cache. A deleted user isn't found.
+func (u *UserService) findUserByUsername(ctx context.Context, username string) (models.User, error) {
 	if _, ok := u.Database.(*models.MongoDB); ok {
 		// search from MongoDB
-		filter := bson.M{"username": username}
-		found, err := u.Database.Read(filter, func() interface{} { return &models.User{} })
+		filter := bson.M{"username": username, "deleted_at": nil}
+		found, err := u.Database.Read(ctx, filter, func() interface{} { return &models.User{} })
 		if err != nil {
-			return models.User{}, err
+			return models.User{}, &StorageError{Op: "read", Err: err}
 		}
 
 		// found one
@@ -241,10 +397,9 @@ func (u *UserService) SearchUserByUsername(username string) (models.User, error)
 			return *user, nil
 		}
 	} else if _, ok := u.Database.(*models.MySQL); ok {
-		found, err := u.Database.Read(fmt.Sprintf("SELECT * FROM users WHERE username = '%s'", username), func() interface{} { return &models.User{} })
-		fmt.Println(found)
+		found, err := u.Database.Read(ctx, models.SQLQuery{Statement: "SELECT " + userColumns + " FROM users WHERE username = ? AND deleted_at IS NULL", Args: []interface{}{username}}, func() interface{} { return &models.User{} })
 		if err != nil {
-			return models.User{}, err
+			return models.User{}, &StorageError{Op: "read", Err: err}
 		}
 		// found one
 		if len(found) > 0 {
@@ -255,12 +410,11 @@ func (u *UserService) SearchUserByUsername(username string) (models.User, error)
 			return *user, nil
 		}
 	} else {
-		// for unit test
-
-		filter := bson.M{"username": username}
-		found, err := u.Database.Read(filter, func() interface{} { return &models.User{} })
+		// JSON file and memory
+		filter := bson.M{"username": username, "deleted_at": nil}
+		found, err := u.Database.Read(ctx, filter, func() interface{} { return &models.User{} })
 		if err != nil {
-			return models.User{}, err
+			return models.User{}, &StorageError{Op: "read", Err: err}
 		}
 
 		// found one
@@ -274,6 +428,6 @@ func (u *UserService) SearchUserByUsername(username string) (models.User, error)
 	}
 
 	// not found
-	return models.User{}, errors.New("not found")
+	return models.User{}, ErrNotFound
 
 }
@@ -0,0 +1,134 @@
+package services
+
+import (
+	"context"
+	"strings"
+	"usermanagement/internal/models"
+	"usermanagement/internal/tracing"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// UserChanges are the changes of a user by UpdateUser, the nil fields are kept
+type UserChanges struct {
+	Roles  *[]string          `json:"roles"`
+	Locked *bool              `json:"locked"`
+	Status *models.UserStatus `json:"status"`
+	// Attributes replace all the attributes, empty ones remove them
+	Attributes *models.Attributes `json:"attributes"`
+}
+
+// versionFilter is the MongoDB condition of a version, the users stored before the versions have none
+func versionFilter(version int64) interface{} {
+	if version == 0 {
+		return bson.M{"$in": bson.A{int64(0), nil}}
+	}
+	return version
+}
+
+// UpdateUser changes the user of id if it's still at version, and increments its version.
+// The version is compared and the user changed in one operation of the database,
+// so of two changes from the same version only the first one is applied.
+// It returns the changed user, ErrNotFound if there's no user of id or it's deleted,
+// and ErrVersionMismatch if the user is at another version.
+func (u *UserService) UpdateUser(ctx context.Context, id string, version int64, changes UserChanges) (_ models.User, err error) {
+	ctx, span := tracing.Start(ctx, "UserService.UpdateUser")
+	defer tracing.End(span, &err)
+
+	objectID, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return models.User{}, &ValidationError{Field: "id", Reason: err.Error()}
+	}
+
+	at := now()
+	fields := bson.M{"updated_at": at}
+	var assignments []string
+	var args []interface{}
+	if changes.Roles != nil {
+		roles := *changes.Roles
+		if err := ValidateRoles(roles); err != nil {
+			return models.User{}, err
+		}
+		if roles == nil {
+			// an empty array rather than null
+			roles = []string{}
+		}
+		fields["roles"] = roles
+		assignments = append(assignments, "roles = ?")
+		args = append(args, strings.Join(roles, ","))
+	}
+	if changes.Locked != nil {
+		fields["locked"] = *changes.Locked
+		assignments = append(assignments, "locked = ?")
+		args = append(args, *changes.Locked)
+	}
+	if changes.Status != nil {
+		if err := ValidateStatus(*changes.Status); err != nil {
+			return models.User{}, err
+		}
+		if *changes.Status == "" {
+			return models.User{}, &ValidationError{Field: "status", Reason: "must not be empty"}
+		}
+		fields["status"] = *changes.Status
+		assignments = append(assignments, "status = ?")
+		args = append(args, string(*changes.Status))
+	}
+	if changes.Attributes != nil {
+		attributes := *changes.Attributes
+		if err := u.attributes.validate(attributes); err != nil {
+			return models.User{}, err
+		}
+		if len(attributes) == 0 {
+			attributes = nil
+		}
+		fields["attributes"] = attributes
+		assignments = append(assignments, "attributes = ?")
+		args = append(args, attributes)
+	}
+	if len(assignments) == 0 {
+		return models.User{}, &ValidationError{Field: "body", Reason: "must change the roles, locked, status or attributes"}
+	}
+
+	// the username of the user, to forget it in the cache even if the change fails
+	current, err := u.findUserByID(ctx, objectID)
+	if err != nil {
+		return models.User{}, err
+	}
+
+	var swapped bool
+	if _, ok := u.Database.(*models.MySQL); ok {
+		args = append(args, models.SQLTime(&at), id, version)
+		swapped, err = u.Database.CompareAndSwap(ctx, models.SQLQuery{
+			Statement: "UPDATE users SET " + strings.Join(assignments, ", ") + ", updated_at = ?, version = version + 1" +
+				" WHERE id = ? AND version = ? AND deleted_at IS NULL",
+			Args: args,
+		}, nil)
+	} else {
+		// MongoDB, JSON file and memory
+		swapped, err = u.Database.CompareAndSwap(ctx,
+			bson.M{"_id": objectID, "version": versionFilter(version), "deleted_at": nil},
+			bson.M{"$set": fields, "$inc": bson.M{"version": 1}})
+	}
+	if err != nil {
+		// the update may have been applied
+		u.cache.forget(ctx, current)
+		return models.User{}, &StorageError{Op: "update", Err: err}
+	}
+
+	user, err := u.findUserByID(ctx, objectID)
+	if err != nil {
+		return models.User{}, err
+	}
+	if !swapped {
+		return models.User{}, ErrVersionMismatch
+	}
+	u.cache.forget(ctx, user)
+	if changes.Attributes != nil {
+		// the display_name and the email are searched
+		if err := u.indexUsers(ctx, user); err != nil {
+			return models.User{}, err
+		}
+	}
+	return user, nil
+}
@@ -0,0 +1,204 @@
+package session
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Memory is a Store in the memory of the process, lost when it stops.
+// The replicas of a server have their own, so it only fits a single replica.
+type Memory struct {
+	mu      sync.Mutex
+	entries map[string]*memoryEntry
+	// swept is when the expired entries were last removed
+	swept time.Time
+}
+
+type memoryEntry struct {
+	// value is a Session, a *family, an int64 count of failures or the string of a one-time token
+	value   interface{}
+	expires time.Time
+}
+
+type family struct {
+	token    string
+	username string
+}
+
+// sweepInterval is how often the expired entries are removed, on a write
+const sweepInterval = time.Minute
+
+// NewMemory returns an empty store
+func NewMemory() *Memory {
+	return &Memory{entries: make(map[string]*memoryEntry), swept: time.Now()}
+}
+
+func (m *Memory) CreateSession(ctx context.Context, session Session, ttl time.Duration) error {
+	id := session.ID
+	session.ID = ""
+	m.put("session:"+digest(id), session, ttl)
+	return nil
+}
+
+func (m *Memory) Session(ctx context.Context, id string) (Session, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	entry := m.get("session:" + digest(id))
+	if entry == nil {
+		return Session{}, ErrNotFound
+	}
+	session := entry.value.(Session)
+	session.ID = id
+	return session, nil
+}
+
+func (m *Memory) DeleteSession(ctx context.Context, id string) error {
+	m.delete("session:" + digest(id))
+	return nil
+}
+
+func (m *Memory) StartFamily(ctx context.Context, familyID, username, token string, ttl time.Duration) error {
+	m.put("refresh:"+familyID, &family{token: digest(token), username: username}, ttl)
+	return nil
+}
+
+func (m *Memory) RotateToken(ctx context.Context, familyID, token, next string, ttl time.Duration) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	key := "refresh:" + familyID
+	entry := m.get(key)
+	if entry == nil {
+		return "", ErrNotFound
+	}
+	f := entry.value.(*family)
+	if f.token != digest(token) {
+		delete(m.entries, key)
+		return "", ErrTokenReused
+	}
+	f.token = digest(next)
+	entry.expires = time.Now().Add(ttl)
+	return f.username, nil
+}
+
+func (m *Memory) RevokeFamily(ctx context.Context, familyID string) error {
+	m.delete("refresh:" + familyID)
+	return nil
+}
+
+func (m *Memory) AddAttempt(ctx context.Context, key string, max int64, window time.Duration) (int64, time.Duration, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	key = "failures:" + key
+	entry := m.get(key)
+	if entry == nil {
+		m.sweep()
+		entry = &memoryEntry{value: int64(0), expires: time.Now().Add(window)}
+		m.entries[key] = entry
+	}
+	count := entry.value.(int64) + 1
+	entry.value = count
+	if count <= max {
+		return count, 0, nil
+	}
+	return count, time.Until(entry.expires), nil
+}
+
+func (m *Memory) ReleaseAttempt(ctx context.Context, key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if entry := m.get("failures:" + key); entry != nil && entry.value.(int64) > 0 {
+		entry.value = entry.value.(int64) - 1
+	}
+	return nil
+}
+
+func (m *Memory) Failures(ctx context.Context, key string) (int64, time.Duration, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	entry := m.get("failures:" + key)
+	if entry == nil {
+		return 0, 0, nil
+	}
+	return entry.value.(int64), time.Until(entry.expires), nil
+}
+
+func (m *Memory) ResetFailures(ctx context.Context, key string) error {
+	m.delete("failures:" + key)
+	return nil
+}
+
+func (m *Memory) PutToken(ctx context.Context, token, value string, ttl time.Duration) error {
+	m.put("token:"+digest(token), value, ttl)
+	return nil
+}
+
+func (m *Memory) ConsumeToken(ctx context.Context, token string) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	key := "token:" + digest(token)
+	entry := m.get(key)
+	if entry == nil {
+		return "", ErrNotFound
+	}
+	delete(m.entries, key)
+	return entry.value.(string), nil
+}
+
+// Ping always succeeds, unless ctx is done
+func (m *Memory) Ping(ctx context.Context) error {
+	return ctx.Err()
+}
+
+// Close does nothing, there's no connection
+func (m *Memory) Close() error {
+	return nil
+}
+
+func (m *Memory) put(key string, value interface{}, ttl time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.sweep()
+	m.entries[key] = &memoryEntry{value: value, expires: time.Now().Add(ttl)}
+}
+
+func (m *Memory) delete(key string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.entries, key)
+}
+
+// get returns the entry of key if it isn't expired, with the lock held
+func (m *Memory) get(key string) *memoryEntry {
+	entry, ok := m.entries[key]
+	if !ok {
+		return nil
+	}
+	if !time.Now().Before(entry.expires) {
+		delete(m.entries, key)
+		return nil
+	}
+	return entry
+}
+
+// sweep removes the expired entries at most once per sweepInterval, with the lock held.
+// Without it the failures of clients never seen again would pile up.
+func (m *Memory) sweep() {
+	now := time.Now()
+	if now.Sub(m.swept) < sweepInterval {
+		return
+	}
+	m.swept = now
+	for key, entry := range m.entries {
+		if !now.Before(entry.expires) {
+			delete(m.entries, key)
+		}
+	}
+}
@@ -0,0 +1,201 @@
+package session
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Redis is a Store in a Redis server, shared by the replicas of the server.
+// Every read-modify-write is a Lua script, so it's atomic even when two replicas race on the same key.
+//
+// The keys, after the prefix, are:
+//
+//	session:<digest of the id>  -> the session, as JSON
+//	refresh:<family>            -> a hash of the digest of the current token and the username
+//	failures:<key>              -> the count of failures, expiring at the end of the window
+//	token:<digest of the token> -> the value of the one-time token
+type Redis struct {
+	client *redis.Client
+	// prefix is added to every key, so the store doesn't collide with the other data of the server
+	prefix string
+}
+
+// NewRedis returns the store of the keys starting with prefix, e.g. usermanagement:
+func NewRedis(client *redis.Client, prefix string) *Redis {
+	return &Redis{client: client, prefix: prefix}
+}
+
+var (
+	// addAttemptScript increments the counter, starts its window on the first attempt,
+	// and returns the time left in the window only if the counter is over the maximum
+	addAttemptScript = redis.NewScript(`
+local count = redis.call('INCR', KEYS[1])
+if count == 1 then
+	redis.call('PEXPIRE', KEYS[1], ARGV[1])
+end
+if count <= tonumber(ARGV[2]) then
+	return {count, 0}
+end
+return {count, redis.call('PTTL', KEYS[1])}
+`)
+
+	// releaseAttemptScript decrements the counter, keeping its window, unless it's gone
+	releaseAttemptScript = redis.NewScript(`
+local count = tonumber(redis.call('GET', KEYS[1]))
+if count and count > 0 then
+	redis.call('DECR', KEYS[1])
+end
+return 0
+`)
+
+	// failuresScript reads the counter and its window together
+	failuresScript = redis.NewScript(`
+local count = redis.call('GET', KEYS[1])
+if not count then
+	return {0, 0}
+end
+return {tonumber(count), redis.call('PTTL', KEYS[1])}
+`)
+
+	// rotateScript replaces the current token of a family, or revokes the family if another token is presented
+	rotateScript = redis.NewScript(`
+local current = redis.call('HGET', KEYS[1], 'token')
+if not current then
+	return {'missing'}
+end
+if current ~= ARGV[1] then
+	redis.call('DEL', KEYS[1])
+	return {'reused'}
+end
+redis.call('HSET', KEYS[1], 'token', ARGV[2])
+redis.call('PEXPIRE', KEYS[1], ARGV[3])
+return {'rotated', redis.call('HGET', KEYS[1], 'username')}
+`)
+
+	// consumeScript returns the value of a token and deletes it, so two replicas can't both use it
+	consumeScript = redis.NewScript(`
+local value = redis.call('GET', KEYS[1])
+if value then
+	redis.call('DEL', KEYS[1])
+end
+return value
+`)
+)
+
+func (r *Redis) CreateSession(ctx context.Context, session Session, ttl time.Duration) error {
+	value, err := json.Marshal(session)
+	if err != nil {
+		return err
+	}
+	return r.client.Set(ctx, r.prefix+"session:"+digest(session.ID), value, ttl).Err()
+}
+
+func (r *Redis) Session(ctx context.Context, id string) (Session, error) {
+	value, err := r.client.Get(ctx, r.prefix+"session:"+digest(id)).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return Session{}, ErrNotFound
+	}
+	if err != nil {
+		return Session{}, err
+	}
+	var session Session
+	if err := json.Unmarshal(value, &session); err != nil {
+		return Session{}, err
+	}
+	session.ID = id
+	return session, nil
+}
+
+func (r *Redis) DeleteSession(ctx context.Context, id string) error {
+	return r.client.Del(ctx, r.prefix+"session:"+digest(id)).Err()
+}
+
+func (r *Redis) StartFamily(ctx context.Context, family, username, token string, ttl time.Duration) error {
+	key := r.prefix + "refresh:" + family
+	_, err := r.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Del(ctx, key)
+		pipe.HSet(ctx, key, "token", digest(token), "username", username)
+		pipe.PExpire(ctx, key, ttl)
+		return nil
+	})
+	return err
+}
+
+func (r *Redis) RotateToken(ctx context.Context, family, token, next string, ttl time.Duration) (string, error) {
+	result, err := rotateScript.Run(ctx, r.client, []string{r.prefix + "refresh:" + family},
+		digest(token), digest(next), ttl.Milliseconds()).Slice()
+	if err != nil {
+		return "", err
+	}
+	switch result[0] {
+	case "missing":
+		return "", ErrNotFound
+	case "reused":
+		return "", ErrTokenReused
+	case "rotated":
+		username, _ := result[1].(string)
+		return username, nil
+	default:
+		return "", fmt.Errorf("rotate refresh token: unexpected result %v", result)
+	}
+}
+
+func (r *Redis) RevokeFamily(ctx context.Context, family string) error {
+	return r.client.Del(ctx, r.prefix+"refresh:"+family).Err()
+}
+
+func (r *Redis) AddAttempt(ctx context.Context, key string, max int64, window time.Duration) (int64, time.Duration, error) {
+	return countAndTTL(addAttemptScript.Run(ctx, r.client, []string{r.prefix + "failures:" + key}, window.Milliseconds(), max))
+}
+
+func (r *Redis) ReleaseAttempt(ctx context.Context, key string) error {
+	return releaseAttemptScript.Run(ctx, r.client, []string{r.prefix + "failures:" + key}).Err()
+}
+
+func (r *Redis) Failures(ctx context.Context, key string) (int64, time.Duration, error) {
+	return countAndTTL(failuresScript.Run(ctx, r.client, []string{r.prefix + "failures:" + key}))
+}
+
+func (r *Redis) ResetFailures(ctx context.Context, key string) error {
+	return r.client.Del(ctx, r.prefix+"failures:"+key).Err()
+}
+
+func (r *Redis) PutToken(ctx context.Context, token, value string, ttl time.Duration) error {
+	return r.client.Set(ctx, r.prefix+"token:"+digest(token), value, ttl).Err()
+}
+
+func (r *Redis) ConsumeToken(ctx context.Context, token string) (string, error) {
+	value, err := consumeScript.Run(ctx, r.client, []string{r.prefix + "token:" + digest(token)}).Text()
+	if errors.Is(err, redis.Nil) {
+		return "", ErrNotFound
+	}
+	return value, err
+}
+
+// Ping checks that the server answers
+func (r *Redis) Ping(ctx context.Context) error {
+	return r.client.Ping(ctx).Err()
+}
+
+// Close closes the connections to the server
+func (r *Redis) Close() error {
+	return r.client.Close()
+}
+
+// countAndTTL reads the {count, PTTL in milliseconds} result of a script
+func countAndTTL(cmd *redis.Cmd) (int64, time.Duration, error) {
+	result, err := cmd.Int64Slice()
+	if err != nil {
+		return 0, 0, err
+	}
+	if len(result) != 2 {
+		return 0, 0, fmt.Errorf("count failures: unexpected result %v", result)
+	}
+	// PTTL is negative for a key without expiry, which the scripts never leave
+	return result[0], time.Duration(max(result[1], 0)) * time.Millisecond, nil
+}
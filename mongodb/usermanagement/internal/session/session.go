@@ -0,0 +1,94 @@
+// Package session keeps the short-lived state of the login flows: the sessions, the refresh-token families,
+// the counters of failed attempts and the one-time tokens.
+// Memory keeps it in the process, Redis shares it between the replicas of the server,
+// so a client can't reset its limits by reaching another replica.
+package session
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"time"
+	"usermanagement/internal/cache"
+	"usermanagement/internal/config"
+)
+
+var (
+	// ErrNotFound is returned for an unknown, expired or already used session or token
+	ErrNotFound = errors.New("session or token not found")
+	// ErrTokenReused is returned when a refresh token is presented after it was rotated.
+	// Its family is revoked, so a stolen token and the one of the legitimate client both stop working.
+	ErrTokenReused = errors.New("refresh token reused")
+)
+
+// Session is a logged in user
+type Session struct {
+	ID        string    `json:"-"`
+	Username  string    `json:"username"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Store keeps the state of the login flows until it expires.
+// The session ids and the tokens are secrets, so only their SHA-256 digest is stored.
+type Store interface {
+	// CreateSession stores session for ttl
+	CreateSession(ctx context.Context, session Session, ttl time.Duration) error
+	// Session returns the session of id, ErrNotFound if it expired or was deleted
+	Session(ctx context.Context, id string) (Session, error)
+	// DeleteSession removes the session of id, a missing one is ignored
+	DeleteSession(ctx context.Context, id string) error
+
+	// StartFamily starts the family of refresh tokens of username with its first token, for ttl
+	StartFamily(ctx context.Context, family, username, token string, ttl time.Duration) error
+	// RotateToken replaces token, the current token of family, by next and extends the family for ttl.
+	// It returns the username of the family, ErrNotFound if the family expired or was revoked,
+	// and ErrTokenReused if token isn't the current one, after revoking the family.
+	RotateToken(ctx context.Context, family, token, next string, ttl time.Duration) (string, error)
+	// RevokeFamily removes family, a missing one is ignored
+	RevokeFamily(ctx context.Context, family string) error
+
+	// AddAttempt counts an attempt of key, in a window of window starting at its first attempt, and compares
+	// the count with max in the same step, so concurrent attempts can't all pass before any is counted.
+	// It returns the attempts in the window, and the time left until it ends if they are more than max, 0 otherwise.
+	// An attempt stays counted as a failure unless it's released.
+	AddAttempt(ctx context.Context, key string, max int64, window time.Duration) (int64, time.Duration, error)
+	// ReleaseAttempt uncounts an attempt of key that didn't fail, a missing key is ignored
+	ReleaseAttempt(ctx context.Context, key string) error
+	// Failures returns the failures of key in its window and the time left until it ends, 0 without any
+	Failures(ctx context.Context, key string) (int64, time.Duration, error)
+	// ResetFailures forgets the failures of key
+	ResetFailures(ctx context.Context, key string) error
+
+	// PutToken stores the one-time token with its value, e.g. a username, for ttl
+	PutToken(ctx context.Context, token, value string, ttl time.Duration) error
+	// ConsumeToken returns the value of token and removes it, so it's used once.
+	// It returns ErrNotFound if it expired or was used before.
+	ConsumeToken(ctx context.Context, token string) (string, error)
+
+	// Ping checks that the store can serve requests
+	Ping(ctx context.Context) error
+	// Close releases the connections, if any
+	Close() error
+}
+
+// redisPrefix is the prefix of the keys of the store in Redis
+const redisPrefix = "usermanagement:"
+
+// New returns the store shared in the Redis server of cfg, or the memory of the process if there isn't any
+func New(cfg config.RedisConfig) (Store, error) {
+	if cfg.URL == "" {
+		return NewMemory(), nil
+	}
+	client, err := cache.NewRedisClient(cfg.URL)
+	if err != nil {
+		return nil, err
+	}
+	return NewRedis(client, redisPrefix), nil
+}
+
+// digest returns the hex SHA-256 of a secret, the key it's stored under
+func digest(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,193 @@
+package test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"usermanagement/internal/config"
+	"usermanagement/internal/handlers"
+	"usermanagement/internal/models"
+	"usermanagement/internal/services"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// TestAdminUpdates tests the user operations of usermgmt-admin
+func TestAdminUpdates(t *testing.T) {
+	tests := []struct {
+		name      string
+		update    func(u *services.UserService) error
+		expect    func(t *testing.T, user models.User)
+		expectErr error
+	}{
+		{
+			name: "reset password",
+			update: func(u *services.UserService) error {
+				return u.ResetPassword(context.Background(), "alice", "$2a$10$hash")
+			},
+			expect: func(t *testing.T, user models.User) {
+				assert.Equal(t, "$2a$10$hash", user.Password)
+				if assert.NotNil(t, user.PasswordChangedAt) {
+					assert.Equal(t, user.UpdatedAt, *user.PasswordChangedAt)
+				}
+			},
+		},
+		{
+			name: "lock",
+			update: func(u *services.UserService) error {
+				return u.SetLocked(context.Background(), "alice", true)
+			},
+			expect: func(t *testing.T, user models.User) {
+				assert.True(t, user.Locked)
+				assert.False(t, user.UpdatedAt.IsZero())
+				assert.Nil(t, user.PasswordChangedAt)
+			},
+		},
+		{
+			name: "set roles",
+			update: func(u *services.UserService) error {
+				return u.SetRoles(context.Background(), "alice", []string{"admin", "support"})
+			},
+			expect: func(t *testing.T, user models.User) {
+				assert.Equal(t, []string{"admin", "support"}, user.Roles)
+			},
+		},
+		{
+			name: "remove roles",
+			update: func(u *services.UserService) error {
+				if err := u.SetRoles(context.Background(), "alice", []string{"admin"}); err != nil {
+					return err
+				}
+				return u.SetRoles(context.Background(), "alice", nil)
+			},
+			expect: func(t *testing.T, user models.User) {
+				assert.Empty(t, user.Roles)
+			},
+		},
+		{
+			name: "suspend",
+			update: func(u *services.UserService) error {
+				return u.SetStatus(context.Background(), "alice", models.StatusSuspended)
+			},
+			expect: func(t *testing.T, user models.User) {
+				assert.Equal(t, models.StatusSuspended, user.Status)
+				assert.False(t, user.UpdatedAt.IsZero())
+			},
+		},
+		{
+			name: "unknown user",
+			update: func(u *services.UserService) error {
+				return u.SetLocked(context.Background(), "bob", true)
+			},
+			expectErr: services.ErrNotFound,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			alice := models.User{ID: primitive.NewObjectID(), Username: "alice", Password: "oldhash"}
+			userService := newMemoryService(t, alice)
+
+			err := tt.update(userService)
+			if tt.expectErr != nil {
+				assert.ErrorIs(t, err, tt.expectErr)
+			} else {
+				assert.NoError(t, err)
+			}
+
+			users := storeUsers(t, userService.Database)
+			if assert.Len(t, users, 1) {
+				if tt.expect != nil {
+					tt.expect(t, users[0])
+				} else {
+					assert.Equal(t, alice, users[0], "the user should be unchanged")
+				}
+			}
+		})
+	}
+}
+
+func TestValidateRoles(t *testing.T) {
+	assert.NoError(t, services.ValidateRoles([]string{"admin", "read-only", "team_1"}))
+	assert.NoError(t, services.ValidateRoles(nil))
+
+	for _, role := range []string{"", "Admin", "a,b", "1st", "has space"} {
+		var validationErr *services.ValidationError
+		assert.ErrorAs(t, services.ValidateRoles([]string{role}), &validationErr, role)
+	}
+}
+
+func TestValidateStatus(t *testing.T) {
+	assert.NoError(t, services.ValidateStatus(models.StatusSuspended))
+	assert.NoError(t, services.ValidateStatus(""))
+
+	var validationErr *services.ValidationError
+	assert.ErrorAs(t, services.ValidateStatus("banned"), &validationErr)
+
+	userService := newMemoryService(t, models.User{ID: primitive.NewObjectID(), Username: "alice", Password: "hash"})
+	assert.ErrorAs(t, userService.SetStatus(context.Background(), "alice", ""), &validationErr)
+	assert.ErrorAs(t, userService.SetStatus(context.Background(), "alice", "banned"), &validationErr)
+}
+
+// TestLoginLocked tests that a locked user with the right password is refused with 403
+func TestLoginLocked(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	hashedPassword, _ := bcrypt.GenerateFromPassword([]byte("testpass"), bcrypt.DefaultCost)
+	mockUserService := new(MockUserService)
+	mockUserService.On("SearchUserForLogin", mock.Anything, "alice").
+		Return(models.User{Username: "alice", Password: string(hashedPassword), Locked: true}, nil)
+	mockUserService.On("RecordEvent", mock.Anything, mock.MatchedBy(func(e models.AuditEvent) bool {
+		return e.Type == models.EventLoginFailed && e.Target == "alice"
+	})).Return(nil)
+
+	server := handlers.NewServer(mockUserService, config.ServerConfig{}, discardLogger)
+	server.SetupRoute()
+
+	body, _ := json.Marshal(map[string]string{"username": "alice", "password": "testpass"})
+	req, _ := http.NewRequest(http.MethodPost, "/login", bytes.NewBuffer(body))
+	w := httptest.NewRecorder()
+	server.GetRouter().ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.Contains(t, w.Body.String(), "/problems/locked")
+	mockUserService.AssertExpectations(t)
+}
+
+// TestLoginInactive tests that a user with the right password is refused with 403 unless active
+func TestLoginInactive(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	hashedPassword, _ := bcrypt.GenerateFromPassword([]byte("testpass"), bcrypt.MinCost)
+	for _, status := range []models.UserStatus{models.StatusPending, models.StatusSuspended, models.StatusDeactivated} {
+		t.Run(string(status), func(t *testing.T) {
+			mockUserService := new(MockUserService)
+			mockUserService.On("SearchUserForLogin", mock.Anything, "alice").
+				Return(models.User{Username: "alice", Password: string(hashedPassword), Status: status}, nil)
+			mockUserService.On("RecordEvent", mock.Anything, mock.MatchedBy(func(e models.AuditEvent) bool {
+				return e.Type == models.EventLoginFailed && e.Target == "alice"
+			})).Return(nil)
+
+			server := handlers.NewServer(mockUserService, config.ServerConfig{}, discardLogger)
+			server.SetupRoute()
+
+			body, _ := json.Marshal(map[string]string{"username": "alice", "password": "testpass"})
+			req, _ := http.NewRequest(http.MethodPost, "/login", bytes.NewBuffer(body))
+			w := httptest.NewRecorder()
+			server.GetRouter().ServeHTTP(w, req)
+
+			assert.Equal(t, http.StatusForbidden, w.Code)
+			assert.Contains(t, w.Body.String(), "/problems/inactive")
+			assert.Contains(t, w.Body.String(), string(status))
+			mockUserService.AssertExpectations(t)
+			mockUserService.AssertNotCalled(t, "RecordLogin", mock.Anything, mock.Anything)
+		})
+	}
+}
@@ -0,0 +1,305 @@
+package test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"usermanagement/internal/config"
+	"usermanagement/internal/handlers"
+	"usermanagement/internal/models"
+	"usermanagement/internal/services"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// attributesSchema declares the attributes of the tests
+const attributesSchema = `{
+	"type": "object",
+	"properties": {
+		"department": {"type": "string"},
+		"phone": {"type": "string", "pattern": "^\\+[0-9]{6,15}$"},
+		"locale": {"type": "string", "enum": ["en-US", "fr-FR"]},
+		"employee_id": {"type": "integer", "minimum": 1},
+		"remote": {"type": "boolean"},
+		"address": {"type": "object", "properties": {"city": {"type": "string"}}}
+	},
+	"additionalProperties": false
+}`
+
+// writeAttributesSchema writes schema to a file and returns its configuration
+func writeAttributesSchema(t *testing.T, schema string) config.AttributesConfig {
+	path := filepath.Join(t.TempDir(), "attributes.json")
+	require.NoError(t, os.WriteFile(path, []byte(schema), 0644))
+	return config.AttributesConfig{SchemaFile: path}
+}
+
+// newAttributesService returns a UserService in memory with the attributes of attributesSchema
+func newAttributesService(t *testing.T, db models.CURDInterface) *services.UserService {
+	schema, err := services.NewAttributeSchema(writeAttributesSchema(t, attributesSchema))
+	require.NoError(t, err)
+	userService := services.NewUserServiceWithBackend(nil, nil, config.Default().Deletion, schema, discardLogger)
+	userService.Database = db
+	userService.Audit = newAuditStore(t)
+	return userService
+}
+
+// TestAttributesSchema tests the schemas rejected by the configuration
+func TestAttributesSchema(t *testing.T) {
+	schema, err := config.AttributesConfig{}.Schema()
+	assert.NoError(t, err)
+	assert.Nil(t, schema, "the attributes are optional")
+
+	for name, content := range map[string]string{
+		"not json":      `{"type": "object"`,
+		"not an object": `{"type": "string"}`,
+		"invalid":       `{"type": "object", "properties": {"phone": {"type": "phone"}}}`,
+	} {
+		_, err := writeAttributesSchema(t, content).Schema()
+		assert.Error(t, err, name)
+	}
+	_, err = config.AttributesConfig{SchemaFile: filepath.Join(t.TempDir(), "missing.json")}.Schema()
+	assert.Error(t, err)
+}
+
+// TestUserAttributes tests that the attributes are validated by the schema when a user is created and updated
+func TestUserAttributes(t *testing.T) {
+	ctx := context.Background()
+	userService := newAttributesService(t, newUserStore(t))
+
+	alice := *models.NewUser("alice", "hash")
+	alice.Attributes = models.Attributes{"department": "sales", "phone": "+33123456789", "employee_id": float64(42),
+		"address": map[string]interface{}{"city": "Paris"}}
+	_, err := userService.CreateUser(ctx, alice)
+	require.NoError(t, err)
+	found, err := userService.SearchUserByUsername(ctx, "alice")
+	require.NoError(t, err)
+	assert.Equal(t, alice.Attributes, found.Attributes)
+
+	var validationErr *services.ValidationError
+	for field, attributes := range map[string]models.Attributes{
+		"attributes.phone":       {"phone": "0123"},
+		"attributes.employee_id": {"employee_id": 4.2},
+		"attributes.locale":      {"locale": "de-DE"},
+		"attributes.address":     {"address": "Paris"},
+		"attributes":             {"badge": "blue"},
+	} {
+		bob := *models.NewUser("bob", "hash")
+		bob.Attributes = attributes
+		_, err := userService.CreateUser(ctx, bob)
+		if assert.ErrorAs(t, err, &validationErr, field) {
+			assert.Equal(t, field, validationErr.Field)
+		}
+	}
+
+	remote := models.Attributes{"department": "support", "remote": true}
+	updated, err := userService.UpdateUser(ctx, alice.ID.Hex(), 0, services.UserChanges{Attributes: &remote})
+	require.NoError(t, err)
+	assert.Equal(t, remote, updated.Attributes, "the attributes should be replaced")
+	assert.Equal(t, int64(1), updated.Version)
+
+	invalid := models.Attributes{"remote": "yes"}
+	_, err = userService.UpdateUser(ctx, alice.ID.Hex(), 1, services.UserChanges{Attributes: &invalid})
+	assert.ErrorAs(t, err, &validationErr)
+
+	none := models.Attributes{}
+	updated, err = userService.UpdateUser(ctx, alice.ID.Hex(), 1, services.UserChanges{Attributes: &none})
+	require.NoError(t, err)
+	assert.Empty(t, updated.Attributes)
+
+	// without schema, the users have no attributes
+	withoutSchema := newMemoryService(t)
+	_, err = withoutSchema.CreateUser(ctx, alice)
+	assert.ErrorAs(t, err, &validationErr)
+	bob := *models.NewUser("bob", "hash")
+	_, err = withoutSchema.CreateUser(ctx, bob)
+	assert.NoError(t, err)
+}
+
+// TestImportAttributes tests that the attributes of an NDJSON import are validated, and exported
+func TestImportAttributes(t *testing.T) {
+	ctx := context.Background()
+	userService := newAttributesService(t, newUserStore(t))
+
+	input := `{"username":"alice","password":"secret","attributes":{"department":"sales"}}
+{"username":"bob","password":"secret","attributes":{"employee_id":"B12"}}
+`
+	result, err := userService.ImportUsers(ctx, strings.NewReader(input), services.ImportOptions{Format: services.FormatNDJSON})
+	require.NoError(t, err)
+	assert.Equal(t, 1, result.Created)
+	if assert.Equal(t, 1, result.Failed) {
+		assert.Equal(t, 2, result.Errors[0].Row)
+		assert.Contains(t, result.Errors[0].Reason, "attributes.employee_id")
+	}
+
+	var out strings.Builder
+	_, err = userService.ExportUsers(ctx, &out, services.FormatNDJSON)
+	require.NoError(t, err)
+	assert.Contains(t, out.String(), `"attributes":{"department":"sales"}`)
+}
+
+// TestSearchUsersByAttributes tests the search of the users by their attributes,
+// on every backend of the conformance suite
+func TestSearchUsersByAttributes(t *testing.T) {
+	for _, fixture := range storeFixtures {
+		fixture := fixture
+		t.Run(fixture.name, func(t *testing.T) {
+			ctx := context.Background()
+			userService := newAttributesService(t, fixture.open(t))
+			for _, user := range []struct {
+				username   string
+				attributes models.Attributes
+			}{
+				{"alice", models.Attributes{"department": "sales", "employee_id": float64(1), "remote": true}},
+				{"bob", models.Attributes{"department": "sales", "employee_id": float64(2), "remote": false}},
+				{"carol", models.Attributes{"department": "support", "employee_id": float64(3)}},
+				{"dave", nil},
+			} {
+				created := *models.NewUser(user.username, "hash")
+				created.Attributes = user.attributes
+				_, err := userService.CreateUser(ctx, created)
+				require.NoError(t, err)
+			}
+			carol, err := userService.SearchUserByUsername(ctx, "carol")
+			require.NoError(t, err)
+			assert.Equal(t, models.Attributes{"department": "support", "employee_id": float64(3)}, carol.Attributes)
+
+			for _, tt := range []struct {
+				query map[string]string
+				want  []string
+			}{
+				{map[string]string{"department": "sales"}, []string{"alice", "bob"}},
+				{map[string]string{"department": "sales", "remote": "true"}, []string{"alice"}},
+				{map[string]string{"remote": "false"}, []string{"bob"}},
+				{map[string]string{"employee_id": "3"}, []string{"carol"}},
+				{map[string]string{"department": "marketing"}, []string{}},
+			} {
+				found, err := userService.SearchUsersByAttributes(ctx, tt.query)
+				require.NoError(t, err, tt.query)
+				assert.ElementsMatch(t, tt.want, usernames(found), tt.query)
+			}
+
+			// a deleted user isn't found
+			_, err = userService.DeleteUser(ctx, carol.ID.Hex())
+			require.NoError(t, err)
+			found, err := userService.SearchUsersByAttributes(ctx, map[string]string{"employee_id": "3"})
+			require.NoError(t, err)
+			assert.Empty(t, found)
+
+			var validationErr *services.ValidationError
+			for _, query := range []map[string]string{{}, {"badge": "blue"}, {"address": "Paris"}, {"employee_id": "one"}} {
+				_, err := userService.SearchUsersByAttributes(ctx, query)
+				assert.ErrorAs(t, err, &validationErr, query)
+			}
+		})
+	}
+}
+
+// TestAttributesHandlers tests the attributes of POST /register, PATCH /users/:id and GET /search
+func TestAttributesHandlers(t *testing.T) {
+	id := primitive.NewObjectID()
+	sales := []models.User{{ID: id, Username: "alice", Attributes: models.Attributes{"department": "sales"}}}
+	attributes := models.Attributes{"department": "sales"}
+
+	tests := []struct {
+		name         string
+		method       string
+		path         string
+		header       string
+		body         string
+		mockSetup    func(m *MockUserService)
+		expectedCode int
+		expectedBody string
+	}{
+		{
+			name:   "register with attributes",
+			method: http.MethodPost,
+			path:   "/register",
+			body:   `{"username":"alice","password":"secret","attributes":{"department":"sales"}}`,
+			mockSetup: func(m *MockUserService) {
+				m.On("CreateUser", mock.Anything, mock.MatchedBy(func(u models.User) bool {
+					return u.Username == "alice" && u.Attributes["department"] == "sales"
+				})).Return(models.User{Username: "alice", Attributes: models.Attributes{"department": "sales"}}, nil)
+				m.On("RecordEvent", mock.Anything, mock.Anything).Return(nil)
+			},
+			expectedCode: http.StatusOK,
+			expectedBody: `"attributes":{"department":"sales"}`,
+		},
+		{
+			name:   "register with invalid attributes",
+			method: http.MethodPost,
+			path:   "/register",
+			body:   `{"username":"alice","password":"secret","attributes":{"phone":"0123"}}`,
+			mockSetup: func(m *MockUserService) {
+				m.On("CreateUser", mock.Anything, mock.Anything).
+					Return(models.User{}, &services.ValidationError{Field: "attributes.phone", Reason: "does not match pattern"})
+			},
+			expectedCode: http.StatusBadRequest,
+			expectedBody: "attributes.phone",
+		},
+		{
+			name:   "search by attributes",
+			method: http.MethodGet,
+			path:   "/search?attributes.department=sales",
+			mockSetup: func(m *MockUserService) {
+				m.On("SearchUsersByAttributes", mock.Anything, map[string]string{"department": "sales"}).Return(sales, nil)
+			},
+			expectedCode: http.StatusOK,
+			expectedBody: `[{"id":"` + id.Hex() + `","username":"alice"`,
+		},
+		{
+			name:   "search by an undeclared attribute",
+			method: http.MethodGet,
+			path:   "/search?attributes.badge=blue",
+			mockSetup: func(m *MockUserService) {
+				m.On("SearchUsersByAttributes", mock.Anything, map[string]string{"badge": "blue"}).
+					Return([]models.User(nil), &services.ValidationError{Field: "attributes.badge", Reason: "is not a declared attribute"})
+			},
+			expectedCode: http.StatusBadRequest,
+		},
+		{
+			name:   "update attributes",
+			method: http.MethodPatch,
+			path:   "/users/" + id.Hex(),
+			header: "Bearer s3cret",
+			body:   `{"attributes":{"department":"sales"}}`,
+			mockSetup: func(m *MockUserService) {
+				m.On("UpdateUser", mock.Anything, id.Hex(), int64(0), services.UserChanges{Attributes: &attributes}).
+					Return(sales[0], nil)
+				m.On("RecordEvent", mock.Anything, mock.MatchedBy(func(e models.AuditEvent) bool {
+					return e.Type == models.EventAttributesChanged && e.Actor == "admin" && e.Target == "alice"
+				})).Return(nil)
+			},
+			expectedCode: http.StatusOK,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockUserService := new(MockUserService)
+			if tt.mockSetup != nil {
+				tt.mockSetup(mockUserService)
+			}
+			server := handlers.NewServer(mockUserService, config.ServerConfig{AdminToken: "s3cret"}, discardLogger)
+			server.SetupRoute()
+
+			req, _ := http.NewRequest(tt.method, tt.path, strings.NewReader(tt.body))
+			if tt.header != "" {
+				req.Header.Set("Authorization", tt.header)
+				req.Header.Set("If-Match", `"0"`)
+			}
+			w := httptest.NewRecorder()
+			server.GetRouter().ServeHTTP(w, req)
+
+			assert.Equal(t, tt.expectedCode, w.Code)
+			assert.Contains(t, w.Body.String(), tt.expectedBody)
+			mockUserService.AssertExpectations(t)
+		})
+	}
+}
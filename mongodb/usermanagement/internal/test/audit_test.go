@@ -0,0 +1,312 @@
+package test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	"usermanagement/internal/config"
+	"usermanagement/internal/handlers"
+	"usermanagement/internal/models"
+	"usermanagement/internal/services"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+// newAuditService returns a UserService with the audit log in memory
+func newAuditService(db models.CURDInterface) *services.UserService {
+	userService := services.NewUserService(config.DatabaseConfig{Memory: true}, discardLogger)
+	userService.Audit = db
+	return userService
+}
+
+func TestAuditChain(t *testing.T) {
+	ctx := context.Background()
+	db := newAuditStore(t)
+	userService := newAuditService(db)
+
+	for _, eventType := range []string{models.EventUserRegistered, models.EventLoginFailed, models.EventLoginSucceeded} {
+		err := userService.RecordEvent(ctx, models.AuditEvent{Type: eventType, Actor: "alice", Target: "alice", IP: "10.0.0.1"})
+		assert.NoError(t, err)
+	}
+
+	recorded := storeEvents(t, db)
+	if assert.Len(t, recorded, 3) {
+		assert.Equal(t, "", recorded[0].PrevHash, "the first event should start the chain")
+		assert.Equal(t, recorded[0].Hash, recorded[1].PrevHash)
+		assert.Equal(t, recorded[1].Hash, recorded[2].PrevHash)
+		assert.Equal(t, recorded[2].Timestamp, recorded[2].Timestamp.Truncate(time.Millisecond))
+	}
+
+	result, err := userService.VerifyAuditLog(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(3), result.Events)
+	assert.Equal(t, recorded[2].Hash, result.LastHash)
+
+	tests := []struct {
+		name       string
+		tamper     func(events []models.AuditEvent) []models.AuditEvent
+		expectSeq  int64
+		expectText string
+	}{
+		{
+			name: "changed event",
+			tamper: func(events []models.AuditEvent) []models.AuditEvent {
+				events[1].Type = models.EventLoginSucceeded
+				return events
+			},
+			expectSeq:  2,
+			expectText: "hash doesn't match the content",
+		},
+		{
+			name: "changed and rehashed event",
+			tamper: func(events []models.AuditEvent) []models.AuditEvent {
+				events[1].Type = models.EventLoginSucceeded
+				events[1].Hash = events[1].ComputeHash()
+				return events
+			},
+			expectSeq:  3,
+			expectText: "previous hash",
+		},
+		{
+			name: "removed event",
+			tamper: func(events []models.AuditEvent) []models.AuditEvent {
+				return append(events[:1], events[2:]...)
+			},
+			expectSeq:  3,
+			expectText: "expected event 2",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tampered := newAuditService(newAuditStore(t, tt.tamper(storeEvents(t, db))...))
+
+			_, err := tampered.VerifyAuditLog(ctx)
+
+			var chainErr *services.ChainError
+			if assert.ErrorAs(t, err, &chainErr) {
+				assert.Equal(t, tt.expectSeq, chainErr.Seq)
+				assert.Contains(t, chainErr.Reason, tt.expectText)
+			}
+		})
+	}
+}
+
+// TestRecordEventLongFields tests that the fields given by the clients are truncated to the MySQL columns,
+// rather than failing the insert, and the truncated event is hashed
+func TestRecordEventLongFields(t *testing.T) {
+	mysql := models.NewMySQL()
+	mysql.DB = openMySQL(t)
+	setupStore(t, mysql)
+
+	for name, db := range map[string]models.CURDInterface{"memory": newAuditStore(t), "mysql": mysql} {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			userService := newAuditService(db)
+
+			err := userService.RecordEvent(ctx, models.AuditEvent{
+				Type: models.EventLoginFailed, Actor: strings.Repeat("é", 300), Target: strings.Repeat("a", 300),
+				IP: "10.0.0.1", UserAgent: strings.Repeat("x", 1024),
+				// whole seconds, the MySQL test server drops the fractions of the prepared statements
+				Timestamp: time.Now().Truncate(time.Second),
+			})
+			require.NoError(t, err)
+
+			events, err := userService.QueryEvents(ctx, services.AuditFilter{})
+			require.NoError(t, err)
+			if assert.Len(t, events, 1) {
+				assert.Equal(t, strings.Repeat("é", 255), events[0].Actor)
+				assert.Equal(t, strings.Repeat("a", 255), events[0].Target)
+				assert.Equal(t, strings.Repeat("x", 512), events[0].UserAgent)
+			}
+			_, err = userService.VerifyAuditLog(ctx)
+			assert.NoError(t, err)
+		})
+	}
+}
+
+// TestRecordEventConcurrentAppend tests that an event appended by another replica at the same time
+// makes RecordEvent retry after it instead of forking the chain
+func TestRecordEventConcurrentAppend(t *testing.T) {
+	ctx := context.Background()
+	db := &hookedDB{CURDInterface: newAuditStore(t)}
+	other := newAuditService(db)
+
+	db.beforeCreate = func() {
+		// the other replica wins the race once
+		db.beforeCreate = nil
+		assert.NoError(t, other.RecordEvent(ctx, models.AuditEvent{Type: models.EventLoginFailed, Actor: "bob"}))
+	}
+
+	err := newAuditService(db).RecordEvent(ctx, models.AuditEvent{Type: models.EventLoginSucceeded, Actor: "alice"})
+	assert.NoError(t, err)
+
+	recorded := storeEvents(t, db)
+	if assert.Len(t, recorded, 2) {
+		assert.Equal(t, "bob", recorded[0].Actor)
+		assert.Equal(t, "alice", recorded[1].Actor)
+		assert.Equal(t, int64(2), recorded[1].Seq)
+	}
+	_, err = other.VerifyAuditLog(ctx)
+	assert.NoError(t, err)
+}
+
+// TestRecordEventConcurrentRequests tests that the requests of one process appending at the same time
+// all get their event in one chain, without waiting for each other's round trips
+func TestRecordEventConcurrentRequests(t *testing.T) {
+	ctx := context.Background()
+	userService := newAuditService(newAuditStore(t))
+
+	const n = 30
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			assert.NoError(t, userService.RecordEvent(ctx, models.AuditEvent{Type: models.EventLoginSucceeded, Actor: fmt.Sprint("user", i)}))
+		}(i)
+	}
+	wg.Wait()
+
+	verification, err := userService.VerifyAuditLog(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(n), verification.Events)
+}
+
+// TestRecordEventGivesUp tests that RecordEvent fails after a bounded number of attempts
+// when another replica always wins the race
+func TestRecordEventGivesUp(t *testing.T) {
+	ctx := context.Background()
+	db := &hookedDB{CURDInterface: newAuditStore(t)}
+	other := newAuditService(db)
+
+	var race func()
+	race = func() {
+		db.beforeCreate = nil
+		assert.NoError(t, other.RecordEvent(ctx, models.AuditEvent{Type: models.EventLoginFailed, Actor: "bob"}))
+		db.beforeCreate = race
+	}
+	db.beforeCreate = race
+
+	err := newAuditService(db).RecordEvent(ctx, models.AuditEvent{Type: models.EventLoginSucceeded, Actor: "alice"})
+	var storageErr *services.StorageError
+	assert.ErrorAs(t, err, &storageErr)
+	assert.ErrorContains(t, err, "too many concurrent appends")
+
+	db.beforeCreate = nil
+	verification, err := other.VerifyAuditLog(ctx)
+	assert.NoError(t, err)
+	assert.Less(t, verification.Events, int64(100), "the attempts should be bounded")
+}
+
+func TestHandleGetAudit(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	tests := []struct {
+		name         string
+		adminToken   string
+		header       string
+		query        string
+		mockSetup    func(m *MockUserService)
+		expectedCode int
+	}{
+		{
+			name:         "disabled without admin token",
+			header:       "Bearer ",
+			expectedCode: http.StatusUnauthorized,
+		},
+		{
+			name:         "missing token",
+			adminToken:   "s3cret",
+			expectedCode: http.StatusUnauthorized,
+		},
+		{
+			name:         "wrong token",
+			adminToken:   "s3cret",
+			header:       "Bearer wrong",
+			expectedCode: http.StatusUnauthorized,
+		},
+		{
+			name:       "filters",
+			adminToken: "s3cret",
+			header:     "Bearer s3cret",
+			query:      "?type=login.failed&target=alice&since=2023-09-01T00:00:00Z&before=42&limit=10",
+			mockSetup: func(m *MockUserService) {
+				m.On("QueryEvents", mock.Anything, services.AuditFilter{
+					Type:      models.EventLoginFailed,
+					Target:    "alice",
+					Since:     time.Date(2023, 9, 1, 0, 0, 0, 0, time.UTC),
+					BeforeSeq: 42,
+					Limit:     10,
+				}).Return([]models.AuditEvent{{Seq: 41, Type: models.EventLoginFailed, Target: "alice"}}, nil)
+			},
+			expectedCode: http.StatusOK,
+		},
+		{
+			name:         "invalid since",
+			adminToken:   "s3cret",
+			header:       "Bearer s3cret",
+			query:        "?since=yesterday",
+			expectedCode: http.StatusBadRequest,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockUserService := new(MockUserService)
+			if tt.mockSetup != nil {
+				tt.mockSetup(mockUserService)
+			}
+			server := handlers.NewServer(mockUserService, config.ServerConfig{AdminToken: tt.adminToken}, discardLogger)
+			server.SetupRoute()
+
+			req, _ := http.NewRequest(http.MethodGet, "/audit"+tt.query, nil)
+			if tt.header != "" {
+				req.Header.Set("Authorization", tt.header)
+			}
+			w := httptest.NewRecorder()
+			server.GetRouter().ServeHTTP(w, req)
+
+			assert.Equal(t, tt.expectedCode, w.Code, w.Body.String())
+			if tt.expectedCode == http.StatusUnauthorized {
+				assert.Equal(t, `Bearer realm="admin"`, w.Header().Get("WWW-Authenticate"))
+			}
+			mockUserService.AssertExpectations(t)
+		})
+	}
+}
+
+// TestLoginRecordsAuditEvent tests that a failed login is audited with the client of the request
+func TestLoginRecordsAuditEvent(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	mockUserService := new(MockUserService)
+	mockUserService.On("SearchUserForLogin", mock.Anything, "alice").Return(models.User{}, services.ErrNotFound)
+	mockUserService.On("RecordEvent", mock.Anything, mock.MatchedBy(func(e models.AuditEvent) bool {
+		return e.Type == models.EventLoginFailed && e.Actor == "alice" && e.Target == "alice" &&
+			e.IP == "192.0.2.1" && e.UserAgent == "test-agent"
+	})).Return(nil)
+
+	server := handlers.NewServer(mockUserService, config.ServerConfig{}, discardLogger)
+	server.SetupRoute()
+
+	body, _ := json.Marshal(map[string]string{"username": "alice", "password": "wrong"})
+	req, _ := http.NewRequest(http.MethodPost, "/login", bytes.NewBuffer(body))
+	req.RemoteAddr = "192.0.2.1:1234"
+	req.Header.Set("User-Agent", "test-agent")
+	w := httptest.NewRecorder()
+	server.GetRouter().ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	mockUserService.AssertExpectations(t)
+}
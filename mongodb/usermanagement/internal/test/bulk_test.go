@@ -0,0 +1,452 @@
+package test
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"usermanagement/internal/config"
+	"usermanagement/internal/handlers"
+	"usermanagement/internal/models"
+	"usermanagement/internal/services"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// argon2idHash hashes password like the usual argon2 tools, with small parameters to be fast
+func argon2idHash(password string) string {
+	salt := []byte("0123456789abcdef")
+	key := argon2.IDKey([]byte(password), salt, 1, 64, 1, 32)
+	return fmt.Sprintf("$argon2id$v=%d$m=64,t=1,p=1$%s$%s", argon2.Version,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key))
+}
+
+func TestPasswordHashes(t *testing.T) {
+	bcryptHash, _ := bcrypt.GenerateFromPassword([]byte("testpass"), bcrypt.MinCost)
+
+	for _, hash := range []string{string(bcryptHash), argon2idHash("testpass")} {
+		assert.NoError(t, services.ValidatePasswordHash(hash))
+		assert.NoError(t, services.ComparePassword(hash, "testpass"))
+		assert.ErrorIs(t, services.ComparePassword(hash, "wrong"), services.ErrPasswordMismatch)
+	}
+
+	for _, hash := range []string{
+		"testpass",
+		"$argon2d$v=19$m=64,t=1,p=1$MDEyMzQ1Njc4OWFiY2RlZg$MDEyMzQ1Njc4OWFiY2RlZg",
+		"$argon2id$v=19$m=4194304,t=1,p=1$MDEyMzQ1Njc4OWFiY2RlZg$MDEyMzQ1Njc4OWFiY2RlZg",
+		"$argon2id$v=19$m=64,t=1,p=1$not base64!$MDEyMzQ1Njc4OWFiY2RlZg",
+	} {
+		assert.Error(t, services.ValidatePasswordHash(hash), hash)
+	}
+}
+
+func TestImportUsers(t *testing.T) {
+	bcryptHash, _ := bcrypt.GenerateFromPassword([]byte("testpass"), bcrypt.MinCost)
+	existingID := primitive.NewObjectID()
+	csvFile := "username,password,password_hash,roles,locked\n" +
+		"alice,alicepass,,,\n" +
+		"bob,," + string(bcryptHash) + ",\"admin,support\",true\n" +
+		"carol,,\"" + argon2idHash("carolpass") + "\",,\n" +
+		"dave,,,,\n" +
+		"erin,erinpass,,Admin,\n" +
+		"alice,otherpass,,,\n" +
+		"frank,frankpass,,,maybe\n" +
+		"grace,gracepass\n" +
+		"existing,newpass,,support,\n"
+
+	tests := []struct {
+		name          string
+		opts          services.ImportOptions
+		expected      services.ImportResult
+		expectedUsers int
+	}{
+		{
+			name:          "create",
+			opts:          services.ImportOptions{Format: services.FormatCSV, Mode: services.ImportCreate},
+			expected:      services.ImportResult{Rows: 9, Created: 3, Failed: 6},
+			expectedUsers: 4,
+		},
+		{
+			name:          "skip existing",
+			opts:          services.ImportOptions{Format: services.FormatCSV, Mode: services.ImportSkipExisting},
+			expected:      services.ImportResult{Rows: 9, Created: 3, Skipped: 1, Failed: 5},
+			expectedUsers: 4,
+		},
+		{
+			name:          "upsert",
+			opts:          services.ImportOptions{Format: services.FormatCSV, Mode: services.ImportUpsert},
+			expected:      services.ImportResult{Rows: 9, Created: 3, Updated: 1, Failed: 5},
+			expectedUsers: 4,
+		},
+		{
+			name:          "dry run",
+			opts:          services.ImportOptions{Format: services.FormatCSV, Mode: services.ImportUpsert, DryRun: true},
+			expected:      services.ImportResult{Rows: 9, Created: 3, Updated: 1, Failed: 5, DryRun: true},
+			expectedUsers: 1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			userService := newMemoryService(t, models.User{ID: existingID, Username: "existing", Password: "oldhash"})
+
+			result, err := userService.ImportUsers(context.Background(), strings.NewReader(csvFile), tt.opts)
+			require.NoError(t, err)
+
+			assert.Equal(t, tt.expected.Rows, result.Rows)
+			assert.Equal(t, tt.expected.Created, result.Created)
+			assert.Equal(t, tt.expected.Updated, result.Updated)
+			assert.Equal(t, tt.expected.Skipped, result.Skipped)
+			assert.Equal(t, tt.expected.Failed, result.Failed)
+			assert.Equal(t, tt.expected.DryRun, result.DryRun)
+			assert.Len(t, result.Errors, result.Failed)
+			users := storeUsers(t, userService.Database)
+			assert.Len(t, users, tt.expectedUsers)
+
+			// the rows are the lines of the file
+			rows := make(map[int]string)
+			for _, rowErr := range result.Errors {
+				rows[rowErr.Row] = rowErr.Reason
+			}
+			assert.Contains(t, rows[5], "password")
+			assert.Contains(t, rows[6], "roles")
+			assert.Contains(t, rows[7], "row 2")
+			assert.Contains(t, rows[8], "locked")
+			assert.Contains(t, rows[9], "number of fields")
+
+			if tt.opts.DryRun {
+				return
+			}
+			_, i := findUser(users, "alice")
+			assert.NoError(t, services.ComparePassword(users[i].Password, "alicepass"), "the plain password should be hashed")
+			_, i = findUser(users, "bob")
+			assert.Equal(t, string(bcryptHash), users[i].Password)
+			assert.Equal(t, []string{"admin", "support"}, users[i].Roles)
+			assert.True(t, users[i].Locked)
+
+			_, i = findUser(users, "existing")
+			assert.Equal(t, existingID, users[i].ID)
+			if tt.opts.Mode == services.ImportUpsert {
+				assert.NoError(t, services.ComparePassword(users[i].Password, "newpass"))
+				assert.Equal(t, []string{"support"}, users[i].Roles)
+			} else {
+				assert.Equal(t, "oldhash", users[i].Password)
+			}
+		})
+	}
+}
+
+// TestImportUsersUpsertFields tests that an upsert keeps the fields of the user that aren't in the file
+func TestImportUsersUpsertFields(t *testing.T) {
+	tests := []struct {
+		name     string
+		format   services.Format
+		file     string
+		expected models.User
+	}{
+		{
+			name:     "csv without roles and lock",
+			format:   services.FormatCSV,
+			file:     "username,password,status\nalice,newpass,suspended\n",
+			expected: models.User{Roles: []string{"admin"}, Locked: true, Status: models.StatusSuspended, Attributes: models.Attributes{"department": "sales"}},
+		},
+		{
+			name:     "csv with every column",
+			format:   services.FormatCSV,
+			file:     "username,password,roles,locked,status\nalice,newpass,,false,\n",
+			expected: models.User{Roles: []string{}, Status: models.StatusActive, Attributes: models.Attributes{"department": "sales"}},
+		},
+		{
+			name:     "ndjson with attributes",
+			format:   services.FormatNDJSON,
+			file:     `{"username":"alice","password":"newpass","attributes":{"department":"support"}}` + "\n",
+			expected: models.User{Roles: []string{"admin"}, Locked: true, Status: models.StatusActive, Attributes: models.Attributes{"department": "support"}},
+		},
+		{
+			name:     "ndjson with lock",
+			format:   services.FormatNDJSON,
+			file:     `{"username":"alice","password":"newpass","locked":false}` + "\n",
+			expected: models.User{Roles: []string{"admin"}, Status: models.StatusActive, Attributes: models.Attributes{"department": "sales"}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			schema, err := services.NewAttributeSchema(writeAttributesSchema(t, attributesSchema))
+			require.NoError(t, err)
+			userService := services.NewUserServiceWithBackend(nil, nil, config.Default().Deletion, schema, discardLogger)
+			userService.Database = newUserStore(t, models.User{ID: primitive.NewObjectID(), Username: "alice", Password: "oldhash",
+				Roles: []string{"admin"}, Locked: true, Status: models.StatusActive, Attributes: models.Attributes{"department": "sales"}})
+			userService.Audit = newAuditStore(t)
+
+			result, err := userService.ImportUsers(context.Background(), strings.NewReader(tt.file), services.ImportOptions{Format: tt.format, Mode: services.ImportUpsert})
+			require.NoError(t, err)
+			require.Equal(t, 1, result.Updated, result.Errors)
+
+			user, _ := findUser(storeUsers(t, userService.Database), "alice")
+			assert.NoError(t, services.ComparePassword(user.Password, "newpass"))
+			assert.Equal(t, tt.expected.Roles, user.Roles)
+			assert.Equal(t, tt.expected.Locked, user.Locked)
+			assert.Equal(t, tt.expected.Status, user.Status)
+			assert.Equal(t, tt.expected.Attributes, user.Attributes)
+		})
+	}
+}
+
+// TestImportUsersBatches tests that a large import is inserted by batches
+func TestImportUsersBatches(t *testing.T) {
+	var file bytes.Buffer
+	hash := argon2idHash("testpass")
+	for i := 0; i < 1234; i++ {
+		line, _ := json.Marshal(services.UserRecord{Username: fmt.Sprintf("user%d", i), PasswordHash: hash})
+		file.Write(append(line, '\n'))
+	}
+
+	db := newUserStore(t)
+	batches := 0
+	userService := newMemoryService(t)
+	userService.Database = &countingUserDB{CURDInterface: db, creates: &batches}
+
+	result, err := userService.ImportUsers(context.Background(), &file, services.ImportOptions{Format: services.FormatNDJSON})
+	require.NoError(t, err)
+	assert.Equal(t, 1234, result.Created)
+	assert.Len(t, storeUsers(t, db), 1234)
+	assert.Equal(t, 3, batches)
+}
+
+// TestImportUsersPlainPasswords tests that the plain passwords of a batch, hashed in parallel,
+// are each the hash of the password of their row
+func TestImportUsersPlainPasswords(t *testing.T) {
+	var file bytes.Buffer
+	for i := 0; i < 20; i++ {
+		line, _ := json.Marshal(services.UserRecord{Username: fmt.Sprintf("user%d", i), Password: fmt.Sprintf("pass%d", i)})
+		file.Write(append(line, '\n'))
+	}
+	userService := newMemoryService(t, models.User{ID: primitive.NewObjectID(), Username: "user0", Password: "oldhash"})
+
+	result, err := userService.ImportUsers(context.Background(), &file, services.ImportOptions{Format: services.FormatNDJSON, Mode: services.ImportUpsert})
+	require.NoError(t, err)
+	assert.Equal(t, 19, result.Created)
+	assert.Equal(t, 1, result.Updated)
+
+	users := storeUsers(t, userService.Database)
+	require.Len(t, users, 20)
+	for i := 0; i < 20; i++ {
+		_, j := findUser(users, fmt.Sprintf("user%d", i))
+		require.GreaterOrEqual(t, j, 0)
+		assert.NoError(t, services.ComparePassword(users[j].Password, fmt.Sprintf("pass%d", i)), users[j].Username)
+	}
+}
+
+// countingUserDB counts the calls of Create
+type countingUserDB struct {
+	models.CURDInterface
+	creates *int
+}
+
+func (c *countingUserDB) Create(ctx context.Context, item interface{}) error {
+	*c.creates++
+	return c.CURDInterface.Create(ctx, item)
+}
+
+func TestExportUsers(t *testing.T) {
+	hash := argon2idHash("testpass")
+	users := []models.User{
+		{ID: primitive.NewObjectID(), Username: "alice", Password: hash, Roles: []string{"admin", "support"}, Status: models.StatusActive},
+		{ID: primitive.NewObjectID(), Username: "bob", Password: hash, Locked: true, Status: models.StatusSuspended},
+	}
+	userService := newMemoryService(t, users...)
+	db := userService.Database
+
+	var csvFile bytes.Buffer
+	n, err := userService.ExportUsers(context.Background(), &csvFile, services.FormatCSV)
+	require.NoError(t, err)
+	assert.Equal(t, 2, n)
+	// the argon2 hashes have commas
+	assert.Equal(t, "id,username,password_hash,roles,locked,status\n"+
+		users[0].ID.Hex()+",alice,\""+hash+"\",\"admin,support\",false,active\n"+
+		users[1].ID.Hex()+",bob,\""+hash+"\",,true,suspended\n", csvFile.String())
+
+	// an export imports back as is
+	imported := newUserStore(t)
+	userService.Database = imported
+	result, err := userService.ImportUsers(context.Background(), &csvFile, services.ImportOptions{Format: services.FormatCSV})
+	require.NoError(t, err)
+	assert.Equal(t, 2, result.Created)
+	assert.Equal(t, users, withoutTimes(storeUsers(t, imported)...))
+
+	var ndjson bytes.Buffer
+	userService.Database = db
+	_, err = userService.ExportUsers(context.Background(), &ndjson, services.FormatNDJSON)
+	require.NoError(t, err)
+	assert.NotContains(t, ndjson.String(), `"password"`)
+	assert.Contains(t, ndjson.String(), `"password_hash":"`+hash+`"`)
+}
+
+func TestHandleBulkUsers(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	tests := []struct {
+		name         string
+		method       string
+		path         string
+		header       string
+		contentType  string
+		body         string
+		mockSetup    func(m *MockUserService)
+		expectedCode int
+		expectedBody string
+	}{
+		{
+			name:         "import without token",
+			method:       http.MethodPost,
+			path:         "/admin/users/import",
+			contentType:  "text/csv",
+			expectedCode: http.StatusUnauthorized,
+		},
+		{
+			name:        "import csv",
+			method:      http.MethodPost,
+			path:        "/admin/users/import?mode=upsert&dry_run=true",
+			header:      "Bearer s3cret",
+			contentType: "text/csv; charset=utf-8",
+			body:        "username,password\nalice,alicepass\n",
+			mockSetup: func(m *MockUserService) {
+				m.On("ImportUsers", mock.Anything, "username,password\nalice,alicepass\n",
+					services.ImportOptions{Format: services.FormatCSV, Mode: services.ImportUpsert, DryRun: true}).
+					Return(services.ImportResult{Rows: 1, Created: 1, DryRun: true, Errors: []services.RowError{}}, nil)
+			},
+			expectedCode: http.StatusOK,
+			expectedBody: `"created":1`,
+		},
+		{
+			name:        "import ndjson",
+			method:      http.MethodPost,
+			path:        "/admin/users/import?format=ndjson",
+			header:      "Bearer s3cret",
+			body:        `{"username":"alice","password":"alicepass"}`,
+			contentType: "application/json",
+			mockSetup: func(m *MockUserService) {
+				m.On("ImportUsers", mock.Anything, mock.Anything,
+					services.ImportOptions{Format: services.FormatNDJSON, Mode: services.ImportCreate}).
+					Return(services.ImportResult{Rows: 1, Created: 1, Errors: []services.RowError{}}, nil)
+				m.On("RecordEvent", mock.Anything, mock.MatchedBy(func(e models.AuditEvent) bool {
+					return e.Type == models.EventUsersImported
+				})).Return(nil)
+			},
+			expectedCode: http.StatusOK,
+		},
+		{
+			name:         "import unknown format",
+			method:       http.MethodPost,
+			path:         "/admin/users/import",
+			header:       "Bearer s3cret",
+			contentType:  "application/json",
+			expectedCode: http.StatusBadRequest,
+		},
+		{
+			name:         "import invalid mode",
+			method:       http.MethodPost,
+			path:         "/admin/users/import?format=csv&mode=replace",
+			header:       "Bearer s3cret",
+			expectedCode: http.StatusBadRequest,
+		},
+		{
+			name:   "export csv",
+			method: http.MethodGet,
+			path:   "/admin/users/export?format=csv",
+			header: "Bearer s3cret",
+			mockSetup: func(m *MockUserService) {
+				m.On("ExportUsers", mock.Anything, mock.Anything, services.FormatCSV).
+					Run(func(args mock.Arguments) {
+						_, _ = args.Get(1).(http.ResponseWriter).Write([]byte("id,username,password_hash,roles,locked\n"))
+					}).
+					Return(0, nil)
+				m.On("RecordEvent", mock.Anything, mock.MatchedBy(func(e models.AuditEvent) bool {
+					return e.Type == models.EventUsersExported && e.Actor == "admin"
+				})).Return(nil)
+			},
+			expectedCode: http.StatusOK,
+			expectedBody: "id,username,password_hash,roles,locked\n",
+		},
+		{
+			name:   "export database down",
+			method: http.MethodGet,
+			path:   "/admin/users/export",
+			header: "Bearer s3cret",
+			mockSetup: func(m *MockUserService) {
+				m.On("ExportUsers", mock.Anything, mock.Anything, services.FormatNDJSON).
+					Return(0, &services.StorageError{Op: "read", Err: fmt.Errorf("connection refused")})
+			},
+			expectedCode: http.StatusServiceUnavailable,
+			expectedBody: "/problems/unavailable",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockUserService := new(MockUserService)
+			if tt.mockSetup != nil {
+				tt.mockSetup(mockUserService)
+			}
+			server := handlers.NewServer(mockUserService, config.ServerConfig{AdminToken: "s3cret"}, discardLogger)
+			server.SetupRoute()
+
+			req, _ := http.NewRequest(tt.method, tt.path, strings.NewReader(tt.body))
+			if tt.header != "" {
+				req.Header.Set("Authorization", tt.header)
+			}
+			if tt.contentType != "" {
+				req.Header.Set("Content-Type", tt.contentType)
+			}
+			w := httptest.NewRecorder()
+			server.GetRouter().ServeHTTP(w, req)
+
+			assert.Equal(t, tt.expectedCode, w.Code, w.Body.String())
+			assert.Contains(t, w.Body.String(), tt.expectedBody)
+			mockUserService.AssertExpectations(t)
+		})
+	}
+}
+
+// TestLoginArgon2 tests that an imported argon2 hash can log in
+func TestLoginArgon2(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	mockUserService := new(MockUserService)
+	mockUserService.On("SearchUserForLogin", mock.Anything, "alice").
+		Return(models.User{Username: "alice", Password: argon2idHash("testpass")}, nil)
+	mockUserService.On("RecordEvent", mock.Anything, mock.Anything).Return(nil)
+	mockUserService.On("RecordLogin", mock.Anything, mock.MatchedBy(func(u models.User) bool { return u.Username == "alice" })).Return(nil)
+
+	server := handlers.NewServer(mockUserService, config.ServerConfig{}, discardLogger)
+	server.SetupRoute()
+
+	for password, expectedCode := range map[string]int{"testpass": http.StatusOK, "wrong": http.StatusUnauthorized} {
+		body, _ := json.Marshal(map[string]string{"username": "alice", "password": password})
+		req, _ := http.NewRequest(http.MethodPost, "/login", bytes.NewBuffer(body))
+		w := httptest.NewRecorder()
+		server.GetRouter().ServeHTTP(w, req)
+		assert.Equal(t, expectedCode, w.Code, password)
+	}
+}
+
+func findUser(users []models.User, username string) (models.User, int) {
+	for i, user := range users {
+		if user.Username == username {
+			return user, i
+		}
+	}
+	return models.User{}, -1
+}
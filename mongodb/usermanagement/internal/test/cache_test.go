@@ -0,0 +1,252 @@
+package test
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+	"usermanagement/internal/cache"
+	"usermanagement/internal/config"
+	"usermanagement/internal/models"
+	"usermanagement/internal/services"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestLRU(t *testing.T) {
+	ctx := context.Background()
+	c := cache.NewLRU(2)
+
+	value := []byte("alice")
+	require.NoError(t, c.Set(ctx, "a", value, time.Minute))
+	value[0] = 'A'
+	got, ok, err := c.Get(ctx, "a")
+	require.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, "alice", string(got), "the cache should keep a copy")
+
+	// a is used after b, so b is evicted first
+	require.NoError(t, c.Set(ctx, "b", []byte("bob"), time.Minute))
+	_, _, _ = c.Get(ctx, "a")
+	require.NoError(t, c.Set(ctx, "c", []byte("carol"), time.Minute))
+	assert.Equal(t, 2, c.Len())
+	_, ok, _ = c.Get(ctx, "b")
+	assert.False(t, ok, "the least recently used key should be evicted")
+	_, ok, _ = c.Get(ctx, "a")
+	assert.True(t, ok)
+
+	require.NoError(t, c.Delete(ctx, "a", "missing"))
+	_, ok, _ = c.Get(ctx, "a")
+	assert.False(t, ok)
+
+	require.NoError(t, c.Set(ctx, "d", []byte("dave"), 10*time.Millisecond))
+	time.Sleep(20 * time.Millisecond)
+	_, ok, _ = c.Get(ctx, "d")
+	assert.False(t, ok, "an expired key should be a miss")
+}
+
+func TestRedisCache(t *testing.T) {
+	ctx := context.Background()
+	server := miniredis.RunT(t)
+	client, err := cache.NewRedisClient("redis://" + server.Addr())
+	require.NoError(t, err)
+	c := cache.NewRedis(client, "test:")
+	defer c.Close()
+
+	require.NoError(t, c.Set(ctx, "a", []byte("alice"), time.Minute))
+	got, ok, err := c.Get(ctx, "a")
+	require.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, "alice", string(got))
+	assert.Equal(t, []string{"test:a"}, server.Keys(), "the keys should be prefixed")
+
+	server.FastForward(2 * time.Minute)
+	_, ok, err = c.Get(ctx, "a")
+	require.NoError(t, err)
+	assert.False(t, ok, "an expired key should be a miss")
+
+	require.NoError(t, c.Set(ctx, "b", []byte("bob"), time.Minute))
+	require.NoError(t, c.Delete(ctx, "b", "missing"))
+	_, ok, _ = c.Get(ctx, "b")
+	assert.False(t, ok)
+	assert.NoError(t, c.Delete(ctx))
+
+	server.Close()
+	_, _, err = c.Get(ctx, "a")
+	assert.Error(t, err)
+}
+
+// withoutPassword returns the user as SearchUserByUsername and SearchUserByID return it, without its password hash
+func withoutPassword(user models.User) models.User {
+	user.Password = ""
+	return user
+}
+
+// readCountingDB counts the calls of Read
+type readCountingDB struct {
+	models.CURDInterface
+	reads atomic.Int64
+}
+
+func (c *readCountingDB) Read(ctx context.Context, filter interface{}, callback func() interface{}) ([]interface{}, error) {
+	c.reads.Add(1)
+	return c.CURDInterface.Read(ctx, filter, callback)
+}
+
+// newCachedService returns a service of db with the cache of cfg
+func newCachedService(t *testing.T, db models.CURDInterface, cfg config.CacheConfig, redisURL string) *services.UserService {
+	userCache, err := services.NewUserCache(cfg, config.RedisConfig{URL: redisURL}, discardLogger)
+	require.NoError(t, err)
+	userService := services.NewUserServiceWithBackend(nil, userCache, config.Default().Deletion, nil, discardLogger)
+	userService.Database = db
+	userService.Audit = newAuditStore(t)
+	t.Cleanup(func() { userService.CloseDB(context.Background()) })
+	return userService
+}
+
+// lruConfig caches the users for a minute
+var lruConfig = config.CacheConfig{Backend: config.CacheLRU, Size: 100, TTL: time.Minute, NegativeTTL: time.Minute}
+
+func TestUserCache(t *testing.T) {
+	ctx := context.Background()
+	alice := models.User{ID: primitive.NewObjectID(), Username: "alice", Password: "hash"}
+	db := &readCountingDB{CURDInterface: newUserStore(t, alice)}
+	userService := newCachedService(t, db, lruConfig, "")
+
+	for i := 0; i < 3; i++ {
+		user, err := userService.SearchUserByUsername(ctx, "alice")
+		require.NoError(t, err)
+		assert.Equal(t, withoutPassword(alice), user)
+	}
+	user, err := userService.SearchUserByID(ctx, alice.ID.Hex())
+	require.NoError(t, err)
+	assert.Equal(t, withoutPassword(alice), user)
+	assert.Equal(t, int64(1), db.reads.Load(), "the user should be read once")
+
+	// the unknown users are cached too
+	for i := 0; i < 3; i++ {
+		_, err = userService.SearchUserByUsername(ctx, "bob")
+		assert.ErrorIs(t, err, services.ErrNotFound)
+		_, err = userService.SearchUserByID(ctx, primitive.NilObjectID.Hex())
+		assert.ErrorIs(t, err, services.ErrNotFound)
+	}
+	assert.Equal(t, int64(3), db.reads.Load())
+
+	// a change removes the user from the cache
+	require.NoError(t, userService.SetLocked(ctx, "alice", true))
+	user, err = userService.SearchUserByID(ctx, alice.ID.Hex())
+	require.NoError(t, err)
+	assert.True(t, user.Locked)
+
+	// and a new user is found at once
+	bob := models.User{ID: primitive.NewObjectID(), Username: "bob", Password: "hash", Status: models.StatusActive}
+	_, err = userService.CreateUser(ctx, bob)
+	require.NoError(t, err)
+	user, err = userService.SearchUserByUsername(ctx, "bob")
+	require.NoError(t, err)
+	assert.Equal(t, []models.User{withoutPassword(bob)}, withoutTimes(user))
+}
+
+// TestUserCacheErrors tests that the errors of the store aren't cached, and the ones of the cache don't fail a lookup
+func TestUserCacheErrors(t *testing.T) {
+	ctx := context.Background()
+	alice := models.User{ID: primitive.NewObjectID(), Username: "alice", Password: "hash"}
+	db := &failingDB{CURDInterface: newUserStore(t, alice), fail: []string{"Read"}, err: errDatabase}
+	server := miniredis.RunT(t)
+	userService := newCachedService(t, db, config.CacheConfig{Backend: config.CacheRedis, TTL: time.Minute, NegativeTTL: time.Minute}, "redis://"+server.Addr())
+
+	_, err := userService.SearchUserByUsername(ctx, "alice")
+	assert.ErrorIs(t, err, errDatabase)
+	assert.Empty(t, server.Keys(), "an error of the store shouldn't be cached")
+
+	db.fail = nil
+	server.Close()
+	user, err := userService.SearchUserByUsername(ctx, "alice")
+	require.NoError(t, err, "the store should be read without the cache")
+	assert.Equal(t, withoutPassword(alice), user)
+}
+
+// TestUserCacheReplicas tests the cache in Redis shared by two replicas
+func TestUserCacheReplicas(t *testing.T) {
+	ctx := context.Background()
+	alice := models.User{ID: primitive.NewObjectID(), Username: "alice", Password: "hash"}
+	store := newUserStore(t, alice)
+	server := miniredis.RunT(t)
+	cfg := config.CacheConfig{Backend: config.CacheRedis, TTL: time.Minute, NegativeTTL: 5 * time.Second}
+
+	first := &readCountingDB{CURDInterface: store}
+	second := &readCountingDB{CURDInterface: store}
+	replica1 := newCachedService(t, first, cfg, "redis://"+server.Addr())
+	replica2 := newCachedService(t, second, cfg, "redis://"+server.Addr())
+
+	_, err := replica1.SearchUserByUsername(ctx, "alice")
+	require.NoError(t, err)
+	user, err := replica2.SearchUserByUsername(ctx, "alice")
+	require.NoError(t, err)
+	assert.Equal(t, withoutPassword(alice), user)
+	assert.Equal(t, int64(0), second.reads.Load(), "the second replica should use the cache of the first one")
+	cached, err := server.Get("usermanagement:user-cache:user:alice")
+	require.NoError(t, err)
+	assert.NotContains(t, cached, "hash", "the password hash shouldn't be cached")
+
+	// a change on one replica is seen by the other
+	require.NoError(t, replica2.SetRoles(ctx, "alice", []string{"admin"}))
+	user, err = replica1.SearchUserByUsername(ctx, "alice")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"admin"}, user.Roles)
+
+	// the unknown users are cached for the negative TTL
+	_, err = replica1.SearchUserByUsername(ctx, "bob")
+	assert.ErrorIs(t, err, services.ErrNotFound)
+	assert.Equal(t, 5*time.Second, server.TTL("usermanagement:user-cache:user:bob"))
+	assert.Equal(t, time.Minute, server.TTL("usermanagement:user-cache:user:alice"))
+}
+
+// TestCreateUserStaleCache tests that a user created elsewhere while it's cached as not found is a conflict
+func TestCreateUserStaleCache(t *testing.T) {
+	ctx := context.Background()
+	store := newUserStore(t)
+	userService := newCachedService(t, store, lruConfig, "")
+
+	_, err := userService.SearchUserByUsername(ctx, "carol")
+	assert.ErrorIs(t, err, services.ErrNotFound)
+	require.NoError(t, store.Create(ctx, models.User{ID: primitive.NewObjectID(), Username: "carol"}))
+
+	_, err = userService.CreateUser(ctx, models.User{ID: primitive.NewObjectID(), Username: "carol", Password: "hash"})
+	assert.ErrorIs(t, err, services.ErrConflict)
+}
+
+// TestUpdateUserLostReply tests that a change applied by the store but reported as failed,
+// e.g. after a timeout, isn't hidden by the cache of the username
+func TestUpdateUserLostReply(t *testing.T) {
+	ctx := context.Background()
+	alice := models.User{ID: primitive.NewObjectID(), Username: "alice", Password: "hash"}
+	userService := newCachedService(t, &lostReplyDB{CURDInterface: newUserStore(t, alice)}, lruConfig, "")
+
+	_, err := userService.SearchUserByUsername(ctx, "alice")
+	require.NoError(t, err)
+
+	locked := true
+	_, err = userService.UpdateUser(ctx, alice.ID.Hex(), 0, services.UserChanges{Locked: &locked})
+	var storageErr *services.StorageError
+	assert.ErrorAs(t, err, &storageErr)
+
+	found, err := userService.SearchUserByUsername(ctx, "alice")
+	require.NoError(t, err)
+	assert.True(t, found.Locked, "the cached user should be forgotten")
+}
+
+// lostReplyDB applies each CompareAndSwap and fails it, as if the reply was lost
+type lostReplyDB struct {
+	models.CURDInterface
+}
+
+func (l *lostReplyDB) CompareAndSwap(ctx context.Context, filter interface{}, update interface{}) (bool, error) {
+	if _, err := l.CURDInterface.CompareAndSwap(ctx, filter, update); err != nil {
+		return false, err
+	}
+	return false, context.DeadlineExceeded
+}
@@ -0,0 +1,233 @@
+package test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+	"usermanagement/internal/config"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// writeConfigFile writes a YAML configuration file in a temporary directory and returns its path
+func writeConfigFile(t *testing.T, content string) string {
+	path := filepath.Join(t.TempDir(), "config.yml")
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// TestLoadConfigPrecedence tests that the flags override the environment variables,
+// which override the file, which overrides the defaults
+func TestLoadConfigPrecedence(t *testing.T) {
+	path := writeConfigFile(t, `
+server:
+  addr: ":9000"
+database:
+  mongo:
+    uri: mongodb://file:27017
+    database: fromfile
+  read_timeout: 2s
+`)
+	t.Setenv("CONFIG_FILE", path)
+	t.Setenv("MONGO_DATABASE", "fromenv")
+	t.Setenv("DB_READ_TIMEOUT", "3s")
+
+	cfg, err := config.Load([]string{"-db-read-timeout", "4s"})
+	assert.NoError(t, err)
+
+	assert.Equal(t, ":9000", cfg.Server.Addr, "file should override the default")
+	assert.Equal(t, "mongodb://file:27017", cfg.Database.Mongo.URI, "file should be used when nothing overrides it")
+	assert.Equal(t, "fromenv", cfg.Database.Mongo.Database, "environment variable should override the file")
+	assert.Equal(t, 4*time.Second, cfg.Database.ReadTimeout, "flag should override the environment variable")
+	assert.Equal(t, config.Default().Database.WriteTimeout, cfg.Database.WriteTimeout, "default should be kept")
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    string
+		env     map[string]string
+		args    []string
+		wantErr []string
+	}{
+		{
+			name:    "mongo without database",
+			env:     map[string]string{"MONGO_URI": "mongodb://localhost:27017"},
+			wantErr: []string{"database.mongo.database"},
+		},
+		{
+			name: "all problems are reported",
+			env:  map[string]string{"MYSQL_URI": "root:password@tcp(127.0.0.1:3306)/user"},
+			args: []string{"-addr", "8080", "-db-write-timeout", "-1s"},
+			wantErr: []string{
+				"server.addr",
+				"database.write_timeout",
+			},
+		},
+		{
+			name:    "invalid duration in environment",
+			env:     map[string]string{"MYSQL_URI": "root@/user", "DB_READ_TIMEOUT": "soon"},
+			wantErr: []string{"invalid DB_READ_TIMEOUT"},
+		},
+		{
+			name:    "invalid bool flag",
+			env:     map[string]string{"MYSQL_URI": "root@/user"},
+			args:    []string{"-mysql-auto-migrate", "sometimes"},
+			wantErr: []string{"invalid -mysql-auto-migrate"},
+		},
+		{
+			name: "invalid log settings",
+			env:  map[string]string{"MYSQL_URI": "root@/user"},
+			args: []string{"-log-level", "verbose", "-log-format", "xml"},
+			wantErr: []string{
+				"log.level",
+				"log.format",
+			},
+		},
+		{
+			name:    "data file in a missing directory",
+			env:     map[string]string{"DATA_FILE": "/does/not/exist/users.json"},
+			wantErr: []string{"database.json.data_file"},
+		},
+		{
+			name:    "redis cache without redis",
+			env:     map[string]string{"CACHE_BACKEND": "redis"},
+			wantErr: []string{"redis.url"},
+		},
+		{
+			name: "invalid cache settings",
+			env:  map[string]string{"CACHE_BACKEND": "lru", "CACHE_SIZE": "0", "CACHE_NEGATIVE_TTL": "-1s", "REDIS_URL": "http://localhost:6379"},
+			args: []string{"-cache-ttl", "0s"},
+			wantErr: []string{
+				"cache.size",
+				"cache.ttl",
+				"cache.negative_ttl",
+				"redis.url",
+			},
+		},
+		{
+			name: "invalid login throttling",
+			env:  map[string]string{"LOGIN_FAILURE_WINDOW": "0s"},
+			args: []string{"-login-max-failures-per-ip", "-5"},
+			wantErr: []string{
+				"server.login.max_failures_per_ip",
+				"server.login.failure_window",
+			},
+		},
+		{
+			name: "invalid deletion settings",
+			env:  map[string]string{"DELETION_GRACE_PERIOD": "0s", "DELETION_USERNAME": "recycle"},
+			args: []string{"-deletion-purge-interval", "-1m"},
+			wantErr: []string{
+				"deletion.grace_period",
+				"deletion.purge_interval",
+				"deletion.username",
+			},
+		},
+		{
+			name:    "missing attributes schema",
+			args:    []string{"-attributes-schema-file", "/nonexistent/attributes.json"},
+			wantErr: []string{"attributes.schema_file"},
+		},
+		{
+			name:    "unknown cache",
+			args:    []string{"-cache-backend", "memcached"},
+			wantErr: []string{"cache.backend"},
+		},
+		{
+			name:    "invalid int flag",
+			args:    []string{"-cache-size", "many"},
+			wantErr: []string{"invalid -cache-size"},
+		},
+		{
+			name:    "unknown key in file",
+			file:    "database:\n  mongo:\n    url: mongodb://localhost:27017\n",
+			wantErr: []string{"field url not found"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, env := range []string{"CONFIG_FILE", "MONGO_URI", "MONGO_DATABASE", "MYSQL_URI", "DATA_FILE", "MEMORY", "DB_READ_TIMEOUT",
+				"CACHE_BACKEND", "CACHE_SIZE", "CACHE_TTL", "CACHE_NEGATIVE_TTL", "REDIS_URL",
+				"LOGIN_MAX_FAILURES", "LOGIN_MAX_FAILURES_PER_IP", "LOGIN_FAILURE_WINDOW",
+				"DELETION_GRACE_PERIOD", "DELETION_PURGE_INTERVAL", "DELETION_USERNAME", "ATTRIBUTES_SCHEMA_FILE"} {
+				t.Setenv(env, "")
+			}
+			for key, value := range tt.env {
+				t.Setenv(key, value)
+			}
+			args := tt.args
+			if tt.file != "" {
+				args = append([]string{"-config", writeConfigFile(t, tt.file)}, args...)
+			}
+
+			_, err := config.Load(args)
+
+			assert.Error(t, err)
+			for _, want := range tt.wantErr {
+				assert.ErrorContains(t, err, want)
+			}
+		})
+	}
+}
+
+// TestDatabaseBackend tests the choice of the backend, the memory first, then MongoDB, then MySQL, then the JSON file,
+// and none without any of them
+func TestDatabaseBackend(t *testing.T) {
+	d := config.DatabaseConfig{JSON: config.JSONConfig{DataFile: "data/users.json"}}
+	assert.Equal(t, config.BackendJSON, d.Backend())
+	assert.Equal(t, "data/users.audit.json", d.JSON.AuditFile())
+
+	d.MySQL.URI = "root@/user"
+	assert.Equal(t, config.BackendMySQL, d.Backend())
+	d.Mongo.URI = "mongodb://localhost:27017"
+	assert.Equal(t, config.BackendMongo, d.Backend())
+
+	d.Memory = true
+	assert.Equal(t, config.BackendMemory, d.Backend(), "memory should win over the databases")
+
+	assert.Equal(t, "", config.DatabaseConfig{}.Backend(), "the memory should never be a fallback")
+}
+
+// TestLoadConfigWithoutDatabase tests that a server without database is refused,
+// it keeps the users in memory only when it's asked to
+func TestLoadConfigWithoutDatabase(t *testing.T) {
+	for _, env := range []string{"CONFIG_FILE", "MONGO_URI", "MONGO_DATABASE", "MYSQL_URI", "DATA_FILE", "MEMORY"} {
+		t.Setenv(env, "")
+	}
+
+	_, err := config.Load(nil)
+	assert.ErrorContains(t, err, "database: one of")
+	assert.ErrorContains(t, err, "MEMORY=true")
+
+	cfg, err := config.Load([]string{"-memory", "true"})
+	require.NoError(t, err)
+	assert.Equal(t, config.BackendMemory, cfg.Database.Backend())
+}
+
+// TestLoadConfigCacheBackend tests that the user cache is shared in Redis when redis.url is set,
+// unless cache.backend says otherwise
+func TestLoadConfigCacheBackend(t *testing.T) {
+	for _, env := range []string{"CONFIG_FILE", "MONGO_URI", "MYSQL_URI", "DATA_FILE", "CACHE_BACKEND", "REDIS_URL"} {
+		t.Setenv(env, "")
+	}
+	t.Setenv("MEMORY", "true")
+
+	cfg, err := config.Load(nil)
+	require.NoError(t, err)
+	assert.Equal(t, config.CacheLRU, cfg.Cache.Backend)
+
+	t.Setenv("REDIS_URL", "redis://localhost:6379/0")
+	cfg, err = config.Load(nil)
+	require.NoError(t, err)
+	assert.Equal(t, config.CacheRedis, cfg.Cache.Backend)
+
+	cfg, err = config.Load([]string{"-cache-backend", "lru"})
+	require.NoError(t, err)
+	assert.Equal(t, config.CacheLRU, cfg.Cache.Backend)
+}
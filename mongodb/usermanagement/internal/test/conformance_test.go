@@ -0,0 +1,465 @@
+package test
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	"usermanagement/internal/config"
+	"usermanagement/internal/models"
+	"usermanagement/internal/services"
+
+	"github.com/FerretDB/FerretDB/ferretdb"
+	sqle "github.com/dolthub/go-mysql-server"
+	"github.com/dolthub/go-mysql-server/memory"
+	"github.com/dolthub/go-mysql-server/server"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	_ "modernc.org/sqlite"
+)
+
+// The conformance suite runs the same operations on every storage backend, through models.CURDInterface,
+// so a backend behaving differently from the others is found here rather than in production.
+// MongoDB and MySQL are replaced by in-process stand-ins speaking their protocols:
+// FerretDB on SQLite and go-mysql-server.
+
+// storeFixture is a storage backend of the users run by the conformance suite
+type storeFixture struct {
+	name string
+	// open returns an empty store, set up like the UserService sets it up
+	open func(t *testing.T) models.CURDInterface
+	// queries are the queries understood by the store
+	queries storeQueries
+}
+
+// storeQueries builds the queries of the suite, MongoDB filters or SQL statements
+type storeQueries interface {
+	insert(user models.User) interface{}
+	byID(id primitive.ObjectID) interface{}
+	byUsername(username string) interface{}
+	// page returns the users sorted by username, after skipping skip of them
+	page(skip, limit int64) interface{}
+	count() interface{}
+	// lock returns the filter and the update locking the user
+	lock(username string) (interface{}, interface{})
+	delete(username string) interface{}
+	// rename returns the filter and the update of a compare-and-swap renaming the user of id at version
+	// and incrementing its version
+	rename(id primitive.ObjectID, version int64, username string) (interface{}, interface{})
+}
+
+// mongoQueries are the queries of MongoDB and of the stores understanding its filters
+type mongoQueries struct{}
+
+func (mongoQueries) insert(user models.User) interface{} { return user }
+
+func (mongoQueries) byID(id primitive.ObjectID) interface{} { return bson.M{"_id": id} }
+
+func (mongoQueries) byUsername(username string) interface{} { return bson.M{"username": username} }
+
+func (mongoQueries) page(skip, limit int64) interface{} {
+	return models.MongoQuery{Filter: bson.M{}, Sort: bson.D{{Key: "username", Value: 1}}, Skip: skip, Limit: limit}
+}
+
+func (mongoQueries) count() interface{} { return bson.M{} }
+
+func (mongoQueries) lock(username string) (interface{}, interface{}) {
+	return bson.M{"username": username}, bson.M{"$set": bson.M{"locked": true}}
+}
+
+func (mongoQueries) delete(username string) interface{} { return bson.M{"username": username} }
+
+func (mongoQueries) rename(id primitive.ObjectID, version int64, username string) (interface{}, interface{}) {
+	return bson.M{"_id": id, "version": version}, bson.M{"$set": bson.M{"username": username}, "$inc": bson.M{"version": 1}}
+}
+
+// sqlQueries are the statements of MySQL, which SQLite runs too
+type sqlQueries struct{}
+
+const conformanceColumns = "id, username, password, roles, locked, status, created_at, updated_at, last_login_at, password_changed_at, deleted_at, deleted_username, version, attributes"
+
+func (sqlQueries) insert(user models.User) interface{} {
+	return models.SQLQuery{
+		Statement: "INSERT INTO users (" + conformanceColumns + ") VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		Args: []interface{}{user.ID.Hex(), user.Username, user.Password, strings.Join(user.Roles, ","), user.Locked, string(user.Status),
+			models.SQLTime(&user.CreatedAt), models.SQLTime(&user.UpdatedAt), models.SQLTime(user.LastLoginAt), models.SQLTime(user.PasswordChangedAt),
+			models.SQLTime(user.DeletedAt), sql.NullString{String: user.DeletedUsername, Valid: user.DeletedUsername != ""}, user.Version, user.Attributes},
+	}
+}
+
+func (sqlQueries) byID(id primitive.ObjectID) interface{} {
+	return models.SQLQuery{Statement: "SELECT " + conformanceColumns + " FROM users WHERE id = ?", Args: []interface{}{id.Hex()}}
+}
+
+func (sqlQueries) byUsername(username string) interface{} {
+	return models.SQLQuery{Statement: "SELECT " + conformanceColumns + " FROM users WHERE username = ?", Args: []interface{}{username}}
+}
+
+func (sqlQueries) page(skip, limit int64) interface{} {
+	return models.SQLQuery{Statement: "SELECT " + conformanceColumns + " FROM users ORDER BY username LIMIT ? OFFSET ?", Args: []interface{}{limit, skip}}
+}
+
+func (sqlQueries) count() interface{} { return "SELECT COUNT(*) FROM users" }
+
+func (sqlQueries) lock(username string) (interface{}, interface{}) {
+	return models.SQLQuery{Statement: "UPDATE users SET locked = ? WHERE username = ?", Args: []interface{}{true, username}}, nil
+}
+
+func (sqlQueries) delete(username string) interface{} {
+	return models.SQLQuery{Statement: "DELETE FROM users WHERE username = ?", Args: []interface{}{username}}
+}
+
+func (sqlQueries) rename(id primitive.ObjectID, version int64, username string) (interface{}, interface{}) {
+	return models.SQLQuery{
+		Statement: "UPDATE users SET username = ?, version = version + 1 WHERE id = ? AND version = ?",
+		Args:      []interface{}{username, id.Hex(), version},
+	}, nil
+}
+
+// setupStore creates the tables or the indexes of db with UserService.SetupDB
+func setupStore(t *testing.T, db models.CURDInterface) {
+	userService := services.NewUserServiceWithBackend(nil, nil, config.Default().Deletion, nil, discardLogger)
+	userService.Database = db
+	require.NoError(t, userService.SetupDB(context.Background()))
+}
+
+// openMySQL starts go-mysql-server with an empty database and connects to it
+func openMySQL(t *testing.T) *sql.DB {
+	logrus.SetLevel(logrus.WarnLevel)
+	engine := sqle.NewDefault(memory.NewDBProvider(memory.NewDatabase("users")))
+	s, err := server.NewDefaultServer(server.Config{Protocol: "tcp", Address: "127.0.0.1:0"}, engine)
+	require.NoError(t, err)
+	go s.Start()
+	t.Cleanup(func() { s.Close() })
+
+	db, err := sql.Open("mysql", fmt.Sprintf("root@tcp(%s)/users", s.Listener.Addr()))
+	require.NoError(t, err)
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+// storeFixtures are the backends run by the suite
+var storeFixtures = []storeFixture{
+	{
+		name: "memory",
+		open: func(t *testing.T) models.CURDInterface {
+			return models.NewMemory(func() interface{} { return &models.User{} }, "username")
+		},
+		queries: mongoQueries{},
+	},
+	{
+		name: "json file",
+		open: func(t *testing.T) models.CURDInterface {
+			return openUsersFile(t, filepath.Join(t.TempDir(), "users.json"))
+		},
+		queries: mongoQueries{},
+	},
+	{
+		name: "sqlite",
+		open: func(t *testing.T) models.CURDInterface {
+			db, err := sql.Open("sqlite", filepath.Join(t.TempDir(), "users.db"))
+			require.NoError(t, err)
+			// one connection, SQLite has one writer at a time
+			db.SetMaxOpenConns(1)
+			t.Cleanup(func() { db.Close() })
+
+			// the schema of the MySQL migrations, in the types of SQLite
+			_, err = db.Exec(`CREATE TABLE users (
+				id CHAR(24) NOT NULL PRIMARY KEY,
+				username VARCHAR(255) NOT NULL UNIQUE,
+				password VARCHAR(255) NOT NULL,
+				roles VARCHAR(255) NOT NULL DEFAULT '',
+				locked BOOLEAN NOT NULL DEFAULT FALSE,
+				status VARCHAR(16) NOT NULL DEFAULT 'active',
+				created_at DATETIME,
+				updated_at DATETIME,
+				last_login_at DATETIME,
+				password_changed_at DATETIME,
+				deleted_at DATETIME,
+				deleted_username VARCHAR(255),
+				version BIGINT NOT NULL DEFAULT 0,
+				attributes TEXT
+			)`)
+			require.NoError(t, err)
+			_, err = db.Exec(`CREATE TABLE user_trigrams (
+				user_id CHAR(24) NOT NULL,
+				trigram VARCHAR(3) NOT NULL,
+				PRIMARY KEY (trigram, user_id)
+			)`)
+			require.NoError(t, err)
+			_, err = db.Exec(`CREATE INDEX user_trigrams_user_id ON user_trigrams (user_id)`)
+			require.NoError(t, err)
+
+			store := models.NewMySQL()
+			store.DB = db
+			return store
+		},
+		queries: sqlQueries{},
+	},
+	{
+		name: "mysql",
+		open: func(t *testing.T) models.CURDInterface {
+			store := models.NewMySQL()
+			store.DB = openMySQL(t)
+			setupStore(t, store)
+			return store
+		},
+		queries: sqlQueries{},
+	},
+	{
+		name: "mongodb",
+		open: func(t *testing.T) models.CURDInterface {
+			f, err := ferretdb.New(&ferretdb.Config{
+				Listener:  ferretdb.ListenerConfig{TCP: "127.0.0.1:0"},
+				Handler:   "sqlite",
+				SQLiteURL: "file:" + t.TempDir() + "/",
+			})
+			require.NoError(t, err)
+			ctx, cancel := context.WithCancel(context.Background())
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				_ = f.Run(ctx)
+			}()
+			t.Cleanup(func() {
+				cancel()
+				<-done
+			})
+
+			// connected like the server, which creates the indexes without `usermgmt-admin init`
+			cfg := config.Default().Database
+			cfg.Mongo = config.MongoConfig{URI: f.MongoDBURI(), Database: "user"}
+			stores, err := services.NewMongoBackend(cfg, discardLogger).Connect(ctx)
+			require.NoError(t, err)
+			store := stores.Users.(*models.MongoDB)
+			t.Cleanup(func() { _ = store.Close(context.Background()) })
+			return store
+		},
+		queries: mongoQueries{},
+	},
+}
+
+// TestStoreConformance runs the suite on every backend
+func TestStoreConformance(t *testing.T) {
+	for _, fixture := range storeFixtures {
+		fixture := fixture
+		t.Run(fixture.name, func(t *testing.T) {
+			runConformance(t, fixture)
+		})
+	}
+}
+
+// readStoreUsers reads the users of query, in the order of the store
+func readStoreUsers(t *testing.T, store models.CURDInterface, query interface{}) []models.User {
+	found, err := store.Read(context.Background(), query, func() interface{} { return &models.User{} })
+	require.NoError(t, err)
+	users := make([]models.User, len(found))
+	for i, item := range found {
+		users[i] = *item.(*models.User)
+	}
+	return users
+}
+
+// countStoreUsers counts the users of the store
+func countStoreUsers(t *testing.T, store models.CURDInterface, q storeQueries) int64 {
+	count, err := store.Count(context.Background(), q.count())
+	require.NoError(t, err)
+	return count
+}
+
+func runConformance(t *testing.T, fixture storeFixture) {
+	q := fixture.queries
+
+	t.Run("ping", func(t *testing.T) {
+		store := fixture.open(t)
+		assert.NoError(t, store.Ping(context.Background()))
+	})
+
+	t.Run("create and read", func(t *testing.T) {
+		ctx := context.Background()
+		store := fixture.open(t)
+		// whole seconds: go-mysql-server drops the milliseconds of DATETIME(3) in the results of prepared statements
+		created := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+		loggedIn := created.Add(36 * time.Hour)
+		alice := models.User{ID: primitive.NewObjectID(), Username: "alice", Password: "hash1", Roles: []string{"admin", "support"},
+			Status: models.StatusActive, CreatedAt: created, UpdatedAt: created, LastLoginAt: &loggedIn, PasswordChangedAt: &created}
+		bob := models.User{ID: primitive.NewObjectID(), Username: "bob", Password: "hash2", Locked: true, Status: models.StatusSuspended}
+		require.NoError(t, store.Create(ctx, q.insert(alice)))
+		require.NoError(t, store.Create(ctx, q.insert(bob)))
+
+		assert.Equal(t, []models.User{alice}, readStoreUsers(t, store, q.byID(alice.ID)))
+		assert.Equal(t, []models.User{bob}, readStoreUsers(t, store, q.byUsername("bob")))
+		assert.Equal(t, int64(2), countStoreUsers(t, store, q))
+	})
+
+	t.Run("duplicates", func(t *testing.T) {
+		ctx := context.Background()
+		store := fixture.open(t)
+		alice := models.User{ID: primitive.NewObjectID(), Username: "alice", Password: "hash"}
+		require.NoError(t, store.Create(ctx, q.insert(alice)))
+
+		err := store.Create(ctx, q.insert(models.User{ID: primitive.NewObjectID(), Username: "alice", Password: "other"}))
+		assert.True(t, models.IsDuplicateKey(err), "same username: %v", err)
+		err = store.Create(ctx, q.insert(models.User{ID: alice.ID, Username: "carol", Password: "other"}))
+		assert.True(t, models.IsDuplicateKey(err), "same id: %v", err)
+
+		assert.Equal(t, int64(1), countStoreUsers(t, store, q))
+		assert.Equal(t, []models.User{alice}, readStoreUsers(t, store, q.byUsername("alice")), "the user should be unchanged")
+	})
+
+	t.Run("not found", func(t *testing.T) {
+		ctx := context.Background()
+		store := fixture.open(t)
+		require.NoError(t, store.Create(ctx, q.insert(models.User{ID: primitive.NewObjectID(), Username: "alice", Password: "hash"})))
+
+		assert.Empty(t, readStoreUsers(t, store, q.byID(primitive.NewObjectID())))
+		assert.Empty(t, readStoreUsers(t, store, q.byUsername("nobody")))
+
+		filter, update := q.lock("nobody")
+		assert.NoError(t, store.Update(ctx, filter, update))
+		assert.NoError(t, store.Delete(ctx, q.delete("nobody")))
+		assert.Equal(t, int64(1), countStoreUsers(t, store, q))
+	})
+
+	t.Run("update", func(t *testing.T) {
+		ctx := context.Background()
+		store := fixture.open(t)
+		alice := models.User{ID: primitive.NewObjectID(), Username: "alice", Password: "hash"}
+		bob := models.User{ID: primitive.NewObjectID(), Username: "bob", Password: "hash"}
+		require.NoError(t, store.Create(ctx, q.insert(alice)))
+		require.NoError(t, store.Create(ctx, q.insert(bob)))
+
+		filter, update := q.lock("alice")
+		require.NoError(t, store.Update(ctx, filter, update))
+
+		alice.Locked = true
+		assert.Equal(t, []models.User{alice}, readStoreUsers(t, store, q.byID(alice.ID)))
+		assert.Equal(t, []models.User{bob}, readStoreUsers(t, store, q.byID(bob.ID)), "the other users should be unchanged")
+	})
+
+	t.Run("compare and swap", func(t *testing.T) {
+		ctx := context.Background()
+		store := fixture.open(t)
+		alice := models.User{ID: primitive.NewObjectID(), Username: "alice", Password: "hash", Version: 1}
+		bob := models.User{ID: primitive.NewObjectID(), Username: "bob", Password: "hash", Version: 1}
+		require.NoError(t, store.Create(ctx, q.insert(alice)))
+		require.NoError(t, store.Create(ctx, q.insert(bob)))
+
+		// a match
+		filter, update := q.rename(alice.ID, 1, "alicia")
+		swapped, err := store.CompareAndSwap(ctx, filter, update)
+		require.NoError(t, err)
+		assert.True(t, swapped)
+		alice.Username, alice.Version = "alicia", 2
+		assert.Equal(t, []models.User{alice}, readStoreUsers(t, store, q.byID(alice.ID)))
+
+		// no match, the version is stale
+		filter, update = q.rename(alice.ID, 1, "alice")
+		swapped, err = store.CompareAndSwap(ctx, filter, update)
+		require.NoError(t, err)
+		assert.False(t, swapped)
+		assert.Equal(t, []models.User{alice}, readStoreUsers(t, store, q.byID(alice.ID)), "a stale swap should change nothing")
+
+		// a match breaking the unique username
+		filter, update = q.rename(alice.ID, 2, "bob")
+		swapped, err = store.CompareAndSwap(ctx, filter, update)
+		if fixture.name == "mongodb" {
+			// FerretDB reports it as an internal error of SQLite, MongoDB as the duplicate key E11000
+			assert.ErrorContains(t, err, "UNIQUE constraint failed")
+		} else {
+			assert.True(t, models.IsDuplicateKey(err), "same username: %v", err)
+		}
+		assert.False(t, swapped)
+		assert.Equal(t, []models.User{alice}, readStoreUsers(t, store, q.byID(alice.ID)), "a conflicting swap should change nothing")
+		assert.Equal(t, []models.User{bob}, readStoreUsers(t, store, q.byID(bob.ID)))
+	})
+
+	t.Run("delete", func(t *testing.T) {
+		ctx := context.Background()
+		store := fixture.open(t)
+		alice := models.User{ID: primitive.NewObjectID(), Username: "alice", Password: "hash"}
+		bob := models.User{ID: primitive.NewObjectID(), Username: "bob", Password: "hash"}
+		require.NoError(t, store.Create(ctx, q.insert(alice)))
+		require.NoError(t, store.Create(ctx, q.insert(bob)))
+
+		require.NoError(t, store.Delete(ctx, q.delete("alice")))
+
+		assert.Empty(t, readStoreUsers(t, store, q.byID(alice.ID)))
+		assert.Equal(t, []models.User{bob}, readStoreUsers(t, store, q.page(0, 10)))
+		assert.Equal(t, int64(1), countStoreUsers(t, store, q))
+
+		// the username is free again
+		assert.NoError(t, store.Create(ctx, q.insert(models.User{ID: primitive.NewObjectID(), Username: "alice", Password: "hash"})))
+	})
+
+	t.Run("pagination", func(t *testing.T) {
+		ctx := context.Background()
+		store := fixture.open(t)
+		// inserted out of order, the pages are sorted by username
+		for _, i := range []int{4, 0, 6, 2, 5, 1, 3} {
+			user := models.User{ID: primitive.NewObjectID(), Username: fmt.Sprintf("user%d", i), Password: "hash"}
+			require.NoError(t, store.Create(ctx, q.insert(user)))
+		}
+
+		var pages [][]string
+		for skip := int64(0); skip <= 9; skip += 3 {
+			var usernames []string
+			for _, user := range readStoreUsers(t, store, q.page(skip, 3)) {
+				usernames = append(usernames, user.Username)
+			}
+			pages = append(pages, usernames)
+		}
+		assert.Equal(t, [][]string{{"user0", "user1", "user2"}, {"user3", "user4", "user5"}, {"user6"}, nil}, pages)
+	})
+
+	t.Run("concurrency", func(t *testing.T) {
+		ctx := context.Background()
+		store := fixture.open(t)
+
+		const writers = 20
+		const racers = 10
+		var wg sync.WaitGroup
+		errs := make(chan error, writers+racers)
+		for i := 0; i < writers; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				errs <- store.Create(ctx, q.insert(models.User{ID: primitive.NewObjectID(), Username: fmt.Sprintf("writer%d", i), Password: "hash"}))
+			}(i)
+		}
+		// the same username from several clients, only one of them gets it
+		raceErrs := make(chan error, racers)
+		for i := 0; i < racers; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				raceErrs <- store.Create(ctx, q.insert(models.User{ID: primitive.NewObjectID(), Username: "racer", Password: "hash"}))
+			}()
+		}
+		wg.Wait()
+		close(errs)
+		close(raceErrs)
+
+		for err := range errs {
+			assert.NoError(t, err)
+		}
+		created := 0
+		for err := range raceErrs {
+			if err == nil {
+				created++
+				continue
+			}
+			assert.True(t, models.IsDuplicateKey(err), "the other racers should get a duplicate key: %v", err)
+		}
+		assert.Equal(t, 1, created)
+		assert.Equal(t, int64(writers+1), countStoreUsers(t, store, q))
+		assert.Len(t, readStoreUsers(t, store, q.byUsername("racer")), 1)
+	})
+}
@@ -0,0 +1,435 @@
+package test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+	"usermanagement/internal/config"
+	"usermanagement/internal/handlers"
+	"usermanagement/internal/models"
+	"usermanagement/internal/services"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// newDeletionService returns a UserService in memory deleting the users with the username policy
+func newDeletionService(t *testing.T, username string, users ...models.User) *services.UserService {
+	userService := services.NewUserServiceWithBackend(nil, nil,
+		config.DeletionConfig{GracePeriod: time.Hour, Username: username}, nil, discardLogger)
+	userService.Database = newUserStore(t, users...)
+	userService.Audit = newAuditStore(t)
+	return userService
+}
+
+// TestDeleteUser tests that a deleted user is hidden until it's restored
+func TestDeleteUser(t *testing.T) {
+	ctx := context.Background()
+	alice := models.User{ID: primitive.NewObjectID(), Username: "alice", Password: "hash"}
+	bob := models.User{ID: primitive.NewObjectID(), Username: "bob", Password: "hash"}
+	userService := newDeletionService(t, config.UsernameReserve, alice, bob)
+
+	deleted, err := userService.DeleteUser(ctx, alice.ID.Hex())
+	require.NoError(t, err)
+	assert.Equal(t, "alice", deleted.Username)
+	assert.True(t, deleted.Deleted())
+
+	users, err := userService.GetAllUsers(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, []models.User{bob}, users)
+	count, err := userService.CountUsers(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), count)
+	_, err = userService.SearchUserByID(ctx, alice.ID.Hex())
+	assert.ErrorIs(t, err, services.ErrNotFound)
+	_, err = userService.SearchUserByUsername(ctx, "alice")
+	assert.ErrorIs(t, err, services.ErrNotFound)
+
+	// the username is reserved until the user is purged
+	_, err = userService.CreateUser(ctx, *models.NewUser("alice", "hash"))
+	assert.ErrorIs(t, err, services.ErrConflict)
+	_, err = userService.DeleteUser(ctx, alice.ID.Hex())
+	assert.ErrorIs(t, err, services.ErrNotFound, "a deleted user can't be deleted again")
+
+	list, err := userService.DeletedUsers(ctx)
+	require.NoError(t, err)
+	if assert.Len(t, list, 1) {
+		assert.Equal(t, alice.ID, list[0].ID)
+	}
+
+	restored, err := userService.RestoreUser(ctx, alice.ID.Hex())
+	require.NoError(t, err)
+	assert.Equal(t, "alice", restored.Username)
+	found, err := userService.SearchUserByUsername(ctx, "alice")
+	require.NoError(t, err)
+	assert.False(t, found.Deleted())
+
+	_, err = userService.RestoreUser(ctx, alice.ID.Hex())
+	assert.ErrorIs(t, err, services.ErrNotDeleted)
+	_, err = userService.RestoreUser(ctx, primitive.NewObjectID().Hex())
+	assert.ErrorIs(t, err, services.ErrNotFound)
+	var validationErr *services.ValidationError
+	_, err = userService.DeleteUser(ctx, "invalid")
+	assert.ErrorAs(t, err, &validationErr)
+}
+
+// TestDeleteUserFreeUsername tests that the username of a deleted user can be registered again with the free policy
+func TestDeleteUserFreeUsername(t *testing.T) {
+	ctx := context.Background()
+	alice := models.User{ID: primitive.NewObjectID(), Username: "alice", Password: "hash"}
+	userService := newDeletionService(t, config.UsernameFree, alice)
+
+	_, err := userService.DeleteUser(ctx, alice.ID.Hex())
+	require.NoError(t, err)
+	list, err := userService.DeletedUsers(ctx)
+	require.NoError(t, err)
+	if assert.Len(t, list, 1) {
+		assert.Equal(t, "alice", list[0].OriginalUsername())
+		assert.NotEqual(t, "alice", list[0].Username)
+	}
+
+	_, err = userService.CreateUser(ctx, *models.NewUser("alice", "hash"))
+	require.NoError(t, err)
+	_, err = userService.RestoreUser(ctx, alice.ID.Hex())
+	assert.ErrorIs(t, err, services.ErrConflict, "the username is taken again")
+
+	other, err := userService.SearchUserByUsername(ctx, "alice")
+	require.NoError(t, err)
+	_, err = userService.DeleteUser(ctx, other.ID.Hex())
+	require.NoError(t, err)
+	restored, err := userService.RestoreUser(ctx, alice.ID.Hex())
+	require.NoError(t, err)
+	assert.Equal(t, "alice", restored.Username)
+	assert.Empty(t, restored.DeletedUsername)
+}
+
+// TestDeleteUserTombstoneUsername tests that the tombstone of a user can't be registered nor imported before it's deleted
+func TestDeleteUserTombstoneUsername(t *testing.T) {
+	ctx := context.Background()
+	alice := models.User{ID: primitive.NewObjectID(), Username: "alice", Password: "hash"}
+	userService := newDeletionService(t, config.UsernameFree, alice)
+	tombstone := "deleted:" + alice.ID.Hex()
+
+	var validationErr *services.ValidationError
+	_, err := userService.CreateUser(ctx, *models.NewUser(tombstone, "hash"))
+	require.ErrorAs(t, err, &validationErr)
+	assert.Equal(t, "username", validationErr.Field)
+	result, err := userService.ImportUsers(ctx, strings.NewReader("username,password\n"+tombstone+",pass\n"),
+		services.ImportOptions{Format: services.FormatCSV, Mode: services.ImportUpsert})
+	require.NoError(t, err)
+	assert.Equal(t, 1, result.Failed)
+
+	_, err = userService.DeleteUser(ctx, alice.ID.Hex())
+	require.NoError(t, err)
+	restored, err := userService.RestoreUser(ctx, alice.ID.Hex())
+	require.NoError(t, err)
+	assert.Equal(t, "alice", restored.Username)
+}
+
+// TestDeleteUserConcurrently tests that a user deleted by another request while it's being deleted,
+// its username registered again meanwhile, is found deleted rather than the new user deleted
+func TestDeleteUserConcurrently(t *testing.T) {
+	ctx := context.Background()
+	alice := models.User{ID: primitive.NewObjectID(), Username: "alice", Password: "hash"}
+	db := &hookedDB{CURDInterface: newUserStore(t, alice)}
+	userService := newDeletionService(t, config.UsernameFree)
+	userService.Database = db
+
+	db.beforeSwap = func() {
+		db.beforeSwap = nil
+		_, err := userService.DeleteUser(ctx, alice.ID.Hex())
+		assert.NoError(t, err)
+		_, err = userService.CreateUser(ctx, *models.NewUser("alice", "hash"))
+		assert.NoError(t, err)
+	}
+
+	_, err := userService.DeleteUser(ctx, alice.ID.Hex())
+	assert.ErrorIs(t, err, services.ErrNotFound)
+	found, err := userService.SearchUserByUsername(ctx, "alice")
+	require.NoError(t, err)
+	assert.NotEqual(t, alice.ID, found.ID)
+	assert.Nil(t, found.DeletedAt, "the new user shouldn't be deleted")
+}
+
+// TestRestoreUserConcurrently tests that a user restored by another request while it's being restored
+// isn't restored twice
+func TestRestoreUserConcurrently(t *testing.T) {
+	ctx := context.Background()
+	alice := models.User{ID: primitive.NewObjectID(), Username: "alice", Password: "hash"}
+	db := &hookedDB{CURDInterface: newUserStore(t, alice)}
+	userService := newDeletionService(t, config.UsernameFree)
+	userService.Database = db
+	_, err := userService.DeleteUser(ctx, alice.ID.Hex())
+	require.NoError(t, err)
+
+	db.beforeSwap = func() {
+		db.beforeSwap = nil
+		_, err := userService.RestoreUser(ctx, alice.ID.Hex())
+		assert.NoError(t, err)
+	}
+
+	_, err = userService.RestoreUser(ctx, alice.ID.Hex())
+	assert.ErrorIs(t, err, services.ErrNotFound)
+	found, err := userService.SearchUserByUsername(ctx, "alice")
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), found.Version, "restored once")
+}
+
+// TestPurgeDeletedUsers tests that the users deleted for longer than the grace period are purged,
+// and can't be restored before
+func TestPurgeDeletedUsers(t *testing.T) {
+	ctx := context.Background()
+	longAgo := time.Now().Add(-2 * time.Hour).Truncate(time.Millisecond)
+	recently := time.Now().Add(-time.Minute).Truncate(time.Millisecond)
+	expired := models.User{ID: primitive.NewObjectID(), Username: "expired", Password: "hash", DeletedAt: &longAgo}
+	recent := models.User{ID: primitive.NewObjectID(), Username: "recent", Password: "hash", DeletedAt: &recently}
+	live := models.User{ID: primitive.NewObjectID(), Username: "live", Password: "hash"}
+	userService := newDeletionService(t, config.UsernameReserve, expired, recent, live)
+
+	_, err := userService.RestoreUser(ctx, expired.ID.Hex())
+	assert.ErrorIs(t, err, services.ErrRestoreExpired)
+
+	purged, err := userService.PurgeDeletedUsers(ctx)
+	require.NoError(t, err)
+	if assert.Len(t, purged, 1) {
+		assert.Equal(t, "expired", purged[0].Username)
+	}
+	assert.Equal(t, []string{"recent", "live"}, usernames(storeUsers(t, userService.Database)))
+
+	purged, err = userService.PurgeDeletedUsers(ctx)
+	require.NoError(t, err)
+	assert.Empty(t, purged)
+}
+
+// TestPurgeDeletedUsersMeanwhile tests that the purge removes only the users it read and returns:
+// a user restored meanwhile is kept, and a user expired meanwhile is left to the next purge
+func TestPurgeDeletedUsersMeanwhile(t *testing.T) {
+	ctx := context.Background()
+	longAgo := time.Now().Add(-2 * time.Hour)
+	expired := models.User{ID: primitive.NewObjectID(), Username: "expired", Password: "hash", DeletedAt: &longAgo}
+	db := &hookedDB{CURDInterface: newUserStore(t, expired)}
+	userService := newDeletionService(t, config.UsernameReserve)
+	userService.Database = db
+
+	db.beforeDelete = func() {
+		db.beforeDelete = nil
+		_, err := db.CURDInterface.CompareAndSwap(ctx, bson.M{"_id": expired.ID}, bson.M{"$unset": bson.M{"deleted_at": ""}})
+		assert.NoError(t, err)
+		assert.NoError(t, db.CURDInterface.Create(ctx, &models.User{ID: primitive.NewObjectID(), Username: "other", Password: "hash", DeletedAt: &longAgo}))
+	}
+
+	_, err := userService.PurgeDeletedUsers(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"expired", "other"}, usernames(storeUsers(t, userService.Database)))
+
+	purged, err := userService.PurgeDeletedUsers(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"other"}, usernames(purged))
+}
+
+// TestDeletionBackends tests the deletion, the restore and the purge on every backend of the conformance suite
+func TestDeletionBackends(t *testing.T) {
+	for _, fixture := range storeFixtures {
+		fixture := fixture
+		t.Run(fixture.name, func(t *testing.T) {
+			ctx := context.Background()
+			userService := services.NewUserServiceWithBackend(nil, nil,
+				config.DeletionConfig{GracePeriod: time.Hour, Username: config.UsernameFree}, nil, discardLogger)
+			userService.Database = fixture.open(t)
+
+			// whole seconds, the MySQL test server drops the fractions
+			longAgo := time.Now().Add(-2 * time.Hour).Truncate(time.Second)
+			expired := models.User{ID: primitive.NewObjectID(), Username: "expired", Password: "hash", DeletedAt: &longAgo}
+			alice := *models.NewUser("alice", "hash")
+			require.NoError(t, userService.InsertUsers(ctx, []models.User{expired, alice, *models.NewUser("bob", "hash")}))
+
+			_, err := userService.DeleteUser(ctx, alice.ID.Hex())
+			require.NoError(t, err)
+			users, err := userService.GetAllUsers(ctx)
+			require.NoError(t, err)
+			assert.Equal(t, []string{"bob"}, usernames(users))
+			_, err = userService.SearchUserByUsername(ctx, "alice")
+			assert.ErrorIs(t, err, services.ErrNotFound)
+
+			deleted, err := userService.DeletedUsers(ctx)
+			require.NoError(t, err)
+			if assert.Len(t, deleted, 2) {
+				assert.Equal(t, "alice", deleted[0].OriginalUsername(), "the recently deleted first")
+			}
+
+			purged, err := userService.PurgeDeletedUsers(ctx)
+			require.NoError(t, err)
+			assert.Equal(t, []string{"expired"}, usernames(purged))
+
+			restored, err := userService.RestoreUser(ctx, alice.ID.Hex())
+			require.NoError(t, err)
+			assert.Equal(t, "alice", restored.Username)
+			found, err := userService.SearchUserByUsername(ctx, "alice")
+			require.NoError(t, err)
+			assert.Nil(t, found.DeletedAt)
+			assert.Empty(t, found.DeletedUsername)
+		})
+	}
+}
+
+// usernames returns the usernames of users, in their order
+func usernames(users []models.User) []string {
+	names := make([]string, len(users))
+	for i, user := range users {
+		names[i] = user.Username
+	}
+	return names
+}
+
+// TestDeletionHandlers tests the DELETE /users/:id, POST /users/:id/restore and GET /admin/users/deleted API endpoints
+func TestDeletionHandlers(t *testing.T) {
+	id := primitive.NewObjectID()
+	deletedAt := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+	alice := models.User{ID: id, Username: "alice"}
+	deletedAlice := models.User{ID: id, Username: "alice", DeletedAt: &deletedAt}
+
+	tests := []struct {
+		name         string
+		method       string
+		path         string
+		header       string
+		mockSetup    func(m *MockUserService)
+		expectedCode int
+		expectedBody string
+	}{
+		{
+			name:         "delete without token",
+			method:       http.MethodDelete,
+			path:         "/users/" + id.Hex(),
+			expectedCode: http.StatusUnauthorized,
+		},
+		{
+			name:   "delete",
+			method: http.MethodDelete,
+			path:   "/users/" + id.Hex(),
+			header: "Bearer s3cret",
+			mockSetup: func(m *MockUserService) {
+				m.On("DeleteUser", mock.Anything, id.Hex()).Return(deletedAlice, nil)
+				m.On("RecordEvent", mock.Anything, mock.MatchedBy(func(e models.AuditEvent) bool {
+					return e.Type == models.EventUserDeleted && e.Actor == "admin" && e.Target == "alice"
+				})).Return(nil)
+			},
+			expectedCode: http.StatusOK,
+			expectedBody: `"deleted_at":"2024-05-01T10:00:00Z"`,
+		},
+		{
+			name:   "delete unknown user",
+			method: http.MethodDelete,
+			path:   "/users/" + id.Hex(),
+			header: "Bearer s3cret",
+			mockSetup: func(m *MockUserService) {
+				m.On("DeleteUser", mock.Anything, id.Hex()).Return(models.User{}, services.ErrNotFound)
+			},
+			expectedCode: http.StatusNotFound,
+		},
+		{
+			name:   "restore",
+			method: http.MethodPost,
+			path:   "/users/" + id.Hex() + "/restore",
+			header: "Bearer s3cret",
+			mockSetup: func(m *MockUserService) {
+				m.On("RestoreUser", mock.Anything, id.Hex()).Return(alice, nil)
+				m.On("RecordEvent", mock.Anything, mock.MatchedBy(func(e models.AuditEvent) bool {
+					return e.Type == models.EventUserRestored && e.Target == "alice"
+				})).Return(nil)
+			},
+			expectedCode: http.StatusOK,
+			expectedBody: `"username":"alice"`,
+		},
+		{
+			name:   "restore expired",
+			method: http.MethodPost,
+			path:   "/users/" + id.Hex() + "/restore",
+			header: "Bearer s3cret",
+			mockSetup: func(m *MockUserService) {
+				m.On("RestoreUser", mock.Anything, id.Hex()).Return(models.User{}, services.ErrRestoreExpired)
+			},
+			expectedCode: http.StatusGone,
+			expectedBody: "/problems/restore-expired",
+		},
+		{
+			name:   "restore user not deleted",
+			method: http.MethodPost,
+			path:   "/users/" + id.Hex() + "/restore",
+			header: "Bearer s3cret",
+			mockSetup: func(m *MockUserService) {
+				m.On("RestoreUser", mock.Anything, id.Hex()).Return(models.User{}, services.ErrNotDeleted)
+			},
+			expectedCode: http.StatusConflict,
+			expectedBody: "/problems/not-deleted",
+		},
+		{
+			name:   "list deleted",
+			method: http.MethodGet,
+			path:   "/admin/users/deleted",
+			header: "Bearer s3cret",
+			mockSetup: func(m *MockUserService) {
+				m.On("DeletedUsers", mock.Anything).Return([]models.User{deletedAlice}, nil)
+			},
+			expectedCode: http.StatusOK,
+			expectedBody: `"username":"alice"`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockUserService := new(MockUserService)
+			if tt.mockSetup != nil {
+				tt.mockSetup(mockUserService)
+			}
+			server := handlers.NewServer(mockUserService, config.ServerConfig{AdminToken: "s3cret"}, discardLogger)
+			server.SetupRoute()
+
+			req, _ := http.NewRequest(tt.method, tt.path, nil)
+			if tt.header != "" {
+				req.Header.Set("Authorization", tt.header)
+			}
+			w := httptest.NewRecorder()
+			server.GetRouter().ServeHTTP(w, req)
+
+			assert.Equal(t, tt.expectedCode, w.Code)
+			assert.Contains(t, w.Body.String(), tt.expectedBody)
+			mockUserService.AssertExpectations(t)
+		})
+	}
+}
+
+// TestRunPurger tests that the purger purges the deleted users periodically and records their original usernames
+func TestRunPurger(t *testing.T) {
+	purged := make(chan struct{})
+	mockUserService := new(MockUserService)
+	mockUserService.On("PurgeDeletedUsers", mock.Anything).
+		Return([]models.User{{ID: primitive.NewObjectID(), Username: "deleted:1", DeletedUsername: "alice"}}, nil).Once()
+	mockUserService.On("PurgeDeletedUsers", mock.Anything).Return([]models.User{}, nil)
+	mockUserService.On("RecordEvent", mock.Anything, mock.MatchedBy(func(e models.AuditEvent) bool {
+		return e.Type == models.EventUserPurged && e.Actor == "purger" && e.Target == "alice"
+	})).Run(func(mock.Arguments) { close(purged) }).Return(nil).Once()
+	server := handlers.NewServer(mockUserService, config.ServerConfig{}, discardLogger)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		server.RunPurger(ctx, time.Millisecond)
+	}()
+
+	select {
+	case <-purged:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the deleted users weren't purged")
+	}
+	cancel()
+	<-done
+	mockUserService.AssertExpectations(t)
+}
@@ -0,0 +1,262 @@
+package test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+	"usermanagement/internal/config"
+	"usermanagement/internal/filter"
+	"usermanagement/internal/handlers"
+	"usermanagement/internal/models"
+	"usermanagement/internal/services"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// filterSchema is the schema of the filter tests: a string, a number and a list
+func filterSchema(name string) (filter.Attribute, bool) {
+	switch strings.ToLower(name) {
+	case "status":
+		return filter.Attribute{Type: filter.String, Path: "status", Column: "status", Default: "active"}, true
+	case "createdat":
+		return filter.Attribute{Type: filter.DateTime, Path: "created_at", Column: "created_at"}, true
+	case "roles":
+		return filter.Attribute{Type: filter.Strings, Path: "roles", Column: "roles"}, true
+	case "version":
+		return filter.Attribute{Type: filter.Number, Path: "version", Column: "version"}, true
+	}
+	return filter.Attribute{}, false
+}
+
+// TestFilterErrors tests that the invalid filters point to the offending token
+func TestFilterErrors(t *testing.T) {
+	tests := []struct {
+		filter string
+		pos    int
+		token  string
+	}{
+		{`status eq`, 10, ""},
+		{`status equals "active"`, 8, "equals"},
+		{`department eq "sales"`, 1, "department"},
+		{`status eq "active" and`, 23, ""},
+		{`status eq "active" version eq 1`, 20, "version"},
+		{`status gt "active"`, 8, "gt"},
+		{`roles co "adm"`, 7, "co"},
+		{`version eq "one"`, 12, `"one"`},
+		{`createdAt gt "yesterday"`, 14, `"yesterday"`},
+		{`createdAt gt 2026-01-01`, 14, "2026-01-01"},
+		{`status eq null`, 11, "null"},
+		{`status eq "active`, 11, `"active`},
+		{`status eq 'active'`, 11, "'"},
+		{`(status eq "active"`, 20, ""},
+		{`not status eq "active"`, 5, "status"},
+		{`status eq "actif" or (roles eq "ops" and version le x)`, 53, "x"},
+		{`rôles eq "ops"`, 1, "rôles"},
+		{`status eq "é" or rôles eq "ops"`, 18, "rôles"},
+		{strings.Repeat("(", 40) + `status pr` + strings.Repeat(")", 40), 33, "("},
+	}
+	for _, tt := range tests {
+		_, err := filter.Parse(tt.filter, filterSchema)
+		var filterErr *filter.Error
+		if assert.ErrorAs(t, err, &filterErr, tt.filter) {
+			assert.Equal(t, tt.pos, filterErr.Pos, tt.filter)
+			assert.Equal(t, tt.token, filterErr.Token, tt.filter)
+		}
+	}
+
+	_, err := filter.Parse(`version eq "one"`, filterSchema)
+	assert.EqualError(t, err, `"\"one\"" at position 12: expected a number value`)
+	_, err = filter.Parse(strings.Repeat("a", filter.MaxLength+1), filterSchema)
+	assert.Error(t, err)
+}
+
+// TestFilterCompile tests the MongoDB filters and the SQL conditions of a filter,
+// with the and operator taking precedence over or
+func TestFilterCompile(t *testing.T) {
+	parsed, err := filter.Parse(`status eq "Active" or ROLES eq "ops" and not (createdAt lt "2026-01-01")`, filterSchema)
+	require.NoError(t, err)
+	january := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	assert.Equal(t, bson.M{"$or": bson.A{
+		bson.M{"$or": bson.A{
+			bson.M{"status": bson.M{"$regex": "^Active$", "$options": "i"}},
+			bson.M{"status": bson.M{"$in": bson.A{nil, ""}}},
+		}},
+		bson.M{"$and": bson.A{
+			bson.M{"roles": "ops"},
+			bson.M{"$nor": bson.A{bson.M{"created_at": bson.M{"$lt": january}}}},
+		}},
+	}}, parsed.BSON())
+
+	condition, args := parsed.SQL()
+	assert.Equal(t, "((LOWER(status) = ? OR status IS NULL OR status = '') OR "+
+		"((roles = ? OR SUBSTR(roles, 1, ?) = ? OR SUBSTR(roles, ?) = ? OR INSTR(roles, ?) > 0) AND "+
+		"NOT COALESCE(created_at < ?, FALSE)))", condition)
+	assert.Equal(t, []interface{}{"active", "ops", 4, "ops,", -4, ",ops", ",ops,", "2026-01-01 00:00:00.000"}, args)
+
+	parsed, err = filter.Parse(`status sw "act" and status ne "suspended"`, filterSchema)
+	require.NoError(t, err)
+	condition, args = parsed.SQL()
+	assert.Equal(t, "((SUBSTR(LOWER(status), 1, ?) = ? OR status IS NULL OR status = '') AND "+
+		"NOT COALESCE(LOWER(status) = ?, FALSE))", condition)
+	assert.Equal(t, []interface{}{3, "act", "suspended"}, args)
+}
+
+// TestFilterUsers tests the filters of the admin listing, on every backend of the conformance suite
+func TestFilterUsers(t *testing.T) {
+	date := func(s string) time.Time {
+		d, err := time.Parse("2006-01-02", s)
+		require.NoError(t, err)
+		return d
+	}
+
+	for _, fixture := range storeFixtures {
+		fixture := fixture
+		t.Run(fixture.name, func(t *testing.T) {
+			ctx := context.Background()
+			userService := newAttributesService(t, fixture.open(t))
+
+			var users []models.User
+			for _, user := range []struct {
+				username   string
+				status     models.UserStatus
+				roles      []string
+				locked     bool
+				createdAt  string
+				attributes models.Attributes
+			}{
+				{"alice", models.StatusActive, []string{"admin", "ops"}, false, "2025-06-01",
+					models.Attributes{"department": "sales", "employee_id": float64(1), "remote": true}},
+				{"bob", models.StatusSuspended, []string{"ops"}, true, "2026-02-01",
+					models.Attributes{"department": "support", "employee_id": float64(2)}},
+				{"carol", models.StatusActive, nil, false, "2026-03-01", nil},
+				{"dave", models.StatusPending, []string{"superadmin"}, false, "2026-01-15", nil},
+				{"eve", models.StatusActive, []string{"admin"}, false, "2026-01-01", nil},
+			} {
+				created := *models.NewUser(user.username, "hash")
+				created.Status = user.status
+				created.Roles = user.roles
+				created.Locked = user.locked
+				created.CreatedAt = date(user.createdAt)
+				created.Attributes = user.attributes
+				users = append(users, created)
+			}
+			require.NoError(t, userService.InsertUsers(ctx, users))
+			require.NoError(t, userService.RecordLogin(ctx, users[0]))
+			// a deleted user isn't found
+			_, err := userService.DeleteUser(ctx, users[4].ID.Hex())
+			require.NoError(t, err)
+
+			tests := []struct {
+				filter string
+				want   []string
+			}{
+				{``, []string{"alice", "bob", "carol", "dave"}},
+				{`status eq "active"`, []string{"alice", "carol"}},
+				{`status eq "ACTIVE" and createdAt gt "2026-01-01"`, []string{"carol"}},
+				{`status ne "active"`, []string{"bob", "dave"}},
+				{`roles eq "admin"`, []string{"alice"}},
+				{`roles eq "ops"`, []string{"alice", "bob"}},
+				{`roles pr`, []string{"alice", "bob", "dave"}},
+				{`not (roles pr)`, []string{"carol"}},
+				{`username sw "a" or username ew "OL"`, []string{"alice", "carol"}},
+				{`userName co "av"`, []string{"dave"}},
+				{`locked eq true`, []string{"bob"}},
+				{`locked ne true`, []string{"alice", "carol", "dave"}},
+				{`createdAt ge "2026-01-15" and createdAt lt "2026-03-01T00:00:00Z"`, []string{"bob", "dave"}},
+				{`lastLoginAt pr`, []string{"alice"}},
+				{`not (lastLoginAt gt "2000-01-01")`, []string{"bob", "carol", "dave"}},
+				{`(status eq "active" or status eq "pending") and not (username eq "carol")`, []string{"alice", "dave"}},
+				{`attributes.department eq "sales"`, []string{"alice"}},
+				{`attributes.department ne "sales"`, []string{"bob", "carol", "dave"}},
+				{`attributes.employee_id ge 2`, []string{"bob"}},
+				{`attributes.remote eq true`, []string{"alice"}},
+				{`attributes.department pr`, []string{"alice", "bob"}},
+			}
+			for _, tt := range tests {
+				found, err := userService.FilterUsers(ctx, tt.filter)
+				require.NoError(t, err, tt.filter)
+				assert.ElementsMatch(t, tt.want, usernames(found), tt.filter)
+			}
+
+			var validationErr *services.ValidationError
+			for _, invalid := range []string{`status eq`, `attributes.badge eq "blue"`, `attributes.department co "sa"`, `attributes.address pr`} {
+				_, err := userService.FilterUsers(ctx, invalid)
+				if assert.ErrorAs(t, err, &validationErr, invalid) {
+					assert.Equal(t, "filter", validationErr.Field)
+				}
+			}
+		})
+	}
+}
+
+// TestFilterHandlers tests GET /admin/users
+func TestFilterHandlers(t *testing.T) {
+	alice := *models.NewUser("alice", "hash")
+	expression := `status eq "active" and createdAt gt "2026-01-01"`
+
+	tests := []struct {
+		name         string
+		path         string
+		header       string
+		mockSetup    func(m *MockUserService)
+		expectedCode int
+		expectedBody string
+	}{
+		{
+			name:   "filter",
+			path:   "/admin/users?filter=" + url.QueryEscape(expression),
+			header: "Bearer s3cret",
+			mockSetup: func(m *MockUserService) {
+				m.On("FilterUsers", mock.Anything, expression).Return([]models.User{alice}, nil)
+			},
+			expectedCode: http.StatusOK,
+			expectedBody: `[{"id":"` + alice.ID.Hex() + `","username":"alice"`,
+		},
+		{
+			name:   "invalid filter",
+			path:   "/admin/users?filter=" + url.QueryEscape(`status gt "active"`),
+			header: "Bearer s3cret",
+			mockSetup: func(m *MockUserService) {
+				m.On("FilterUsers", mock.Anything, `status gt "active"`).Return([]models.User(nil),
+					&services.ValidationError{Field: "filter", Reason: `"gt" at position 8: the attribute status only has the operators eq, ne, co, sw, ew and pr`})
+			},
+			expectedCode: http.StatusBadRequest,
+			expectedBody: "at position 8",
+		},
+		{
+			name:         "without the admin token",
+			path:         "/admin/users",
+			expectedCode: http.StatusUnauthorized,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockUserService := new(MockUserService)
+			if tt.mockSetup != nil {
+				tt.mockSetup(mockUserService)
+			}
+			server := handlers.NewServer(mockUserService, config.ServerConfig{AdminToken: "s3cret"}, discardLogger)
+			server.SetupRoute()
+
+			req, _ := http.NewRequest(http.MethodGet, tt.path, nil)
+			if tt.header != "" {
+				req.Header.Set("Authorization", tt.header)
+			}
+			w := httptest.NewRecorder()
+			server.GetRouter().ServeHTTP(w, req)
+
+			assert.Equal(t, tt.expectedCode, w.Code)
+			assert.Contains(t, w.Body.String(), tt.expectedBody)
+			mockUserService.AssertExpectations(t)
+		})
+	}
+}
@@ -2,14 +2,21 @@ package test
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"sort"
 	"testing"
+	"time"
+	"usermanagement/internal/config"
 	"usermanagement/internal/handlers"
 	"usermanagement/internal/models"
+	"usermanagement/internal/services"
 
 	"github.com/gin-gonic/gin"
 	"github.com/stretchr/testify/assert"
@@ -35,23 +42,23 @@ func TestHandleRegister(t *testing.T) {
 				"password": "testpass",
 			},
 			mockSetup: func(m *MockUserService) {
-				m.On("SearchUserByUsername", "testuser").Return(models.User{}, errors.New("not found"))
-				m.On("CreateUser", mock.AnythingOfType("models.User")).Return(nil)
+				m.On("SearchUserByUsername", mock.Anything, "testuser").Return(models.User{}, errors.New("not found"))
+				m.On("CreateUser", mock.Anything, mock.AnythingOfType("models.User")).Return(models.User{Username: "testuser"}, nil)
 			},
 			wantStatus: http.StatusOK,
 		},
 		{
-			// test case 2: user already exist, return http.StatusBadRequest
+			// test case 2: user already exist, return http.StatusConflict
 			name: "username already exists",
 			body: map[string]string{
 				"username": "existinguser",
 				"password": "testpass",
 			},
 			mockSetup: func(m *MockUserService) {
-				m.On("SearchUserByUsername", "existinguser").Return(models.User{Username: "existinguser"}, nil)
-				m.On("CreateUser", mock.AnythingOfType("models.User")).Return(errors.New("user already exists"))
+				m.On("SearchUserByUsername", mock.Anything, "existinguser").Return(models.User{Username: "existinguser"}, nil)
+				m.On("CreateUser", mock.Anything, mock.AnythingOfType("models.User")).Return(models.User{}, services.ErrConflict)
 			},
-			wantStatus: http.StatusBadRequest,
+			wantStatus: http.StatusConflict,
 		},
 		{
 			// test case 3: empty username, return http.StatusBadRequest
@@ -61,8 +68,8 @@ func TestHandleRegister(t *testing.T) {
 				"password": "testpass",
 			},
 			mockSetup: func(m *MockUserService) {
-				m.On("SearchUserByUsername", "").Return(models.User{}, nil)
-				m.On("CreateUser", mock.AnythingOfType("models.User")).Return(errors.New("empty user name"))
+				m.On("SearchUserByUsername", mock.Anything, "").Return(models.User{}, nil)
+				m.On("CreateUser", mock.Anything, mock.AnythingOfType("models.User")).Return(models.User{}, errors.New("empty user name"))
 			},
 			wantStatus: http.StatusBadRequest,
 		},
@@ -71,8 +78,8 @@ func TestHandleRegister(t *testing.T) {
 			name: "invalid JSON",
 			body: "test body",
 			mockSetup: func(m *MockUserService) {
-				m.On("SearchUserByUsername", "").Return(models.User{}, nil)
-				m.On("CreateUser", mock.AnythingOfType("models.User")).Return(errors.New("empty user name"))
+				m.On("SearchUserByUsername", mock.Anything, "").Return(models.User{}, nil)
+				m.On("CreateUser", mock.Anything, mock.AnythingOfType("models.User")).Return(models.User{}, errors.New("empty user name"))
 			},
 			wantStatus: http.StatusBadRequest,
 		},
@@ -83,9 +90,10 @@ func TestHandleRegister(t *testing.T) {
 			// setup mock
 			mockUserService := new(MockUserService)
 			tt.mockSetup(mockUserService)
+			mockUserService.On("RecordEvent", mock.Anything, mock.Anything).Return(nil).Maybe()
 
 			// setup router
-			server := handlers.NewServer(mockUserService)
+			server := handlers.NewServer(mockUserService, config.ServerConfig{}, discardLogger)
 			server.SetupRoute()
 
 			bodyBytes, _ := json.Marshal(tt.body)
@@ -100,6 +108,30 @@ func TestHandleRegister(t *testing.T) {
 	}
 }
 
+// TestHandleRegisterStoredUser tests that the response is the user as stored, with its lifecycle fields
+func TestHandleRegisterStoredUser(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	server := handlers.NewServer(newMemoryService(t), config.ServerConfig{}, discardLogger)
+	server.SetupRoute()
+
+	body, _ := json.Marshal(map[string]string{"username": "alice", "password": "testpass"})
+	req := httptest.NewRequest(http.MethodPost, "/register", bytes.NewReader(body))
+	resp := httptest.NewRecorder()
+	server.GetRouter().ServeHTTP(resp, req)
+	assert.Equal(t, http.StatusOK, resp.Code, resp.Body.String())
+
+	var user models.User
+	if !assert.NoError(t, json.Unmarshal(resp.Body.Bytes(), &user)) {
+		return
+	}
+	assert.Equal(t, models.StatusActive, user.Status)
+	assert.False(t, user.CreatedAt.IsZero(), "created_at should be set")
+	assert.Equal(t, user.CreatedAt, user.UpdatedAt)
+	if assert.NotNil(t, user.PasswordChangedAt) {
+		assert.Equal(t, user.CreatedAt, *user.PasswordChangedAt)
+	}
+}
+
 func TestHandleLogin(t *testing.T) {
 	gin.SetMode(gin.TestMode)
 
@@ -118,7 +150,7 @@ func TestHandleLogin(t *testing.T) {
 			},
 			mockSetup: func(m *MockUserService) {
 				hashedPassword, _ := bcrypt.GenerateFromPassword([]byte("testpass"), bcrypt.DefaultCost)
-				m.On("SearchUserByUsername", "testuser").Return(models.User{
+				m.On("SearchUserForLogin", mock.Anything, "testuser").Return(models.User{
 					Username: "testuser",
 					Password: string(hashedPassword),
 					ID:       primitive.NewObjectID(),
@@ -127,40 +159,40 @@ func TestHandleLogin(t *testing.T) {
 			wantStatus: http.StatusOK,
 		},
 		{
-			// test case 2: invalid password, return http.StatusBadRequest
+			// test case 2: invalid password, return http.StatusUnauthorized
 			name: "invalid password",
 			body: map[string]string{
 				"username": "testuser",
 				"password": "wrongpass",
 			},
 			mockSetup: func(m *MockUserService) {
-				m.On("SearchUserByUsername", "testuser").Return(models.User{
+				m.On("SearchUserForLogin", mock.Anything, "testuser").Return(models.User{
 					Username: "testuser",
 					Password: "testpass",
 					ID:       primitive.NewObjectID(),
 				}, nil)
 			},
-			wantStatus: http.StatusBadRequest,
+			wantStatus: http.StatusUnauthorized,
 		},
 		{
-			// test case 3: user not found, return http.StatusBadRequest
+			// test case 3: user not found, return http.StatusUnauthorized
 			name: "user not found",
 			body: map[string]string{
 				"username": "testuser",
 				"password": "testpass",
 			},
 			mockSetup: func(m *MockUserService) {
-				m.On("SearchUserByUsername", "testuser").Return(models.User{}, errors.New("not found"))
+				m.On("SearchUserForLogin", mock.Anything, "testuser").Return(models.User{}, services.ErrNotFound)
 			},
-			wantStatus: http.StatusBadRequest,
+			wantStatus: http.StatusUnauthorized,
 		},
 		{
 			// test case 4: invalid JSON, return http.StatusBadRequest
 			name: "invalid JSON",
 			body: "test body",
 			mockSetup: func(m *MockUserService) {
-				m.On("SearchUserByUsername", "").Return(models.User{}, nil)
-				m.On("CreateUser", mock.AnythingOfType("models.User")).Return(errors.New("empty user name"))
+				m.On("SearchUserForLogin", mock.Anything, "").Return(models.User{}, nil)
+				m.On("CreateUser", mock.Anything, mock.AnythingOfType("models.User")).Return(models.User{}, errors.New("empty user name"))
 			},
 			wantStatus: http.StatusBadRequest,
 		},
@@ -170,8 +202,10 @@ func TestHandleLogin(t *testing.T) {
 		t.Run(tt.name, func(t *testing.T) {
 			MockUserService := new(MockUserService)
 			tt.mockSetup(MockUserService)
+			MockUserService.On("RecordEvent", mock.Anything, mock.Anything).Return(nil).Maybe()
+			MockUserService.On("RecordLogin", mock.Anything, mock.Anything).Return(nil).Maybe()
 
-			server := handlers.NewServer(MockUserService)
+			server := handlers.NewServer(MockUserService, config.ServerConfig{}, discardLogger)
 			server.SetupRoute()
 
 			bodyBytes, _ := json.Marshal(tt.body)
@@ -186,6 +220,70 @@ func TestHandleLogin(t *testing.T) {
 	}
 }
 
+// TestHandleLoginUniformFailure tests that an unknown username and a wrong password
+// can't be told apart, neither by the response nor by the response time
+func TestHandleLoginUniformFailure(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	hashedPassword, _ := bcrypt.GenerateFromPassword([]byte("testpass"), bcrypt.DefaultCost)
+	mockUserService := new(MockUserService)
+	mockUserService.On("SearchUserForLogin", mock.Anything, "existinguser").Return(models.User{
+		Username: "existinguser",
+		Password: string(hashedPassword),
+		ID:       primitive.NewObjectID(),
+	}, nil)
+	mockUserService.On("SearchUserForLogin", mock.Anything, "unknownuser").Return(models.User{}, services.ErrNotFound)
+	mockUserService.On("RecordEvent", mock.Anything, mock.Anything).Return(nil)
+
+	server := handlers.NewServer(mockUserService, config.ServerConfig{}, discardLogger)
+	server.SetupRoute()
+
+	login := func(username string) (*httptest.ResponseRecorder, time.Duration) {
+		bodyBytes, _ := json.Marshal(map[string]string{
+			"username": username,
+			"password": "wrongpass",
+		})
+		req, err := http.NewRequest(http.MethodPost, "/login", bytes.NewBuffer(bodyBytes))
+		assert.NoError(t, err, "Should be able to create a request")
+
+		resp := httptest.NewRecorder()
+		start := time.Now()
+		server.GetRouter().ServeHTTP(resp, req)
+		return resp, time.Since(start)
+	}
+
+	// same status and body
+	wrongPassword, _ := login("existinguser")
+	unknownUser, _ := login("unknownuser")
+	assert.Equal(t, http.StatusUnauthorized, wrongPassword.Code)
+	assert.Equal(t, wrongPassword.Code, unknownUser.Code)
+	assert.Equal(t, wrongPassword.Body.String(), unknownUser.Body.String())
+
+	if testing.Short() {
+		t.Skip("skip timing comparison in short mode")
+	}
+
+	// same response time: interleave the samples so that noise affects both sides equally,
+	// then compare the medians
+	const samples = 15
+	wrongPasswordTimes := make([]time.Duration, 0, samples)
+	unknownUserTimes := make([]time.Duration, 0, samples)
+	for i := 0; i < samples; i++ {
+		_, d := login("existinguser")
+		wrongPasswordTimes = append(wrongPasswordTimes, d)
+		_, d = login("unknownuser")
+		unknownUserTimes = append(unknownUserTimes, d)
+	}
+
+	median := func(times []time.Duration) time.Duration {
+		sort.Slice(times, func(i, j int) bool { return times[i] < times[j] })
+		return times[len(times)/2]
+	}
+	a, b := median(wrongPasswordTimes), median(unknownUserTimes)
+	ratio := float64(a) / float64(b)
+	assert.InDelta(t, 1.0, ratio, 0.3, "median login time differs: wrong password %v, unknown user %v", a, b)
+}
+
 func TestHandleGetAllUsers(t *testing.T) {
 	gin.SetMode(gin.TestMode)
 
@@ -198,7 +296,7 @@ func TestHandleGetAllUsers(t *testing.T) {
 			// test case 1: successful get all users, return http.StatusOK
 			name: "successful get all users",
 			mockSetup: func(m *MockUserService) {
-				m.On("GetAllUsers").Return([]models.User{
+				m.On("GetAllUsers", mock.Anything).Return([]models.User{
 					{
 						Username: "testuser1",
 						Password: "testpass1",
@@ -214,12 +312,12 @@ func TestHandleGetAllUsers(t *testing.T) {
 			wantStatus: http.StatusOK,
 		},
 		{
-			// test case 2: cannot get data from the database, return http.StatusBadRequest
+			// test case 2: cannot get data from the database, return http.StatusServiceUnavailable
 			name: "cannot get data from the database",
 			mockSetup: func(m *MockUserService) {
-				m.On("GetAllUsers").Return([]models.User{}, errors.New("cannot get data from the database"))
+				m.On("GetAllUsers", mock.Anything).Return([]models.User{}, &services.StorageError{Op: "read", Err: errors.New("cannot get data from the database")})
 			},
-			wantStatus: http.StatusBadRequest,
+			wantStatus: http.StatusServiceUnavailable,
 		},
 	}
 
@@ -228,7 +326,7 @@ func TestHandleGetAllUsers(t *testing.T) {
 			MockUserService := new(MockUserService)
 			tt.mockSetup(MockUserService)
 
-			server := handlers.NewServer(MockUserService)
+			server := handlers.NewServer(MockUserService, config.ServerConfig{}, discardLogger)
 			server.SetupRoute()
 
 			req, err := http.NewRequest(http.MethodGet, "/users", nil)
@@ -258,7 +356,7 @@ func TestHandleSearchUser(t *testing.T) {
 			name:  "successful search user by username",
 			query: "username=testuser",
 			mockSetup: func(m *MockUserService) {
-				m.On("SearchUserByUsername", "testuser").Return(models.User{
+				m.On("SearchUserByUsername", mock.Anything, "testuser").Return(models.User{
 					Username: "testuser",
 					Password: "testpass",
 					ID:       primitive.NewObjectID(),
@@ -271,7 +369,7 @@ func TestHandleSearchUser(t *testing.T) {
 			name:  "successful search user by id",
 			query: fmt.Sprintf("id=%s", testID.Hex()),
 			mockSetup: func(m *MockUserService) {
-				m.On("SearchUserByID", testID.Hex()).Return(models.User{
+				m.On("SearchUserByID", mock.Anything, testID.Hex()).Return(models.User{
 					Username: "testuser",
 					Password: "testpass",
 					ID:       testID,
@@ -280,22 +378,22 @@ func TestHandleSearchUser(t *testing.T) {
 			wantStatus: http.StatusOK,
 		},
 		{
-			// test case 3.1: user not found, return http.StatusBadRequest
+			// test case 3.1: user not found, return http.StatusNotFound
 			name:  "user not found",
 			query: "username=testuser",
 			mockSetup: func(m *MockUserService) {
-				m.On("SearchUserByUsername", "testuser").Return(models.User{}, errors.New("not found"))
+				m.On("SearchUserByUsername", mock.Anything, "testuser").Return(models.User{}, services.ErrNotFound)
 			},
-			wantStatus: http.StatusBadRequest,
+			wantStatus: http.StatusNotFound,
 		},
 		{
-			// test case 3.2: user not found, return http.StatusBadRequest
+			// test case 3.2: user not found, return http.StatusNotFound
 			name:  "user not found",
 			query: fmt.Sprintf("id=%s", testID.Hex()),
 			mockSetup: func(m *MockUserService) {
-				m.On("SearchUserByID", testID.Hex()).Return(models.User{}, errors.New("not found"))
+				m.On("SearchUserByID", mock.Anything, testID.Hex()).Return(models.User{}, services.ErrNotFound)
 			},
-			wantStatus: http.StatusBadRequest,
+			wantStatus: http.StatusNotFound,
 		},
 		{
 			// test case 4: invalid query, return http.StatusBadRequest
@@ -311,7 +409,7 @@ func TestHandleSearchUser(t *testing.T) {
 			MockUserService := new(MockUserService)
 			tt.mockSetup(MockUserService)
 
-			server := handlers.NewServer(MockUserService)
+			server := handlers.NewServer(MockUserService, config.ServerConfig{}, discardLogger)
 			server.SetupRoute()
 
 			req, err := http.NewRequest(http.MethodGet, "/search?"+tt.query, nil)
@@ -322,3 +420,165 @@ func TestHandleSearchUser(t *testing.T) {
 		})
 	}
 }
+
+func TestErrorHandler(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	tests := []struct {
+		name       string
+		err        error
+		wantStatus int
+		wantType   string
+	}{
+		{
+			name:       "validation error",
+			err:        &services.ValidationError{Field: "id", Reason: "bad id"},
+			wantStatus: http.StatusBadRequest,
+			wantType:   "/problems/validation",
+		},
+		{
+			name:       "not found",
+			err:        services.ErrNotFound,
+			wantStatus: http.StatusNotFound,
+			wantType:   "/problems/not-found",
+		},
+		{
+			name:       "conflict",
+			err:        services.ErrConflict,
+			wantStatus: http.StatusConflict,
+			wantType:   "/problems/conflict",
+		},
+		{
+			name:       "wrapped invalid credentials",
+			err:        fmt.Errorf("%w: invalid password", services.ErrInvalidCredentials),
+			wantStatus: http.StatusUnauthorized,
+			wantType:   "/problems/invalid-credentials",
+		},
+		{
+			name:       "database unavailable",
+			err:        &services.StorageError{Op: "read", Err: errors.New("connection refused")},
+			wantStatus: http.StatusServiceUnavailable,
+			wantType:   "/problems/unavailable",
+		},
+		{
+			name:       "unknown error",
+			err:        errors.New("type assertion failed"),
+			wantStatus: http.StatusInternalServerError,
+			wantType:   "about:blank",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			router := gin.New()
+			router.Use(handlers.ErrorHandler())
+			router.GET("/error", func(c *gin.Context) {
+				_ = c.Error(tt.err)
+			})
+
+			req, err := http.NewRequest(http.MethodGet, "/error", nil)
+			assert.NoError(t, err, "Should be able to create a request")
+
+			resp := httptest.NewRecorder()
+			router.ServeHTTP(resp, req)
+
+			assert.Equal(t, tt.wantStatus, resp.Code, "Unexpected response status")
+			assert.Equal(t, handlers.ProblemContentType, resp.Header().Get("Content-Type"))
+
+			var problem handlers.Problem
+			assert.NoError(t, json.Unmarshal(resp.Body.Bytes(), &problem))
+			assert.Equal(t, tt.wantType, problem.Type)
+			assert.Equal(t, tt.wantStatus, problem.Status)
+			assert.Equal(t, "/error", problem.Instance)
+			assert.NotContains(t, problem.Detail, "connection refused", "Should not leak database errors")
+		})
+	}
+}
+
+type ctxKey struct{}
+
+// TestHandlersPassRequestContext tests that the handlers pass the context of the request
+// to the user service, so a client disconnect cancels the database query
+func TestHandlersPassRequestContext(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	fromRequest := mock.MatchedBy(func(ctx context.Context) bool {
+		return ctx.Value(ctxKey{}) == "request"
+	})
+
+	mockUserService := new(MockUserService)
+	mockUserService.On("GetAllUsers", fromRequest).Return([]models.User{}, nil)
+	mockUserService.On("SearchUserByUsername", fromRequest, "testuser").Return(models.User{Username: "testuser"}, nil)
+
+	server := handlers.NewServer(mockUserService, config.ServerConfig{}, discardLogger)
+	server.SetupRoute()
+
+	for _, target := range []string{"/users", "/search?username=testuser"} {
+		ctx := context.WithValue(context.Background(), ctxKey{}, "request")
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+		assert.NoError(t, err, "Should be able to create a request")
+
+		resp := httptest.NewRecorder()
+		server.GetRouter().ServeHTTP(resp, req)
+
+		assert.Equal(t, http.StatusOK, resp.Code, "Unexpected response status")
+	}
+	mockUserService.AssertExpectations(t)
+}
+
+// TestServeDrainsInFlightRequests tests that a request in flight when the server is stopped
+// still gets its response, and that the server stops afterwards
+func TestServeDrainsInFlightRequests(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	server := handlers.NewServer(new(MockUserService), config.Default().Server, discardLogger)
+	started := make(chan struct{})
+	server.GetRouter().GET("/slow", func(c *gin.Context) {
+		close(started)
+		time.Sleep(200 * time.Millisecond)
+		c.String(http.StatusOK, "done")
+	})
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+
+	ctx, stop := context.WithCancel(context.Background())
+	served := make(chan error, 1)
+	go func() {
+		served <- server.Serve(ctx, listener)
+	}()
+
+	type result struct {
+		resp *http.Response
+		err  error
+	}
+	responses := make(chan result, 1)
+	go func() {
+		resp, err := http.Get("http://" + listener.Addr().String() + "/slow")
+		responses <- result{resp, err}
+	}()
+
+	// stop the server while the request is in flight
+	<-started
+	stop()
+
+	r := <-responses
+	assert.NoError(t, r.err)
+	if r.err == nil {
+		body, _ := io.ReadAll(r.resp.Body)
+		r.resp.Body.Close()
+		assert.Equal(t, http.StatusOK, r.resp.StatusCode)
+		assert.Equal(t, "done", string(body))
+	}
+
+	select {
+	case err := <-served:
+		assert.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("server didn't stop")
+	}
+
+	// new connections are refused
+	_, err = http.Get("http://" + listener.Addr().String() + "/slow")
+	assert.Error(t, err)
+}
@@ -0,0 +1,144 @@
+package test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+	"usermanagement/internal/config"
+	"usermanagement/internal/handlers"
+	"usermanagement/internal/session"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHandleHealthz(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	// liveness must not depend on the database, so no expectation is set on the mock
+	mockUserService := new(MockUserService)
+	server := handlers.NewServer(mockUserService, config.Default().Server, discardLogger)
+	server.SetupRoute()
+
+	req, err := http.NewRequest(http.MethodGet, "/healthz", nil)
+	assert.NoError(t, err, "Should be able to create a request")
+
+	resp := httptest.NewRecorder()
+	server.GetRouter().ServeHTTP(resp, req)
+
+	assert.Equal(t, http.StatusOK, resp.Code, "Unexpected response status")
+	mockUserService.AssertExpectations(t)
+}
+
+func TestHandleReadyz(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	tests := []struct {
+		name          string
+		mockSetup     func(m *MockUserService)
+		wantStatus    int
+		wantComponent string
+		wantError     string
+	}{
+		{
+			// test case 1: database is up, return http.StatusOK
+			name: "database up",
+			mockSetup: func(m *MockUserService) {
+				m.On("PingDB", mock.Anything).Return(nil)
+			},
+			wantStatus:    http.StatusOK,
+			wantComponent: "up",
+		},
+		{
+			// test case 2: database is down, return http.StatusServiceUnavailable
+			name: "database down",
+			mockSetup: func(m *MockUserService) {
+				m.On("PingDB", mock.Anything).Return(errors.New("connection refused"))
+			},
+			wantStatus: http.StatusServiceUnavailable,
+			// the error is only logged, it may tell the address of the database
+			wantComponent: "down",
+		},
+		{
+			// test case 3: database doesn't answer in time, return http.StatusServiceUnavailable
+			name: "database timeout",
+			mockSetup: func(m *MockUserService) {
+				m.On("PingDB", mock.Anything).Return(nil).Run(func(args mock.Arguments) {
+					<-args.Get(0).(context.Context).Done()
+				})
+			},
+			wantStatus:    http.StatusServiceUnavailable,
+			wantComponent: "down",
+			wantError:     "timeout after 50ms",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockUserService := new(MockUserService)
+			tt.mockSetup(mockUserService)
+
+			cfg := config.Default().Server
+			cfg.ReadinessTimeout = 50 * time.Millisecond
+			server := handlers.NewServer(mockUserService, cfg, discardLogger)
+			server.SetupRoute()
+
+			req, err := http.NewRequest(http.MethodGet, "/readyz", nil)
+			assert.NoError(t, err, "Should be able to create a request")
+
+			resp := httptest.NewRecorder()
+			server.GetRouter().ServeHTTP(resp, req)
+
+			assert.Equal(t, tt.wantStatus, resp.Code, "Unexpected response status")
+
+			var body handlers.ReadinessResponse
+			assert.NoError(t, json.Unmarshal(resp.Body.Bytes(), &body))
+			assert.Equal(t, tt.wantComponent, body.Components["database"].Status)
+			assert.Equal(t, tt.wantError, body.Components["database"].Error)
+		})
+	}
+}
+
+func TestHandleReadyzRedis(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	redisServer := miniredis.RunT(t)
+	state, err := session.New(config.RedisConfig{URL: "redis://:secret@" + redisServer.Addr()})
+	require.NoError(t, err)
+	defer state.Close()
+
+	mockUserService := new(MockUserService)
+	mockUserService.On("PingDB", mock.Anything).Return(nil)
+
+	cfg := config.Default().Server
+	cfg.ReadinessTimeout = 50 * time.Millisecond
+	server := handlers.NewServerWithStore(mockUserService, state, cfg, discardLogger)
+	server.AddReadinessCheck("redis", server.PingLoginState)
+	server.SetupRoute()
+
+	readyz := func() (int, handlers.ReadinessResponse) {
+		resp := httptest.NewRecorder()
+		server.GetRouter().ServeHTTP(resp, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+		var body handlers.ReadinessResponse
+		require.NoError(t, json.Unmarshal(resp.Body.Bytes(), &body))
+		return resp.Code, body
+	}
+
+	code, body := readyz()
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "up", body.Components["redis"].Status)
+
+	redisServer.RequireAuth("other")
+	code, body = readyz()
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, "up", body.Components["database"].Status)
+	assert.Equal(t, "down", body.Components["redis"].Status)
+	assert.Empty(t, body.Components["redis"].Error, "the error must not be responded")
+}
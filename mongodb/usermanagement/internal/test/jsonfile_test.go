@@ -0,0 +1,203 @@
+package test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+	"usermanagement/internal/config"
+	"usermanagement/internal/models"
+	"usermanagement/internal/services"
+
+	"github.com/rs/xid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// openUsersFile opens the users saved at path
+func openUsersFile(t *testing.T, path string) *models.JSONFile {
+	f, err := models.NewJSONFile(path, func() interface{} { return &models.User{} }, "username")
+	require.NoError(t, err)
+	return f
+}
+
+// readUsers reads the users of f matching filter
+func readUsers(t *testing.T, f *models.JSONFile, filter interface{}) []string {
+	found, err := f.Read(context.Background(), filter, func() interface{} { return &models.User{} })
+	require.NoError(t, err)
+	usernames := make([]string, len(found))
+	for i, item := range found {
+		usernames[i] = item.(*models.User).Username
+	}
+	return usernames
+}
+
+func TestJSONFile(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "users.json")
+	f := openUsersFile(t, path)
+	require.NoError(t, f.Ping(ctx), "a missing file is an empty collection")
+
+	alice := models.User{ID: primitive.NewObjectID(), Username: "alice", Password: "hash", Roles: []string{"admin"}}
+	bob := models.User{ID: primitive.NewObjectID(), Username: "bob", Password: "hash"}
+	require.NoError(t, f.Create(ctx, alice))
+	require.NoError(t, f.Create(ctx, bob))
+
+	err := f.Create(ctx, models.User{ID: primitive.NewObjectID(), Username: "alice"})
+	assert.True(t, models.IsDuplicateKey(err), "the usernames are unique")
+	err = f.Create(ctx, models.User{ID: alice.ID, Username: "carol"})
+	assert.True(t, models.IsDuplicateKey(err), "the ids are unique")
+
+	count, err := f.Count(ctx, bson.M{})
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), count)
+
+	assert.Equal(t, []string{"alice"}, readUsers(t, f, bson.M{"_id": alice.ID}))
+	assert.Equal(t, []string{"alice"}, readUsers(t, f, bson.M{"roles": "admin"}))
+	assert.Equal(t, []string{"bob"}, readUsers(t, f, bson.M{"username": bson.M{"$regex": "^B", "$options": "i"}}))
+	assert.Equal(t, []string{"bob"}, readUsers(t, f, models.MongoQuery{Sort: bson.D{{Key: "username", Value: -1}}, Limit: 1}))
+
+	require.NoError(t, f.Update(ctx, bson.M{"username": "bob"}, bson.M{"$set": bson.M{"locked": true}}))
+	assert.Equal(t, []string{"bob"}, readUsers(t, f, bson.M{"locked": true}))
+	err = f.Update(ctx, bson.M{"username": "bob"}, bson.M{"$set": bson.M{"username": "alice"}})
+	assert.True(t, models.IsDuplicateKey(err))
+
+	require.NoError(t, f.Delete(ctx, bson.M{"username": "alice"}))
+
+	// every write is saved
+	reopened := openUsersFile(t, path)
+	assert.Equal(t, []string{"bob"}, readUsers(t, reopened, bson.M{"locked": true}))
+	count, err = reopened.Count(ctx, bson.M{})
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), count)
+}
+
+// TestJSONFileIndexes tests that the unique values and the indexes follow the writes,
+// and are restored with the documents when a write can't be saved
+func TestJSONFileIndexes(t *testing.T) {
+	ctx := context.Background()
+	dir := filepath.Join(t.TempDir(), "data")
+	require.NoError(t, os.Mkdir(dir, 0755))
+	f := openUsersFile(t, filepath.Join(dir, "users.json"))
+	require.NoError(t, f.Index("usernames", func(item interface{}) []string { return []string{item.(*models.User).Username} }))
+	byUsername := func(usernames ...string) []string {
+		found, err := f.ReadIndex(ctx, "usernames", usernames, bson.M{}, func() interface{} { return &models.User{} })
+		require.NoError(t, err)
+		names := make([]string, len(found))
+		for i, item := range found {
+			names[i] = item.(*models.User).Username
+		}
+		return names
+	}
+
+	for _, username := range []string{"alice", "bob", "carol", "dave"} {
+		require.NoError(t, f.Create(ctx, models.User{ID: primitive.NewObjectID(), Username: username, Password: "hash"}))
+	}
+	require.NoError(t, f.Update(ctx, bson.M{"username": "bob"}, bson.M{"$set": bson.M{"username": "robert"}}))
+	require.NoError(t, f.Delete(ctx, bson.M{"username": "alice"}))
+	assert.Equal(t, []string{"robert", "dave"}, byUsername("alice", "bob", "robert", "dave"))
+	assert.NoError(t, f.Create(ctx, models.User{ID: primitive.NewObjectID(), Username: "bob", Password: "hash"}), "bob is free")
+	err := f.Update(ctx, bson.M{"username": "carol"}, bson.M{"$set": bson.M{"username": "dave"}})
+	assert.True(t, models.IsDuplicateKey(err), "after a delete: %v", err)
+
+	// the directory is gone, no write can be saved
+	require.NoError(t, os.RemoveAll(dir))
+	assert.Error(t, f.Update(ctx, bson.M{"username": "carol"}, bson.M{"$set": bson.M{"username": "caroline"}}))
+	assert.Error(t, f.Create(ctx, models.User{ID: primitive.NewObjectID(), Username: "erin", Password: "hash"}))
+	assert.Equal(t, []string{"carol"}, byUsername("carol", "caroline", "erin"))
+	err = f.Create(ctx, models.User{ID: primitive.NewObjectID(), Username: "carol", Password: "hash"})
+	assert.True(t, models.IsDuplicateKey(err), "carol is kept: %v", err)
+
+	require.NoError(t, os.Mkdir(dir, 0755))
+	assert.NoError(t, f.Create(ctx, models.User{ID: primitive.NewObjectID(), Username: "caroline", Password: "hash"}), "caroline is free")
+	assert.Equal(t, []string{"robert", "carol", "dave", "bob", "caroline"}, readUsers(t, f, bson.M{}))
+}
+
+// TestJSONFileLazyFields tests that the updates of the lazy fields are saved later, with the next write or by Close
+func TestJSONFileLazyFields(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "users.json")
+	f := openUsersFile(t, path)
+	f.SetLazyFields("last_login_at")
+	alice := models.User{ID: primitive.NewObjectID(), Username: "alice", Password: "hash"}
+	require.NoError(t, f.Create(ctx, alice))
+	loggedIn := bson.M{"$set": bson.M{"last_login_at": time.Now()}}
+
+	swapped, err := f.CompareAndSwap(ctx, bson.M{"_id": alice.ID}, loggedIn)
+	require.NoError(t, err)
+	assert.True(t, swapped)
+	assert.Equal(t, []string{"alice"}, readUsers(t, f, bson.M{"last_login_at": bson.M{"$exists": true}}))
+	assert.Empty(t, readUsers(t, openUsersFile(t, path), bson.M{"last_login_at": bson.M{"$exists": true}}), "the login isn't saved yet")
+	require.NoError(t, f.Close(ctx))
+	assert.Equal(t, []string{"alice"}, readUsers(t, openUsersFile(t, path), bson.M{"last_login_at": bson.M{"$exists": true}}))
+
+	// saved with the next write
+	require.NoError(t, f.Update(ctx, bson.M{"_id": alice.ID}, bson.M{"$unset": bson.M{"last_login_at": ""}}))
+	require.NoError(t, f.Update(ctx, bson.M{"_id": alice.ID}, loggedIn))
+	require.NoError(t, f.Update(ctx, bson.M{"_id": alice.ID}, bson.M{"$set": bson.M{"locked": true}}))
+	assert.Equal(t, []string{"alice"}, readUsers(t, openUsersFile(t, path), bson.M{"last_login_at": bson.M{"$exists": true}, "locked": true}))
+
+	// or after a while
+	require.NoError(t, f.Update(ctx, bson.M{"_id": alice.ID}, bson.M{"$set": bson.M{"last_login_at": time.Now().Add(time.Hour)}}))
+	assert.Eventually(t, func() bool {
+		return len(readUsers(t, openUsersFile(t, path), bson.M{"last_login_at": bson.M{"$gt": time.Now()}})) == 1
+	}, 3*models.LazySaveDelay, 50*time.Millisecond)
+}
+
+// TestJSONFileXID tests that the files with the xid ids of the older JSON files are read
+func TestJSONFileXID(t *testing.T) {
+	id := xid.New()
+	path := writeJSONUsers(t, map[string]string{"id": id.String(), "username": "user1", "password": "password"})
+
+	f := openUsersFile(t, path)
+
+	var objectID primitive.ObjectID
+	copy(objectID[:], id.Bytes())
+	assert.Equal(t, []string{"user1"}, readUsers(t, f, bson.M{"_id": objectID}))
+}
+
+func TestJSONBackend(t *testing.T) {
+	ctx := context.Background()
+	path := writeJSONUsers(t, map[string]string{"id": xid.New().String(), "username": "user1", "password": "password"})
+	cfg := config.DatabaseConfig{JSON: config.JSONConfig{DataFile: path}}
+
+	userService := services.NewUserServiceWithBackend(services.NewJSONBackend(cfg, discardLogger), nil, config.Default().Deletion, nil, discardLogger)
+	require.NoError(t, userService.LoginDB())
+	require.NoError(t, userService.PingDB(ctx))
+
+	// the plain password of the older file is hashed on startup
+	user, err := userService.SearchUserForLogin(ctx, "user1")
+	require.NoError(t, err)
+	assert.NoError(t, bcrypt.CompareHashAndPassword([]byte(user.Password), []byte("password")))
+
+	found, err := userService.SearchUserByID(ctx, user.ID.Hex())
+	require.NoError(t, err)
+	assert.Equal(t, "user1", found.Username)
+
+	hashed, _ := bcrypt.GenerateFromPassword([]byte("bobpass"), bcrypt.MinCost)
+	_, err = userService.CreateUser(ctx, models.User{ID: primitive.NewObjectID(), Username: "bob", Password: string(hashed)})
+	require.NoError(t, err)
+	_, err = userService.CreateUser(ctx, models.User{ID: primitive.NewObjectID(), Username: "bob"})
+	assert.ErrorIs(t, err, services.ErrConflict)
+
+	require.NoError(t, userService.RecordEvent(ctx, models.AuditEvent{Type: models.EventUserRegistered, Actor: "bob"}))
+	verification, err := userService.VerifyAuditLog(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), verification.Events)
+	_, err = os.Stat(cfg.JSON.AuditFile())
+	assert.NoError(t, err, "the audit log should be saved next to the data file")
+
+	// a new server reads the same users
+	restarted := services.NewUserService(cfg, discardLogger)
+	require.NoError(t, restarted.LoginDB())
+	users, err := restarted.GetAllUsers(ctx)
+	require.NoError(t, err)
+	assert.Len(t, users, 2)
+	count, err := restarted.CountUsers(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), count)
+}
@@ -0,0 +1,116 @@
+package test
+
+import (
+	"context"
+	"testing"
+	"time"
+	"usermanagement/internal/config"
+	"usermanagement/internal/models"
+	"usermanagement/internal/services"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// TestUserLifecycle tests the times and the status maintained by the service
+func TestUserLifecycle(t *testing.T) {
+	ctx := context.Background()
+	userService := newMemoryService(t)
+	start := time.Now().Truncate(time.Millisecond)
+
+	_, err := userService.CreateUser(ctx, *models.NewUser("alice", "hash1"))
+	require.NoError(t, err)
+	alice, err := userService.SearchUserByUsername(ctx, "alice")
+	require.NoError(t, err)
+	assert.Equal(t, models.StatusActive, alice.Status)
+	assert.False(t, alice.CreatedAt.Before(start), "the creation should be recorded")
+	assert.Equal(t, alice.CreatedAt, alice.UpdatedAt)
+	if assert.NotNil(t, alice.PasswordChangedAt) {
+		assert.Equal(t, alice.CreatedAt, *alice.PasswordChangedAt)
+	}
+	assert.Nil(t, alice.LastLoginAt)
+
+	// a login isn't a change of the user
+	time.Sleep(2 * time.Millisecond)
+	require.NoError(t, userService.RecordLogin(ctx, alice))
+	loggedIn, err := userService.SearchUserByUsername(ctx, "alice")
+	require.NoError(t, err)
+	if assert.NotNil(t, loggedIn.LastLoginAt) {
+		assert.True(t, loggedIn.LastLoginAt.After(alice.CreatedAt))
+	}
+	assert.Equal(t, alice.UpdatedAt, loggedIn.UpdatedAt)
+
+	time.Sleep(2 * time.Millisecond)
+	require.NoError(t, userService.ResetPassword(ctx, "alice", "hash2"))
+	changed, err := userService.SearchUserByUsername(ctx, "alice")
+	require.NoError(t, err)
+	assert.Equal(t, alice.CreatedAt, changed.CreatedAt)
+	assert.True(t, changed.UpdatedAt.After(*loggedIn.LastLoginAt))
+	if assert.NotNil(t, changed.PasswordChangedAt) {
+		assert.Equal(t, changed.UpdatedAt, *changed.PasswordChangedAt)
+	}
+	assert.Equal(t, loggedIn.LastLoginAt, changed.LastLoginAt)
+}
+
+// TestUserLifecycleKept tests that the status and the times of a user are kept when they are given,
+// e.g. by a migration, and that the users stored before them are active
+func TestUserLifecycleKept(t *testing.T) {
+	ctx := context.Background()
+	created := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+	legacy := models.User{ID: primitive.NewObjectID(), Username: "legacy", Password: "hash"}
+	userService := newMemoryService(t, legacy)
+
+	pending := models.User{ID: primitive.NewObjectID(), Username: "pending", Password: "hash",
+		Status: models.StatusPending, CreatedAt: created}
+	require.NoError(t, userService.InsertUsers(ctx, []models.User{pending}))
+
+	found, err := userService.SearchUserByUsername(ctx, "pending")
+	require.NoError(t, err)
+	assert.Equal(t, models.StatusPending, found.Status)
+	assert.Equal(t, created, found.CreatedAt)
+	assert.Equal(t, created, found.UpdatedAt)
+
+	found, err = userService.SearchUserByUsername(ctx, "legacy")
+	require.NoError(t, err)
+	assert.Equal(t, models.UserStatus(""), found.Status)
+	assert.Equal(t, models.StatusActive, found.CurrentStatus())
+	assert.True(t, found.CreatedAt.IsZero())
+
+	// a login of a user stored before the times were recorded
+	assert.NoError(t, userService.RecordLogin(ctx, found))
+	assert.ErrorIs(t, userService.SetStatus(ctx, "nobody", models.StatusActive), services.ErrNotFound)
+}
+
+// TestUserLifecycleBackends tests that the status and the times are persisted by every backend of the conformance suite
+func TestUserLifecycleBackends(t *testing.T) {
+	for _, fixture := range storeFixtures {
+		fixture := fixture
+		t.Run(fixture.name, func(t *testing.T) {
+			ctx := context.Background()
+			userService := services.NewUserServiceWithBackend(nil, nil, config.Default().Deletion, nil, discardLogger)
+			userService.Database = fixture.open(t)
+
+			created, err := userService.CreateUser(ctx, *models.NewUser("alice", "hash1"))
+			require.NoError(t, err)
+			require.NoError(t, userService.InsertUsers(ctx, []models.User{*models.NewUser("bob", "hash1")}))
+			require.NoError(t, userService.RecordLogin(ctx, created))
+			require.NoError(t, userService.ResetPassword(ctx, "alice", "hash2"))
+			require.NoError(t, userService.SetStatus(ctx, "alice", models.StatusSuspended))
+
+			alice, err := userService.SearchUserByUsername(ctx, "alice")
+			require.NoError(t, err)
+			assert.Equal(t, models.StatusSuspended, alice.Status)
+			assert.False(t, alice.CreatedAt.IsZero())
+			assert.False(t, alice.UpdatedAt.Before(alice.CreatedAt))
+			assert.NotNil(t, alice.LastLoginAt)
+			assert.NotNil(t, alice.PasswordChangedAt)
+
+			bob, err := userService.SearchUserByUsername(ctx, "bob")
+			require.NoError(t, err)
+			assert.Equal(t, models.StatusActive, bob.Status)
+			assert.False(t, bob.CreatedAt.IsZero())
+			assert.Nil(t, bob.LastLoginAt)
+		})
+	}
+}
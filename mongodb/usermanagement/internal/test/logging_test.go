@@ -0,0 +1,120 @@
+package test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"usermanagement/internal/config"
+	"usermanagement/internal/handlers"
+	"usermanagement/internal/logging"
+	"usermanagement/internal/models"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+// logLines decodes the JSON log lines written to buf
+func logLines(t *testing.T, buf *bytes.Buffer) []map[string]interface{} {
+	var lines []map[string]interface{}
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		if line == "" {
+			continue
+		}
+		var m map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &m); err != nil {
+			t.Fatalf("log line %q is not JSON: %v", line, err)
+		}
+		lines = append(lines, m)
+	}
+	return lines
+}
+
+func TestRequestID(t *testing.T) {
+	tests := []struct {
+		name     string
+		header   string
+		expectID string // empty when a new ID is expected
+	}{
+		{name: "generated", header: ""},
+		{name: "from the client", header: "gateway-1234", expectID: "gateway-1234"},
+		{name: "invalid from the client", header: "bad id\nlevel=ERROR"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			logger, err := logging.New(&buf, "info", "json")
+			assert.NoError(t, err)
+
+			mockUserService := new(MockUserService)
+			mockUserService.On("GetAllUsers", mock.Anything).Return([]models.User{}, nil)
+			server := handlers.NewServer(mockUserService, config.ServerConfig{}, logger)
+			server.SetupRoute()
+
+			req, _ := http.NewRequest(http.MethodGet, "/users", nil)
+			if tt.header != "" {
+				req.Header.Set(logging.RequestIDHeader, tt.header)
+			}
+			w := httptest.NewRecorder()
+			server.GetRouter().ServeHTTP(w, req)
+
+			id := w.Header().Get(logging.RequestIDHeader)
+			if tt.expectID != "" {
+				assert.Equal(t, tt.expectID, id)
+			} else {
+				assert.Regexp(t, "^[0-9a-f]{32}$", id)
+			}
+
+			lines := logLines(t, &buf)
+			if assert.Len(t, lines, 1) {
+				assert.Equal(t, "request", lines[0]["msg"])
+				assert.Equal(t, id, lines[0]["request_id"])
+				assert.Equal(t, "/users", lines[0]["route"])
+				assert.Equal(t, float64(http.StatusOK), lines[0]["status"])
+			}
+		})
+	}
+}
+
+func TestLogRedaction(t *testing.T) {
+	var buf bytes.Buffer
+	logger, err := logging.New(&buf, "debug", "json")
+	assert.NoError(t, err)
+
+	user := models.NewUser("alice", "$2a$10$hash")
+	ctx := logging.WithRequestID(context.Background(), "req-1")
+	logger.InfoContext(ctx, "user",
+		slog.Any("user", user),
+		slog.String("password", "secret1"),
+		slog.Group("body", slog.String("Password", "secret2")),
+	)
+
+	out := buf.String()
+	assert.NotContains(t, out, "$2a$10$hash")
+	assert.NotContains(t, out, "secret1")
+	assert.NotContains(t, out, "secret2")
+	assert.Contains(t, out, `"username":"alice"`)
+	assert.Contains(t, out, `"request_id":"req-1"`)
+	assert.Equal(t, 2, strings.Count(out, logging.Redacted))
+}
+
+func TestLoggerLevelAndFormat(t *testing.T) {
+	var buf bytes.Buffer
+	logger, err := logging.New(&buf, "warn", "text")
+	assert.NoError(t, err)
+
+	logger.Info("hidden")
+	logger.Warn("shown")
+	assert.NotContains(t, buf.String(), "hidden")
+	assert.Contains(t, buf.String(), "level=WARN msg=shown")
+
+	_, err = logging.New(&buf, "verbose", "json")
+	assert.Error(t, err)
+	_, err = logging.New(&buf, "info", "xml")
+	assert.Error(t, err)
+}
@@ -0,0 +1,85 @@
+package test
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"usermanagement/internal/config"
+	"usermanagement/internal/handlers"
+	"usermanagement/internal/metrics"
+	"usermanagement/internal/models"
+	"usermanagement/internal/services"
+
+	"github.com/gin-gonic/gin"
+	_ "github.com/go-sql-driver/mysql"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestMetrics(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	mockUserService := new(MockUserService)
+	mockUserService.On("GetAllUsers", mock.Anything).Return([]models.User{}, nil)
+	mockUserService.On("SearchUserForLogin", mock.Anything, "unknownuser").Return(models.User{}, services.ErrNotFound)
+	mockUserService.On("CountUsers", mock.Anything).Return(int64(42), nil)
+	mockUserService.On("RecordEvent", mock.Anything, mock.Anything).Return(nil)
+
+	server := handlers.NewServer(mockUserService, config.Default().Server, discardLogger)
+	server.SetupRoute()
+
+	serve := func(method, target string, body interface{}) *httptest.ResponseRecorder {
+		var reader *bytes.Buffer
+		if body != nil {
+			bodyBytes, _ := json.Marshal(body)
+			reader = bytes.NewBuffer(bodyBytes)
+		} else {
+			reader = &bytes.Buffer{}
+		}
+		req, err := http.NewRequest(method, target, reader)
+		assert.NoError(t, err, "Should be able to create a request")
+
+		resp := httptest.NewRecorder()
+		server.GetRouter().ServeHTTP(resp, req)
+		return resp
+	}
+
+	usersBefore := testutil.ToFloat64(metrics.HTTPRequests.WithLabelValues("GET", "/users", "200"))
+	failuresBefore := testutil.ToFloat64(metrics.Logins.WithLabelValues(metrics.LoginFailure))
+
+	serve(http.MethodGet, "/users", nil)
+	serve(http.MethodPost, "/login", map[string]string{"username": "unknownuser", "password": "testpass"})
+
+	assert.Equal(t, usersBefore+1, testutil.ToFloat64(metrics.HTTPRequests.WithLabelValues("GET", "/users", "200")))
+	assert.Equal(t, failuresBefore+1, testutil.ToFloat64(metrics.Logins.WithLabelValues(metrics.LoginFailure)))
+
+	resp := serve(http.MethodGet, "/metrics", nil)
+	assert.Equal(t, http.StatusOK, resp.Code, "Unexpected response status")
+	body := resp.Body.String()
+	assert.Contains(t, body, `usermanagement_http_request_duration_seconds_bucket{method="POST",route="/login",status="401"`)
+	assert.Contains(t, body, `usermanagement_password_hash_duration_seconds_count{operation="compare"}`)
+	assert.Contains(t, body, "usermanagement_registered_users 42")
+}
+
+// TestStorageMetrics tests that the backends record the latency and the errors of their operations
+func TestStorageMetrics(t *testing.T) {
+	// nothing listens on port 1, so every operation fails quickly
+	db, err := sql.Open("mysql", "root:password@tcp(127.0.0.1:1)/user")
+	assert.NoError(t, err)
+	defer db.Close()
+	mysql := models.NewMySQL()
+	mysql.DB = db
+
+	errorsBefore := testutil.ToFloat64(metrics.StorageErrors.WithLabelValues("mysql", "count"))
+
+	_, err = mysql.Count(context.Background(), "SELECT COUNT(*) FROM users")
+	assert.Error(t, err)
+
+	assert.Equal(t, errorsBefore+1, testutil.ToFloat64(metrics.StorageErrors.WithLabelValues("mysql", "count")))
+	assert.GreaterOrEqual(t, testutil.CollectAndCount(metrics.StorageDuration, "usermanagement_storage_operation_duration_seconds"), 1)
+}
@@ -1,90 +1,264 @@
 package test
 
 import (
-	"errors"
+	"context"
+	"io"
+	"log/slog"
+	"slices"
+	"testing"
+	"time"
+	"usermanagement/internal/config"
 	"usermanagement/internal/models"
 	"usermanagement/internal/services"
 
 	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
 )
 
+// discardLogger is given to the servers and services under test, so the test output stays readable
+var discardLogger = slog.New(slog.NewTextHandler(io.Discard, nil))
+
 // ----- mock for handlers_test.go -----
 
 type MockUserService struct {
 	mock.Mock
 }
 
-func (m *MockUserService) LoginDB() {
-	m.Called()
+func (m *MockUserService) LoginDB() error {
+	args := m.Called()
+	return args.Error(0)
 }
 
-func (m *MockUserService) CreateUser(user models.User) error {
-	args := m.Called(user)
+func (m *MockUserService) PingDB(ctx context.Context) error {
+	args := m.Called(ctx)
 	return args.Error(0)
 }
 
-func (m *MockUserService) GetAllUsers() ([]models.User, error) {
-	args := m.Called()
+func (m *MockUserService) CloseDB(ctx context.Context) error {
+	args := m.Called(ctx)
+	return args.Error(0)
+}
+
+func (m *MockUserService) CreateUser(ctx context.Context, user models.User) (models.User, error) {
+	args := m.Called(ctx, user)
+	return args.Get(0).(models.User), args.Error(1)
+}
+
+func (m *MockUserService) GetAllUsers(ctx context.Context) ([]models.User, error) {
+	args := m.Called(ctx)
 	return args.Get(0).([]models.User), args.Error(1)
 }
 
-func (m *MockUserService) SearchUserByUsername(username string) (models.User, error) {
-	args := m.Called(username)
+func (m *MockUserService) CountUsers(ctx context.Context) (int64, error) {
+	args := m.Called(ctx)
+	return args.Get(0).(int64), args.Error(1)
+}
+
+func (m *MockUserService) SearchUserByUsername(ctx context.Context, username string) (models.User, error) {
+	args := m.Called(ctx, username)
 	return args.Get(0).(models.User), args.Error(1)
 }
 
-func (m *MockUserService) SearchUserByID(ID string) (models.User, error) {
-	args := m.Called(ID)
+func (m *MockUserService) SearchUserForLogin(ctx context.Context, username string) (models.User, error) {
+	args := m.Called(ctx, username)
 	return args.Get(0).(models.User), args.Error(1)
 }
 
-type MockDB struct {
-	mock.Mock
+func (m *MockUserService) SearchUserByID(ctx context.Context, ID string) (models.User, error) {
+	args := m.Called(ctx, ID)
+	return args.Get(0).(models.User), args.Error(1)
 }
 
-func (m *MockDB) Create(item interface{}) error {
-	args := m.Called(item)
+func (m *MockUserService) RecordLogin(ctx context.Context, user models.User) error {
+	args := m.Called(ctx, user)
 	return args.Error(0)
 }
 
-func (m *MockDB) Read(filter interface{}, callback func() interface{}) ([]interface{}, error) {
-	args := m.Called(filter, callback)
-	return args.Get(0).([]interface{}), args.Error(1)
+func (m *MockUserService) RecordEvent(ctx context.Context, event models.AuditEvent) error {
+	args := m.Called(ctx, event)
+	return args.Error(0)
 }
 
-func (m *MockDB) Update(filter interface{}, update interface{}) error {
-	args := m.Called(filter, update)
-	return args.Error(0)
+func (m *MockUserService) QueryEvents(ctx context.Context, filter services.AuditFilter) ([]models.AuditEvent, error) {
+	args := m.Called(ctx, filter)
+	return args.Get(0).([]models.AuditEvent), args.Error(1)
 }
 
-func (m *MockDB) Delete(filter interface{}) error {
-	args := m.Called(filter)
-	return args.Error(0)
+func (m *MockUserService) VerifyAuditLog(ctx context.Context) (services.AuditVerification, error) {
+	args := m.Called(ctx)
+	return args.Get(0).(services.AuditVerification), args.Error(1)
 }
 
-// ----- mock for user_test.go -----
+func (m *MockUserService) ImportUsers(ctx context.Context, r io.Reader, opts services.ImportOptions) (services.ImportResult, error) {
+	body, _ := io.ReadAll(r)
+	args := m.Called(ctx, string(body), opts)
+	return args.Get(0).(services.ImportResult), args.Error(1)
+}
 
-type mockUserService struct {
-	userservice *services.UserService
-	mock.Mock
+func (m *MockUserService) ExportUsers(ctx context.Context, w io.Writer, format services.Format) (int, error) {
+	args := m.Called(ctx, w, format)
+	return args.Int(0), args.Error(1)
 }
 
-func (m *mockUserService) SearchUserByUsername(username string) (models.User, error) {
-	args := m.Called(username)
+func (m *MockUserService) DeleteUser(ctx context.Context, ID string) (models.User, error) {
+	args := m.Called(ctx, ID)
 	return args.Get(0).(models.User), args.Error(1)
 }
 
-func (m *mockUserService) CreateUser(user models.User) error {
-	// if the user already exists, return error
-	_, err := m.SearchUserByUsername(user.Username)
-	if err == nil {
-		return errors.New("user already exist")
+func (m *MockUserService) RestoreUser(ctx context.Context, ID string) (models.User, error) {
+	args := m.Called(ctx, ID)
+	return args.Get(0).(models.User), args.Error(1)
+}
+
+func (m *MockUserService) DeletedUsers(ctx context.Context) ([]models.User, error) {
+	args := m.Called(ctx)
+	return args.Get(0).([]models.User), args.Error(1)
+}
+
+func (m *MockUserService) PurgeDeletedUsers(ctx context.Context) ([]models.User, error) {
+	args := m.Called(ctx)
+	return args.Get(0).([]models.User), args.Error(1)
+}
+
+func (m *MockUserService) UpdateUser(ctx context.Context, ID string, version int64, changes services.UserChanges) (models.User, error) {
+	args := m.Called(ctx, ID, version, changes)
+	return args.Get(0).(models.User), args.Error(1)
+}
+
+func (m *MockUserService) SearchUsersByAttributes(ctx context.Context, query map[string]string) ([]models.User, error) {
+	args := m.Called(ctx, query)
+	return args.Get(0).([]models.User), args.Error(1)
+}
+
+func (m *MockUserService) SearchUsers(ctx context.Context, q string, limit int) ([]services.SearchResult, error) {
+	args := m.Called(ctx, q, limit)
+	return args.Get(0).([]services.SearchResult), args.Error(1)
+}
+
+func (m *MockUserService) FilterUsers(ctx context.Context, expression string) ([]models.User, error) {
+	args := m.Called(ctx, expression)
+	return args.Get(0).([]models.User), args.Error(1)
+}
+
+// ----- memory stores for the service tests -----
+
+// newUserStore returns a memory store of users holding users, in this order
+func newUserStore(t testing.TB, users ...models.User) *models.Memory {
+	db := models.NewMemory(func() interface{} { return &models.User{} }, "username")
+	for _, user := range users {
+		require.NoError(t, db.Create(context.Background(), user))
+	}
+	return db
+}
+
+// storeUsers returns the users of db, in the order of insertion
+func storeUsers(t testing.TB, db models.CURDInterface) []models.User {
+	found, err := db.Read(context.Background(), bson.M{}, func() interface{} { return &models.User{} })
+	require.NoError(t, err)
+	users := make([]models.User, len(found))
+	for i, item := range found {
+		users[i] = *item.(*models.User)
 	}
+	return users
+}
+
+// withoutTimes returns the users without the times of their lifecycle, set by the service when they are stored
+func withoutTimes(users ...models.User) []models.User {
+	result := make([]models.User, len(users))
+	for i, user := range users {
+		user.CreatedAt, user.UpdatedAt = time.Time{}, time.Time{}
+		user.LastLoginAt, user.PasswordChangedAt = nil, nil
+		result[i] = user
+	}
+	return result
+}
+
+// newAuditStore returns a memory store of audit events holding events, in this order
+func newAuditStore(t testing.TB, events ...models.AuditEvent) *models.Memory {
+	db := models.NewMemory(func() interface{} { return &models.AuditEvent{} }, "seq")
+	for _, event := range events {
+		require.NoError(t, db.Create(context.Background(), event))
+	}
+	return db
+}
+
+// storeEvents returns the audit events of db, in the order of insertion
+func storeEvents(t testing.TB, db models.CURDInterface) []models.AuditEvent {
+	found, err := db.Read(context.Background(), bson.M{}, func() interface{} { return &models.AuditEvent{} })
+	require.NoError(t, err)
+	events := make([]models.AuditEvent, len(found))
+	for i, item := range found {
+		events[i] = *item.(*models.AuditEvent)
+	}
+	return events
+}
+
+// newMemoryService returns a UserService with its users and its audit log in memory
+func newMemoryService(t testing.TB, users ...models.User) *services.UserService {
+	userService := services.NewUserService(config.DatabaseConfig{Memory: true}, discardLogger)
+	userService.Database = newUserStore(t, users...)
+	userService.Audit = newAuditStore(t)
+	return userService
+}
+
+// failingDB fails the operations named in fail, e.g. Create, with err and passes the others to the store
+type failingDB struct {
+	models.CURDInterface
+	fail []string
+	err  error
+}
 
-	// insert to MongoDB
-	err = m.userservice.Database.Create(user)
-	if err != nil {
-		return err
+func (f *failingDB) Create(ctx context.Context, item interface{}) error {
+	if slices.Contains(f.fail, "Create") {
+		return f.err
 	}
-	return nil
+	return f.CURDInterface.Create(ctx, item)
+}
+
+func (f *failingDB) Read(ctx context.Context, filter interface{}, callback func() interface{}) ([]interface{}, error) {
+	if slices.Contains(f.fail, "Read") {
+		return nil, f.err
+	}
+	return f.CURDInterface.Read(ctx, filter, callback)
+}
+
+// hookedDB runs beforeCreate before each Create of the store, e.g. to simulate another replica
+type hookedDB struct {
+	models.CURDInterface
+	beforeCreate func()
+	beforeSwap   func()
+	beforeDelete func()
+}
+
+func (h *hookedDB) Create(ctx context.Context, item interface{}) error {
+	if h.beforeCreate != nil {
+		h.beforeCreate()
+	}
+	return h.CURDInterface.Create(ctx, item)
+}
+
+func (h *hookedDB) CompareAndSwap(ctx context.Context, filter interface{}, update interface{}) (bool, error) {
+	if h.beforeSwap != nil {
+		h.beforeSwap()
+	}
+	return h.CURDInterface.CompareAndSwap(ctx, filter, update)
+}
+
+func (h *hookedDB) Delete(ctx context.Context, filter interface{}) error {
+	if h.beforeDelete != nil {
+		h.beforeDelete()
+	}
+	return h.CURDInterface.Delete(ctx, filter)
+}
+
+// contextDB records the contexts given to Read
+type contextDB struct {
+	models.CURDInterface
+	contexts []context.Context
+}
+
+func (c *contextDB) Read(ctx context.Context, filter interface{}, callback func() interface{}) ([]interface{}, error) {
+	c.contexts = append(c.contexts, ctx)
+	return c.CURDInterface.Read(ctx, filter, callback)
 }
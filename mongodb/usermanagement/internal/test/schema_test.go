@@ -0,0 +1,252 @@
+package test
+
+import (
+	"context"
+	"regexp"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"usermanagement/internal/models"
+	"usermanagement/internal/schema"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	mysqldriver "github.com/go-sql-driver/mysql"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSchemaMigrations(t *testing.T) {
+	migrations, err := schema.MySQLMigrations()
+	require.NoError(t, err)
+	require.Len(t, migrations, 8)
+	assert.Equal(t, "create_users", migrations[0].Name)
+	assert.Equal(t, []string{"DROP TABLE users"}, migrations[0].Down)
+	for i, migration := range migrations {
+		assert.Equal(t, i+1, migration.Version)
+		for _, statement := range migration.Up {
+			assert.NotContains(t, statement, "--", "the comments should be removed")
+		}
+	}
+}
+
+func TestSchemaLoad(t *testing.T) {
+	file := &fstest.MapFile{Data: []byte("SELECT 1;")}
+
+	_, err := schema.Load(fstest.MapFS{"m/0001_a.up.sql": file}, "m")
+	assert.ErrorContains(t, err, "up and down")
+
+	_, err = schema.Load(fstest.MapFS{"m/0001_a.up.sql": file, "m/0001_a.down.sql": file, "m/0003_c.up.sql": file, "m/0003_c.down.sql": file}, "m")
+	assert.ErrorContains(t, err, "migration 2 is missing")
+
+	_, err = schema.Load(fstest.MapFS{"m/0001_a.up.sql": file, "m/0001_b.down.sql": file}, "m")
+	assert.ErrorContains(t, err, "named both")
+
+	_, err = schema.Load(fstest.MapFS{"m/users.sql": file}, "m")
+	assert.ErrorContains(t, err, "<version>_<name>")
+
+	assert.Equal(t, []string{"CREATE TABLE t(a INT)", "DROP TABLE u"},
+		schema.SplitStatements("-- a comment;\nCREATE TABLE t(a INT);\n\n  -- another\nDROP TABLE u;\n"))
+}
+
+// newMigrator returns a migrator of a mocked MySQL
+func newMigrator(t *testing.T) (*schema.Migrator, sqlmock.Sqlmock) {
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	t.Cleanup(func() { db.Close() })
+	migrator, err := schema.NewMySQLMigrator(db, discardLogger)
+	require.NoError(t, err)
+	return migrator, mock
+}
+
+// expectLock expects the lock of the schema and the version of schema_version
+func expectLock(mock sqlmock.Sqlmock, version int) {
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT GET_LOCK(")).WithArgs("schema_version:", 60).
+		WillReturnRows(sqlmock.NewRows([]string{"lock"}).AddRow(1))
+	mock.ExpectExec("CREATE TABLE IF NOT EXISTS schema_version").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT COALESCE(MAX(version), 0) FROM schema_version")).
+		WillReturnRows(sqlmock.NewRows([]string{"version"}).AddRow(version))
+}
+
+func expectRelease(mock sqlmock.Sqlmock) {
+	mock.ExpectExec(regexp.QuoteMeta("DO RELEASE_LOCK(")).WillReturnResult(sqlmock.NewResult(0, 0))
+}
+
+func TestSchemaUp(t *testing.T) {
+	migrator, mock := newMigrator(t)
+	migrations, err := schema.MySQLMigrations()
+	require.NoError(t, err)
+
+	expectLock(mock, 0)
+	mock.ExpectQuery("FROM information_schema.columns").WillReturnRows(sqlmock.NewRows([]string{"table_name", "column_name"}))
+	for _, migration := range migrations[:2] {
+		for _, statement := range migration.Up {
+			mock.ExpectExec(regexp.QuoteMeta(statement)).WillReturnResult(sqlmock.NewResult(0, 0))
+		}
+		mock.ExpectExec("INSERT INTO schema_version").WithArgs(migration.Version, migration.Name, sqlmock.AnyArg()).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+	}
+	expectRelease(mock)
+
+	applied, err := migrator.Up(context.Background(), 2)
+	require.NoError(t, err)
+	assert.Len(t, applied, 2)
+	assert.NoError(t, mock.ExpectationsWereMet())
+
+	// a failed statement stops the migration and isn't recorded
+	expectLock(mock, 2)
+	mock.ExpectExec("SET @add_username_key").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("PREPARE add_username_key").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("EXECUTE add_username_key").WillReturnError(&mysqldriver.MySQLError{Number: 1062, Message: "Duplicate entry 'alice' for key 'username'"})
+	expectRelease(mock)
+
+	applied, err = migrator.Up(context.Background(), 0)
+	assert.ErrorContains(t, err, "migration 3 add_roles_and_locked up, statement 3 of 5")
+	assert.ErrorContains(t, err, "remove the duplicates")
+	assert.Empty(t, applied)
+	assert.NoError(t, mock.ExpectationsWereMet())
+
+	_, err = migrator.Up(context.Background(), 9)
+	assert.ErrorContains(t, err, "unknown version 9")
+}
+
+func TestSchemaUpExistingTables(t *testing.T) {
+	migrator, mock := newMigrator(t)
+	migrations, err := schema.MySQLMigrations()
+	require.NoError(t, err)
+
+	// the tables of `usermgmt-admin init` before the migrations
+	expectLock(mock, 0)
+	mock.ExpectQuery("FROM information_schema.columns").WillReturnRows(sqlmock.NewRows([]string{"table_name", "column_name"}).
+		AddRow("users", "id").AddRow("users", "roles").AddRow("audit_events", "seq"))
+	for version, name := range []string{"create_users", "create_audit_events", "add_roles_and_locked"} {
+		mock.ExpectExec("INSERT INTO schema_version").WithArgs(version+1, name, sqlmock.AnyArg()).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+	}
+	// the later migrations are applied
+	for _, migration := range migrations[3:] {
+		for _, statement := range migration.Up {
+			mock.ExpectExec(regexp.QuoteMeta(statement)).WillReturnResult(sqlmock.NewResult(0, 0))
+		}
+		mock.ExpectExec("INSERT INTO schema_version").WithArgs(migration.Version, migration.Name, sqlmock.AnyArg()).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+	}
+	expectRelease(mock)
+
+	applied, err := migrator.Up(context.Background(), 0)
+	require.NoError(t, err)
+	if assert.Len(t, applied, 5, "the existing tables should only be recorded") {
+		assert.Equal(t, "add_lifecycle", applied[0].Name)
+		assert.Equal(t, "add_soft_delete", applied[1].Name)
+		assert.Equal(t, "add_version", applied[2].Name)
+		assert.Equal(t, "add_attributes", applied[3].Name)
+		assert.Equal(t, "create_user_trigrams", applied[4].Name)
+	}
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestSchemaDown(t *testing.T) {
+	migrator, mock := newMigrator(t)
+
+	expectLock(mock, 3)
+	mock.ExpectExec("ALTER TABLE users\\s+DROP COLUMN roles").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("DELETE FROM schema_version").WithArgs(3).WillReturnResult(sqlmock.NewResult(0, 1))
+	expectRelease(mock)
+
+	reverted, err := migrator.Down(context.Background(), 2)
+	require.NoError(t, err)
+	if assert.Len(t, reverted, 1) {
+		assert.Equal(t, 3, reverted[0].Version)
+	}
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestSchemaLocked(t *testing.T) {
+	migrator, mock := newMigrator(t)
+
+	// GET_LOCK returns 0 after the timeout
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT GET_LOCK(")).WillReturnRows(sqlmock.NewRows([]string{"lock"}).AddRow(0))
+
+	_, err := migrator.Up(context.Background(), 0)
+	assert.ErrorIs(t, err, schema.ErrLocked)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestSchemaStatus(t *testing.T) {
+	migrator, mock := newMigrator(t)
+
+	mock.ExpectQuery("FROM schema_version").WillReturnError(&mysqldriver.MySQLError{Number: 1146, Message: "Table 'users.schema_version' doesn't exist"})
+	mock.ExpectQuery("FROM information_schema.columns").WillReturnRows(sqlmock.NewRows([]string{"table_name", "column_name"}).
+		AddRow("users", "id").AddRow("users", "password"))
+
+	status, err := migrator.Status(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, 1, status.Version, "the users table of the first README is version 1")
+	assert.Equal(t, 8, status.Latest)
+	assert.Equal(t, []string{"0002_create_audit_events", "0003_add_roles_and_locked", "0004_add_lifecycle", "0005_add_soft_delete",
+		"0006_add_version", "0007_add_attributes", "0008_create_user_trigrams"}, status.Pending)
+
+	mock.ExpectQuery("FROM schema_version").WillReturnRows(sqlmock.NewRows([]string{"version", "name", "applied_at"}).
+		AddRow(1, "create_users", "2024-05-01 10:00:00.000").
+		AddRow(2, "create_audit_events", "2024-05-01 10:00:00.000").
+		AddRow(3, "add_roles_and_locked", "2024-06-01 10:00:00.000").
+		AddRow(4, "add_lifecycle", "2024-07-01 10:00:00.000").
+		AddRow(5, "add_soft_delete", "2024-08-01 10:00:00.000").
+		AddRow(6, "add_version", "2024-09-01 10:00:00.000").
+		AddRow(7, "add_attributes", "2024-10-01 10:00:00.000").
+		AddRow(8, "create_user_trigrams", "2024-11-01 10:00:00.000"))
+
+	status, err = migrator.Status(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, 8, status.Version)
+	assert.Len(t, status.Applied, 8)
+	assert.Empty(t, status.Pending)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+// TestSchemaUpReadmeTable tests that the users table of the first README, without a unique key of the usernames,
+// gets one, and that the migration stops on duplicate usernames
+func TestSchemaUpReadmeTable(t *testing.T) {
+	ctx := context.Background()
+	db := openMySQL(t)
+	_, err := db.ExecContext(ctx, "CREATE TABLE users(id CHAR(30) NOT NULL, username CHAR(50) NOT NULL, password CHAR(65) NOT NULL, PRIMARY KEY (id))")
+	require.NoError(t, err)
+	_, err = db.ExecContext(ctx, "INSERT INTO users VALUES ('1', 'alice', 'hash'), ('2', 'alice', 'hash')")
+	require.NoError(t, err)
+	migrator, err := schema.NewMySQLMigrator(db, discardLogger)
+	require.NoError(t, err)
+
+	_, err = migrator.Up(ctx, 0)
+	assert.ErrorContains(t, err, "remove the duplicates")
+	status, err := migrator.Status(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 2, status.Version)
+
+	_, err = db.ExecContext(ctx, "DELETE FROM users WHERE id = '2'")
+	require.NoError(t, err)
+	_, err = migrator.Up(ctx, 0)
+	require.NoError(t, err)
+
+	var unique int
+	require.NoError(t, db.QueryRowContext(ctx, `SELECT COUNT(*) FROM information_schema.statistics
+		WHERE table_schema = DATABASE() AND table_name = 'users' AND column_name = 'username' AND non_unique = 0`).Scan(&unique))
+	assert.Equal(t, 1, unique, "the usernames should have one unique key")
+	_, err = db.ExecContext(ctx, "INSERT INTO users (id, username, password) VALUES ('3', 'alice', 'hash')")
+	assert.True(t, models.IsDuplicateKey(err), "the username should be unique, got %v", err)
+	_, err = db.ExecContext(ctx, "INSERT INTO users (id, username, password) VALUES ('4', ?, 'hash')", strings.Repeat("a", 200))
+	assert.NoError(t, err, "the usernames should be VARCHAR(255)")
+}
+
+// TestSchemaUpMigratedTable tests that a users table created by the first migration doesn't get a second unique key
+func TestSchemaUpMigratedTable(t *testing.T) {
+	ctx := context.Background()
+	db := openMySQL(t)
+	migrator, err := schema.NewMySQLMigrator(db, discardLogger)
+	require.NoError(t, err)
+	_, err = migrator.Up(ctx, 0)
+	require.NoError(t, err)
+
+	var unique int
+	require.NoError(t, db.QueryRowContext(ctx, `SELECT COUNT(*) FROM information_schema.statistics
+		WHERE table_schema = DATABASE() AND table_name = 'users' AND column_name = 'username' AND non_unique = 0`).Scan(&unique))
+	assert.Equal(t, 1, unique)
+}
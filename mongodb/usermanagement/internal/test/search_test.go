@@ -0,0 +1,266 @@
+package test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"usermanagement/internal/config"
+	"usermanagement/internal/handlers"
+	"usermanagement/internal/models"
+	"usermanagement/internal/services"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+// searchSchema declares the attributes searched by SearchUsers
+const searchSchema = `{
+	"type": "object",
+	"properties": {
+		"display_name": {"type": "string"},
+		"email": {"type": "string"}
+	}
+}`
+
+// newSearchService returns a UserService on db with the attributes of searchSchema,
+// holding alice, alicia, jmartin, bob and carol
+func newSearchService(t *testing.T, db models.CURDInterface) *services.UserService {
+	schema, err := services.NewAttributeSchema(writeAttributesSchema(t, searchSchema))
+	require.NoError(t, err)
+	userService := services.NewUserServiceWithBackend(nil, nil, config.Default().Deletion, schema, discardLogger)
+	userService.Database = db
+	userService.Audit = newAuditStore(t)
+
+	for _, user := range []struct {
+		username, displayName, email string
+	}{
+		{"alice", "Alice Martin", "alice@example.com"},
+		{"alicia", "Alicia Keys", "ak@example.org"},
+		{"jmartin", "Jean Martin", "jean.martin@example.com"},
+		{"bob", "Robert <Bob> Smith", "bob@example.com"},
+		{"carol", "", ""},
+	} {
+		created := *models.NewUser(user.username, "hash")
+		if user.displayName != "" {
+			created.Attributes = models.Attributes{"display_name": user.displayName, "email": user.email}
+		}
+		_, err := userService.CreateUser(context.Background(), created)
+		require.NoError(t, err)
+	}
+	return userService
+}
+
+// searchedUsernames returns the usernames of results, in their order
+func searchedUsernames(results []services.SearchResult) []string {
+	found := make([]string, len(results))
+	for i, result := range results {
+		found[i] = result.User.Username
+	}
+	return found
+}
+
+// TestSearchRanking tests the matches of SearchUsers, their order and their highlights
+func TestSearchRanking(t *testing.T) {
+	ctx := context.Background()
+	userService := newSearchService(t, newUserStore(t))
+
+	tests := []struct {
+		q    string
+		want []string
+	}{
+		// exact, then prefixes; alicia is 2 typos away from alice
+		{"alice", []string{"alice"}},
+		{"ALI", []string{"alice", "alicia"}},
+		// substrings of the display names and the emails, the ties by username
+		{"martin", []string{"alice", "jmartin"}},
+		{"example.org", []string{"alicia"}},
+		// typos, one in a short word and two in a long one
+		{"alcie", []string{"alice"}},
+		{"robret smiht", []string{"bob"}},
+		// every word must match, the last one as a prefix
+		{"jean mar", []string{"jmartin"}},
+		{"jean smith", []string{}},
+		{"zzz", []string{}},
+	}
+	for _, tt := range tests {
+		results, err := userService.SearchUsers(ctx, tt.q, 0)
+		require.NoError(t, err, tt.q)
+		assert.Equal(t, tt.want, searchedUsernames(results), tt.q)
+	}
+
+	results, err := userService.SearchUsers(ctx, "alice", 0)
+	require.NoError(t, err)
+	require.Len(t, results, 1)
+	assert.Equal(t, services.SearchResult{User: results[0].User, Score: 1, Field: "username", Highlight: "<em>alice</em>"}, results[0])
+	assert.Equal(t, "<em>alic</em>ia", highlightOf(t, userService, "alic", "alicia"))
+	assert.Equal(t, "j<em>martin</em>", highlightOf(t, userService, "martin", "jmartin"))
+	assert.Equal(t, "<em>Jean</em> Martin", highlightOf(t, userService, "jean", "jmartin"))
+	assert.Equal(t, "<em>Robert</em> &lt;Bob&gt; <em>Smith</em>", highlightOf(t, userService, "robret smiht", "bob"),
+		"the values should be escaped")
+
+	results, err = userService.SearchUsers(ctx, "alic", 0)
+	require.NoError(t, err)
+	require.Len(t, results, 2)
+	assert.Equal(t, results[0].Score, results[1].Score, "both are prefixes")
+	results, err = userService.SearchUsers(ctx, "alcie", 0)
+	require.NoError(t, err)
+	require.Len(t, results, 1)
+	assert.Less(t, results[0].Score, 0.8, "a typo should rank below a substring")
+
+	results, err = userService.SearchUsers(ctx, "ali", 1)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"alice"}, searchedUsernames(results))
+
+	var validationErr *services.ValidationError
+	for q, limit := range map[string]int{"": 0, " -- ": 0, strings.Repeat("a", 101): 0, "a": -1, "b": 101} {
+		_, err := userService.SearchUsers(ctx, q, limit)
+		assert.ErrorAs(t, err, &validationErr, q)
+	}
+}
+
+// highlightOf returns the highlight of username in the results of q
+func highlightOf(t *testing.T, userService *services.UserService, q, username string) string {
+	results, err := userService.SearchUsers(context.Background(), q, 0)
+	require.NoError(t, err)
+	for _, result := range results {
+		if result.User.Username == username {
+			return result.Highlight
+		}
+	}
+	t.Fatalf("%s not found by %q", username, q)
+	return ""
+}
+
+// TestSearchUsers tests that the search index follows the writes of the users,
+// on every backend of the conformance suite
+func TestSearchUsers(t *testing.T) {
+	for _, fixture := range storeFixtures {
+		fixture := fixture
+		t.Run(fixture.name, func(t *testing.T) {
+			ctx := context.Background()
+			userService := newSearchService(t, fixture.open(t))
+
+			search := func(q string) []string {
+				results, err := userService.SearchUsers(ctx, q, 0)
+				require.NoError(t, err, q)
+				return searchedUsernames(results)
+			}
+			assert.Equal(t, []string{"alice", "alicia"}, search("ali"))
+			assert.Equal(t, []string{"alice", "jmartin"}, search("Martin"))
+			assert.Equal(t, []string{"alice"}, search("alcie"))
+			assert.Equal(t, []string{"alice", "jmartin"}, search("artin"), "a substring shares only its inner trigrams")
+			assert.Equal(t, []string{"alice", "jmartin"}, search("martni"), "a typo changes some trigrams")
+			results, err := userService.SearchUsers(ctx, "ali", 0)
+			require.NoError(t, err)
+			for _, result := range results {
+				assert.Empty(t, result.User.Password, "the password hashes aren't read")
+			}
+
+			// the changed attributes are indexed
+			alice, err := userService.SearchUserByUsername(ctx, "alice")
+			require.NoError(t, err)
+			assert.Empty(t, alice.Password, "the password hash isn't returned")
+			renamed := models.Attributes{"display_name": "Alice Durand"}
+			_, err = userService.UpdateUser(ctx, alice.ID.Hex(), alice.Version, services.UserChanges{Attributes: &renamed})
+			require.NoError(t, err)
+			assert.Equal(t, []string{"jmartin"}, search("martin"))
+			assert.Equal(t, []string{"alice"}, search("durand"))
+
+			// and the ones of an import
+			input := `{"username":"carol","password":"secret","attributes":{"display_name":"Caroline Martin"}}
+{"username":"dave","password":"secret","attributes":{"email":"dave.martin@example.net"}}
+`
+			_, err = userService.ImportUsers(ctx, strings.NewReader(input),
+				services.ImportOptions{Format: services.FormatNDJSON, Mode: services.ImportUpsert})
+			require.NoError(t, err)
+			assert.ElementsMatch(t, []string{"jmartin", "carol", "dave"}, search("martin"))
+
+			// a deleted user isn't found, until it's restored
+			jmartin, err := userService.SearchUserByUsername(ctx, "jmartin")
+			require.NoError(t, err)
+			_, err = userService.DeleteUser(ctx, jmartin.ID.Hex())
+			require.NoError(t, err)
+			assert.Equal(t, []string{}, search("jean"))
+			_, err = userService.RestoreUser(ctx, jmartin.ID.Hex())
+			require.NoError(t, err)
+			assert.Equal(t, []string{"jmartin"}, search("jean"))
+
+			n, err := userService.ReindexUsers(ctx)
+			require.NoError(t, err)
+			assert.Equal(t, 6, n)
+			assert.ElementsMatch(t, []string{"jmartin", "carol", "dave"}, search("martin"))
+		})
+	}
+}
+
+// TestSearchHandlers tests the text search of GET /search
+func TestSearchHandlers(t *testing.T) {
+	alice := *models.NewUser("alice", "hash")
+	results := []services.SearchResult{{User: alice, Score: 0.9, Field: "username", Highlight: "<em>ali</em>ce"}}
+
+	tests := []struct {
+		name         string
+		path         string
+		mockSetup    func(m *MockUserService)
+		expectedCode int
+		expectedBody string
+	}{
+		{
+			name: "search",
+			path: "/search?q=ali",
+			mockSetup: func(m *MockUserService) {
+				m.On("SearchUsers", mock.Anything, "ali", 0).Return(results, nil)
+			},
+			expectedCode: http.StatusOK,
+			// the JSON of gin escapes < and >
+			expectedBody: `"score":0.9,"field":"username","highlight":"\u003cem\u003eali\u003c/em\u003ece"}]`,
+		},
+		{
+			name: "search with a limit",
+			path: "/search?q=ali&limit=5",
+			mockSetup: func(m *MockUserService) {
+				m.On("SearchUsers", mock.Anything, "ali", 5).Return([]services.SearchResult{}, nil)
+			},
+			expectedCode: http.StatusOK,
+			expectedBody: `[]`,
+		},
+		{
+			name:         "invalid limit",
+			path:         "/search?q=ali&limit=many",
+			expectedCode: http.StatusBadRequest,
+			expectedBody: "limit",
+		},
+		{
+			name: "invalid query",
+			path: "/search?q=--",
+			mockSetup: func(m *MockUserService) {
+				m.On("SearchUsers", mock.Anything, "--", 0).
+					Return([]services.SearchResult(nil), &services.ValidationError{Field: "q", Reason: "must have a letter or a digit"})
+			},
+			expectedCode: http.StatusBadRequest,
+			expectedBody: "must have a letter or a digit",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockUserService := new(MockUserService)
+			if tt.mockSetup != nil {
+				tt.mockSetup(mockUserService)
+			}
+			server := handlers.NewServer(mockUserService, config.ServerConfig{}, discardLogger)
+			server.SetupRoute()
+
+			req, _ := http.NewRequest(http.MethodGet, tt.path, nil)
+			w := httptest.NewRecorder()
+			server.GetRouter().ServeHTTP(w, req)
+
+			assert.Equal(t, tt.expectedCode, w.Code)
+			assert.Contains(t, w.Body.String(), tt.expectedBody)
+			mockUserService.AssertExpectations(t)
+		})
+	}
+}
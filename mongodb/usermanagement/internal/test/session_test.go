@@ -0,0 +1,262 @@
+package test
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+	"usermanagement/internal/cache"
+	"usermanagement/internal/config"
+	"usermanagement/internal/session"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// sessionStore is a store under test, and how to let its time pass
+type sessionStore struct {
+	name string
+	new  func(t *testing.T) (session.Store, func(d time.Duration))
+}
+
+var sessionStores = []sessionStore{
+	{
+		name: "memory",
+		new: func(t *testing.T) (session.Store, func(d time.Duration)) {
+			return session.NewMemory(), time.Sleep
+		},
+	},
+	{
+		name: "redis",
+		new: func(t *testing.T) (session.Store, func(d time.Duration)) {
+			server := miniredis.RunT(t)
+			client, err := cache.NewRedisClient("redis://" + server.Addr())
+			require.NoError(t, err)
+			store := session.NewRedis(client, "test:")
+			t.Cleanup(func() { store.Close() })
+			return store, server.FastForward
+		},
+	},
+}
+
+// TestSessionStore runs the same tests on every store
+func TestSessionStore(t *testing.T) {
+	for _, s := range sessionStores {
+		t.Run(s.name, func(t *testing.T) {
+			t.Run("sessions", func(t *testing.T) { testSessions(t, s) })
+			t.Run("refresh tokens", func(t *testing.T) { testRefreshTokens(t, s) })
+			t.Run("failures", func(t *testing.T) { testFailures(t, s) })
+			t.Run("concurrent failures", func(t *testing.T) { testConcurrentFailures(t, s) })
+			t.Run("one-time tokens", func(t *testing.T) { testOneTimeTokens(t, s) })
+		})
+	}
+}
+
+func testSessions(t *testing.T, s sessionStore) {
+	ctx := context.Background()
+	store, wait := s.new(t)
+
+	created := session.Session{ID: "s3cret", Username: "alice", CreatedAt: time.Now().UTC().Truncate(time.Second)}
+	require.NoError(t, store.CreateSession(ctx, created, 50*time.Millisecond))
+	got, err := store.Session(ctx, "s3cret")
+	require.NoError(t, err)
+	assert.Equal(t, created, got)
+
+	_, err = store.Session(ctx, "other")
+	assert.ErrorIs(t, err, session.ErrNotFound)
+
+	require.NoError(t, store.DeleteSession(ctx, "s3cret"))
+	_, err = store.Session(ctx, "s3cret")
+	assert.ErrorIs(t, err, session.ErrNotFound)
+	assert.NoError(t, store.DeleteSession(ctx, "s3cret"), "a missing session should be ignored")
+
+	require.NoError(t, store.CreateSession(ctx, created, 50*time.Millisecond))
+	wait(100 * time.Millisecond)
+	_, err = store.Session(ctx, "s3cret")
+	assert.ErrorIs(t, err, session.ErrNotFound, "the session should expire")
+}
+
+func testRefreshTokens(t *testing.T, s sessionStore) {
+	ctx := context.Background()
+	store, wait := s.new(t)
+
+	require.NoError(t, store.StartFamily(ctx, "family", "alice", "token1", time.Minute))
+	username, err := store.RotateToken(ctx, "family", "token1", "token2", 50*time.Millisecond)
+	require.NoError(t, err)
+	assert.Equal(t, "alice", username)
+	username, err = store.RotateToken(ctx, "family", "token2", "token3", 50*time.Millisecond)
+	require.NoError(t, err)
+	assert.Equal(t, "alice", username)
+
+	// the reuse of a rotated token revokes the family, even the current token
+	_, err = store.RotateToken(ctx, "family", "token1", "token4", time.Minute)
+	assert.ErrorIs(t, err, session.ErrTokenReused)
+	_, err = store.RotateToken(ctx, "family", "token3", "token4", time.Minute)
+	assert.ErrorIs(t, err, session.ErrNotFound)
+
+	require.NoError(t, store.StartFamily(ctx, "revoked", "bob", "token1", time.Minute))
+	require.NoError(t, store.RevokeFamily(ctx, "revoked"))
+	_, err = store.RotateToken(ctx, "revoked", "token1", "token2", time.Minute)
+	assert.ErrorIs(t, err, session.ErrNotFound)
+
+	// the rotation extends the family for the new ttl
+	require.NoError(t, store.StartFamily(ctx, "expiring", "carol", "token1", time.Minute))
+	_, err = store.RotateToken(ctx, "expiring", "token1", "token2", 50*time.Millisecond)
+	require.NoError(t, err)
+	wait(100 * time.Millisecond)
+	_, err = store.RotateToken(ctx, "expiring", "token2", "token3", time.Minute)
+	assert.ErrorIs(t, err, session.ErrNotFound, "the family should expire")
+}
+
+func testFailures(t *testing.T, s sessionStore) {
+	ctx := context.Background()
+	store, wait := s.new(t)
+
+	count, ttl, err := store.Failures(ctx, "alice")
+	require.NoError(t, err)
+	assert.Zero(t, count)
+	assert.Zero(t, ttl)
+
+	for i := 1; i <= 3; i++ {
+		count, retryAfter, err := store.AddAttempt(ctx, "alice", 2, 100*time.Millisecond)
+		require.NoError(t, err)
+		assert.Equal(t, int64(i), count)
+		if i <= 2 {
+			assert.Zero(t, retryAfter, "the attempts up to the maximum should pass")
+		} else {
+			assert.Positive(t, retryAfter)
+			assert.LessOrEqual(t, retryAfter, 100*time.Millisecond, "the window starts at the first attempt")
+		}
+	}
+	count, _, err = store.Failures(ctx, "alice")
+	require.NoError(t, err)
+	assert.Equal(t, int64(3), count)
+	count, _, _ = store.Failures(ctx, "bob")
+	assert.Zero(t, count, "the counters should be independent")
+
+	require.NoError(t, store.ReleaseAttempt(ctx, "alice"))
+	count, _, _ = store.Failures(ctx, "alice")
+	assert.Equal(t, int64(2), count, "a released attempt shouldn't count")
+	require.NoError(t, store.ReleaseAttempt(ctx, "bob"), "releasing a missing counter should be a no-op")
+	count, _, _ = store.Failures(ctx, "bob")
+	assert.Zero(t, count)
+
+	require.NoError(t, store.ResetFailures(ctx, "alice"))
+	count, _, _ = store.Failures(ctx, "alice")
+	assert.Zero(t, count)
+
+	_, _, err = store.AddAttempt(ctx, "alice", 5, 50*time.Millisecond)
+	require.NoError(t, err)
+	wait(100 * time.Millisecond)
+	count, _, _ = store.Failures(ctx, "alice")
+	assert.Zero(t, count, "the failures should expire with the window")
+	count, _, err = store.AddAttempt(ctx, "alice", 5, time.Minute)
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), count, "a new window should start")
+}
+
+func testConcurrentFailures(t *testing.T, s sessionStore) {
+	ctx := context.Background()
+	store, _ := s.new(t)
+
+	const n, max = 50, 10
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	passed := 0
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, retryAfter, err := store.AddAttempt(ctx, "alice", max, time.Minute)
+			assert.NoError(t, err)
+			if retryAfter == 0 {
+				mu.Lock()
+				passed++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	assert.Equal(t, max, passed, "only the attempts up to the maximum should pass")
+	count, ttl, err := store.Failures(ctx, "alice")
+	require.NoError(t, err)
+	assert.Equal(t, int64(n), count, "no increment should be lost")
+	assert.Positive(t, ttl)
+}
+
+func testOneTimeTokens(t *testing.T, s sessionStore) {
+	ctx := context.Background()
+	store, wait := s.new(t)
+
+	require.NoError(t, store.PutToken(ctx, "reset", "alice", time.Minute))
+
+	// the token is used once, even by concurrent requests
+	const n = 10
+	var wg sync.WaitGroup
+	values := make(chan string, n)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			value, err := store.ConsumeToken(ctx, "reset")
+			if err == nil {
+				values <- value
+			} else {
+				assert.ErrorIs(t, err, session.ErrNotFound)
+			}
+		}()
+	}
+	wg.Wait()
+	close(values)
+	var used []string
+	for value := range values {
+		used = append(used, value)
+	}
+	assert.Equal(t, []string{"alice"}, used)
+
+	require.NoError(t, store.PutToken(ctx, "verify", "bob", 50*time.Millisecond))
+	wait(100 * time.Millisecond)
+	_, err := store.ConsumeToken(ctx, "verify")
+	assert.ErrorIs(t, err, session.ErrNotFound, "the token should expire")
+}
+
+// TestRedisSessionKeys tests that only the digests of the secrets are stored in Redis
+func TestRedisSessionKeys(t *testing.T) {
+	ctx := context.Background()
+	server := miniredis.RunT(t)
+	store, err := session.New(config.RedisConfig{URL: "redis://" + server.Addr()})
+	require.NoError(t, err)
+	defer store.Close()
+
+	require.NoError(t, store.CreateSession(ctx, session.Session{ID: "session-secret", Username: "alice"}, time.Minute))
+	require.NoError(t, store.StartFamily(ctx, "family", "alice", "refresh-secret", time.Minute))
+	require.NoError(t, store.PutToken(ctx, "token-secret", "alice", time.Minute))
+	_, _, err = store.AddAttempt(ctx, "login:user:alice", 5, time.Minute)
+	require.NoError(t, err)
+
+	keys := server.Keys()
+	assert.Len(t, keys, 4)
+	assert.Contains(t, keys, "usermanagement:failures:login:user:alice")
+	assert.Contains(t, keys, "usermanagement:refresh:family")
+	for _, key := range keys {
+		assert.NotContains(t, key, "secret")
+	}
+	assert.NotContains(t, server.HGet("usermanagement:refresh:family", "token"), "secret")
+	assert.Equal(t, time.Minute, server.TTL("usermanagement:failures:login:user:alice"))
+
+	server.Close()
+	_, err = store.Session(ctx, "session-secret")
+	assert.Error(t, err)
+	assert.NotErrorIs(t, err, session.ErrNotFound)
+}
+
+func TestNewSessionStore(t *testing.T) {
+	store, err := session.New(config.RedisConfig{})
+	require.NoError(t, err)
+	assert.IsType(t, &session.Memory{}, store, "without Redis the state should be in memory")
+
+	_, err = session.New(config.RedisConfig{URL: "http://localhost:6379"})
+	assert.Error(t, err)
+}
@@ -0,0 +1,229 @@
+package test
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+	"usermanagement/internal/cache"
+	"usermanagement/internal/config"
+	"usermanagement/internal/handlers"
+	"usermanagement/internal/models"
+	"usermanagement/internal/services"
+	"usermanagement/internal/session"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// newLoginService returns a mock knowing the users, all with the password "testpass"
+func newLoginService(t *testing.T, usernames ...string) *MockUserService {
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte("testpass"), bcrypt.MinCost)
+	require.NoError(t, err)
+	mockUserService := new(MockUserService)
+	for _, username := range usernames {
+		mockUserService.On("SearchUserForLogin", mock.Anything, username).Return(models.User{
+			ID:       primitive.NewObjectID(),
+			Username: username,
+			Password: string(hashedPassword),
+		}, nil)
+	}
+	mockUserService.On("SearchUserForLogin", mock.Anything, mock.Anything).Return(models.User{}, services.ErrNotFound)
+	mockUserService.On("RecordEvent", mock.Anything, mock.Anything).Return(nil)
+	mockUserService.On("RecordLogin", mock.Anything, mock.Anything).Return(nil)
+	return mockUserService
+}
+
+// login posts the credentials to /login from the client IP
+func login(t *testing.T, server *handlers.Server, ip, username, password string) *httptest.ResponseRecorder {
+	body, err := json.Marshal(map[string]string{"username": username, "password": password})
+	require.NoError(t, err)
+	req := httptest.NewRequest(http.MethodPost, "/login", bytes.NewReader(body))
+	req.RemoteAddr = ip + ":1234"
+	resp := httptest.NewRecorder()
+	server.GetRouter().ServeHTTP(resp, req)
+	return resp
+}
+
+func TestHandleLoginThrottled(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	tests := []struct {
+		name  string
+		login config.LoginConfig
+		run   func(t *testing.T, server *handlers.Server)
+	}{
+		{
+			name:  "username throttled",
+			login: config.LoginConfig{MaxFailures: 3, FailureWindow: time.Minute},
+			run: func(t *testing.T, server *handlers.Server) {
+				for i := 0; i < 3; i++ {
+					assert.Equal(t, http.StatusUnauthorized, login(t, server, "192.0.2.1", "alice", "wrongpass").Code)
+				}
+				// even the right password, from another IP
+				resp := login(t, server, "192.0.2.2", "alice", "testpass")
+				assert.Equal(t, http.StatusTooManyRequests, resp.Code)
+				assert.Equal(t, handlers.ProblemContentType, resp.Header().Get("Content-Type"))
+				assert.Contains(t, resp.Body.String(), "/problems/too-many-attempts")
+				retryAfter, err := strconv.Atoi(resp.Header().Get("Retry-After"))
+				require.NoError(t, err)
+				assert.InDelta(t, 60, retryAfter, 1)
+
+				assert.Equal(t, http.StatusOK, login(t, server, "192.0.2.1", "bob", "testpass").Code, "another user should log in")
+			},
+		},
+		{
+			name:  "unknown username throttled",
+			login: config.LoginConfig{MaxFailures: 2, FailureWindow: time.Minute},
+			run: func(t *testing.T, server *handlers.Server) {
+				assert.Equal(t, http.StatusUnauthorized, login(t, server, "192.0.2.1", "mallory", "wrongpass").Code)
+				assert.Equal(t, http.StatusUnauthorized, login(t, server, "192.0.2.1", "mallory", "wrongpass").Code)
+				assert.Equal(t, http.StatusTooManyRequests, login(t, server, "192.0.2.1", "mallory", "wrongpass").Code)
+			},
+		},
+		{
+			name:  "success resets the username",
+			login: config.LoginConfig{MaxFailures: 3, FailureWindow: time.Minute},
+			run: func(t *testing.T, server *handlers.Server) {
+				for i := 0; i < 2; i++ {
+					assert.Equal(t, http.StatusUnauthorized, login(t, server, "192.0.2.1", "alice", "wrongpass").Code)
+				}
+				assert.Equal(t, http.StatusOK, login(t, server, "192.0.2.1", "alice", "testpass").Code)
+				for i := 0; i < 2; i++ {
+					assert.Equal(t, http.StatusUnauthorized, login(t, server, "192.0.2.1", "alice", "wrongpass").Code)
+				}
+				assert.Equal(t, http.StatusOK, login(t, server, "192.0.2.1", "alice", "testpass").Code)
+			},
+		},
+		{
+			name:  "client IP throttled",
+			login: config.LoginConfig{MaxFailuresPerIP: 3, FailureWindow: time.Minute},
+			run: func(t *testing.T, server *handlers.Server) {
+				for _, username := range []string{"alice", "bob", "carol"} {
+					assert.Equal(t, http.StatusUnauthorized, login(t, server, "192.0.2.1", username, "wrongpass").Code)
+				}
+				// a success doesn't reset the failures of the IP
+				assert.Equal(t, http.StatusTooManyRequests, login(t, server, "192.0.2.1", "alice", "testpass").Code)
+				assert.Equal(t, http.StatusOK, login(t, server, "192.0.2.2", "alice", "testpass").Code, "another IP should log in")
+			},
+		},
+		{
+			name:  "throttled attempts not counted",
+			login: config.LoginConfig{MaxFailures: 2, MaxFailuresPerIP: 4, FailureWindow: time.Minute},
+			run: func(t *testing.T, server *handlers.Server) {
+				for i := 0; i < 2; i++ {
+					assert.Equal(t, http.StatusUnauthorized, login(t, server, "192.0.2.1", "alice", "wrongpass").Code)
+				}
+				for i := 0; i < 5; i++ {
+					assert.Equal(t, http.StatusTooManyRequests, login(t, server, "192.0.2.1", "alice", "wrongpass").Code)
+				}
+				// the throttled username doesn't use up the attempts of the IP
+				assert.Equal(t, http.StatusOK, login(t, server, "192.0.2.1", "bob", "testpass").Code)
+			},
+		},
+		{
+			name:  "no limit",
+			login: config.LoginConfig{},
+			run: func(t *testing.T, server *handlers.Server) {
+				for i := 0; i < 10; i++ {
+					assert.Equal(t, http.StatusUnauthorized, login(t, server, "192.0.2.1", "alice", "wrongpass").Code)
+				}
+				assert.Equal(t, http.StatusOK, login(t, server, "192.0.2.1", "alice", "testpass").Code)
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockUserService := newLoginService(t, "alice", "bob")
+			server := handlers.NewServer(mockUserService, config.ServerConfig{Login: tt.login}, discardLogger)
+			server.SetupRoute()
+			tt.run(t, server)
+		})
+	}
+}
+
+// TestHandleLoginThrottledReplicas tests that the failures counted in Redis are shared by the replicas,
+// so a client can't get more attempts by reaching the other one
+func TestHandleLoginThrottledReplicas(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	redisServer := miniredis.RunT(t)
+	cfg := config.ServerConfig{Login: config.LoginConfig{MaxFailures: 4, FailureWindow: time.Minute}}
+
+	replicas := make([]*handlers.Server, 2)
+	for i := range replicas {
+		client, err := cache.NewRedisClient("redis://" + redisServer.Addr())
+		require.NoError(t, err)
+		replicas[i] = handlers.NewServerWithStore(newLoginService(t, "alice"), session.NewRedis(client, "usermanagement:"), cfg, discardLogger)
+		replicas[i].SetupRoute()
+	}
+
+	for i := 0; i < 4; i++ {
+		assert.Equal(t, http.StatusUnauthorized, login(t, replicas[i%2], "192.0.2.1", "alice", "wrongpass").Code)
+	}
+	for _, replica := range replicas {
+		assert.Equal(t, http.StatusTooManyRequests, login(t, replica, "192.0.2.1", "alice", "testpass").Code)
+	}
+	assert.Equal(t, time.Minute, redisServer.TTL("usermanagement:failures:login:user:alice"))
+
+	// the throttling ends with the window
+	redisServer.FastForward(time.Minute)
+	assert.Equal(t, http.StatusOK, login(t, replicas[0], "192.0.2.1", "alice", "testpass").Code)
+
+	// without Redis the logins aren't throttled rather than all refused
+	redisServer.Close()
+	assert.Equal(t, http.StatusOK, login(t, replicas[1], "192.0.2.1", "alice", "testpass").Code)
+	assert.Equal(t, http.StatusUnauthorized, login(t, replicas[1], "192.0.2.1", "alice", "wrongpass").Code)
+}
+
+// TestHandleLoginThrottledConcurrently tests that parallel guesses can't pass the limits,
+// each one is counted before its password is checked
+func TestHandleLoginThrottledConcurrently(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	// guess sends n logins at once with a wrong password, of username or of n usernames if it's empty,
+	// and returns the count of each status code
+	guess := func(t *testing.T, limits config.LoginConfig, n int, username string) map[int]int {
+		redisServer := miniredis.RunT(t)
+		client, err := cache.NewRedisClient("redis://" + redisServer.Addr())
+		require.NoError(t, err)
+		server := handlers.NewServerWithStore(newLoginService(t, "alice"), session.NewRedis(client, "usermanagement:"),
+			config.ServerConfig{Login: limits}, discardLogger)
+		server.SetupRoute()
+
+		codes := make(chan int, n)
+		var wg sync.WaitGroup
+		for i := 0; i < n; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				name := username
+				if name == "" {
+					name = "user" + strconv.Itoa(i)
+				}
+				codes <- login(t, server, "192.0.2.1", name, "wrongpass").Code
+			}(i)
+		}
+		wg.Wait()
+		close(codes)
+		counts := map[int]int{}
+		for code := range codes {
+			counts[code]++
+		}
+		return counts
+	}
+
+	assert.Equal(t, map[int]int{http.StatusUnauthorized: 3, http.StatusTooManyRequests: 17},
+		guess(t, config.LoginConfig{MaxFailures: 3, FailureWindow: time.Minute}, 20, "alice"))
+	assert.Equal(t, map[int]int{http.StatusUnauthorized: 5, http.StatusTooManyRequests: 15},
+		guess(t, config.LoginConfig{MaxFailuresPerIP: 5, FailureWindow: time.Minute}, 20, ""))
+}
@@ -0,0 +1,115 @@
+package test
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"usermanagement/internal/config"
+	"usermanagement/internal/handlers"
+	"usermanagement/internal/models"
+
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/crypto/bcrypt"
+)
+
+var (
+	spanExporterOnce sync.Once
+	spanExporter     *tracetest.InMemoryExporter
+)
+
+// recordSpans registers, once for all the tests, a tracer provider keeping the spans in memory,
+// and empties it
+func recordSpans() *tracetest.InMemoryExporter {
+	spanExporterOnce.Do(func() {
+		spanExporter = tracetest.NewInMemoryExporter()
+		otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSyncer(spanExporter)))
+	})
+	spanExporter.Reset()
+	return spanExporter
+}
+
+// findSpan returns the span named name, failing the test if there is none
+func findSpan(t *testing.T, spans tracetest.SpanStubs, name string) tracetest.SpanStub {
+	for _, span := range spans {
+		if span.Name == name {
+			return span
+		}
+	}
+	names := make([]string, 0, len(spans))
+	for _, span := range spans {
+		names = append(names, span.Name)
+	}
+	t.Fatalf("no span %q in %v", name, names)
+	return tracetest.SpanStub{}
+}
+
+// TestLoginTrace tests that a login continues the trace of the caller,
+// with one span for the user lookup and one for bcrypt
+func TestLoginTrace(t *testing.T) {
+	exporter := recordSpans()
+
+	hashed, err := bcrypt.GenerateFromPassword([]byte("testpass"), bcrypt.MinCost)
+	assert.NoError(t, err)
+	user := models.NewUser("testuser", string(hashed))
+	userService := newMemoryService(t, *user)
+
+	server := handlers.NewServer(userService, config.Default().Server, discardLogger)
+	server.SetupRoute()
+
+	body, _ := json.Marshal(map[string]string{"username": "testuser", "password": "testpass"})
+	req, _ := http.NewRequest(http.MethodPost, "/login", bytes.NewBuffer(body))
+	const traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+	req.Header.Set("traceparent", "00-"+traceID+"-00f067aa0ba902b7-01")
+	w := httptest.NewRecorder()
+	server.GetRouter().ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	spans := exporter.GetSpans()
+	root := findSpan(t, spans, "POST /login")
+	lookup := findSpan(t, spans, "UserService.SearchUserForLogin")
+	compare := findSpan(t, spans, "bcrypt.CompareHashAndPassword")
+
+	assert.Equal(t, traceID, root.SpanContext.TraceID().String(), "the trace of the caller should be continued")
+	assert.Equal(t, "00f067aa0ba902b7", root.Parent.SpanID().String())
+	assert.Equal(t, trace.SpanKindServer, root.SpanKind)
+	assert.Contains(t, root.Attributes, attribute.String("http.route", "/login"))
+	assert.Contains(t, root.Attributes, attribute.Int("http.status_code", http.StatusOK))
+
+	assert.Equal(t, root.SpanContext.SpanID(), lookup.Parent.SpanID())
+	assert.Equal(t, root.SpanContext.SpanID(), compare.Parent.SpanID())
+}
+
+// TestStorageTrace tests that the backends create client spans with the database attributes
+func TestStorageTrace(t *testing.T) {
+	exporter := recordSpans()
+
+	// nothing listens on port 1, so every operation fails quickly
+	db, err := sql.Open("mysql", "root:password@tcp(127.0.0.1:1)/user")
+	assert.NoError(t, err)
+	defer db.Close()
+	mysql := models.NewMySQL()
+	mysql.DB = db
+
+	_, err = mysql.Read(context.Background(), "select * FROM users", func() interface{} { return &models.User{} })
+	assert.Error(t, err)
+
+	span := findSpan(t, exporter.GetSpans(), "SELECT")
+	assert.Equal(t, trace.SpanKindClient, span.SpanKind)
+	assert.Contains(t, span.Attributes, attribute.String("db.system", "mysql"))
+	assert.Contains(t, span.Attributes, attribute.String("db.operation", "SELECT"))
+	assert.Equal(t, codes.Error, span.Status.Code)
+	for _, attr := range span.Attributes {
+		assert.NotEqual(t, "db.statement", string(attr.Key), "the statement may contain password hashes")
+	}
+}
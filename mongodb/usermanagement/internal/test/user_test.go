@@ -1,40 +1,36 @@
 package test
 
 import (
+	"context"
 	"errors"
 	"testing"
+	"usermanagement/internal/config"
 	"usermanagement/internal/models"
 	"usermanagement/internal/services"
 
 	"github.com/stretchr/testify/assert"
-	"github.com/stretchr/testify/mock"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
+// errDatabase is the error of a failing database
+var errDatabase = errors.New("database error")
+
 // TestGetAllUsers tests the GetAllUsers method of the UserService
 func TestGetAllUsers(t *testing.T) {
 	tests := []struct {
 		name      string
-		mockSetup func(m *MockDB)
+		database  func(t *testing.T) models.CURDInterface
 		wantError bool
 		wantUsers int
 	}{
 		{
 			// test case 1: successfully get all users
 			name: "successfully get all users",
-			mockSetup: func(m *MockDB) {
-				m.On("Read", mock.Anything, mock.Anything).Return([]interface{}{
-					&models.User{
-						ID:       primitive.NewObjectID(),
-						Username: "testuser1",
-						Password: "testpass1",
-					},
-					&models.User{
-						ID:       primitive.NewObjectID(),
-						Username: "testuser2",
-						Password: "testpass2",
-					},
-				}, nil)
+			database: func(t *testing.T) models.CURDInterface {
+				return newUserStore(t,
+					models.User{ID: primitive.NewObjectID(), Username: "testuser1", Password: "testpass1"},
+					models.User{ID: primitive.NewObjectID(), Username: "testuser2", Password: "testpass2"},
+				)
 			},
 			wantError: false,
 			wantUsers: 2,
@@ -42,8 +38,8 @@ func TestGetAllUsers(t *testing.T) {
 		{
 			// test case 2: failed to get all users
 			name: "failed to get all users",
-			mockSetup: func(m *MockDB) {
-				m.On("Read", mock.Anything, mock.Anything).Return([]interface{}{}, errors.New("failed to read from db"))
+			database: func(t *testing.T) models.CURDInterface {
+				return &failingDB{CURDInterface: newUserStore(t), fail: []string{"Read"}, err: errDatabase}
 			},
 			wantError: true,
 			wantUsers: 0,
@@ -52,15 +48,12 @@ func TestGetAllUsers(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			mockDB := new(MockDB)
-			tt.mockSetup(mockDB)
-
-			// create a new UserService with the mockDB
-			userService := services.NewUserService()
-			userService.Database = mockDB
+			// create a new UserService with the database of the test
+			userService := newMemoryService(t)
+			userService.Database = tt.database(t)
 
 			// call the GetAllUsers method
-			users, err := userService.GetAllUsers()
+			users, err := userService.GetAllUsers(context.Background())
 
 			if tt.wantError && err == nil {
 				t.Fatal("expected an error but got none")
@@ -74,94 +67,86 @@ func TestGetAllUsers(t *testing.T) {
 			if len(users) != tt.wantUsers {
 				t.Errorf("expected %v users, got %v", tt.wantUsers, len(users))
 			}
-
-			// assert the mockDB
-			mockDB.AssertExpectations(t)
 		})
 	}
 }
 
 func TestCreateUser(t *testing.T) {
+	existing := models.User{ID: primitive.NewObjectID(), Username: "testuser", Password: "testpass"}
+
 	tests := []struct {
 		name      string
 		inputUser models.User
-		mockSetup func(m *mockUserService, db *MockDB)
-		wantErr   bool
+		database  func(t *testing.T) models.CURDInterface
+		wantErr   error
+		wantUsers int
 	}{
 		{
 			name:      "successfully create user",
-			inputUser: models.User{Username: "testuser", Password: "testpass"},
-			mockSetup: func(m *mockUserService, db *MockDB) {
-				m.On("SearchUserByUsername", "testuser").Return(models.User{}, errors.New("user not found"))
-				db.On("Create", mock.Anything).Return(nil)
+			inputUser: models.User{ID: primitive.NewObjectID(), Username: "testuser", Password: "testpass"},
+			database: func(t *testing.T) models.CURDInterface {
+				return newUserStore(t)
 			},
-			wantErr: false,
+			wantUsers: 1,
 		},
 		{
 			name:      "user already exists",
-			inputUser: models.User{Username: "testuser", Password: "testpass"},
-			mockSetup: func(m *mockUserService, db *MockDB) {
-				m.On("SearchUserByUsername", "testuser").Return(models.User{
-					Username: "testuser",
-					Password: "testpass",
-					ID:       primitive.NewObjectID(),
-				}, nil)
+			inputUser: models.User{ID: primitive.NewObjectID(), Username: "testuser", Password: "testpass"},
+			database: func(t *testing.T) models.CURDInterface {
+				return newUserStore(t, existing)
 			},
-			wantErr: true,
+			wantErr:   services.ErrConflict,
+			wantUsers: 1,
 		},
 		{
 			name:      "database error on create",
-			inputUser: models.User{Username: "testuser", Password: "testpass"},
-			mockSetup: func(m *mockUserService, db *MockDB) {
-				m.On("SearchUserByUsername", "testuser").Return(models.User{}, errors.New("user not found"))
-				db.On("Create", mock.Anything).Return(errors.New("database error"))
+			inputUser: models.User{ID: primitive.NewObjectID(), Username: "testuser", Password: "testpass"},
+			database: func(t *testing.T) models.CURDInterface {
+				return &failingDB{CURDInterface: newUserStore(t), fail: []string{"Create"}, err: errDatabase}
 			},
-			wantErr: true,
+			wantErr:   errDatabase,
+			wantUsers: 0,
 		},
 	}
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			mockDB := new(MockDB)
-			mockService := &mockUserService{userservice: &services.UserService{Database: mockDB}}
-			tt.mockSetup(mockService, mockDB)
+			db := tt.database(t)
+			userService := newMemoryService(t)
+			userService.Database = db
 
-			err := mockService.CreateUser(tt.inputUser)
+			_, err := userService.CreateUser(context.Background(), tt.inputUser)
 
-			if tt.wantErr {
-				assert.Error(t, err, "Expected an error")
+			if tt.wantErr != nil {
+				assert.ErrorIs(t, err, tt.wantErr)
 			} else {
 				assert.NoError(t, err, "Did not expect an error")
 			}
 
-			mockService.AssertExpectations(t)
-			mockDB.AssertExpectations(t)
+			count, err := db.Count(context.Background(), map[string]interface{}{})
+			assert.NoError(t, err)
+			assert.Equal(t, int64(tt.wantUsers), count)
 		})
 	}
 }
 
 // TestSearchUserByID tests the SearchUserByID method of the UserService
 func TestSearchUserByID(t *testing.T) {
+	existing := models.User{ID: primitive.NewObjectID(), Username: "testuser1", Password: "testpass1"}
 
 	tests := []struct {
 		name      string
 		ID        string
-		mockSetup func(m *MockDB)
+		database  func(t *testing.T) models.CURDInterface
 		wantError bool
 		wantUser  bool
 	}{
 		{
 			// test case 1: successfully get user by ID
 			name: "successfully get user by ID",
-			ID:   primitive.NewObjectID().Hex(),
-			mockSetup: func(m *MockDB) {
-				m.On("Read", mock.Anything, mock.Anything).Return([]interface{}{
-					&models.User{
-						ID:       primitive.NewObjectID(),
-						Username: "testuser1",
-						Password: "testpass1",
-					},
-				}, nil)
+			ID:   existing.ID.Hex(),
+			database: func(t *testing.T) models.CURDInterface {
+				return newUserStore(t, existing)
 			},
 			wantError: false,
 			wantUser:  true,
@@ -169,9 +154,9 @@ func TestSearchUserByID(t *testing.T) {
 		{
 			// test case 2: failed to get user by ID
 			name: "failed to get user by ID",
-			ID:   primitive.NewObjectID().Hex(),
-			mockSetup: func(m *MockDB) {
-				m.On("Read", mock.Anything, mock.Anything).Return([]interface{}{}, errors.New("failed to read from db"))
+			ID:   existing.ID.Hex(),
+			database: func(t *testing.T) models.CURDInterface {
+				return &failingDB{CURDInterface: newUserStore(t, existing), fail: []string{"Read"}, err: errDatabase}
 			},
 			wantError: true,
 			wantUser:  false,
@@ -180,8 +165,8 @@ func TestSearchUserByID(t *testing.T) {
 			// test case 3: user not found
 			name: "user not found",
 			ID:   primitive.NewObjectID().Hex(),
-			mockSetup: func(m *MockDB) {
-				m.On("Read", mock.Anything, mock.Anything).Return([]interface{}{}, nil)
+			database: func(t *testing.T) models.CURDInterface {
+				return newUserStore(t, existing)
 			},
 			wantError: true,
 			wantUser:  false,
@@ -190,8 +175,8 @@ func TestSearchUserByID(t *testing.T) {
 			// test case 4: error when converting ID to ObjectID
 			name: "error when converting ID to ObjectID",
 			ID:   "invalidID",
-			mockSetup: func(m *MockDB) {
-				m.On("Read", mock.Anything, mock.Anything).Return([]interface{}{}, nil)
+			database: func(t *testing.T) models.CURDInterface {
+				return newUserStore(t, existing)
 			},
 			wantError: true,
 			wantUser:  false,
@@ -200,15 +185,12 @@ func TestSearchUserByID(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			mockDB := new(MockDB)
-			tt.mockSetup(mockDB)
-
-			// create a new UserService with the mockDB
-			userService := services.NewUserService()
-			userService.Database = mockDB
+			// create a new UserService with the database of the test
+			userService := newMemoryService(t)
+			userService.Database = tt.database(t)
 
 			// call the SearchUserByID method
-			user, err := userService.SearchUserByID(tt.ID)
+			user, err := userService.SearchUserByID(context.Background(), tt.ID)
 
 			if tt.wantError {
 				assert.Error(t, err, "Expected an error")
@@ -217,7 +199,7 @@ func TestSearchUserByID(t *testing.T) {
 			}
 
 			if tt.wantUser {
-				assert.NotEmpty(t, user.Username, "Expected a user but got none")
+				assert.Equal(t, withoutPassword(existing), user)
 			} else {
 				assert.Empty(t, user.Username, "Did not expect a user")
 			}
@@ -227,42 +209,41 @@ func TestSearchUserByID(t *testing.T) {
 
 // TestSearchUserByUsername tests the SearchUserByUsername method of the UserService
 func TestSearchUserByUsername(t *testing.T) {
+	existing := models.User{ID: primitive.NewObjectID(), Username: "testuser1", Password: "testpass1"}
 
 	tests := []struct {
 		name      string
-		mockSetup func(m *MockDB)
+		username  string
+		database  func(t *testing.T) models.CURDInterface
 		wantError bool
 		wantUser  bool
 	}{
 		{
 			// test case 1: successfully get user by username
-			name: "successfully get user by username",
-			mockSetup: func(m *MockDB) {
-				m.On("Read", mock.Anything, mock.Anything).Return([]interface{}{
-					&models.User{
-						ID:       primitive.NewObjectID(),
-						Username: "testuser1",
-						Password: "testpass1",
-					},
-				}, nil)
+			name:     "successfully get user by username",
+			username: "testuser1",
+			database: func(t *testing.T) models.CURDInterface {
+				return newUserStore(t, existing)
 			},
 			wantError: false,
 			wantUser:  true,
 		},
 		{
 			// test case 2: failed to get user by username
-			name: "failed to get user by username",
-			mockSetup: func(m *MockDB) {
-				m.On("Read", mock.Anything, mock.Anything).Return([]interface{}{}, errors.New("failed to read from db"))
+			name:     "failed to get user by username",
+			username: "testuser1",
+			database: func(t *testing.T) models.CURDInterface {
+				return &failingDB{CURDInterface: newUserStore(t, existing), fail: []string{"Read"}, err: errDatabase}
 			},
 			wantError: true,
 			wantUser:  false,
 		},
 		{
 			// test case 3: user not found
-			name: "user not found",
-			mockSetup: func(m *MockDB) {
-				m.On("Read", mock.Anything, mock.Anything).Return([]interface{}{}, nil)
+			name:     "user not found",
+			username: "testuser2",
+			database: func(t *testing.T) models.CURDInterface {
+				return newUserStore(t, existing)
 			},
 			wantError: true,
 			wantUser:  false,
@@ -271,15 +252,12 @@ func TestSearchUserByUsername(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			mockDB := new(MockDB)
-			tt.mockSetup(mockDB)
+			// create a new UserService with the database of the test
+			userService := newMemoryService(t)
+			userService.Database = tt.database(t)
 
-			// create a new UserService with the mockDB
-			userService := services.NewUserService()
-			userService.Database = mockDB
-
-			// call the SearchUserByID method
-			user, err := userService.SearchUserByUsername("testuser1")
+			// call the SearchUserByUsername method
+			user, err := userService.SearchUserByUsername(context.Background(), tt.username)
 
 			if tt.wantError && err == nil {
 				t.Fatal("expected an error but got none")
@@ -290,12 +268,56 @@ func TestSearchUserByUsername(t *testing.T) {
 			}
 
 			// assert the returned user
-			if tt.wantUser && user.Username == "" {
-				t.Errorf("expected a user but got none")
+			if tt.wantUser {
+				assert.Equal(t, withoutPassword(existing), user)
 			}
-
-			// assert the mockDB
-			mockDB.AssertExpectations(t)
 		})
 	}
 }
+
+type callerKey struct{}
+
+// TestUserServicePassesContext tests that the UserService passes the caller's context, or a child of it,
+// to the database, and reports a cancelled query as unavailable
+func TestUserServicePassesContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.WithValue(context.Background(), callerKey{}, "caller"))
+	cancel()
+
+	db := &contextDB{CURDInterface: newUserStore(t)}
+	userService := newMemoryService(t)
+	userService.Database = db
+
+	_, err := userService.SearchUserByUsername(ctx, "testuser")
+	assert.ErrorIs(t, err, services.ErrUnavailable)
+	assert.ErrorIs(t, err, context.Canceled)
+
+	if assert.Len(t, db.contexts, 1) {
+		assert.Equal(t, "caller", db.contexts[0].Value(callerKey{}))
+		assert.ErrorIs(t, db.contexts[0].Err(), context.Canceled)
+	}
+}
+
+// TestLoginDBWithoutDatabase tests that LoginDB keeps the users in memory when it's asked to,
+// and fails when no database is configured
+func TestLoginDBWithoutDatabase(t *testing.T) {
+	ctx := context.Background()
+	assert.Error(t, services.NewUserService(config.DatabaseConfig{}, discardLogger).LoginDB())
+
+	userService := services.NewUserService(config.DatabaseConfig{Memory: true}, discardLogger)
+	assert.NoError(t, userService.LoginDB())
+	assert.NoError(t, userService.PingDB(ctx))
+
+	user := models.NewUser("testuser", "$2a$10$hash")
+	_, err := userService.CreateUser(ctx, *user)
+	assert.NoError(t, err)
+	found, err := userService.SearchUserByID(ctx, user.ID.Hex())
+	assert.NoError(t, err)
+	assert.Equal(t, []models.User{withoutPassword(*user)}, withoutTimes(found))
+	assert.NoError(t, userService.RecordEvent(ctx, models.AuditEvent{Type: models.EventUserRegistered, Actor: "testuser"}))
+
+	assert.NoError(t, userService.CloseDB(ctx))
+
+	// without backend, there is nothing to connect to
+	assert.Error(t, services.NewUserServiceWithBackend(nil, nil, config.Default().Deletion, nil, discardLogger).LoginDB())
+	assert.NoError(t, services.NewUserServiceWithBackend(nil, nil, config.Default().Deletion, nil, discardLogger).CloseDB(ctx), "closing without a connection should be a no-op")
+}
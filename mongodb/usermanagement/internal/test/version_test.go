@@ -0,0 +1,274 @@
+package test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"usermanagement/internal/config"
+	"usermanagement/internal/handlers"
+	"usermanagement/internal/models"
+	"usermanagement/internal/services"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// TestUpdateUser tests that a user is only updated from its current version
+func TestUpdateUser(t *testing.T) {
+	ctx := context.Background()
+	alice := models.User{ID: primitive.NewObjectID(), Username: "alice", Password: "hash"}
+	userService := newMemoryService(t, alice)
+	locked, admins := true, []string{"admin"}
+
+	updated, err := userService.UpdateUser(ctx, alice.ID.Hex(), 0, services.UserChanges{Roles: &admins, Locked: &locked})
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), updated.Version)
+	assert.Equal(t, admins, updated.Roles)
+	assert.True(t, updated.Locked)
+
+	// another administrator read version 0 too
+	suspended := models.StatusSuspended
+	_, err = userService.UpdateUser(ctx, alice.ID.Hex(), 0, services.UserChanges{Status: &suspended})
+	assert.ErrorIs(t, err, services.ErrVersionMismatch)
+	found, err := userService.SearchUserByID(ctx, alice.ID.Hex())
+	require.NoError(t, err)
+	assert.Equal(t, models.UserStatus(""), found.Status, "the stale change shouldn't be applied")
+
+	// the changes of usermgmt-admin and of the deletion make new versions too
+	require.NoError(t, userService.SetLocked(ctx, "alice", false))
+	_, err = userService.UpdateUser(ctx, alice.ID.Hex(), 1, services.UserChanges{Status: &suspended})
+	assert.ErrorIs(t, err, services.ErrVersionMismatch)
+	updated, err = userService.UpdateUser(ctx, alice.ID.Hex(), 2, services.UserChanges{Status: &suspended})
+	require.NoError(t, err)
+	assert.Equal(t, int64(3), updated.Version)
+	assert.Equal(t, models.StatusSuspended, updated.Status)
+
+	// a login isn't a change
+	require.NoError(t, userService.RecordLogin(ctx, alice))
+	deleted, err := userService.DeleteUser(ctx, alice.ID.Hex())
+	require.NoError(t, err)
+	assert.Equal(t, int64(4), deleted.Version)
+	_, err = userService.UpdateUser(ctx, alice.ID.Hex(), 4, services.UserChanges{Status: &suspended})
+	assert.ErrorIs(t, err, services.ErrNotFound, "a deleted user can't be updated")
+	restored, err := userService.RestoreUser(ctx, alice.ID.Hex())
+	require.NoError(t, err)
+	assert.Equal(t, int64(5), restored.Version)
+
+	_, err = userService.UpdateUser(ctx, primitive.NewObjectID().Hex(), 0, services.UserChanges{Status: &suspended})
+	assert.ErrorIs(t, err, services.ErrNotFound)
+
+	var validationErr *services.ValidationError
+	invalid := []string{"Admin"}
+	unknown := models.UserStatus("banned")
+	for _, changes := range []services.UserChanges{{}, {Roles: &invalid}, {Status: &unknown}} {
+		_, err = userService.UpdateUser(ctx, alice.ID.Hex(), 5, changes)
+		assert.ErrorAs(t, err, &validationErr)
+	}
+	_, err = userService.UpdateUser(ctx, "invalid", 5, services.UserChanges{Status: &suspended})
+	assert.ErrorAs(t, err, &validationErr)
+}
+
+// TestUpdateUserWithoutVersion tests that a user stored before the versions is at version 0
+func TestUpdateUserWithoutVersion(t *testing.T) {
+	ctx := context.Background()
+	id := primitive.NewObjectID()
+	userService := newMemoryService(t)
+	require.NoError(t, userService.Database.Create(ctx, bson.M{"_id": id, "username": "legacy", "password": "hash"}))
+
+	found, err := userService.SearchUserByID(ctx, id.Hex())
+	require.NoError(t, err)
+	assert.Equal(t, int64(0), found.Version)
+
+	locked := true
+	updated, err := userService.UpdateUser(ctx, id.Hex(), 0, services.UserChanges{Locked: &locked})
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), updated.Version)
+}
+
+// TestUpdateUserBackends tests that of concurrent updates from the same version only one is applied,
+// on every backend of the conformance suite
+func TestUpdateUserBackends(t *testing.T) {
+	for _, fixture := range storeFixtures {
+		fixture := fixture
+		t.Run(fixture.name, func(t *testing.T) {
+			ctx := context.Background()
+			userService := services.NewUserServiceWithBackend(nil, nil, config.Default().Deletion, nil, discardLogger)
+			userService.Database = fixture.open(t)
+			alice := *models.NewUser("alice", "hash")
+			_, err := userService.CreateUser(ctx, alice)
+			require.NoError(t, err)
+
+			const writers = 8
+			var wg sync.WaitGroup
+			errs := make([]error, writers)
+			for i := 0; i < writers; i++ {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					roles := []string{"role" + string(rune('a'+i))}
+					_, errs[i] = userService.UpdateUser(ctx, alice.ID.Hex(), 0, services.UserChanges{Roles: &roles})
+				}(i)
+			}
+			wg.Wait()
+
+			applied := 0
+			for _, err := range errs {
+				if err == nil {
+					applied++
+				} else {
+					assert.ErrorIs(t, err, services.ErrVersionMismatch)
+				}
+			}
+			assert.Equal(t, 1, applied)
+
+			found, err := userService.SearchUserByUsername(ctx, "alice")
+			require.NoError(t, err)
+			assert.Equal(t, int64(1), found.Version)
+			require.NoError(t, userService.ResetPassword(ctx, "alice", "hash2"))
+			found, err = userService.SearchUserByUsername(ctx, "alice")
+			require.NoError(t, err)
+			assert.Equal(t, int64(2), found.Version)
+		})
+	}
+}
+
+// TestVersionHandlers tests the ETags of GET /users/:id and GET /search, and the If-Match of PATCH /users/:id
+func TestVersionHandlers(t *testing.T) {
+	id := primitive.NewObjectID()
+	alice := models.User{ID: id, Username: "alice", Version: 3}
+	locked := true
+
+	tests := []struct {
+		name         string
+		method       string
+		path         string
+		header       string
+		ifMatch      string
+		body         string
+		mockSetup    func(m *MockUserService)
+		expectedCode int
+		expectedETag string
+		expectedBody string
+	}{
+		{
+			name:   "get user",
+			method: http.MethodGet,
+			path:   "/users/" + id.Hex(),
+			mockSetup: func(m *MockUserService) {
+				m.On("SearchUserByID", mock.Anything, id.Hex()).Return(alice, nil)
+			},
+			expectedCode: http.StatusOK,
+			expectedETag: `"3"`,
+			expectedBody: `"version":3`,
+		},
+		{
+			name:   "search user",
+			method: http.MethodGet,
+			path:   "/search?username=alice",
+			mockSetup: func(m *MockUserService) {
+				m.On("SearchUserByUsername", mock.Anything, "alice").Return(alice, nil)
+			},
+			expectedCode: http.StatusOK,
+			expectedETag: `"3"`,
+		},
+		{
+			name:         "update without token",
+			method:       http.MethodPatch,
+			path:         "/users/" + id.Hex(),
+			ifMatch:      `"3"`,
+			body:         `{"locked":true}`,
+			expectedCode: http.StatusUnauthorized,
+		},
+		{
+			name:         "update without If-Match",
+			method:       http.MethodPatch,
+			path:         "/users/" + id.Hex(),
+			header:       "Bearer s3cret",
+			body:         `{"locked":true}`,
+			expectedCode: http.StatusPreconditionRequired,
+			expectedBody: "/problems/precondition-required",
+		},
+		{
+			name:         "update with a weak ETag",
+			method:       http.MethodPatch,
+			path:         "/users/" + id.Hex(),
+			header:       "Bearer s3cret",
+			ifMatch:      `W/"3"`,
+			body:         `{"locked":true}`,
+			expectedCode: http.StatusPreconditionFailed,
+		},
+		{
+			name:    "update",
+			method:  http.MethodPatch,
+			path:    "/users/" + id.Hex(),
+			header:  "Bearer s3cret",
+			ifMatch: `"3"`,
+			body:    `{"locked":true}`,
+			mockSetup: func(m *MockUserService) {
+				m.On("UpdateUser", mock.Anything, id.Hex(), int64(3), services.UserChanges{Locked: &locked}).
+					Return(models.User{ID: id, Username: "alice", Locked: true, Version: 4}, nil)
+				m.On("RecordEvent", mock.Anything, mock.MatchedBy(func(e models.AuditEvent) bool {
+					return e.Type == models.EventUserLocked && e.Actor == "admin" && e.Target == "alice"
+				})).Return(nil)
+			},
+			expectedCode: http.StatusOK,
+			expectedETag: `"4"`,
+			expectedBody: `"locked":true`,
+		},
+		{
+			name:    "update a changed user",
+			method:  http.MethodPatch,
+			path:    "/users/" + id.Hex(),
+			header:  "Bearer s3cret",
+			ifMatch: `"2"`,
+			body:    `{"locked":true}`,
+			mockSetup: func(m *MockUserService) {
+				m.On("UpdateUser", mock.Anything, id.Hex(), int64(2), services.UserChanges{Locked: &locked}).
+					Return(models.User{}, services.ErrVersionMismatch)
+			},
+			expectedCode: http.StatusPreconditionFailed,
+			expectedBody: "/problems/precondition-failed",
+		},
+		{
+			name:         "update with invalid JSON",
+			method:       http.MethodPatch,
+			path:         "/users/" + id.Hex(),
+			header:       "Bearer s3cret",
+			ifMatch:      `"3"`,
+			body:         `{"locked":`,
+			expectedCode: http.StatusBadRequest,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockUserService := new(MockUserService)
+			if tt.mockSetup != nil {
+				tt.mockSetup(mockUserService)
+			}
+			server := handlers.NewServer(mockUserService, config.ServerConfig{AdminToken: "s3cret"}, discardLogger)
+			server.SetupRoute()
+
+			req, _ := http.NewRequest(tt.method, tt.path, strings.NewReader(tt.body))
+			if tt.header != "" {
+				req.Header.Set("Authorization", tt.header)
+			}
+			if tt.ifMatch != "" {
+				req.Header.Set("If-Match", tt.ifMatch)
+			}
+			w := httptest.NewRecorder()
+			server.GetRouter().ServeHTTP(w, req)
+
+			assert.Equal(t, tt.expectedCode, w.Code)
+			assert.Equal(t, tt.expectedETag, w.Header().Get("ETag"))
+			assert.Contains(t, w.Body.String(), tt.expectedBody)
+			mockUserService.AssertExpectations(t)
+		})
+	}
+}